@@ -0,0 +1,326 @@
+package image_analyzer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gocv.io/x/gocv"
+	"image"
+	"image_matcher/image_handling"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultFeatureCacheDirectory = "test-output/feature-cache"
+
+// DefaultFeatureCacheSize is the size in bytes the cache is limited to, the least recently used entries are evicted
+const DefaultFeatureCacheSize = 4 << 30
+
+// eviction frees space down to this fraction of the limit, so that not every following store evicts again
+const featureCacheEvictionTarget = 0.9
+
+const orientedPHashKind = "oriented-phash"
+
+// extractorVersions are part of the cache key and need to be increased whenever the extraction of the kind changes,
+// e.g. the preprocessing or the parameters of an analyzer. Entries of other versions are removed from the cache.
+var extractorVersions = map[string]int{
+	SIFT:              1,
+	ORB:               1,
+	BRISK:             1,
+	PHASH:             1,
+	orientedPHashKind: 1,
+}
+
+// featureParameters are the parameters of the extraction that are part of the cache key
+var featureParameters = map[string]string{
+	SIFT:              "gray,black-and-white-background",
+	ORB:               "gray,black-and-white-background",
+	BRISK:             "gray,black-and-white-background",
+	PHASH:             "dct-32x32",
+	orientedPHashKind: "dct-32x32,contour-orientation",
+}
+
+// FeatureCache stores the extraction results of search images on disk, addressed by the pixel digest of the image,
+// the kind of extraction and its parameters, so that the same image isn't extracted again in later runs. Hits report
+// the time of the lookup as extraction time, so runs on a filled cache measure the cache and not the extraction.
+type FeatureCache struct {
+	directory string
+	maxBytes  int64
+	mutex     sync.Mutex
+	size      int64
+	hits      int
+	misses    int
+}
+
+type cachedExtraction struct {
+	Keypoints      []gocv.KeyPoint
+	DescriptorRows int
+	DescriptorCols int
+	DescriptorType int
+	Descriptors    []byte
+	Hashes         []uint64
+}
+
+var activeFeatureCache *FeatureCache
+
+// UseFeatureCache makes the cached extractions use the cache, nil disables it
+func UseFeatureCache(cache *FeatureCache) {
+	activeFeatureCache = cache
+}
+
+// OpenFeatureCache removes the entries of outdated extractor versions and determines the size of the cache
+func OpenFeatureCache(directory string, maxBytes int64) (*FeatureCache, error) {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	currentDirectories := make(map[string]bool)
+	for kind := range extractorVersions {
+		currentDirectories[kindDirectory(kind)] = true
+	}
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !currentDirectories[entry.Name()] {
+			log.Println("Removing outdated feature cache", entry.Name())
+			err = os.RemoveAll(filepath.Join(directory, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cache := FeatureCache{directory: directory, maxBytes: maxBytes}
+	err = filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err == nil {
+			cache.size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cache, nil
+}
+
+// kindDirectory separates the entries per kind and version, the opencv version is included because the extracted
+// features depend on it
+func kindDirectory(kind string) string {
+	return fmt.Sprintf("%s-v%d-opencv%s", kind, extractorVersions[kind], gocv.OpenCVVersion())
+}
+
+func (c *FeatureCache) entryPath(kind string, img *image.Image) string {
+	hash := sha256.New()
+	hash.Write([]byte(image_handling.PixelDigest(img)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(kind))
+	hash.Write([]byte{0})
+	hash.Write([]byte(featureParameters[kind]))
+	key := hex.EncodeToString(hash.Sum(nil))
+	return filepath.Join(c.directory, kindDirectory(kind), key[:2], key+".gob")
+}
+
+func (c *FeatureCache) load(path string, extraction *cachedExtraction) bool {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(content)).Decode(extraction)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		c.misses++
+		return false
+	}
+	c.hits++
+	// the modification time is the last use of the entry
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return true
+}
+
+// store writes the entry to a temporary file first, so that concurrent workers never read a partial entry
+func (c *FeatureCache) store(path string, extraction *cachedExtraction) {
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(extraction)
+	if err != nil {
+		log.Println("couldn't encode feature cache entry", err)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		log.Println("couldn't create feature cache directory", err)
+		return
+	}
+	temporaryFile, err := os.CreateTemp(filepath.Dir(path), ".entry-*")
+	if err != nil {
+		log.Println("couldn't write feature cache entry", err)
+		return
+	}
+	_, err = temporaryFile.Write(content.Bytes())
+	temporaryFile.Close()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// a concurrent worker may have stored the same entry already, the rename replaces it
+	var replacedSize int64
+	if err == nil {
+		info, statErr := os.Stat(path)
+		if statErr == nil {
+			replacedSize = info.Size()
+		}
+		err = os.Rename(temporaryFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temporaryFile.Name())
+		log.Println("couldn't write feature cache entry", err)
+		return
+	}
+	c.size += int64(content.Len()) - replacedSize
+	if c.size > c.maxBytes {
+		c.evict()
+	}
+}
+
+// evict removes the least recently used entries until the cache is below the eviction target
+func (c *FeatureCache) evict() {
+	type cacheEntry struct {
+		path     string
+		size     int64
+		lastUsed time.Time
+	}
+	var entries []cacheEntry
+	var size int64
+	_ = filepath.WalkDir(c.directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err == nil {
+			entries = append(entries, cacheEntry{path: path, size: info.Size(), lastUsed: info.ModTime()})
+			size += info.Size()
+		}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+
+	target := int64(float64(c.maxBytes) * featureCacheEvictionTarget)
+	for _, entry := range entries {
+		if size <= target {
+			break
+		}
+		if os.Remove(entry.path) == nil {
+			size -= entry.size
+		}
+	}
+	c.size = size
+}
+
+// Statistics returns the hits and misses since the cache was opened and its size in bytes
+func (c *FeatureCache) Statistics() (int, int, int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.misses, c.size
+}
+
+// ExtractKeypointsAndDescriptorsCached extracts the features with the analyzer of the given name or loads them from
+// the active feature cache
+func ExtractKeypointsAndDescriptorsCached(img *image.Image, analyzer string) (
+	[]gocv.KeyPoint,
+	gocv.Mat,
+	time.Duration,
+	error,
+) {
+	imageAnalyzer := AnalyzerMapping[analyzer]
+	if imageAnalyzer == nil {
+		return nil, gocv.NewMat(), 0, errors.New(fmt.Sprintf("couldn't find analyzer %s", analyzer))
+	}
+	cache := activeFeatureCache
+	if cache == nil {
+		keypoints, descriptors, extractionTime := ExtractKeypointsAndDescriptors(img, &imageAnalyzer)
+		return keypoints, descriptors, extractionTime, nil
+	}
+
+	lookupStart := time.Now()
+	path := cache.entryPath(analyzer, img)
+	var extraction cachedExtraction
+	if cache.load(path, &extraction) {
+		if extraction.DescriptorRows == 0 {
+			return extraction.Keypoints, gocv.NewMat(), time.Since(lookupStart), nil
+		}
+		descriptors, err := gocv.NewMatFromBytes(
+			extraction.DescriptorRows, extraction.DescriptorCols, gocv.MatType(extraction.DescriptorType),
+			extraction.Descriptors,
+		)
+		if err == nil {
+			return extraction.Keypoints, descriptors, time.Since(lookupStart), nil
+		}
+	}
+
+	keypoints, descriptors, extractionTime := ExtractKeypointsAndDescriptors(img, &imageAnalyzer)
+	extraction = cachedExtraction{Keypoints: keypoints}
+	if !descriptors.Empty() {
+		extraction.DescriptorRows = descriptors.Rows()
+		extraction.DescriptorCols = descriptors.Cols()
+		extraction.DescriptorType = int(descriptors.Type())
+		extraction.Descriptors = descriptors.ToBytes()
+	}
+	cache.store(path, &extraction)
+	return keypoints, descriptors, extractionTime, nil
+}
+
+// GetPHashValueCached calculates the phash or loads it from the active feature cache
+func GetPHashValueCached(img *image.Image) (uint64, time.Duration) {
+	hashes, extractionTime := cachedHashes(img, PHASH, func() ([]uint64, time.Duration) {
+		hash, extractionTime := GetPHashValue(img)
+		return []uint64{hash}, extractionTime
+	})
+	return hashes[0], extractionTime
+}
+
+// CalculateOrientedHashesCached calculates the oriented hashes or loads them from the active feature cache
+func CalculateOrientedHashesCached(img *image.Image) ([]uint64, time.Duration) {
+	return cachedHashes(img, orientedPHashKind, func() ([]uint64, time.Duration) {
+		return CalculateOrientedHashes(img)
+	})
+}
+
+func cachedHashes(
+	img *image.Image, kind string, calculate func() ([]uint64, time.Duration),
+) ([]uint64, time.Duration) {
+	cache := activeFeatureCache
+	if cache == nil {
+		return calculate()
+	}
+
+	lookupStart := time.Now()
+	path := cache.entryPath(kind, img)
+	var extraction cachedExtraction
+	if cache.load(path, &extraction) && len(extraction.Hashes) > 0 {
+		return extraction.Hashes, time.Since(lookupStart)
+	}
+
+	hashes, extractionTime := calculate()
+	if len(hashes) > 0 {
+		cache.store(path, &cachedExtraction{Hashes: hashes})
+	}
+	return hashes, extractionTime
+}
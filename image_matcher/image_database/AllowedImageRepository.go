@@ -0,0 +1,86 @@
+package image_database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// AllowedImageEntity is a known-good image of the allow-list, it has the same features as a forbidden image but no
+// metadata
+type AllowedImageEntity = ForbiddenImageEntity
+
+const allowedImageColumns = "external_reference, sift_descriptor, orb_descriptor, brisk_descriptor, " +
+	"COALESCE(p_hash, 0), COALESCE(rotation_hash, 0)"
+
+// UpsertImageIntoAllowList registers the image in the allow-list or replaces the features of the allowed image with
+// the same reference
+func UpsertImageIntoAllowList(databaseConnection *sql.DB, allowedImage ForbiddenImageCreation) error {
+	externalReference := allowedImage.ExternalReference
+	_, err := databaseConnection.Exec(
+		"INSERT INTO allowed_image (external_reference, sift_descriptor, orb_descriptor, brisk_descriptor, p_hash, "+
+			"rotation_hash, registered_by) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE "+
+			"sift_descriptor = VALUES(sift_descriptor), orb_descriptor = VALUES(orb_descriptor), "+
+			"brisk_descriptor = VALUES(brisk_descriptor), p_hash = VALUES(p_hash), "+
+			"rotation_hash = VALUES(rotation_hash), registered_by = VALUES(registered_by)",
+		externalReference,
+		allowedImage.SiftDescriptor,
+		allowedImage.OrbDescriptor,
+		allowedImage.BriskDescriptor,
+		allowedImage.PHash,
+		allowedImage.RotationInvariantHash,
+		currentActor(),
+	)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't insert %s into allow-list %s", externalReference, err.Error()))
+	}
+	log.Println(fmt.Sprintf("Inserted %s into allow-list", externalReference))
+	return nil
+}
+
+// DeleteImageFromAllowList removes the image from the allow-list, its matches aren't suppressed anymore
+func DeleteImageFromAllowList(databaseConnection *sql.DB, externalReference string) error {
+	result, err := databaseConnection.Exec(
+		"DELETE FROM allowed_image WHERE external_reference = ?", externalReference,
+	)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't delete %s from allow-list %s", externalReference, err.Error()))
+	}
+	deletedRows, err := result.RowsAffected()
+	if err == nil && deletedRows == 0 {
+		return errors.New(fmt.Sprintf("%s isn't in the allow-list", externalReference))
+	}
+	log.Println(fmt.Sprintf("Deleted %s from allow-list", externalReference))
+	return nil
+}
+
+// ApplyChunkedAllowedImageRetrievalOperation applies the function to every image of the allow-list, an empty
+// allow-list isn't an error
+func ApplyChunkedAllowedImageRetrievalOperation(
+	ctx context.Context, applyFunction func(allowedImage AllowedImageEntity) error,
+) error {
+	return applyChunkedRetrievalOperation(ctx, allowedImageQuery(), false, applyFunction)
+}
+
+func allowedImageQuery() keysetQuery[AllowedImageEntity, string] {
+	return keysetQuery[AllowedImageEntity, string]{
+		table:     "allowed_image",
+		keyColumn: "external_reference",
+		columns:   allowedImageColumns,
+		scan: func(imageRows *sql.Rows) (AllowedImageEntity, bool, error) {
+			var image AllowedImageEntity
+			err := imageRows.Scan(
+				&image.ExternalReference,
+				&image.SiftDescriptor,
+				&image.OrbDescriptor,
+				&image.BriskDescriptor,
+				&image.PHash,
+				&image.RotationHash,
+			)
+			return image, true, err
+		},
+		key: func(image AllowedImageEntity) string { return image.ExternalReference },
+	}
+}
@@ -0,0 +1,53 @@
+package image_database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// the file digest only matches byte-identical uploads, the pixel digest also matches the same pixels in another file
+// format or encoding
+const digestColumns = "COALESCE(file_sha256, ''), COALESCE(pixel_sha256, '')"
+
+// DigestMatch is a forbidden image whose file or pixels are identical to the ones of a search image
+type DigestMatch struct {
+	ExternalReference string
+	// FileMatch is whether the files are byte-identical, otherwise only the pixels are identical
+	FileMatch bool
+	Metadata  ForbiddenImageMetadata
+}
+
+// RetrieveDigestMatches returns the forbidden images that have the file digest or the pixel digest ordered by
+// reference, images registered before the digests were stored are never returned
+func RetrieveDigestMatches(databaseConnection *sql.DB, fileDigest string, pixelDigest string) (
+	*[]DigestMatch, error,
+) {
+	imageRows, err := databaseConnection.Query(
+		"SELECT external_reference, COALESCE(file_sha256, ''), "+metadataColumns+" FROM forbidden_image "+
+			"WHERE (file_sha256 = ? OR pixel_sha256 = ?) AND "+activeForbiddenImage+" ORDER BY external_reference",
+		nullableString(fileDigest),
+		nullableString(pixelDigest),
+	)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't retrieve digest matches from database: %s", err.Error()))
+	}
+	defer imageRows.Close()
+
+	var matches []DigestMatch
+	for imageRows.Next() {
+		var match DigestMatch
+		var matchedFileDigest string
+		var metadata metadataRow
+		err = imageRows.Scan(
+			append([]interface{}{&match.ExternalReference, &matchedFileDigest}, metadata.destinations()...)...,
+		)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("couldn't read digest matches from database: %s", err.Error()))
+		}
+		match.FileMatch = fileDigest != "" && matchedFileDigest == fileDigest
+		match.Metadata = metadata.metadata()
+		matches = append(matches, match)
+	}
+	return &matches, imageRows.Err()
+}
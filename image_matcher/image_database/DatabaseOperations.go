@@ -1,11 +1,15 @@
 package image_database
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"errors"
 )
 
-const MaxChunkSize = 50
+const DefaultChunkSize = 50
+
+// ChunkSize is the number of rows the chunked retrievals retrieve per query
+var ChunkSize = DefaultChunkSize
 
 func ApplyDatabaseOperation(applyFunction func(databaseConnection *sql.DB)) error {
 	databaseConnection, err := openDatabaseConnection()
@@ -13,92 +17,65 @@ func ApplyDatabaseOperation(applyFunction func(databaseConnection *sql.DB)) erro
 		return err
 	}
 	defer databaseConnection.Close()
+	migrateSchemaOnce(databaseConnection)
 
 	applyFunction(databaseConnection)
 
 	return nil
 }
 
-func ApplyChunkedFeatureBasedRetrievalOperation(
-	applyFunction func(databaseImage FeatureImageEntity), descriptor string,
+// applyChunkedRetrievalOperation opens a connection and applies the function to every complete row of the query,
+// requireRows makes an empty result an error. The retrieval stops at the first error of the function and returns it.
+func applyChunkedRetrievalOperation[Entity any, Key any](
+	ctx context.Context, query keysetQuery[Entity, Key], requireRows bool, applyFunction func(entity Entity) error,
 ) error {
+	var applied int
+	var retrievalErr error
 	err := ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
-		offset := 0
-		for {
-			databaseImageChunk, err := retrieveFeatureImageChunk(
-				databaseConnection,
-				descriptor,
-				offset,
-				MaxChunkSize+1,
-			)
-			if err != nil {
-				log.Println("Error while retrieving chunk from database images: ", err)
-			}
-			if len(*databaseImageChunk) == 0 {
-				log.Fatal("No Images retrieved!")
-			}
-
-			for _, databaseImage := range (*databaseImageChunk)[0:len(*databaseImageChunk)] {
-				applyFunction(databaseImage)
-			}
-
-			if len(*databaseImageChunk) < MaxChunkSize+1 {
-				break
-			}
-			offset += MaxChunkSize
-
-			databaseImageChunk = nil
-		}
+		applied, retrievalErr = iterateKeyset(ctx, databaseConnection, query, ChunkSize, applyFunction)
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	if retrievalErr != nil {
+		return retrievalErr
+	}
+	if requireRows && applied == 0 {
+		return errors.New("no images retrieved from " + query.table)
+	}
+	return nil
 }
 
-func ApplyChunkedPHashRetrievalOperation(applyFunction func(databaseImage PHashImageEntity)) error {
-	err := ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
-		offset := 0
-		for {
-			databaseImageChunk, err := retrievePHashImageChunk(databaseConnection, offset, MaxChunkSize+1)
-			if err != nil {
-				log.Println("Error while retrieving chunk from database images: ", err)
-			}
-			if len(*databaseImageChunk) == 0 {
-				log.Fatal("No Images retrieved!")
-			}
-
-			for _, databaseImage := range (*databaseImageChunk)[0:len(*databaseImageChunk)] {
-				applyFunction(databaseImage)
-			}
+func ApplyChunkedFeatureBasedRetrievalOperation(
+	ctx context.Context, applyFunction func(databaseImage FeatureImageEntity) error, descriptor string,
+) error {
+	return applyChunkedRetrievalOperation(ctx, featureImageQuery(descriptor), true, applyFunction)
+}
 
-			if len(*databaseImageChunk) < MaxChunkSize+1 {
-				break
-			}
-			offset += MaxChunkSize
-		}
-	})
-	return err
+func ApplyChunkedPHashRetrievalOperation(
+	ctx context.Context, applyFunction func(databaseImage PHashImageEntity) error,
+) error {
+	return applyChunkedRetrievalOperation(ctx, pHashImageQuery(), true, applyFunction)
 }
 
-func ApplyChunkedHybridRetrievalOperation(applyFunction func(databaseImage HybridEntity)) error {
-	err := ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
-		offset := 0
-		for {
-			databaseImageChunk, err := retrieveHybridChunk(databaseConnection, offset, MaxChunkSize+1)
-			if err != nil {
-				log.Println("Error while retrieving chunk from database images: ", err)
-			}
-			if len(*databaseImageChunk) == 0 {
-				log.Fatal("No Images retrieved!")
-			}
+func ApplyChunkedHybridRetrievalOperation(
+	ctx context.Context, applyFunction func(databaseImage HybridEntity) error,
+) error {
+	return applyChunkedRetrievalOperation(ctx, hybridQuery(), true, applyFunction)
+}
 
-			for _, databaseImage := range (*databaseImageChunk)[0:len(*databaseImageChunk)] {
-				applyFunction(databaseImage)
-			}
+// ApplyChunkedForbiddenImageRetrievalOperation applies the function to every complete row of the forbidden set, unlike
+// the other retrievals an empty forbidden set isn't an error
+func ApplyChunkedForbiddenImageRetrievalOperation(
+	ctx context.Context, applyFunction func(databaseImage ForbiddenImageEntity) error,
+) error {
+	return applyChunkedRetrievalOperation(ctx, forbiddenImageQuery(), false, applyFunction)
+}
 
-			if len(*databaseImageChunk) < MaxChunkSize+1 {
-				break
-			}
-			offset += MaxChunkSize
-		}
-	})
-	return err
+// ApplyChunkedSearchImageRetrievalOperation applies the function to the search images of the scenario in the order they
+// were inserted
+func ApplyChunkedSearchImageRetrievalOperation(
+	ctx context.Context, scenario string, applyFunction func(searchImage SearchImageEntity) error,
+) error {
+	return applyChunkedRetrievalOperation(ctx, searchImageQuery(scenario), false, applyFunction)
 }
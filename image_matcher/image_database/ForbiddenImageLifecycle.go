@@ -0,0 +1,457 @@
+package image_database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os/user"
+	"strings"
+)
+
+// the audit actions of the forbidden set
+const (
+	RegisterAction = "register"
+	ReplaceAction  = "replace"
+	RestoreAction  = "restore"
+	DeleteAction   = "delete"
+	RenameAction   = "rename"
+	AnnotateAction = "annotate"
+)
+
+// activeForbiddenImage restricts the queries of the forbidden set to images that aren't deleted
+const activeForbiddenImage = "deleted_at IS NULL"
+
+const forbiddenImageSummaryColumns = "external_reference, COALESCE(p_hash, 0), COALESCE(rotation_hash, 0), " +
+	"COALESCE(LENGTH(sift_descriptor), 0), COALESCE(LENGTH(orb_descriptor), 0), " +
+	"COALESCE(LENGTH(brisk_descriptor), 0), " + digestColumns + ", COALESCE(deleted_at, ''), " + metadataColumns
+
+// ForbiddenImageSummary describes a registered image without its descriptors, the descriptor sizes are in bytes
+type ForbiddenImageSummary struct {
+	ExternalReference string
+	PHash             uint64
+	RotationHash      uint64
+	SiftBytes         int
+	OrbBytes          int
+	BriskBytes        int
+	FileDigest        string
+	PixelDigest       string
+	// DeletedAt is empty for images that aren't deleted
+	DeletedAt string
+	Metadata  ForbiddenImageMetadata
+}
+
+type AuditEntry struct {
+	Id                int
+	ExternalReference string
+	Action            string
+	Details           string
+	Actor             string
+	CreatedAt         string
+}
+
+// UpsertImageIntoDatabaseSet registers the image or replaces the features of the image with the same reference, a
+// deleted image is restored. The action is recorded in the audit trail and returned. A new image is registered by the
+// current user if the metadata doesn't name anyone, a replaced image keeps the metadata fields that aren't given.
+func UpsertImageIntoDatabaseSet(databaseConnection *sql.DB, databaseSetImage ForbiddenImageCreation) (string, error) {
+	externalReference := databaseSetImage.ExternalReference
+	action := RegisterAction
+	givenRegisteredBy := nullableString(databaseSetImage.Metadata.RegisteredBy)
+	if databaseSetImage.Metadata.RegisteredBy == "" {
+		databaseSetImage.Metadata.RegisteredBy = currentActor()
+	}
+
+	err := applyTransaction(databaseConnection, func(transaction *sql.Tx) error {
+		var deletedAt *string
+		err := transaction.QueryRow(
+			"SELECT deleted_at FROM forbidden_image WHERE external_reference = ? FOR UPDATE", externalReference,
+		).Scan(&deletedAt)
+		if err == nil && deletedAt == nil {
+			action = ReplaceAction
+		} else if err == nil {
+			action = RestoreAction
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		_, err = transaction.Exec(
+			"INSERT INTO forbidden_image (external_reference, sift_descriptor, orb_descriptor, brisk_descriptor, "+
+				"p_hash, rotation_hash, file_sha256, pixel_sha256, registered_by, reason, tags, expires_at, "+
+				"source_url) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE "+
+				"sift_descriptor = VALUES(sift_descriptor), orb_descriptor = VALUES(orb_descriptor), "+
+				"brisk_descriptor = VALUES(brisk_descriptor), p_hash = VALUES(p_hash), "+
+				"rotation_hash = VALUES(rotation_hash), file_sha256 = VALUES(file_sha256), "+
+				"pixel_sha256 = VALUES(pixel_sha256), registered_by = COALESCE(?, registered_by), "+
+				"reason = COALESCE(VALUES(reason), reason), tags = COALESCE(VALUES(tags), tags), "+
+				"expires_at = COALESCE(VALUES(expires_at), expires_at), "+
+				"source_url = COALESCE(VALUES(source_url), source_url), deleted_at = NULL",
+			append(
+				append(
+					[]interface{}{
+						externalReference,
+						databaseSetImage.SiftDescriptor,
+						databaseSetImage.OrbDescriptor,
+						databaseSetImage.BriskDescriptor,
+						databaseSetImage.PHash,
+						databaseSetImage.RotationInvariantHash,
+						nullableString(databaseSetImage.FileDigest),
+						nullableString(databaseSetImage.PixelDigest),
+					},
+					metadataArguments(databaseSetImage.Metadata)...,
+				),
+				givenRegisteredBy,
+			)...,
+		)
+		if err != nil {
+			return err
+		}
+		return insertAuditEntry(transaction, externalReference, action, "")
+	})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("couldn't register %s in database %s", externalReference, err.Error()))
+	}
+	log.Println(fmt.Sprintf("%s %s in Database Set", action, externalReference))
+	return action, nil
+}
+
+// ReplaceImageInDatabaseSet replaces the features of a registered image that isn't deleted
+func ReplaceImageInDatabaseSet(databaseConnection *sql.DB, databaseSetImage ForbiddenImageCreation) error {
+	externalReference := databaseSetImage.ExternalReference
+	err := applyTransaction(databaseConnection, func(transaction *sql.Tx) error {
+		err := lockActiveForbiddenImage(transaction, externalReference)
+		if err != nil {
+			return err
+		}
+		_, err = transaction.Exec(
+			"UPDATE forbidden_image SET sift_descriptor = ?, orb_descriptor = ?, brisk_descriptor = ?, p_hash = ?, "+
+				"rotation_hash = ?, file_sha256 = ?, pixel_sha256 = ? WHERE external_reference = ?",
+			databaseSetImage.SiftDescriptor,
+			databaseSetImage.OrbDescriptor,
+			databaseSetImage.BriskDescriptor,
+			databaseSetImage.PHash,
+			databaseSetImage.RotationInvariantHash,
+			nullableString(databaseSetImage.FileDigest),
+			nullableString(databaseSetImage.PixelDigest),
+			externalReference,
+		)
+		if err != nil {
+			return err
+		}
+		return insertAuditEntry(transaction, externalReference, ReplaceAction, "")
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't replace %s in database %s", externalReference, err.Error()))
+	}
+	log.Println(fmt.Sprintf("Replaced %s in Database Set", externalReference))
+	return nil
+}
+
+// UpdateMetadataInDatabaseSet replaces the metadata of a registered image that isn't deleted, the registering user is
+// kept if the metadata doesn't contain one
+func UpdateMetadataInDatabaseSet(
+	databaseConnection *sql.DB, externalReference string, metadata ForbiddenImageMetadata,
+) error {
+	err := applyTransaction(databaseConnection, func(transaction *sql.Tx) error {
+		err := lockActiveForbiddenImage(transaction, externalReference)
+		if err != nil {
+			return err
+		}
+		_, err = transaction.Exec(
+			"UPDATE forbidden_image SET registered_by = COALESCE(?, registered_by), reason = ?, tags = ?, "+
+				"expires_at = ?, source_url = ? WHERE external_reference = ?",
+			append(metadataArguments(metadata), externalReference)...,
+		)
+		if err != nil {
+			return err
+		}
+		return insertAuditEntry(transaction, externalReference, AnnotateAction, describeMetadata(metadata))
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't annotate %s in database %s", externalReference, err.Error()))
+	}
+	log.Println(fmt.Sprintf("Annotated %s in Database Set", externalReference))
+	return nil
+}
+
+// RetrieveForbiddenImageMetadata returns the metadata of the images that aren't deleted by reference
+func RetrieveForbiddenImageMetadata(
+	databaseConnection *sql.DB, externalReferences []string,
+) (map[string]ForbiddenImageMetadata, error) {
+	metadataByReference := make(map[string]ForbiddenImageMetadata)
+	if len(externalReferences) == 0 {
+		return metadataByReference, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(externalReferences)), ", ")
+	arguments := make([]interface{}, len(externalReferences))
+	for index, externalReference := range externalReferences {
+		arguments[index] = externalReference
+	}
+	imageRows, err := databaseConnection.Query(
+		"SELECT external_reference, "+metadataColumns+" FROM forbidden_image WHERE external_reference IN ("+
+			placeholders+") AND "+activeForbiddenImage,
+		arguments...,
+	)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't retrieve metadata from database: %s", err.Error()))
+	}
+	defer imageRows.Close()
+
+	for imageRows.Next() {
+		var externalReference string
+		var metadata metadataRow
+		err = imageRows.Scan(append([]interface{}{&externalReference}, metadata.destinations()...)...)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("couldn't read metadata from database: %s", err.Error()))
+		}
+		metadataByReference[externalReference] = metadata.metadata()
+	}
+	return metadataByReference, imageRows.Err()
+}
+
+// DeleteImageFromDatabaseSet marks the image as deleted, deleted images are kept in the database with their audit
+// trail but aren't matched anymore
+func DeleteImageFromDatabaseSet(databaseConnection *sql.DB, externalReference string, reason string) error {
+	err := applyTransaction(databaseConnection, func(transaction *sql.Tx) error {
+		err := lockActiveForbiddenImage(transaction, externalReference)
+		if err != nil {
+			return err
+		}
+		_, err = transaction.Exec(
+			"UPDATE forbidden_image SET deleted_at = NOW() WHERE external_reference = ?", externalReference,
+		)
+		if err != nil {
+			return err
+		}
+		return insertAuditEntry(transaction, externalReference, DeleteAction, reason)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't delete %s from database %s", externalReference, err.Error()))
+	}
+	log.Println(fmt.Sprintf("Deleted %s from Database Set", externalReference))
+	return nil
+}
+
+// RenameImageInDatabaseSet changes the reference of a registered image and of the search images that are variations
+// of it, so that they are still evaluated as its duplicates. The rename is recorded in the audit trail of both
+// references.
+func RenameImageInDatabaseSet(databaseConnection *sql.DB, externalReference string, newReference string) error {
+	err := applyTransaction(databaseConnection, func(transaction *sql.Tx) error {
+		err := lockActiveForbiddenImage(transaction, externalReference)
+		if err != nil {
+			return err
+		}
+		var existingReference string
+		err = transaction.QueryRow(
+			"SELECT external_reference FROM forbidden_image WHERE external_reference = ?", newReference,
+		).Scan(&existingReference)
+		if err == nil {
+			return errors.New(fmt.Sprintf("%s is already registered", newReference))
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		_, err = transaction.Exec(
+			"UPDATE forbidden_image SET external_reference = ? WHERE external_reference = ?",
+			newReference,
+			externalReference,
+		)
+		if err != nil {
+			return err
+		}
+		searchImageResult, err := transaction.Exec(
+			"UPDATE search_image SET original_reference = ? WHERE original_reference = ?",
+			newReference,
+			externalReference,
+		)
+		if err != nil {
+			return err
+		}
+		details := "renamed to " + newReference
+		renamedSearchImages, _ := searchImageResult.RowsAffected()
+		if renamedSearchImages > 0 {
+			details += fmt.Sprintf(" with %d search images", renamedSearchImages)
+		}
+		err = insertAuditEntry(transaction, externalReference, RenameAction, details)
+		if err != nil {
+			return err
+		}
+		return insertAuditEntry(transaction, newReference, RenameAction, "renamed from "+externalReference)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't rename %s in database %s", externalReference, err.Error()))
+	}
+	log.Println(fmt.Sprintf("Renamed %s to %s in Database Set", externalReference, newReference))
+	return nil
+}
+
+// ApplyChunkedForbiddenImageListOperation applies the function to the summary of every registered image, deleted
+// images are only included if includeDeleted is set
+func ApplyChunkedForbiddenImageListOperation(
+	ctx context.Context, includeDeleted bool, applyFunction func(summary ForbiddenImageSummary) error,
+) error {
+	query := forbiddenImageSummaryQuery()
+	if !includeDeleted {
+		query.condition = activeForbiddenImage
+	}
+	return applyChunkedRetrievalOperation(ctx, query, false, applyFunction)
+}
+
+// RetrieveForbiddenImageSummary returns the summary of the image including deleted images
+func RetrieveForbiddenImageSummary(
+	databaseConnection *sql.DB, externalReference string,
+) (*ForbiddenImageSummary, error) {
+	imageRows, err := databaseConnection.Query(
+		"SELECT "+forbiddenImageSummaryColumns+" FROM forbidden_image WHERE external_reference = ?",
+		externalReference,
+	)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't retrieve %s from database: %s", externalReference, err.Error()))
+	}
+	defer imageRows.Close()
+
+	if !imageRows.Next() {
+		return nil, errors.New(fmt.Sprintf("%s was never registered", externalReference))
+	}
+	summary, err := scanForbiddenImageSummary(imageRows)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read %s from database: %s", externalReference, err.Error()))
+	}
+	return &summary, nil
+}
+
+// RetrieveAuditTrail returns the audit entries of the reference in the order they were recorded
+func RetrieveAuditTrail(databaseConnection *sql.DB, externalReference string) (*[]AuditEntry, error) {
+	auditRows, err := databaseConnection.Query(
+		"SELECT id, external_reference, action, COALESCE(details, ''), COALESCE(actor, ''), "+
+			"COALESCE(created_at, '') FROM forbidden_image_audit WHERE external_reference = ? ORDER BY id",
+		externalReference,
+	)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf(
+			"couldn't retrieve audit trail of %s from database: %s", externalReference, err.Error(),
+		))
+	}
+	defer auditRows.Close()
+
+	var auditTrail []AuditEntry
+	for auditRows.Next() {
+		var entry AuditEntry
+		err = auditRows.Scan(
+			&entry.Id, &entry.ExternalReference, &entry.Action, &entry.Details, &entry.Actor, &entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("couldn't read audit trail of %s: %s", externalReference, err.Error()))
+		}
+		auditTrail = append(auditTrail, entry)
+	}
+	return &auditTrail, auditRows.Err()
+}
+
+func forbiddenImageSummaryQuery() keysetQuery[ForbiddenImageSummary, string] {
+	return keysetQuery[ForbiddenImageSummary, string]{
+		table:     "forbidden_image",
+		keyColumn: "external_reference",
+		columns:   forbiddenImageSummaryColumns,
+		scan: func(imageRows *sql.Rows) (ForbiddenImageSummary, bool, error) {
+			summary, err := scanForbiddenImageSummary(imageRows)
+			return summary, true, err
+		},
+		key: func(summary ForbiddenImageSummary) string { return summary.ExternalReference },
+	}
+}
+
+func scanForbiddenImageSummary(imageRows *sql.Rows) (ForbiddenImageSummary, error) {
+	var summary ForbiddenImageSummary
+	var metadata metadataRow
+	err := imageRows.Scan(append(
+		[]interface{}{
+			&summary.ExternalReference,
+			&summary.PHash,
+			&summary.RotationHash,
+			&summary.SiftBytes,
+			&summary.OrbBytes,
+			&summary.BriskBytes,
+			&summary.FileDigest,
+			&summary.PixelDigest,
+			&summary.DeletedAt,
+		},
+		metadata.destinations()...,
+	)...)
+	summary.Metadata = metadata.metadata()
+	return summary, err
+}
+
+// applyTransaction commits the transaction if the function succeeds and rolls it back otherwise
+func applyTransaction(databaseConnection *sql.DB, applyFunction func(transaction *sql.Tx) error) error {
+	transaction, err := databaseConnection.Begin()
+	if err != nil {
+		return err
+	}
+	err = applyFunction(transaction)
+	if err != nil {
+		_ = transaction.Rollback()
+		return err
+	}
+	return transaction.Commit()
+}
+
+// errNotInForbiddenSet is wrapped by the errors of images that aren't registered or are deleted
+var errNotInForbiddenSet = errors.New("isn't in the forbidden set")
+
+// lockActiveForbiddenImage locks the row of the image until the transaction ends, it fails with errNotInForbiddenSet
+// if the image isn't registered or deleted
+func lockActiveForbiddenImage(transaction *sql.Tx, externalReference string) error {
+	var lockedReference string
+	err := transaction.QueryRow(
+		"SELECT external_reference FROM forbidden_image WHERE external_reference = ? AND "+activeForbiddenImage+
+			" FOR UPDATE",
+		externalReference,
+	).Scan(&lockedReference)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%s %w", externalReference, errNotInForbiddenSet)
+	}
+	return err
+}
+
+func insertAuditEntry(transaction *sql.Tx, externalReference string, action string, details string) error {
+	_, err := transaction.Exec(
+		"INSERT INTO forbidden_image_audit (external_reference, action, details, actor) VALUES (?, ?, ?, ?)",
+		externalReference,
+		action,
+		details,
+		currentActor(),
+	)
+	return err
+}
+
+// currentActor is the name of the user running the command, it is recorded in the audit trail
+func currentActor() string {
+	currentUser, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return currentUser.Username
+}
+
+// describeMetadata lists the fields of the metadata for the audit trail
+func describeMetadata(metadata ForbiddenImageMetadata) string {
+	var fields []string
+	if metadata.RegisteredBy != "" {
+		fields = append(fields, "registered by "+metadata.RegisteredBy)
+	}
+	if metadata.Reason != "" {
+		fields = append(fields, "reason "+metadata.Reason)
+	}
+	if len(metadata.Tags) > 0 {
+		fields = append(fields, "tags "+strings.Join(metadata.Tags, ","))
+	}
+	if metadata.ExpiresAt != "" {
+		fields = append(fields, "expires "+metadata.ExpiresAt)
+	}
+	if metadata.SourceURL != "" {
+		fields = append(fields, "source "+metadata.SourceURL)
+	}
+	return strings.Join(fields, ", ")
+}
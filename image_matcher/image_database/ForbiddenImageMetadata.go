@@ -0,0 +1,143 @@
+package image_database
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the reasons a design is forbidden for
+const (
+	TrademarkReason = "trademark"
+	CopyrightReason = "copyright"
+	OffensiveReason = "offensive"
+)
+
+var Reasons = []string{TrademarkReason, CopyrightReason, OffensiveReason}
+
+const ExpiryDateFormat = "2006-01-02"
+
+// ForbiddenImageMetadata describes who registered a forbidden image and why, every field is optional
+type ForbiddenImageMetadata struct {
+	RegisteredBy string
+	Reason       string
+	Tags         []string
+	// ExpiresAt is the last day the image is forbidden, formatted as ExpiryDateFormat
+	ExpiresAt string
+	SourceURL string
+}
+
+const metadataColumns = "COALESCE(registered_by, ''), COALESCE(reason, ''), COALESCE(tags, ''), " +
+	"COALESCE(DATE_FORMAT(expires_at, '%Y-%m-%d'), ''), COALESCE(source_url, '')"
+
+// ValidateMetadata checks the reason, the expiry date and the source url
+func ValidateMetadata(metadata ForbiddenImageMetadata) error {
+	if metadata.Reason != "" && !IsReason(metadata.Reason) {
+		return errors.New(fmt.Sprintf(
+			"unknown reason %s, the reasons are %s", metadata.Reason, strings.Join(Reasons, ", "),
+		))
+	}
+	if metadata.ExpiresAt != "" {
+		_, err := time.Parse(ExpiryDateFormat, metadata.ExpiresAt)
+		if err != nil {
+			return errors.New(fmt.Sprintf("expiry date %s isn't formatted as yyyy-mm-dd", metadata.ExpiresAt))
+		}
+	}
+	if metadata.SourceURL != "" {
+		sourceURL, err := url.Parse(metadata.SourceURL)
+		if err != nil || !sourceURL.IsAbs() {
+			return errors.New(fmt.Sprintf("source url %s isn't an absolute url", metadata.SourceURL))
+		}
+	}
+	for _, tag := range metadata.Tags {
+		if strings.Contains(tag, ",") {
+			return errors.New(fmt.Sprintf("tag %s contains a comma", tag))
+		}
+	}
+	return nil
+}
+
+// IsReason returns whether the reason is one of the Reasons
+func IsReason(reason string) bool {
+	for _, knownReason := range Reasons {
+		if reason == knownReason {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired returns whether the last day of the image was before the given day
+func (m ForbiddenImageMetadata) Expired(now time.Time) bool {
+	return m.ExpiresAt != "" && m.ExpiresAt < now.Format(ExpiryDateFormat)
+}
+
+func (m ForbiddenImageMetadata) HasTag(tag string) bool {
+	for _, imageTag := range m.Tags {
+		if imageTag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeTags trims, lower cases, sorts and deduplicates the tags
+func NormalizeTags(tags []string) []string {
+	normalizedTags := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalizedTags = append(normalizedTags, tag)
+	}
+	sort.Strings(normalizedTags)
+	return normalizedTags
+}
+
+// metadataRow receives the metadata columns of a row, the tags are stored comma separated
+type metadataRow struct {
+	registeredBy string
+	reason       string
+	tags         string
+	expiresAt    string
+	sourceURL    string
+}
+
+func (r *metadataRow) destinations() []interface{} {
+	return []interface{}{&r.registeredBy, &r.reason, &r.tags, &r.expiresAt, &r.sourceURL}
+}
+
+func (r *metadataRow) metadata() ForbiddenImageMetadata {
+	return ForbiddenImageMetadata{
+		RegisteredBy: r.registeredBy,
+		Reason:       r.reason,
+		Tags:         NormalizeTags(strings.Split(r.tags, ",")),
+		ExpiresAt:    r.expiresAt,
+		SourceURL:    r.sourceURL,
+	}
+}
+
+// metadataArguments returns the values of the metadata columns in the order of metadataColumns, empty fields are
+// stored as null
+func metadataArguments(metadata ForbiddenImageMetadata) []interface{} {
+	return []interface{}{
+		nullableString(metadata.RegisteredBy),
+		nullableString(metadata.Reason),
+		nullableString(strings.Join(NormalizeTags(metadata.Tags), ",")),
+		nullableString(metadata.ExpiresAt),
+		nullableString(metadata.SourceURL),
+	}
+}
+
+func nullableString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
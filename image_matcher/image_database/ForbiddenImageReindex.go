@@ -0,0 +1,93 @@
+package image_database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+const ReindexAction = "reindex"
+
+// FeatureColumns are the columns of the forbidden set that are computed from the image
+var FeatureColumns = []string{
+	"sift_descriptor", "orb_descriptor", "brisk_descriptor", "p_hash", "rotation_hash", "file_sha256", "pixel_sha256",
+}
+
+// FeatureUpdate holds the recomputed feature columns of a registered image
+type FeatureUpdate struct {
+	ExternalReference string
+	Columns           map[string]interface{}
+}
+
+// UpdateFeaturesInDatabaseSet writes the recomputed features of the images in one transaction and records them in
+// the audit trail, images that were deleted in the meantime are skipped and returned. Other errors, e.g. lock wait
+// timeouts, roll back the transaction.
+func UpdateFeaturesInDatabaseSet(databaseConnection *sql.DB, updates []FeatureUpdate) (*[]string, error) {
+	var skippedReferences []string
+	err := applyTransaction(databaseConnection, func(transaction *sql.Tx) error {
+		for _, update := range updates {
+			columns, err := sortedFeatureColumns(update.Columns)
+			if err != nil {
+				return err
+			}
+			err = lockActiveForbiddenImage(transaction, update.ExternalReference)
+			if errors.Is(err, errNotInForbiddenSet) {
+				skippedReferences = append(skippedReferences, update.ExternalReference)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			assignments := make([]string, len(columns))
+			arguments := make([]interface{}, 0, len(columns)+1)
+			for index, column := range columns {
+				assignments[index] = column + " = ?"
+				arguments = append(arguments, update.Columns[column])
+			}
+			_, err = transaction.Exec(
+				"UPDATE forbidden_image SET "+strings.Join(assignments, ", ")+" WHERE external_reference = ?",
+				append(arguments, update.ExternalReference)...,
+			)
+			if err != nil {
+				return err
+			}
+			err = insertAuditEntry(
+				transaction, update.ExternalReference, ReindexAction, "recomputed "+strings.Join(columns, ", "),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't write %d reindexed images %s", len(updates), err.Error()))
+	}
+	log.Println(fmt.Sprintf("Reindexed %d images in Database Set", len(updates)-len(skippedReferences)))
+	return &skippedReferences, nil
+}
+
+// sortedFeatureColumns checks that only feature columns are updated, the columns are sorted so that every update of
+// the same columns has the same statement
+func sortedFeatureColumns(columns map[string]interface{}) ([]string, error) {
+	sortedColumns := make([]string, 0, len(columns))
+	for column := range columns {
+		isFeatureColumn := false
+		for _, featureColumn := range FeatureColumns {
+			isFeatureColumn = isFeatureColumn || column == featureColumn
+		}
+		if !isFeatureColumn {
+			return nil, errors.New(fmt.Sprintf("%s isn't a feature column", column))
+		}
+		sortedColumns = append(sortedColumns, column)
+	}
+	if len(sortedColumns) == 0 {
+		return nil, errors.New("no feature columns to update")
+	}
+	sort.Strings(sortedColumns)
+	return sortedColumns, nil
+}
@@ -0,0 +1,122 @@
+package image_database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// keysetQuery retrieves the rows of a table in chunks ordered by the primary key. Every chunk continues after the key
+// of the last row of the previous chunk, so no row is retrieved twice or skipped and the queries don't slow down with
+// the position in the table like offsets do.
+type keysetQuery[Entity any, Key any] struct {
+	table     string
+	keyColumn string
+	// columns are the selected columns, scan reads them in this order
+	columns string
+	// condition optionally restricts the rows, its placeholders are filled with the arguments
+	condition string
+	arguments []interface{}
+	// scan reads the current row, rows that aren't complete are skipped but still move the cursor
+	scan func(rows *sql.Rows) (entity Entity, complete bool, err error)
+	key  func(entity Entity) Key
+}
+
+func (q *keysetQuery[Entity, Key]) statement(cursor *Key, chunkSize int) (string, []interface{}) {
+	var conditions []string
+	var arguments []interface{}
+	if q.condition != "" {
+		conditions = append(conditions, q.condition)
+		arguments = append(arguments, q.arguments...)
+	}
+	if cursor != nil {
+		conditions = append(conditions, q.keyColumn+" > ?")
+		arguments = append(arguments, *cursor)
+	}
+
+	statement := fmt.Sprintf("SELECT %s FROM %s", q.columns, q.table)
+	for index, condition := range conditions {
+		if index == 0 {
+			statement += " WHERE " + condition
+		} else {
+			statement += " AND " + condition
+		}
+	}
+	statement += fmt.Sprintf(" ORDER BY %s LIMIT ?", q.keyColumn)
+	return statement, append(arguments, chunkSize)
+}
+
+type keysetRow[Entity any] struct {
+	entity   Entity
+	complete bool
+}
+
+// retrieveChunk reads the whole chunk before it is applied, so that the rows don't hold the connection while the
+// entities are processed
+func (q *keysetQuery[Entity, Key]) retrieveChunk(
+	ctx context.Context, databaseConnection *sql.DB, cursor *Key, chunkSize int,
+) ([]keysetRow[Entity], error) {
+	statement, arguments := q.statement(cursor, chunkSize)
+	rows, err := databaseConnection.QueryContext(ctx, statement, arguments...)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't retrieve chunk of %s from database: %s", q.table, err.Error()))
+	}
+	defer rows.Close()
+
+	var chunk []keysetRow[Entity]
+	for rows.Next() {
+		entity, complete, err := q.scan(rows)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("couldn't read row of %s from database: %s", q.table, err.Error()))
+		}
+		chunk = append(chunk, keysetRow[Entity]{entity: entity, complete: complete})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't retrieve chunk of %s from database: %s", q.table, err.Error()))
+	}
+	return chunk, nil
+}
+
+// iterateKeyset applies the function to every complete row of the query and returns the number of applied rows. The
+// iteration stops at the first error of the database or the function and when the context is cancelled.
+func iterateKeyset[Entity any, Key any](
+	ctx context.Context,
+	databaseConnection *sql.DB,
+	query keysetQuery[Entity, Key],
+	chunkSize int,
+	applyFunction func(entity Entity) error,
+) (int, error) {
+	if chunkSize < 1 {
+		return 0, errors.New(fmt.Sprintf("chunk size must be positive, got %d", chunkSize))
+	}
+
+	var cursor *Key
+	applied := 0
+	for {
+		chunk, err := query.retrieveChunk(ctx, databaseConnection, cursor, chunkSize)
+		if err != nil {
+			return applied, err
+		}
+
+		for _, row := range chunk {
+			if err = ctx.Err(); err != nil {
+				return applied, err
+			}
+			key := query.key(row.entity)
+			cursor = &key
+			if !row.complete {
+				continue
+			}
+			err = applyFunction(row.entity)
+			if err != nil {
+				return applied, err
+			}
+			applied++
+		}
+
+		if len(chunk) < chunkSize {
+			return applied, nil
+		}
+	}
+}
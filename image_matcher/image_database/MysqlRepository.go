@@ -15,23 +15,30 @@ type ForbiddenImageCreation struct {
 	BriskDescriptor       []byte
 	PHash                 uint64
 	RotationInvariantHash uint64
+	// FileDigest and PixelDigest are the sha-256 of the file and of the decoded pixels, see ContentDigest.go
+	FileDigest  string
+	PixelDigest string
+	Metadata    ForbiddenImageMetadata
 }
 
 type SearchImageCreation struct {
 	ExternalReference string
 	OriginalReference string
 	Scenario          string
-	ModificationInfo  string
+	Notes             string
+	SpecHash          string
 }
 
 type FeatureImageEntity struct {
 	ExternalReference string
 	Descriptors       []byte
+	Metadata          ForbiddenImageMetadata
 }
 
 type PHashImageEntity struct {
 	ExternalReference string
 	Hash              uint64
+	Metadata          ForbiddenImageMetadata
 }
 
 type SearchImageEntity struct {
@@ -40,6 +47,21 @@ type SearchImageEntity struct {
 	OriginalReference string
 	Scenario          string
 	Notes             string
+	// SpecHash identifies the variation spec the image was generated from, empty for images generated before specs
+	SpecHash string
+}
+
+// ForbiddenImageEntity is a complete row of the forbidden set, as loaded by the in-memory index
+type ForbiddenImageEntity struct {
+	ExternalReference string
+	SiftDescriptor    []byte
+	OrbDescriptor     []byte
+	BriskDescriptor   []byte
+	PHash             uint64
+	RotationHash      uint64
+	FileDigest        string
+	PixelDigest       string
+	Metadata          ForbiddenImageMetadata
 }
 
 type HybridEntity struct {
@@ -47,6 +69,7 @@ type HybridEntity struct {
 	OrientedHash      uint64
 	RegularHash       uint64
 	SiftDescriptors   []byte
+	Metadata          ForbiddenImageMetadata
 }
 
 func openDatabaseConnection() (*sql.DB, error) {
@@ -64,7 +87,9 @@ func openDatabaseConnection() (*sql.DB, error) {
 }
 
 func GetForbiddenReferences(databaseConnection *sql.DB) (*[]string, error) {
-	imageRows, err := databaseConnection.Query("SELECT external_reference FROM forbidden_image")
+	imageRows, err := databaseConnection.Query(
+		"SELECT external_reference FROM forbidden_image WHERE " + activeForbiddenImage,
+	)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("couldn't retrieve external references from database %s", err.Error()))
 	}
@@ -87,161 +112,146 @@ func GetForbiddenReferences(databaseConnection *sql.DB) (*[]string, error) {
 	return &forbiddenReferences, nil
 }
 
-func InsertRotationHashIntoDatabase(databaseConnection *sql.DB, externalReference string, rotHash uint64) error {
-	_, err := databaseConnection.Exec(
-		"UPDATE forbidden_image SET rotation_hash = ? WHERE external_reference = ?",
-		rotHash,
-		externalReference,
-	)
-	if err != nil {
-		return errors.New(fmt.Sprintf("couldn't update %s into database %s", externalReference, err.Error()))
+func featureImageQuery(descriptorType string) keysetQuery[FeatureImageEntity, string] {
+	return keysetQuery[FeatureImageEntity, string]{
+		table:     "forbidden_image",
+		keyColumn: "external_reference",
+		condition: activeForbiddenImage,
+		columns:   "external_reference, " + descriptorType + ", " + metadataColumns,
+		scan: func(imageRows *sql.Rows) (FeatureImageEntity, bool, error) {
+			var image FeatureImageEntity
+			var metadata metadataRow
+			err := imageRows.Scan(append(
+				[]interface{}{&image.ExternalReference, &image.Descriptors}, metadata.destinations()...,
+			)...)
+			image.Metadata = metadata.metadata()
+			return image, true, err
+		},
+		key: func(image FeatureImageEntity) string { return image.ExternalReference },
 	}
-	log.Println(fmt.Sprintf("Updated %s into Database Set with %d", externalReference, rotHash))
-	return nil
 }
 
-func InsertImageIntoDatabaseSet(databaseConnection *sql.DB, databaseSetImage ForbiddenImageCreation) error {
-	externalReference := databaseSetImage.ExternalReference
-	siftDescriptor := databaseSetImage.SiftDescriptor
-	orbDescriptor := databaseSetImage.OrbDescriptor
-	briskDescriptor := databaseSetImage.BriskDescriptor
-	pHash := databaseSetImage.PHash
-	rotationInvariantHash := databaseSetImage.RotationInvariantHash
-
-	_, err := databaseConnection.Exec(
-		"INSERT INTO forbidden_image (external_reference, sift_descriptor, orb_descriptor, brisk_descriptor, p_hash, rotation_hash) VALUES (?, ?, ?, ?, ?, ?)",
-		externalReference,
-		siftDescriptor,
-		orbDescriptor,
-		briskDescriptor,
-		pHash,
-		rotationInvariantHash,
-	)
-
-	if err != nil {
-		return errors.New(fmt.Sprintf("couldn't insert %s into database %s", externalReference, err.Error()))
+// pHashImageQuery skips the images without a phash
+func pHashImageQuery() keysetQuery[PHashImageEntity, string] {
+	return keysetQuery[PHashImageEntity, string]{
+		table:     "forbidden_image",
+		keyColumn: "external_reference",
+		condition: activeForbiddenImage,
+		columns:   "external_reference, p_hash, " + metadataColumns,
+		scan: func(imageRows *sql.Rows) (PHashImageEntity, bool, error) {
+			var image PHashImageEntity
+			var hash *uint64
+			var metadata metadataRow
+			err := imageRows.Scan(append([]interface{}{&image.ExternalReference, &hash}, metadata.destinations()...)...)
+			image.Metadata = metadata.metadata()
+			if hash != nil {
+				image.Hash = *hash
+			}
+			return image, hash != nil, err
+		},
+		key: func(image PHashImageEntity) string { return image.ExternalReference },
 	}
-	log.Println(fmt.Sprintf("Inserted %s into Database Set", externalReference))
-	return nil
 }
 
-func retrieveFeatureImageChunk(
-	databaseConnection *sql.DB,
-	descriptorType string,
-	offset int,
-	limit int) (*[]FeatureImageEntity, error) {
-	imageRows, err := databaseConnection.Query(
-		fmt.Sprintf("SELECT external_reference, %s FROM forbidden_image LIMIT ? OFFSET ?", descriptorType),
-		limit,
-		offset,
-	)
-
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("couldn't retreive database set images from database: %s", err.Error()))
+// hybridQuery skips the images without a phash or a rotation hash
+func hybridQuery() keysetQuery[HybridEntity, string] {
+	return keysetQuery[HybridEntity, string]{
+		table:     "forbidden_image",
+		keyColumn: "external_reference",
+		condition: activeForbiddenImage,
+		columns:   "external_reference, sift_descriptor, rotation_hash, p_hash, " + metadataColumns,
+		scan: func(imageRows *sql.Rows) (HybridEntity, bool, error) {
+			var image HybridEntity
+			var orientedHash, regularHash *uint64
+			var metadata metadataRow
+			err := imageRows.Scan(append(
+				[]interface{}{&image.ExternalReference, &image.SiftDescriptors, &orientedHash, &regularHash},
+				metadata.destinations()...,
+			)...)
+			image.Metadata = metadata.metadata()
+			if orientedHash == nil || regularHash == nil {
+				return image, false, err
+			}
+			image.OrientedHash = *orientedHash
+			image.RegularHash = *regularHash
+			return image, true, err
+		},
+		key: func(image HybridEntity) string { return image.ExternalReference },
 	}
-	defer imageRows.Close()
-
-	var imageEntityChunk []FeatureImageEntity
-
-	for imageRows.Next() {
-		var image FeatureImageEntity
-
-		var err = imageRows.Scan(
-			&image.ExternalReference,
-			&image.Descriptors,
-		)
-
-		if err != nil {
-			continue
-		}
-
-		imageEntityChunk = append(imageEntityChunk, image)
+}
 
-		//log.Println(fmt.Sprintf("Retrieved %s from Database Set", image.ExternalReference))
+const forbiddenImageColumns = "external_reference, sift_descriptor, orb_descriptor, brisk_descriptor, " +
+	"COALESCE(p_hash, 0), COALESCE(rotation_hash, 0), " + digestColumns + ", " + metadataColumns
+
+func forbiddenImageQuery() keysetQuery[ForbiddenImageEntity, string] {
+	return keysetQuery[ForbiddenImageEntity, string]{
+		table:     "forbidden_image",
+		keyColumn: "external_reference",
+		condition: activeForbiddenImage,
+		columns:   forbiddenImageColumns,
+		scan: func(imageRows *sql.Rows) (ForbiddenImageEntity, bool, error) {
+			image, err := scanForbiddenImage(imageRows)
+			return image, true, err
+		},
+		key: func(image ForbiddenImageEntity) string { return image.ExternalReference },
 	}
-	return &imageEntityChunk, nil
 }
 
-func retrievePHashImageChunk(databaseConnection *sql.DB, offset int, limit int) (*[]PHashImageEntity, error) {
+func RetrieveForbiddenImage(databaseConnection *sql.DB, externalReference string) (*ForbiddenImageEntity, error) {
 	imageRows, err := databaseConnection.Query(
-		"SELECT external_reference, p_hash FROM forbidden_image LIMIT ? OFFSET ?",
-		limit,
-		offset,
+		"SELECT "+forbiddenImageColumns+" FROM forbidden_image WHERE external_reference = ? AND "+
+			activeForbiddenImage,
+		externalReference,
 	)
-
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("couldn't retreive database set images from database: %s", err.Error()))
+		return nil, errors.New(fmt.Sprintf("couldn't retrieve %s from database: %s", externalReference, err.Error()))
 	}
 	defer imageRows.Close()
 
-	var imageEntityChunk []PHashImageEntity
-
-	for imageRows.Next() {
-		var image PHashImageEntity
-
-		var err = imageRows.Scan(
-			&image.ExternalReference,
-			&image.Hash,
-		)
-
-		if err != nil {
-			continue
-		}
-
-		imageEntityChunk = append(imageEntityChunk, image)
-
-		//log.Println(fmt.Sprintf("Retrieved %s from Database Set", image.ExternalReference))
+	if !imageRows.Next() {
+		return nil, errors.New(fmt.Sprintf("%s isn't in the forbidden set", externalReference))
 	}
-	return &imageEntityChunk, nil
-}
-
-func retrieveHybridChunk(databaseConnection *sql.DB, offset int, limit int) (*[]HybridEntity, error) {
-	imageRows, err := databaseConnection.Query(
-		"SELECT external_reference, sift_descriptor, rotation_hash, p_hash FROM forbidden_image LIMIT ? OFFSET ?",
-		limit,
-		offset,
-	)
-
+	image, err := scanForbiddenImage(imageRows)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("couldn't retreive database set images from database: %s", err.Error()))
+		return nil, errors.New(fmt.Sprintf("couldn't read %s from database: %s", externalReference, err.Error()))
 	}
-	defer imageRows.Close()
-
-	var imageEntityChunk []HybridEntity
-
-	for imageRows.Next() {
-		var image HybridEntity
+	return &image, nil
+}
 
-		var err = imageRows.Scan(
+func scanForbiddenImage(imageRows *sql.Rows) (ForbiddenImageEntity, error) {
+	var image ForbiddenImageEntity
+	var metadata metadataRow
+	err := imageRows.Scan(append(
+		[]interface{}{
 			&image.ExternalReference,
-			&image.SiftDescriptors,
-			&image.OrientedHash,
-			&image.RegularHash,
-		)
-
-		if err != nil {
-			continue
-		}
-
-		imageEntityChunk = append(imageEntityChunk, image)
-
-		//log.Println(fmt.Sprintf("Retrieved %s from Database Set", image.ExternalReference))
-	}
-	return &imageEntityChunk, nil
+			&image.SiftDescriptor,
+			&image.OrbDescriptor,
+			&image.BriskDescriptor,
+			&image.PHash,
+			&image.RotationHash,
+			&image.FileDigest,
+			&image.PixelDigest,
+		},
+		metadata.destinations()...,
+	)...)
+	image.Metadata = metadata.metadata()
+	return image, err
 }
 
 func InsertImageIntoSearchSet(databaseConnection *sql.DB, modifiedImage SearchImageCreation) error {
 	externalReference := modifiedImage.ExternalReference
 	originalReference := modifiedImage.OriginalReference
 	scenario := modifiedImage.Scenario
-	notes := modifiedImage.ModificationInfo
+	notes := modifiedImage.Notes
+	specHash := modifiedImage.SpecHash
 
 	_, err := databaseConnection.Exec(
-		"INSERT INTO search_image (external_reference, original_reference, scenario, notes) VALUES (?, ?, ?, ?)",
+		"INSERT INTO search_image (external_reference, original_reference, scenario, notes, spec_hash) VALUES (?, ?, ?, ?, ?)",
 		externalReference,
 		originalReference,
 		scenario,
 		notes,
+		specHash,
 	)
 
 	if err != nil {
@@ -251,39 +261,20 @@ func InsertImageIntoSearchSet(databaseConnection *sql.DB, modifiedImage SearchIm
 	return nil
 }
 
-func RetrieveChunkFromSearchSet(
-	databaseConnection *sql.DB,
-	scenario string,
-	offset int,
-	limit int,
-) ([]SearchImageEntity, error) {
-	imageRows, err := databaseConnection.Query(
-		"SELECT * FROM search_image WHERE scenario = ? LIMIT ? OFFSET ?",
-		scenario,
-		limit,
-		offset,
-	)
-
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("couldn't retreive search set images from database: %s", err.Error()))
-	}
-	defer imageRows.Close()
-
-	var imageEntityChunk []SearchImageEntity
-
-	for imageRows.Next() {
-		var image SearchImageEntity
-
-		err := imageRows.Scan(&image.Id, &image.ExternalReference, &image.OriginalReference, &image.Scenario,
-			&image.Notes)
-
-		if err != nil {
-			continue
-		}
-
-		imageEntityChunk = append(imageEntityChunk, image)
-
-		//log.Println(fmt.Sprintf("Retrieved %s from search set", image.ExternalReference))
+func searchImageQuery(scenario string) keysetQuery[SearchImageEntity, int] {
+	return keysetQuery[SearchImageEntity, int]{
+		table:     "search_image",
+		keyColumn: "id",
+		columns: "id, external_reference, COALESCE(original_reference, ''), scenario, COALESCE(notes, ''), " +
+			"COALESCE(spec_hash, '')",
+		condition: "scenario = ?",
+		arguments: []interface{}{scenario},
+		scan: func(imageRows *sql.Rows) (SearchImageEntity, bool, error) {
+			var image SearchImageEntity
+			err := imageRows.Scan(&image.Id, &image.ExternalReference, &image.OriginalReference, &image.Scenario,
+				&image.Notes, &image.SpecHash)
+			return image, true, err
+		},
+		key: func(image SearchImageEntity) int { return image.Id },
 	}
-	return imageEntityChunk, nil
 }
@@ -0,0 +1,164 @@
+package image_database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// schemaColumn is a column that was added to or changed in mysql-dump/init.sql after databases were created with it
+type schemaColumn struct {
+	table      string
+	name       string
+	definition string
+	// index is the name of the index of the column, empty if the column isn't indexed
+	index string
+	// dataType is the type of the definition as named by information_schema, an existing column of another type is
+	// changed to the definition. Columns without data type are only added.
+	dataType string
+}
+
+// migratedTables are created in databases that lack them, the statements match mysql-dump/init.sql
+var migratedTables = []string{
+	"CREATE TABLE IF NOT EXISTS forbidden_image_audit (id INT AUTO_INCREMENT, external_reference VARCHAR(255), " +
+		"action VARCHAR(16), details TEXT, actor VARCHAR(255), created_at DATETIME DEFAULT CURRENT_TIMESTAMP, " +
+		"PRIMARY KEY(id))",
+	"CREATE TABLE IF NOT EXISTS allowed_image (external_reference VARCHAR(255), sift_descriptor MEDIUMBLOB, " +
+		"orb_descriptor MEDIUMBLOB, brisk_descriptor MEDIUMBLOB, p_hash BIGINT UNSIGNED, " +
+		"rotation_hash BIGINT UNSIGNED, registered_by VARCHAR(255), PRIMARY KEY (external_reference))",
+}
+
+// renamedColumn is a column whose name in mysql-dump/init.sql differed from the name the queries use
+type renamedColumn struct {
+	table      string
+	oldName    string
+	name       string
+	definition string
+}
+
+// renamedColumns are renamed in databases that still have the old name, before the missing columns are added
+var renamedColumns = []renamedColumn{
+	{table: "forbidden_image", oldName: "rotation_phash", name: "rotation_hash", definition: "BIGINT UNSIGNED"},
+}
+
+// migratedColumns are added to databases that lack them or changed if their type differs from mysql-dump/init.sql
+var migratedColumns = []schemaColumn{
+	{table: "forbidden_image", name: "rotation_hash", definition: "BIGINT UNSIGNED"},
+	{table: "forbidden_image", name: "deleted_at", definition: "DATETIME DEFAULT NULL"},
+	{table: "forbidden_image", name: "registered_by", definition: "VARCHAR(255)"},
+	{table: "forbidden_image", name: "reason", definition: "VARCHAR(32)"},
+	{table: "forbidden_image", name: "tags", definition: "VARCHAR(1024)"},
+	{table: "forbidden_image", name: "expires_at", definition: "DATE"},
+	{table: "forbidden_image", name: "source_url", definition: "VARCHAR(2048)"},
+	{table: "forbidden_image", name: "file_sha256", definition: "CHAR(64)", index: "file_sha256_index"},
+	{table: "forbidden_image", name: "pixel_sha256", definition: "CHAR(64)", index: "pixel_sha256_index"},
+	{table: "search_image", name: "spec_hash", definition: "VARCHAR(64)"},
+	// the modification parameters are stored as json in the notes, which exceeds the former 255 characters
+	{table: "search_image", name: "notes", definition: "TEXT", dataType: "text"},
+	// the scenarios were an enum that rejected new and user-defined scenarios
+	{table: "search_image", name: "scenario", definition: "VARCHAR(64)", dataType: "varchar"},
+}
+
+var schemaMigrationOnce sync.Once
+
+// migrateSchemaOnce migrates the schema with the first connection of the process, a failed migration is logged and
+// the queries of the missing columns fail as before
+func migrateSchemaOnce(databaseConnection *sql.DB) {
+	schemaMigrationOnce.Do(func() {
+		err := migrateSchema(databaseConnection)
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// migrateSchema creates the tables, renames the columns and adds the columns of mysql-dump/init.sql that databases
+// created with an older version of it lack, it changes nothing in a database that is up-to-date
+func migrateSchema(databaseConnection *sql.DB) error {
+	for _, statement := range migratedTables {
+		_, err := databaseConnection.Exec(statement)
+		if err != nil {
+			return errors.New(fmt.Sprintf("couldn't migrate database schema %s", err.Error()))
+		}
+	}
+
+	for _, column := range renamedColumns {
+		_, err := columnDataType(databaseConnection, column.table, column.oldName)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return errors.New(fmt.Sprintf("couldn't read database schema %s", err.Error()))
+		}
+		_, err = columnDataType(databaseConnection, column.table, column.name)
+		if err == nil {
+			log.Println(fmt.Sprintf(
+				"Column %s of %s exists as well as %s, %s isn't renamed", column.name, column.table, column.oldName,
+				column.oldName,
+			))
+			continue
+		} else if err != sql.ErrNoRows {
+			return errors.New(fmt.Sprintf("couldn't read database schema %s", err.Error()))
+		}
+
+		_, err = databaseConnection.Exec(
+			"ALTER TABLE " + column.table + " CHANGE COLUMN " + column.oldName + " " + column.name + " " +
+				column.definition,
+		)
+		if err != nil {
+			return errors.New(fmt.Sprintf(
+				"couldn't rename column %s of %s %s", column.oldName, column.table, err.Error(),
+			))
+		}
+		log.Println(fmt.Sprintf("Renamed column %s of %s to %s", column.oldName, column.table, column.name))
+	}
+
+	for _, column := range migratedColumns {
+		dataType, err := columnDataType(databaseConnection, column.table, column.name)
+		if err == nil {
+			if column.dataType == "" || column.dataType == dataType {
+				continue
+			}
+			_, err = databaseConnection.Exec(
+				"ALTER TABLE " + column.table + " MODIFY COLUMN " + column.name + " " + column.definition,
+			)
+			if err != nil {
+				return errors.New(fmt.Sprintf(
+					"couldn't change column %s of %s %s", column.name, column.table, err.Error(),
+				))
+			}
+			log.Println(fmt.Sprintf(
+				"Changed column %s of %s from %s to %s", column.name, column.table, dataType, column.definition,
+			))
+			continue
+		} else if err != sql.ErrNoRows {
+			return errors.New(fmt.Sprintf("couldn't read database schema %s", err.Error()))
+		}
+
+		statement := "ALTER TABLE " + column.table + " ADD COLUMN " + column.name + " " + column.definition
+		if column.index != "" {
+			statement += ", ADD INDEX " + column.index + " (" + column.name + ")"
+		}
+		_, err = databaseConnection.Exec(statement)
+		if err != nil {
+			return errors.New(fmt.Sprintf(
+				"couldn't add column %s to %s %s", column.name, column.table, err.Error(),
+			))
+		}
+		log.Println(fmt.Sprintf("Added column %s to %s", column.name, column.table))
+	}
+	return nil
+}
+
+// columnDataType returns the type of the column as named by information_schema, sql.ErrNoRows if it doesn't exist
+func columnDataType(databaseConnection *sql.DB, table string, name string) (string, error) {
+	var dataType string
+	err := databaseConnection.QueryRow(
+		"SELECT LOWER(DATA_TYPE) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() "+
+			"AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		table,
+		name,
+	).Scan(&dataType)
+	return dataType, err
+}
@@ -0,0 +1,161 @@
+package image_dataset
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image_matcher/image_handling"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	referenceDirectory = "references"
+	queryDirectory     = "queries"
+)
+
+// values of the ground truth that mark a query without reference
+var noReferenceValues = map[string]bool{"": true, "none": true, "-": true}
+
+// ExternalDataset is a copy detection dataset with reference images and query images. A query either is a copy of a
+// reference or has no reference.
+type ExternalDataset struct {
+	ReferencePaths []string
+	Queries        []DatasetQuery
+}
+
+type DatasetQuery struct {
+	Path              string
+	ExternalReference string
+	// OriginalReference is the reference the query is a copy of, empty if it has none
+	OriginalReference string
+}
+
+// LoadExternalDataset reads a dataset directory with a references and a queries directory. Without ground truth file
+// the folder layout is the ground truth: queries in a subdirectory named after a reference are copies of it, queries
+// directly in the queries directory have no reference. The ground truth csv maps query to reference, queries that
+// aren't listed have no reference. The references of the images are their file names, so two references or two
+// queries with the same file name in different subdirectories are rejected.
+func LoadExternalDataset(directory string, groundTruthPath string) (*ExternalDataset, error) {
+	referencesPath := filepath.Join(directory, referenceDirectory)
+	queriesPath := filepath.Join(directory, queryDirectory)
+	for _, path := range []string{referencesPath, queriesPath} {
+		fileInfo, err := os.Stat(path)
+		if err != nil || !fileInfo.IsDir() {
+			return nil, errors.New(fmt.Sprintf("dataset %s needs a %s directory", directory, filepath.Base(path)))
+		}
+	}
+
+	var dataset ExternalDataset
+	referencePaths := make(map[string]string)
+	for _, path := range image_handling.GetFilePathsFromDirectory(referencesPath) {
+		if !image_handling.IsImageFile(path) {
+			continue
+		}
+		err := addUniqueReference(referencePaths, path)
+		if err != nil {
+			return nil, err
+		}
+		dataset.ReferencePaths = append(dataset.ReferencePaths, path)
+	}
+
+	var groundTruth map[string]string
+	if groundTruthPath != "" {
+		var err error
+		groundTruth, err = readGroundTruth(groundTruthPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	unlistedQueries := 0
+	queryPaths := make(map[string]string)
+	for _, path := range image_handling.GetFilePathsFromDirectory(queriesPath) {
+		if !image_handling.IsImageFile(path) {
+			continue
+		}
+		err := addUniqueReference(queryPaths, path)
+		if err != nil {
+			return nil, err
+		}
+		query := DatasetQuery{Path: path, ExternalReference: fileReference(path)}
+
+		if groundTruth != nil {
+			reference, listed := groundTruth[query.ExternalReference]
+			if !listed {
+				unlistedQueries++
+			}
+			query.OriginalReference = reference
+		} else if filepath.Dir(path) != filepath.Clean(queriesPath) {
+			query.OriginalReference = filepath.Base(filepath.Dir(path))
+		}
+
+		if _, exists := referencePaths[query.OriginalReference]; query.OriginalReference != "" && !exists {
+			return nil, errors.New(
+				fmt.Sprintf("reference %s of query %s isn't in the dataset", query.OriginalReference, path),
+			)
+		}
+		dataset.Queries = append(dataset.Queries, query)
+	}
+	if unlistedQueries > 0 {
+		log.Println(unlistedQueries, "queries aren't listed in the ground truth and are imported without reference")
+	}
+
+	return &dataset, nil
+}
+
+// addUniqueReference adds the reference of the path, an image with the same reference in another directory would
+// silently replace the image of the path when it is registered or imported
+func addUniqueReference(pathsByReference map[string]string, path string) error {
+	reference := fileReference(path)
+	if existingPath, exists := pathsByReference[reference]; exists {
+		return errors.New(fmt.Sprintf(
+			"%s and %s have the same reference %s, rename one of them", existingPath, path, reference,
+		))
+	}
+	pathsByReference[reference] = path
+	return nil
+}
+
+// readGroundTruth maps the query to its reference, the first two columns are query and reference. File extensions
+// are ignored and a header is skipped.
+func readGroundTruth(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't open ground truth %s: %s", path, err.Error()))
+	}
+	defer file.Close()
+
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read ground truth %s: %s", path, err.Error()))
+	}
+
+	groundTruth := make(map[string]string)
+	for index, row := range rows {
+		if index == 0 && len(row) > 0 && strings.Contains(strings.ToLower(row[0]), "query") {
+			continue
+		}
+		if len(row) == 0 || strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+
+		query := fileReference(strings.TrimSpace(row[0]))
+		reference := ""
+		if len(row) > 1 && !noReferenceValues[strings.ToLower(strings.TrimSpace(row[1]))] {
+			reference = fileReference(strings.TrimSpace(row[1]))
+		}
+		groundTruth[query] = reference
+	}
+	return groundTruth, nil
+}
+
+// fileReference is the file name without extension, like the external references of registered images
+func fileReference(path string) string {
+	fileName := filepath.Base(path)
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName))
+}
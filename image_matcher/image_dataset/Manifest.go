@@ -0,0 +1,174 @@
+package image_dataset
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image_matcher/image_database"
+	"image_matcher/image_handling"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const ManifestFileName = "manifest.jsonl"
+
+// ManifestEntry describes a single search image of a dataset, every entry is a line of the manifest
+type ManifestEntry struct {
+	// File is the path of the image, relative to the directory of the manifest
+	File              string `json:"file"`
+	ExternalReference string `json:"externalReference"`
+	Scenario          string `json:"scenario"`
+	// OriginalReference is the forbidden image the search image was generated from, empty for uniques
+	OriginalReference string                            `json:"originalReference"`
+	Metadata          *image_handling.VariationMetadata `json:"metadata,omitempty"`
+	// Notes that aren't variation metadata, e.g. of search images generated before the metadata was introduced
+	Notes    string `json:"notes,omitempty"`
+	SpecHash string `json:"specHash,omitempty"`
+}
+
+// Manifest is a self-contained search set, the images are located relative to the directory of the manifest
+type Manifest struct {
+	Directory string
+	Entries   []ManifestEntry
+}
+
+// ReadManifest reads the manifest file or the manifest in the given dataset directory
+func ReadManifest(path string) (*Manifest, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't find manifest %s: %s", path, err.Error()))
+	}
+	if fileInfo.IsDir() {
+		path = filepath.Join(path, ManifestFileName)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't open manifest %s: %s", path, err.Error()))
+	}
+	defer file.Close()
+
+	manifest := Manifest{Directory: filepath.Dir(path)}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var entry ManifestEntry
+		err = json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("couldn't decode line %d of manifest %s: %s", lineNumber, path, err.Error()))
+		}
+		if entry.File == "" || entry.ExternalReference == "" || entry.Scenario == "" {
+			return nil, errors.New(
+				fmt.Sprintf("line %d of manifest %s needs a file, an external reference and a scenario", lineNumber, path),
+			)
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read manifest %s: %s", path, err.Error()))
+	}
+
+	return &manifest, nil
+}
+
+// WriteManifest writes the entries as manifest into the directory of the manifest
+func WriteManifest(manifest *Manifest) error {
+	err := os.MkdirAll(manifest.Directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(manifest.Directory, ManifestFileName)
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't create manifest %s: %s", path, err.Error()))
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range manifest.Entries {
+		err = encoder.Encode(entry)
+		if err != nil {
+			return errors.New(fmt.Sprintf("couldn't write %s to manifest: %s", entry.ExternalReference, err.Error()))
+		}
+	}
+	return writer.Flush()
+}
+
+// ImagePath resolves the file of the entry against the directory of the manifest
+func (m *Manifest) ImagePath(entry *ManifestEntry) string {
+	if filepath.IsAbs(entry.File) {
+		return entry.File
+	}
+	return filepath.Join(m.Directory, entry.File)
+}
+
+// Scenarios returns the scenarios of the manifest in the order they first appear
+func (m *Manifest) Scenarios() []string {
+	var scenarios []string
+	seen := make(map[string]bool)
+	for _, entry := range m.Entries {
+		if !seen[entry.Scenario] {
+			seen[entry.Scenario] = true
+			scenarios = append(scenarios, entry.Scenario)
+		}
+	}
+	return scenarios
+}
+
+func (m *Manifest) EntriesOfScenario(scenario string) []ManifestEntry {
+	var entries []ManifestEntry
+	for _, entry := range m.Entries {
+		if entry.Scenario == scenario {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// NewManifestEntry converts a search image of the database, the notes are decoded into the variation metadata if
+// possible
+func NewManifestEntry(searchImage image_database.SearchImageEntity, file string) ManifestEntry {
+	entry := ManifestEntry{
+		File:              filepath.ToSlash(file),
+		ExternalReference: searchImage.ExternalReference,
+		Scenario:          searchImage.Scenario,
+		OriginalReference: searchImage.OriginalReference,
+		SpecHash:          searchImage.SpecHash,
+	}
+
+	metadata, err := image_handling.DecodeVariationMetadata(searchImage.Notes)
+	if err != nil {
+		entry.Notes = searchImage.Notes
+	} else {
+		entry.Metadata = metadata
+	}
+	return entry
+}
+
+// SearchImage converts the entry into a search image like it is stored in the database
+func (e *ManifestEntry) SearchImage() image_database.SearchImageEntity {
+	notes := e.Notes
+	if e.Metadata != nil {
+		notes = image_handling.EncodeVariationMetadata(*e.Metadata)
+	}
+
+	return image_database.SearchImageEntity{
+		ExternalReference: e.ExternalReference,
+		OriginalReference: e.OriginalReference,
+		Scenario:          e.Scenario,
+		Notes:             notes,
+		SpecHash:          e.SpecHash,
+	}
+}
@@ -0,0 +1,160 @@
+package image_dataset
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image_matcher/image_database"
+	"image_matcher/image_handling"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DefaultSplitsPath = "splits.json"
+
+const (
+	TrainSplit      = "train"
+	ValidationSplit = "validation"
+	TestSplit       = "test"
+)
+
+// Splits partition the search set by design, all variations of an original are in the same split. The assignments
+// are persisted, so that the same search images are used for tuning and testing in every run.
+type Splits struct {
+	Seed               int64   `json:"seed"`
+	ValidationFraction float64 `json:"validationFraction"`
+	TestFraction       float64 `json:"testFraction"`
+	// Folds is the number of cross-validation folds the train and validation designs are divided into, 0 or 1
+	// disables cross-validation
+	Folds       int                   `json:"folds"`
+	Assignments map[string]Assignment `json:"assignments"`
+}
+
+// Assignment is the split of a design, designs of the test split have no fold
+type Assignment struct {
+	Split string `json:"split"`
+	Fold  int    `json:"fold"`
+}
+
+func NewSplits(seed int64, validationFraction float64, testFraction float64, folds int) (*Splits, error) {
+	if validationFraction < 0 || testFraction < 0 || validationFraction+testFraction >= 1 {
+		return nil, errors.New("validation and test fraction need to be positive and leave designs for training")
+	}
+	if folds < 0 {
+		return nil, errors.New("number of folds can't be negative")
+	}
+	return &Splits{
+		Seed:               seed,
+		ValidationFraction: validationFraction,
+		TestFraction:       testFraction,
+		Folds:              folds,
+		Assignments:        make(map[string]Assignment),
+	}, nil
+}
+
+func LoadSplits(path string) (*Splits, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read splits %s: %s", path, err.Error()))
+	}
+
+	var splits Splits
+	err = json.Unmarshal(content, &splits)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't decode splits %s: %s", path, err.Error()))
+	}
+	if splits.Assignments == nil {
+		splits.Assignments = make(map[string]Assignment)
+	}
+	return &splits, nil
+}
+
+func WriteSplits(splits *Splits, path string) error {
+	content, err := json.MarshalIndent(splits, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if directory := filepath.Dir(path); directory != "." {
+		err = os.MkdirAll(directory, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.WriteFile(path, content, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't write splits %s: %s", path, err.Error()))
+	}
+	return nil
+}
+
+// Assign returns the persisted assignment of the design or assigns it. New designs are assigned by a hash of the
+// seed and the design, so the assignment doesn't depend on the order the designs are seen in.
+func (s *Splits) Assign(design string) Assignment {
+	assignment, exists := s.Assignments[design]
+	if exists {
+		return assignment
+	}
+
+	position := s.designRandom(design, "split").Float64()
+	switch {
+	case position < s.TestFraction:
+		assignment.Split = TestSplit
+	case position < s.TestFraction+s.ValidationFraction:
+		assignment.Split = ValidationSplit
+	default:
+		assignment.Split = TrainSplit
+	}
+	if assignment.Split != TestSplit && s.Folds > 1 {
+		assignment.Fold = s.designRandom(design, "fold").Intn(s.Folds)
+	}
+
+	s.Assignments[design] = assignment
+	return assignment
+}
+
+// Count returns the number of designs per split
+func (s *Splits) Count() map[string]int {
+	counts := make(map[string]int)
+	for _, assignment := range s.Assignments {
+		counts[assignment.Split]++
+	}
+	return counts
+}
+
+// designRandom is seeded by the design, the hash of similar designs only differs in the low bits, the random source
+// spreads them
+func (s *Splits) designRandom(design string, purpose string) *rand.Rand {
+	hash := fnv.New64a()
+	seedBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seedBytes, uint64(s.Seed))
+	hash.Write(seedBytes)
+	hash.Write([]byte(purpose))
+	hash.Write([]byte{0})
+	hash.Write([]byte(design))
+	return rand.New(rand.NewSource(int64(hash.Sum64())))
+}
+
+// Design returns the original the search image shows: the original reference of duplicates, the query of hard
+// negatives and the original uniques were generated from, which is the prefix of their external reference. Imported
+// search images without such a prefix are a design of their own.
+func Design(searchImage image_database.SearchImageEntity) string {
+	if searchImage.OriginalReference != "" {
+		return searchImage.OriginalReference
+	}
+
+	metadata, err := image_handling.DecodeVariationMetadata(searchImage.Notes)
+	if err == nil && metadata.HardNegative != nil {
+		return metadata.HardNegative.Query
+	}
+
+	separatorIndex := strings.LastIndex(searchImage.ExternalReference, "-"+searchImage.Scenario+"-")
+	if separatorIndex > 0 {
+		return searchImage.ExternalReference[:separatorIndex]
+	}
+	return searchImage.ExternalReference
+}
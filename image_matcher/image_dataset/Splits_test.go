@@ -0,0 +1,168 @@
+package image_dataset
+
+import (
+	"fmt"
+	"image_matcher/image_database"
+	"image_matcher/image_handling"
+	"testing"
+)
+
+func TestNewSplitsValidation(t *testing.T) {
+	tests := []struct {
+		name               string
+		validationFraction float64
+		testFraction       float64
+		folds              int
+		valid              bool
+	}{
+		{"default fractions", 0.2, 0.2, 5, true},
+		{"no validation and test", 0, 0, 0, true},
+		{"negative validation", -0.1, 0.2, 0, false},
+		{"negative test", 0.2, -0.1, 0, false},
+		{"no designs left for training", 0.5, 0.5, 0, false},
+		{"negative folds", 0.2, 0.2, -1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewSplits(1, test.validationFraction, test.testFraction, test.folds)
+			if (err == nil) != test.valid {
+				t.Errorf("NewSplits(%g, %g, %d) error = %v, want valid %t",
+					test.validationFraction, test.testFraction, test.folds, err, test.valid)
+			}
+		})
+	}
+}
+
+func TestAssignIsDeterministicAndOrderIndependent(t *testing.T) {
+	var designs []string
+	for index := 0; index < 200; index++ {
+		designs = append(designs, fmt.Sprintf("design-%d", index))
+	}
+
+	forward := newTestSplits(t, 42, 5)
+	for _, design := range designs {
+		forward.Assign(design)
+	}
+	backward := newTestSplits(t, 42, 5)
+	for index := len(designs) - 1; index >= 0; index-- {
+		backward.Assign(designs[index])
+	}
+
+	for _, design := range designs {
+		if forward.Assignments[design] != backward.Assignments[design] {
+			t.Errorf("assignment of %s depends on the order: %v and %v",
+				design, forward.Assignments[design], backward.Assignments[design])
+		}
+	}
+}
+
+func TestAssignDependsOnSeed(t *testing.T) {
+	first := newTestSplits(t, 1, 0)
+	second := newTestSplits(t, 2, 0)
+	differences := 0
+	for index := 0; index < 200; index++ {
+		design := fmt.Sprintf("design-%d", index)
+		if first.Assign(design) != second.Assign(design) {
+			differences++
+		}
+	}
+	if differences == 0 {
+		t.Error("assignments are the same for different seeds")
+	}
+}
+
+func TestAssignReturnsPersistedAssignment(t *testing.T) {
+	splits := newTestSplits(t, 42, 5)
+	persisted := Assignment{Split: ValidationSplit, Fold: 3}
+	splits.Assignments["persisted"] = persisted
+
+	if assignment := splits.Assign("persisted"); assignment != persisted {
+		t.Errorf("Assign returned %v, want the persisted %v", assignment, persisted)
+	}
+}
+
+func TestAssignFolds(t *testing.T) {
+	splits := newTestSplits(t, 42, 5)
+	for index := 0; index < 500; index++ {
+		assignment := splits.Assign(fmt.Sprintf("design-%d", index))
+		if assignment.Split == TestSplit && assignment.Fold != 0 {
+			t.Errorf("test design has fold %d", assignment.Fold)
+		}
+		if assignment.Fold < 0 || assignment.Fold >= splits.Folds {
+			t.Errorf("fold %d is out of range", assignment.Fold)
+		}
+	}
+
+	counts := splits.Count()
+	for _, split := range []string{TrainSplit, ValidationSplit, TestSplit} {
+		if counts[split] == 0 {
+			t.Errorf("no designs were assigned to the %s split", split)
+		}
+	}
+	if counts[TrainSplit] < counts[ValidationSplit] || counts[TrainSplit] < counts[TestSplit] {
+		t.Errorf("split counts %v don't follow the fractions", counts)
+	}
+}
+
+func TestAssignWithoutFolds(t *testing.T) {
+	for _, folds := range []int{0, 1} {
+		splits := newTestSplits(t, 42, folds)
+		for index := 0; index < 100; index++ {
+			if assignment := splits.Assign(fmt.Sprintf("design-%d", index)); assignment.Fold != 0 {
+				t.Errorf("%d folds: design has fold %d", folds, assignment.Fold)
+			}
+		}
+	}
+}
+
+func TestDesign(t *testing.T) {
+	hardNegativeNotes := image_handling.EncodeVariationMetadata(image_handling.VariationMetadata{
+		HardNegative: &image_handling.HardNegative{Query: "query.jpg", Reference: "reference.jpg"},
+	})
+	tests := []struct {
+		name        string
+		searchImage image_database.SearchImageEntity
+		design      string
+	}{
+		{
+			"duplicate",
+			image_database.SearchImageEntity{
+				ExternalReference: "original.jpg-scaled-1", OriginalReference: "original.jpg", Scenario: "scaled",
+			},
+			"original.jpg",
+		},
+		{
+			"hard negative",
+			image_database.SearchImageEntity{
+				ExternalReference: "query.jpg-hard-negatives-1", Scenario: "hard-negatives", Notes: hardNegativeNotes,
+			},
+			"query.jpg",
+		},
+		{
+			"unique",
+			image_database.SearchImageEntity{ExternalReference: "original.jpg-uniques-7", Scenario: "uniques"},
+			"original.jpg",
+		},
+		{
+			"imported",
+			image_database.SearchImageEntity{ExternalReference: "imported.jpg", Scenario: "external"},
+			"imported.jpg",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if design := Design(test.searchImage); design != test.design {
+				t.Errorf("Design() = %s, want %s", design, test.design)
+			}
+		})
+	}
+}
+
+func newTestSplits(t *testing.T, seed int64, folds int) *Splits {
+	t.Helper()
+	splits, err := NewSplits(seed, 0.2, 0.2, folds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return splits
+}
@@ -1,10 +1,14 @@
 package image_handling
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"github.com/disintegration/imaging"
 	"gocv.io/x/gocv"
 	"image"
 	"image/color"
+	"image/draw"
 	"log"
 )
 
@@ -19,6 +23,21 @@ const siftDescriptorByteLength = 128 * 4
 const orbDescriptorByteLength = 256 / 8
 const briskDescriptorByteLength = 512 / 8
 
+// DescriptorByteLength is the number of bytes of a single descriptor of the analyzer, 0 for analyzers without
+// descriptors
+func DescriptorByteLength(imageAnalyzer string) int {
+	switch imageAnalyzer {
+	case "sift":
+		return siftDescriptorByteLength
+	case "orb":
+		return orbDescriptorByteLength
+	case "brisk":
+		return briskDescriptorByteLength
+	default:
+		return 0
+	}
+}
+
 func ConvertImageMatToByteArray(mat gocv.Mat) []byte {
 	if mat.Empty() {
 		log.Println("descriptor is empty!")
@@ -85,3 +104,28 @@ func ConvertImageToGrayMat(img *image.Image) gocv.Mat {
 
 	return mat
 }
+
+// FileDigest is the sha-256 of the file content, only byte-identical files have the same digest
+func FileDigest(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// PixelDigest is the sha-256 of the size and the non-premultiplied RGBA pixels of the image, the same image in
+// different file formats or encodings has the same digest
+func PixelDigest(img *image.Image) string {
+	bounds := (*img).Bounds()
+	pixels, isNRGBA := (*img).(*image.NRGBA)
+	if !isNRGBA || pixels.Rect.Min != (image.Point{}) || pixels.Stride != 4*bounds.Dx() {
+		pixels = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(pixels, pixels.Bounds(), *img, bounds.Min, draw.Src)
+	}
+
+	hash := sha256.New()
+	size := make([]byte, 16)
+	binary.LittleEndian.PutUint64(size[:8], uint64(bounds.Dx()))
+	binary.LittleEndian.PutUint64(size[8:], uint64(bounds.Dy()))
+	hash.Write(size)
+	hash.Write(pixels.Pix)
+	return hex.EncodeToString(hash.Sum(nil))
+}
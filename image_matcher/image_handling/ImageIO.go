@@ -1,6 +1,9 @@
 package image_handling
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"gocv.io/x/gocv"
 	"image"
 	"image/color"
@@ -17,9 +20,14 @@ import (
 type RawImage struct {
 	ExternalReference string
 	Data              image.Image
+	// FileDigest is the sha-256 of the file the image was loaded from, empty if it wasn't loaded from a file
+	FileDigest string
+	// IgnoredReference is the forbidden image the search image is a copy of, e.g. the query of a hard negative. An
+	// exact match with it doesn't decide the search, so the image is still compared with the features.
+	IgnoredReference string
 }
 
-var allowedImageExtensions = [...]string{".png", ".jpg"}
+var allowedImageExtensions = [...]string{".png", ".jpg", ".jpeg"}
 
 func LoadImagesFromPath(path string) []*RawImage {
 	fileInfo, err := os.Stat(path)
@@ -73,31 +81,58 @@ func LoadImagesFromDirectory(filePaths []string) []*RawImage {
 }
 
 func LoadRawImage(path string) *RawImage {
-	if !isAllowedImageFile(path) {
+	if !IsImageFile(path) {
 		return nil
 	}
 
-	img := loadImageFromDisk(path)
+	rawImage, err := ReadRawImage(path)
+	if err != nil {
+		log.Fatal("Error loading the image: ", err)
+	}
+	return rawImage
+}
+
+// ReadRawImage loads the image like LoadRawImage, but an image that can't be read or decoded is returned as error
+// instead of ending the process
+func ReadRawImage(path string) (*RawImage, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't decode %s: %s", path, err.Error()))
+	}
 
 	filenameWithExt := filepath.Base(path)
 	filenameWithoutExt := strings.TrimSuffix(filenameWithExt, filepath.Ext(filenameWithExt))
 
-	return &RawImage{ExternalReference: filenameWithoutExt, Data: *img}
+	return &RawImage{ExternalReference: filenameWithoutExt, Data: img, FileDigest: FileDigest(content)}, nil
 }
 
 func loadImageFromDisk(path string) *image.Image {
-	file, err := os.Open(path)
+	content, err := os.ReadFile(path)
 	if err != nil {
 		log.Fatal("Error opening the image: ", err)
 	}
-	defer file.Close()
+	return decodeImage(content)
+}
+
+// readImageFromDisk reads and decodes the image, unlike loadImageFromDisk an unreadable image is returned as error
+func readImageFromDisk(path string) (image.Image, error) {
+	rawImage, err := ReadRawImage(path)
+	if err != nil {
+		return nil, err
+	}
+	return rawImage.Data, nil
+}
 
-	img, _, err := image.Decode(file)
+func decodeImage(content []byte) *image.Image {
+	img, _, err := image.Decode(bytes.NewReader(content))
 	if err != nil {
 		log.Fatal("Error decoding the image: ", err)
 	}
 
-	//log.Println("successfully loaded: ", path)
 	return &img
 }
 
@@ -118,7 +153,7 @@ func SaveImageToDisk(path string, image image.Image) {
 	log.Println("saved variation", newPath)
 }
 
-func isAllowedImageFile(filePath string) bool {
+func IsImageFile(filePath string) bool {
 	fileExtension := strings.ToLower(filepath.Ext(filePath))
 
 	for _, allowedExtension := range allowedImageExtensions {
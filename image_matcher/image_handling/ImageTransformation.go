@@ -1,13 +1,15 @@
 package image_handling
 
 import (
+	"bytes"
 	"github.com/disintegration/imaging"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/jpeg"
+	"log"
 	"math"
 	"math/rand"
-	"time"
 )
 
 func ResizeImage(img *image.Image, scalingFactor int) image.Image {
@@ -40,10 +42,10 @@ func MirrorImage(img *image.Image, horizontal bool) (image.Image, string) {
 	return mirroredImage, axis
 }
 
-func ChangeBackgroundColor(img *image.Image) (image.Image, color.Color) {
-	r := uint8(rand.Intn(255))
-	g := uint8(rand.Intn(255))
-	b := uint8(rand.Intn(255))
+func ChangeBackgroundColor(img *image.Image, random *rand.Rand) (image.Image, color.Color) {
+	r := uint8(random.Intn(255))
+	g := uint8(random.Intn(255))
+	b := uint8(random.Intn(255))
 	newBackground := color.RGBA{R: r, G: g, B: b, A: 255}
 
 	newImage := imaging.New((*img).Bounds().Size().X, (*img).Bounds().Size().Y, newBackground)
@@ -52,28 +54,33 @@ func ChangeBackgroundColor(img *image.Image) (image.Image, color.Color) {
 	return newImage, newBackground
 }
 
-func MoveMotive(img *image.Image) (image.Image, float64) {
+// MoveMotive pastes the motive at a random position of a transparent canvas, the canvas is canvasFactor times the
+// size of the image
+func MoveMotive(img *image.Image, canvasFactor float64, random *rand.Rand) (image.Image, image.Point) {
 	croppedImage := cropImage(img)
-	newWidth := int(float64((*img).Bounds().Dx()) * 2)
-	newHeight := int(float64((*img).Bounds().Dy()) * 2)
+	newWidth := int(float64((*img).Bounds().Dx()) * canvasFactor)
+	newHeight := int(float64((*img).Bounds().Dy()) * canvasFactor)
 
 	newImage := imaging.New(newWidth, newHeight, color.Transparent)
 
-	movedImage, movedDistance := pasteImageRandomly(&croppedImage, newImage)
+	movedImage, offset := pasteImageRandomly(&croppedImage, newImage, random)
 
-	return movedImage, movedDistance
+	return movedImage, offset
 }
 
-func IntegrateInOtherImage(img *image.Image) (image.Image, float64) {
+func IntegrateInOtherImage(img *image.Image, random *rand.Rand) (image.Image, image.Point) {
 	croppedImage := cropImage(img)
 	biggerImage := loadImageFromDisk("images/part-background.png")
 
-	newImage, movedDistance := pasteImageRandomly(&croppedImage, *biggerImage)
+	newImage, offset := pasteImageRandomly(&croppedImage, *biggerImage, random)
 
-	return newImage, movedDistance
+	return newImage, offset
 }
 
-func pasteImageRandomly(pastedImage *image.Image, backgroundImage image.Image) (image.Image, float64) {
+// pasteImageRandomly returns the generated image and the position the pasted image was drawn at
+func pasteImageRandomly(
+	pastedImage *image.Image, backgroundImage image.Image, random *rand.Rand,
+) (image.Image, image.Point) {
 	pastedImagedWidth := (*pastedImage).Bounds().Dx()
 	pastedImageHeight := (*pastedImage).Bounds().Dy()
 
@@ -83,7 +90,6 @@ func pasteImageRandomly(pastedImage *image.Image, backgroundImage image.Image) (
 	maxX := (backgroundWidth - pastedImagedWidth) / 2
 	maxY := (backgroundHeight - pastedImageHeight) / 2
 
-	random := rand.New(rand.NewSource(time.Now().UnixNano()))
 	movedX := random.Intn(2*maxX+1) - maxX
 	movedY := random.Intn(2*maxY+1) - maxY
 
@@ -101,11 +107,7 @@ func pasteImageRandomly(pastedImage *image.Image, backgroundImage image.Image) (
 
 	generatedImage := pasteImage(backgroundNRGBA, foregroundNRGBA, offsetX, offsetY)
 
-	movedDistance := math.Sqrt(
-		float64(offsetX*offsetX + offsetY*offsetY),
-	)
-
-	return generatedImage, movedDistance
+	return generatedImage, image.Pt(offsetX, offsetY)
 }
 
 func pasteImage(bgImage *image.NRGBA, fgImage *image.NRGBA, offsetX, offsetY int) image.Image {
@@ -144,3 +146,182 @@ func cropImage(img *image.Image) image.Image {
 
 	return croppedImage
 }
+
+// RecompressJPEG flattens the image onto a white background and encodes it as jpeg with the given quality
+func RecompressJPEG(img *image.Image, quality int) image.Image {
+	flattenedImage := imaging.New((*img).Bounds().Dx(), (*img).Bounds().Dy(), color.White)
+	flattenedImage = imaging.Overlay(flattenedImage, *img, image.Pt(0, 0), 1.0)
+
+	imageByteBuffer := new(bytes.Buffer)
+	err := jpeg.Encode(imageByteBuffer, flattenedImage, &jpeg.Options{Quality: quality})
+	if err != nil {
+		log.Println("Error while encoding image as jpeg: ", err)
+		return flattenedImage
+	}
+
+	recompressedImage, err := jpeg.Decode(imageByteBuffer)
+	if err != nil {
+		log.Println("Error while decoding recompressed jpeg: ", err)
+		return flattenedImage
+	}
+	return recompressedImage
+}
+
+// AddGaussianNoise adds noise with the given standard deviation to every colour channel, alpha is kept
+func AddGaussianNoise(img *image.Image, deviation float64, random *rand.Rand) image.Image {
+	noisyImage := imaging.Clone(*img)
+
+	for index := 0; index < len(noisyImage.Pix); index += 4 {
+		for channel := 0; channel < 3; channel++ {
+			value := float64(noisyImage.Pix[index+channel]) + random.NormFloat64()*deviation
+			noisyImage.Pix[index+channel] = uint8(math.Max(0, math.Min(255, math.Round(value))))
+		}
+	}
+	return noisyImage
+}
+
+func BlurImage(img *image.Image, sigma float64) image.Image {
+	return imaging.Blur(*img, sigma)
+}
+
+// CropPartially keeps the given fraction of the width and height of the motive at a random position and returns
+// the position of the kept part relative to the motive
+func CropPartially(img *image.Image, fraction float64, random *rand.Rand) (image.Image, image.Point) {
+	croppedMotive := cropImage(img)
+	motiveWidth := croppedMotive.Bounds().Dx()
+	motiveHeight := croppedMotive.Bounds().Dy()
+
+	partWidth := int(math.Max(1, math.Round(float64(motiveWidth)*fraction)))
+	partHeight := int(math.Max(1, math.Round(float64(motiveHeight)*fraction)))
+
+	offset := image.Pt(random.Intn(motiveWidth-partWidth+1), random.Intn(motiveHeight-partHeight+1))
+	partialImage := imaging.Crop(croppedMotive, image.Rect(offset.X, offset.Y, offset.X+partWidth, offset.Y+partHeight))
+
+	return partialImage, offset
+}
+
+// ShiftColour rotates the hue by the given degrees and changes the saturation by the given percentage (-100 to 100)
+func ShiftColour(img *image.Image, hueShift float64, saturationShift float64) image.Image {
+	shiftedImage := imaging.AdjustFunc(*img, func(c color.NRGBA) color.NRGBA {
+		hue, saturation, lightness := rgbToHSL(c)
+		hue = math.Mod(hue+hueShift/360+1, 1)
+		r, g, b := hslToRGB(hue, saturation, lightness)
+		return color.NRGBA{R: r, G: g, B: b, A: c.A}
+	})
+	if saturationShift != 0 {
+		shiftedImage = imaging.AdjustSaturation(shiftedImage, saturationShift)
+	}
+	return shiftedImage
+}
+
+// ChangeContrast changes the contrast by the given percentage (-100 to 100)
+func ChangeContrast(img *image.Image, percentage float64) image.Image {
+	return imaging.AdjustContrast(*img, percentage)
+}
+
+// StretchImage changes the aspect ratio by scaling only the width with the given factor
+func StretchImage(img *image.Image, factor float64) image.Image {
+	newWidth := int(math.Max(1, math.Round(float64((*img).Bounds().Dx())*factor)))
+	return imaging.Resize(*img, newWidth, (*img).Bounds().Dy(), imaging.Lanczos)
+}
+
+func UpscaleImage(img *image.Image, scalingFactor int) image.Image {
+	newWidth := (*img).Bounds().Dx() * scalingFactor
+	newHeight := (*img).Bounds().Dy() * scalingFactor
+
+	return imaging.Resize(*img, newWidth, newHeight, imaging.Lanczos)
+}
+
+// WarpImagePerspective tilts the image away from the viewer on a random side, strength is the fraction the far
+// side is shortened by. Returns the quad the image corners were mapped to.
+func WarpImagePerspective(img *image.Image, strength float64, random *rand.Rand) (image.Image, [4]Corner) {
+	width := float64((*img).Bounds().Dx())
+	height := float64((*img).Bounds().Dy())
+	insetX := width * strength / 2
+	insetY := height * strength / 2
+
+	quad := [4]Corner{{0, 0}, {width, 0}, {width, height}, {0, height}}
+	switch random.Intn(4) {
+	case 0: // top side is further away
+		quad[0].X, quad[1].X = insetX, width-insetX
+	case 1: // right side
+		quad[1].Y, quad[2].Y = insetY, height-insetY
+	case 2: // bottom side
+		quad[3].X, quad[2].X = insetX, width-insetX
+	default: // left side
+		quad[0].Y, quad[3].Y = insetY, height-insetY
+	}
+
+	warpedImage, err := WarpPerspective(img, quad, int(width), int(height))
+	if err != nil {
+		log.Println("Error while warping image: ", err)
+		return *img, quad
+	}
+	return warpedImage, quad
+}
+
+// rgbToHSL returns hue, saturation and lightness in the range 0 to 1
+func rgbToHSL(c color.NRGBA) (float64, float64, float64) {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	maximum := math.Max(r, math.Max(g, b))
+	minimum := math.Min(r, math.Min(g, b))
+	lightness := (maximum + minimum) / 2
+
+	if maximum == minimum {
+		return 0, 0, lightness
+	}
+
+	delta := maximum - minimum
+	saturation := delta / (maximum + minimum)
+	if lightness > 0.5 {
+		saturation = delta / (2 - maximum - minimum)
+	}
+
+	var hue float64
+	switch maximum {
+	case r:
+		hue = (g - b) / delta
+		if g < b {
+			hue += 6
+		}
+	case g:
+		hue = (b-r)/delta + 2
+	default:
+		hue = (r-g)/delta + 4
+	}
+
+	return hue / 6, saturation, lightness
+}
+
+func hslToRGB(hue, saturation, lightness float64) (uint8, uint8, uint8) {
+	if saturation == 0 {
+		gray := uint8(math.Round(lightness * 255))
+		return gray, gray, gray
+	}
+
+	var q float64
+	if lightness < 0.5 {
+		q = lightness * (1 + saturation)
+	} else {
+		q = lightness + saturation - lightness*saturation
+	}
+	p := 2*lightness - q
+
+	hueToChannel := func(t float64) uint8 {
+		t = math.Mod(t+1, 1)
+		var value float64
+		switch {
+		case t < 1.0/6:
+			value = p + (q-p)*6*t
+		case t < 1.0/2:
+			value = q
+		case t < 2.0/3:
+			value = p + (q-p)*(2.0/3-t)*6
+		default:
+			value = p
+		}
+		return uint8(math.Round(value * 255))
+	}
+
+	return hueToChannel(hue + 1.0/3), hueToChannel(hue), hueToChannel(hue - 1.0/3)
+}
@@ -1,173 +1,375 @@
 package image_handling
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"image"
+	"log"
 	"math/rand"
 	"strconv"
-	"time"
 )
 
 const (
-	IDENTICAL  = "identical"
-	SCALED     = "scaled"
-	ROTATED    = "rotated"
-	MIRRORED   = "mirrored"
-	MOVED      = "moved"
-	BACKGROUND = "background"
-	PART       = "part"
+	IDENTICAL   = "identical"
+	SCALED      = "scaled"
+	ROTATED     = "rotated"
+	MIRRORED    = "mirrored"
+	MOVED       = "moved"
+	BACKGROUND  = "background"
+	PART        = "part"
+	JPEG        = "jpeg"
+	NOISE       = "noise"
+	BLURRED     = "blurred"
+	CROPPED     = "cropped"
+	COLOUR      = "colour"
+	CONTRAST    = "contrast"
+	STRETCHED   = "stretched"
+	UPSCALED    = "upscaled"
+	PERSPECTIVE = "perspective"
+	MOCKUP      = "mockup"
 )
 
-var Modifiers = []string{IDENTICAL, SCALED, ROTATED, MIRRORED, MOVED, BACKGROUND, PART}
+var Modifiers = []string{
+	IDENTICAL, SCALED, ROTATED, MIRRORED, MOVED, BACKGROUND, PART,
+	JPEG, NOISE, BLURRED, CROPPED, COLOUR, CONTRAST, STRETCHED, UPSCALED, PERSPECTIVE, MOCKUP,
+}
 
-var scalingFactors = []int{2, 4, 10}
+const duplicateVariation = "duplicate"
+const uniqueVariation = "unique"
 
-var rotationAngles = []float64{5, 10, 45, 90, 180}
+const defaultCanvasFactor = 2
 
 type ImageVariation struct {
 	ModifiedImage    image.Image
 	ModificationInfo string
+	Modifications    []ModificationParameters
+	// Seed is the seed of the whole generation run, ImageSeed the seed derived from it for this original and modifier
+	Seed      int64
+	ImageSeed int64
+	// SpecHash identifies the variation spec the variation was generated from
+	SpecHash string
 }
 
-func GenerateDuplicateVariations(originalImage *RawImage, modifier string) *[]ImageVariation {
-
-	switch modifier {
-	case SCALED:
-		return generateAllScaledVariations(&originalImage.Data)
-
-	case ROTATED:
-		return generateAllRotatedVariations(&originalImage.Data)
-
-	case MIRRORED:
-		return generateAllMirroredVariations(&originalImage.Data)
-
-	default:
-		modifiedImage, modificationInfo := modifyImage(&originalImage.Data, modifier)
-
-		return &[]ImageVariation{{*modifiedImage, modificationInfo}}
+// GenerateDuplicateVariations generates the duplicates of a modifier declared by the spec, random modifications are
+// derived from the seed, the reference of the original and the modifier.
+// The same seed and spec always generate identical variations.
+func GenerateDuplicateVariations(
+	originalImage *RawImage, modifierSpec *ModifierSpec, specHash string, seed int64,
+) *[]ImageVariation {
+	var variations []ImageVariation
+	imageSeed := DeriveSeed(seed, duplicateVariation, originalImage.ExternalReference, modifierSpec.Modifier)
+	random := rand.New(rand.NewSource(imageSeed))
+
+	var modifications []ModificationParameters
+	if modifierSpec.Sampling == RandomSampling {
+		for i := 0; i < modifierSpec.Count; i++ {
+			parameters, err := modifierSpec.sample(random)
+			if err != nil {
+				log.Println("Error while sampling parameters: ", err)
+				continue
+			}
+			modifications = append(modifications, parameters)
+		}
+	} else {
+		var err error
+		modifications, err = modifierSpec.grid()
+		if err != nil {
+			log.Println("Error while generating parameter grid: ", err)
+		}
 	}
 
+	for index, specParameters := range modifications {
+		modifiedImage, parameters, err := applyModification(&originalImage.Data, specParameters, random)
+		if err != nil {
+			log.Println("Skipping", modifierSpec.Modifier, "variation of", originalImage.ExternalReference+":", err)
+			continue
+		}
+		info := modificationInfo(parameters)
+		if modifierSpec.Sampling == RandomSampling {
+			// random samples can draw the same parameters, the index keeps the references unique
+			info = fmt.Sprintf("%s-%d", info, index+1)
+		}
+		variations = append(variations, ImageVariation{
+			ModifiedImage:    modifiedImage,
+			ModificationInfo: info,
+			Modifications:    []ModificationParameters{parameters},
+			Seed:             seed,
+			ImageSeed:        imageSeed,
+			SpecHash:         specHash,
+		})
+	}
+	return &variations
 }
 
-func GenerateUniqueVariation(originalImage *RawImage, modifier string) *ImageVariation {
-	modifiedImage, modificationInfo := modifyImage(&originalImage.Data, modifier)
+// GenerateUniqueVariation generates the unique variation with the given index, the parameters are sampled randomly.
+// An error means the modification failed and the variation has to be skipped.
+func GenerateUniqueVariation(
+	originalImage *RawImage, modifierSpec *ModifierSpec, specHash string, seed int64, index int,
+) (*ImageVariation, error) {
+	imageSeed := DeriveSeed(
+		seed, indexedSeedParts(index, uniqueVariation, originalImage.ExternalReference, modifierSpec.Modifier)...,
+	)
+	random := rand.New(rand.NewSource(imageSeed))
+
+	modifiedImage, parameters, err := modifyImage(&originalImage.Data, modifierSpec, random)
+	if err != nil {
+		return nil, err
+	}
+	info := modificationInfo(parameters)
+	if index > 0 {
+		info = fmt.Sprintf("%s-%d", info, index+1)
+	}
 
 	return &ImageVariation{
 		ModifiedImage:    *modifiedImage,
-		ModificationInfo: modificationInfo,
-	}
+		ModificationInfo: info,
+		Modifications:    []ModificationParameters{parameters},
+		Seed:             seed,
+		ImageSeed:        imageSeed,
+		SpecHash:         specHash,
+	}, nil
 }
 
-func GenerateMixedVariation(originalImage *RawImage) *ImageVariation {
-	shuffledModifiers := shuffleArray(Modifiers)
+// GenerateMixedVariation chains a random number of the mixed modifiers of the spec, unique variations derive a
+// different seed than duplicates of the same original. An error means a modification of the chain failed.
+func GenerateMixedVariation(
+	originalImage *RawImage, spec *VariationSpec, seed int64, unique bool, index int,
+) (*ImageVariation, error) {
+	kind := duplicateVariation
+	if unique {
+		kind = uniqueVariation
+	}
+	imageSeed := DeriveSeed(seed, indexedSeedParts(index, kind, originalImage.ExternalReference, "mixed")...)
+	random := rand.New(rand.NewSource(imageSeed))
 
-	random := rand.New(rand.NewSource(time.Now().UnixNano()))
-	modifierAmount := random.Intn(4)
+	shuffledModifiers := shuffleArray(spec.Mixed.Modifiers, random)
+	modifierAmount := spec.Mixed.MinModifiers + random.Intn(spec.Mixed.MaxModifiers-spec.Mixed.MinModifiers+1)
 
 	modifiedImage := &originalImage.Data
-	modificationInfo := ""
+	mixedModificationInfo := ""
+	var modifications []ModificationParameters
 	for i := 0; i < modifierAmount; i++ {
 		modifier := shuffledModifiers[i]
-		modifiedImage, _ = modifyImage(modifiedImage, modifier)
-		modificationInfo += modifier + "-"
+		var parameters ModificationParameters
+		var err error
+		modifiedImage, parameters, err = modifyImage(modifiedImage, spec.ModifierSpec(modifier), random)
+		if err != nil {
+			return nil, err
+		}
+		mixedModificationInfo += modifier + "-"
+		modifications = append(modifications, parameters)
+	}
+	if index > 0 {
+		mixedModificationInfo += strconv.Itoa(index + 1)
+	}
+	return &ImageVariation{
+		ModifiedImage:    *modifiedImage,
+		ModificationInfo: mixedModificationInfo,
+		Modifications:    modifications,
+		Seed:             seed,
+		ImageSeed:        imageSeed,
+		SpecHash:         spec.Hash,
+	}, nil
+}
+
+// GenerateScenarioVariation applies the chain of the user-defined scenario in order, unique variations derive a
+// different seed than duplicates of the same original. An error means a modification of the chain failed.
+func GenerateScenarioVariation(
+	originalImage *RawImage, scenario *ScenarioSpec, specHash string, seed int64, unique bool, index int,
+) (*ImageVariation, error) {
+	kind := duplicateVariation
+	if unique {
+		kind = uniqueVariation
+	}
+	imageSeed := DeriveSeed(seed, kind, originalImage.ExternalReference, scenario.Name, strconv.Itoa(index))
+	random := rand.New(rand.NewSource(imageSeed))
+
+	modifiedImage := &originalImage.Data
+	var modifications []ModificationParameters
+	for stepIndex := range scenario.Chain {
+		var parameters ModificationParameters
+		var err error
+		modifiedImage, parameters, err = modifyImage(modifiedImage, &scenario.Chain[stepIndex], random)
+		if err != nil {
+			return nil, err
+		}
+		modifications = append(modifications, parameters)
+	}
+
+	return &ImageVariation{
+		ModifiedImage:    *modifiedImage,
+		ModificationInfo: strconv.Itoa(index + 1),
+		Modifications:    modifications,
+		Seed:             seed,
+		ImageSeed:        imageSeed,
+		SpecHash:         specHash,
+	}, nil
+}
+
+// DeriveSeed combines the seed of a generation run with the given parts, so that every image gets its own seed
+// that doesn't depend on the order the images are generated in
+func DeriveSeed(seed int64, parts ...string) int64 {
+	hash := fnv.New64a()
+	seedBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seedBytes, uint64(seed))
+	hash.Write(seedBytes)
+	for _, part := range parts {
+		hash.Write([]byte{0})
+		hash.Write([]byte(part))
+	}
+	return int64(hash.Sum64())
+}
+
+// indexedSeedParts appends the index for every variation after the first, the first variation keeps the seed it
+// had before multiple variations per original were possible
+func indexedSeedParts(index int, parts ...string) []string {
+	if index > 0 {
+		return append(parts, strconv.Itoa(index))
 	}
-	return &ImageVariation{*modifiedImage, modificationInfo}
+	return parts
 }
 
-func shuffleArray(array []string) []string {
-	random := rand.New(rand.NewSource(time.Now().UnixNano()))
-	for i := len(array) - 1; i > 0; i-- {
+// shuffleArray returns a shuffled copy, the given array is not modified
+func shuffleArray(array []string, random *rand.Rand) []string {
+	shuffled := make([]string, len(array))
+	copy(shuffled, array)
+	for i := len(shuffled) - 1; i > 0; i-- {
 		j := random.Intn(i + 1)
-		array[i], array[j] = array[j], array[i]
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
 	}
-	return array
+	return shuffled
 }
 
-func modifyImage(originalImage *image.Image, modifier string) (*image.Image, string) {
-	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+// modifyImage applies the modifier with randomly sampled parameters
+func modifyImage(
+	originalImage *image.Image, modifierSpec *ModifierSpec, random *rand.Rand,
+) (*image.Image, ModificationParameters, error) {
+	specParameters, err := modifierSpec.sample(random)
+	if err != nil {
+		return nil, specParameters, err
+	}
 
-	switch modifier {
-	case SCALED:
-		randomIndex := random.Intn(len(scalingFactors))
-		scalingFactor := scalingFactors[randomIndex]
+	modifiedImage, parameters, err := applyModification(originalImage, specParameters, random)
+	if err != nil {
+		return nil, parameters, err
+	}
+	return &modifiedImage, parameters, nil
+}
 
-		scaled := ResizeImage(originalImage, scalingFactor)
-		return &scaled, strconv.Itoa(scalingFactor)
+// applyModification applies the modifier with the given parameters, parameters that are chosen randomly are
+// filled into the returned parameters. The variation is skipped if the mockup can't be composed or the modifier is
+// unknown.
+func applyModification(
+	originalImage *image.Image, parameters ModificationParameters, random *rand.Rand,
+) (image.Image, ModificationParameters, error) {
+	switch parameters.Modifier {
+	case SCALED:
+		return ResizeImage(originalImage, parameters.ScaleFactor), parameters, nil
 
 	case ROTATED:
-		randomIndex := random.Intn(len(rotationAngles))
-		angle := rotationAngles[randomIndex]
-
-		rotated := RotateImage(originalImage, angle)
-		return &rotated, fmt.Sprintf("%.0f", angle)
+		return RotateImage(originalImage, parameters.Angle), parameters, nil
 
 	case MIRRORED:
-		horizontal := random.Intn(2) == 0
-
-		mirrored, axis := MirrorImage(originalImage, horizontal)
-		return &mirrored, axis
+		mirrored, _ := MirrorImage(originalImage, parameters.Axis == "Y")
+		return mirrored, parameters, nil
 
 	case MOVED:
-		moved, distance := MoveMotive(originalImage)
-
-		return &moved, fmt.Sprintf("%.0f", distance)
+		if parameters.CanvasFactor == 0 {
+			parameters.CanvasFactor = defaultCanvasFactor
+		}
+		moved, offset := MoveMotive(originalImage, parameters.CanvasFactor, random)
+		parameters.Offset = newOffset(offset)
+		return moved, parameters, nil
 
 	case BACKGROUND:
-		changed, bg := ChangeBackgroundColor(originalImage)
-		r, g, b, _ := bg.RGBA()
-		r8, g8, b8 := uint8(r>>8), uint8(g>>8), uint8(b>>8)
-
-		return &changed, fmt.Sprintf("%d, %d, %d", r8, g8, b8)
+		changed, bg := ChangeBackgroundColor(originalImage, random)
+		parameters.Background = newBackgroundColor(bg)
+		return changed, parameters, nil
 
 	case PART:
-		newImage, distance := IntegrateInOtherImage(originalImage)
+		newImage, offset := IntegrateInOtherImage(originalImage, random)
+		parameters.Offset = newOffset(offset)
+		return newImage, parameters, nil
 
-		return &newImage, fmt.Sprintf("%.0f", distance)
+	case JPEG:
+		return RecompressJPEG(originalImage, parameters.Quality), parameters, nil
 
-	default:
-		return originalImage, ""
-	}
-}
+	case NOISE:
+		return AddGaussianNoise(originalImage, parameters.NoiseDeviation, random), parameters, nil
 
-func generateAllScaledVariations(originalImage *image.Image) *[]ImageVariation {
-	var variations []ImageVariation
-	for _, scalingFactor := range scalingFactors {
-		scaled := ResizeImage(originalImage, scalingFactor)
-		variations = append(
-			variations,
-			ImageVariation{
-				ModifiedImage:    scaled,
-				ModificationInfo: strconv.Itoa(scalingFactor),
-			},
-		)
-	}
-	return &variations
-}
+	case BLURRED:
+		return BlurImage(originalImage, parameters.BlurSigma), parameters, nil
 
-func generateAllRotatedVariations(originalImage *image.Image) *[]ImageVariation {
-	var variations []ImageVariation
-	for _, angle := range rotationAngles {
-		rotated := RotateImage(originalImage, angle)
-		variations = append(
-			variations,
-			ImageVariation{
-				ModifiedImage:    rotated,
-				ModificationInfo: fmt.Sprintf("%.0f", angle),
-			},
-		)
-	}
-	return &variations
-}
+	case CROPPED:
+		cropped, offset := CropPartially(originalImage, parameters.CropFraction, random)
+		parameters.Offset = newOffset(offset)
+		return cropped, parameters, nil
+
+	case COLOUR:
+		return ShiftColour(originalImage, parameters.HueShift, parameters.SaturationShift), parameters, nil
+
+	case CONTRAST:
+		return ChangeContrast(originalImage, parameters.ContrastChange), parameters, nil
+
+	case STRETCHED:
+		return StretchImage(originalImage, parameters.StretchFactor), parameters, nil
+
+	case UPSCALED:
+		return UpscaleImage(originalImage, parameters.ScaleFactor), parameters, nil
+
+	case PERSPECTIVE:
+		warped, quad := WarpImagePerspective(originalImage, parameters.PerspectiveStrength, random)
+		parameters.Quad = quad[:]
+		return warped, parameters, nil
 
-func generateAllMirroredVariations(originalImage *image.Image) *[]ImageVariation {
-	mirroredHorizontal, axisHorizontal := MirrorImage(originalImage, true)
-	horizontalVariation := ImageVariation{mirroredHorizontal, axisHorizontal}
+	case MOCKUP:
+		composed, template, quad, err := ComposeIntoMockup(originalImage, random)
+		parameters.Template = template
+		parameters.Quad = quad[:]
+		return composed, parameters, err
 
-	mirroredVertical, axisVertical := MirrorImage(originalImage, false)
-	verticalVariation := ImageVariation{mirroredVertical, axisVertical}
+	case IDENTICAL:
+		return *originalImage, parameters, nil
 
-	return &[]ImageVariation{
-		horizontalVariation,
-		verticalVariation,
+	default:
+		return *originalImage, parameters, errors.New(fmt.Sprintf("unknown modifier %s", parameters.Modifier))
+	}
+}
+
+// modificationInfo is the short description of the modification that is used in the external reference
+func modificationInfo(parameters ModificationParameters) string {
+	switch parameters.Modifier {
+	case SCALED, UPSCALED:
+		return strconv.Itoa(parameters.ScaleFactor)
+	case ROTATED:
+		return fmt.Sprintf("%.0f", parameters.Angle)
+	case MIRRORED:
+		return parameters.Axis
+	case MOVED, PART:
+		return fmt.Sprintf("%.0f", parameters.Offset.Distance())
+	case BACKGROUND:
+		return fmt.Sprintf("%d, %d, %d", parameters.Background.R, parameters.Background.G, parameters.Background.B)
+	case JPEG:
+		return "q" + strconv.Itoa(parameters.Quality)
+	case NOISE:
+		return formatParameter(parameters.NoiseDeviation)
+	case BLURRED:
+		return formatParameter(parameters.BlurSigma)
+	case CROPPED:
+		return formatParameter(parameters.CropFraction)
+	case COLOUR:
+		return fmt.Sprintf("h%.0f-s%.0f", parameters.HueShift, parameters.SaturationShift)
+	case CONTRAST:
+		return fmt.Sprintf("%.0f", parameters.ContrastChange)
+	case STRETCHED:
+		return formatParameter(parameters.StretchFactor)
+	case PERSPECTIVE:
+		return formatParameter(parameters.PerspectiveStrength)
+	case MOCKUP:
+		return parameters.Template
+	default:
+		return ""
 	}
 }
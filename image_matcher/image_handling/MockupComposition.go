@@ -0,0 +1,259 @@
+package image_handling
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+const mockupDirectory = "images/mockups/"
+
+// MockupTemplate is declared by a json file in the mockup directory, the image paths are relative to it.
+// The quad is the area of the template the motive is printed on.
+type MockupTemplate struct {
+	Name  string    `json:"-"`
+	Image string    `json:"image"`
+	Quad  [4]Corner `json:"quad"`
+	// ShadingMap is a greyscale image, mid grey leaves the motive unchanged, darker pixels shade and lighter ones
+	// highlight it
+	ShadingMap string `json:"shadingMap,omitempty"`
+	// DisplacementMap shifts the motive by the red (x) and green (y) channel, 128 is no displacement
+	DisplacementMap string `json:"displacementMap,omitempty"`
+	// DisplacementStrength is the maximum displacement in pixels
+	DisplacementStrength float64 `json:"displacementStrength,omitempty"`
+	// Opacity of the motive, defaults to 1
+	Opacity float64 `json:"opacity,omitempty"`
+
+	// the decoded images of the template, they are loaded with the declaration
+	templateImage   image.Image
+	shadingMap      image.Image
+	displacementMap image.Image
+}
+
+var mockupTemplates *[]MockupTemplate
+var mockupTemplatesErr error
+var mockupTemplatesOnce sync.Once
+
+// ComposeIntoMockup prints the motive onto a random template of the mockup directory. The motive is fit into the
+// placement quad with a random size and position, warped, displaced, shaded and blended into the template.
+// Returns the name of the template and the quad the motive corners were mapped to, or an error if the templates can't
+// be loaded or the motive can't be composed, the motive is never returned uncomposed.
+func ComposeIntoMockup(img *image.Image, random *rand.Rand) (image.Image, string, [4]Corner, error) {
+	templates, err := loadMockupTemplatesOnce()
+	if err != nil {
+		return nil, "", [4]Corner{}, err
+	}
+	template := (*templates)[random.Intn(len(*templates))]
+
+	composedImage, quad, err := composeMockup(img, &template, random)
+	if err != nil {
+		return nil, "", [4]Corner{}, errors.New(fmt.Sprintf("couldn't compose mockup %s: %s", template.Name, err.Error()))
+	}
+	return composedImage, template.Name, quad, nil
+}
+
+// loadMockupTemplatesOnce loads the templates of the mockup directory with the first mockup of the process, a
+// directory without templates is an error
+func loadMockupTemplatesOnce() (*[]MockupTemplate, error) {
+	mockupTemplatesOnce.Do(func() {
+		mockupTemplates, mockupTemplatesErr = LoadMockupTemplates(mockupDirectory)
+		if mockupTemplatesErr == nil && len(*mockupTemplates) == 0 {
+			mockupTemplatesErr = errors.New(fmt.Sprintf("no mockup templates in %s", mockupDirectory))
+		}
+		if mockupTemplatesErr != nil {
+			log.Println("Error while loading mockup templates, mockups are skipped: ", mockupTemplatesErr)
+		}
+	})
+	return mockupTemplates, mockupTemplatesErr
+}
+
+// LoadMockupTemplates reads all template declarations of the directory ordered by name, so that the random template
+// choice doesn't depend on the file system, and decodes their images
+func LoadMockupTemplates(directory string) (*[]MockupTemplate, error) {
+	declarations, err := filepath.Glob(filepath.Join(directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(declarations)
+
+	var templates []MockupTemplate
+	for _, declaration := range declarations {
+		content, err := os.ReadFile(declaration)
+		if err != nil {
+			return nil, err
+		}
+
+		var template MockupTemplate
+		err = json.Unmarshal(content, &template)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("couldn't decode mockup template %s: %s", declaration, err.Error()))
+		}
+		if template.Image == "" {
+			return nil, errors.New(fmt.Sprintf("mockup template %s has no image", declaration))
+		}
+
+		template.Name = strings.TrimSuffix(filepath.Base(declaration), filepath.Ext(declaration))
+		template.Image = templatePath(directory, template.Image)
+		template.ShadingMap = templatePath(directory, template.ShadingMap)
+		template.DisplacementMap = templatePath(directory, template.DisplacementMap)
+		if template.Opacity == 0 {
+			template.Opacity = 1
+		}
+		err = template.loadImages()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("couldn't load mockup template %s: %s", declaration, err.Error()))
+		}
+		templates = append(templates, template)
+	}
+
+	return &templates, nil
+}
+
+func (t *MockupTemplate) loadImages() error {
+	var err error
+	t.templateImage, err = readImageFromDisk(t.Image)
+	if err != nil {
+		return err
+	}
+	if t.ShadingMap != "" {
+		t.shadingMap, err = readImageFromDisk(t.ShadingMap)
+		if err != nil {
+			return err
+		}
+	}
+	if t.DisplacementMap != "" {
+		t.displacementMap, err = readImageFromDisk(t.DisplacementMap)
+	}
+	return err
+}
+
+func templatePath(directory string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(directory, path)
+}
+
+func composeMockup(img *image.Image, template *MockupTemplate, random *rand.Rand) (image.Image, [4]Corner, error) {
+	motive := cropImage(img)
+	templateImage := imaging.Clone(template.templateImage)
+	width, height := templateImage.Bounds().Dx(), templateImage.Bounds().Dy()
+
+	quad, err := placeMotive(&motive, template.Quad, random)
+	if err != nil {
+		return nil, quad, err
+	}
+
+	motiveLayer, err := WarpPerspective(&motive, quad, width, height)
+	if err != nil {
+		return nil, quad, err
+	}
+
+	if template.displacementMap != nil {
+		displacementMap := imaging.Resize(template.displacementMap, width, height, imaging.Linear)
+		motiveLayer = displaceImage(motiveLayer, displacementMap, template.DisplacementStrength)
+	}
+	if template.shadingMap != nil {
+		shadingMap := imaging.Resize(template.shadingMap, width, height, imaging.Linear)
+		shadeImage(motiveLayer, shadingMap)
+	}
+
+	composedImage := image.NewNRGBA(templateImage.Bounds())
+	draw.Draw(composedImage, composedImage.Bounds(), templateImage, image.Point{}, draw.Src)
+	opacity := uint8(math.Round(template.Opacity * 255))
+	draw.DrawMask(
+		composedImage, composedImage.Bounds(), motiveLayer, image.Point{},
+		image.NewUniform(color.Alpha{A: opacity}), image.Point{}, draw.Over,
+	)
+
+	return composedImage, quad, nil
+}
+
+// placeMotive fits the motive into the placement quad keeping its aspect ratio. The size varies between 70% and
+// 100% of the quad and the motive is moved randomly inside of it.
+func placeMotive(motive *image.Image, placementQuad [4]Corner, random *rand.Rand) ([4]Corner, error) {
+	unitSquare := [4]Corner{{0, 0}, {1, 0}, {1, 1}, {0, 1}}
+	toPlacement, err := computeHomography(unitSquare, placementQuad)
+	if err != nil {
+		return [4]Corner{}, err
+	}
+
+	placementWidth := (distance(placementQuad[0], placementQuad[1]) + distance(placementQuad[3], placementQuad[2])) / 2
+	placementHeight := (distance(placementQuad[0], placementQuad[3]) + distance(placementQuad[1], placementQuad[2])) / 2
+	motiveAspectRatio := float64((*motive).Bounds().Dx()) / float64((*motive).Bounds().Dy())
+
+	// size of the motive relative to the placement quad
+	width, height := 1.0, placementWidth/motiveAspectRatio/placementHeight
+	if height > 1 {
+		width, height = 1/height, 1
+	}
+	size := 0.7 + random.Float64()*0.3
+	width, height = width*size, height*size
+
+	left := random.Float64() * (1 - width)
+	top := random.Float64() * (1 - height)
+
+	motiveCorners := [4]Corner{{left, top}, {left + width, top}, {left + width, top + height}, {left, top + height}}
+	var quad [4]Corner
+	for i, corner := range motiveCorners {
+		x, y := toPlacement.apply(corner.X, corner.Y)
+		quad[i] = Corner{X: x, Y: y}
+	}
+	return quad, nil
+}
+
+// displaceImage moves every pixel by the displacement map, so that the motive follows folds and curvature
+func displaceImage(img *image.NRGBA, displacementMap *image.NRGBA, strength float64) *image.NRGBA {
+	bounds := img.Bounds()
+	displacedImage := image.NewNRGBA(bounds)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			displacement := displacementMap.NRGBAAt(x, y)
+			offsetX := (float64(displacement.R) - 128) / 128 * strength
+			offsetY := (float64(displacement.G) - 128) / 128 * strength
+			displacedImage.SetNRGBA(x, y, sampleBilinear(img, float64(x)+offsetX, float64(y)+offsetY))
+		}
+	}
+
+	return displacedImage
+}
+
+// shadeImage multiplies the colour of every pixel with the brightness of the shading map, mid grey is neutral
+func shadeImage(img *image.NRGBA, shadingMap *image.NRGBA) {
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
+			shading := shadingMap.NRGBAAt(x, y)
+			factor := (0.299*float64(shading.R) + 0.587*float64(shading.G) + 0.114*float64(shading.B)) / 128
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(math.Min(255, float64(c.R)*factor)),
+				G: uint8(math.Min(255, float64(c.G)*factor)),
+				B: uint8(math.Min(255, float64(c.B)*factor)),
+				A: c.A,
+			})
+		}
+	}
+}
+
+func distance(a, b Corner) float64 {
+	return math.Hypot(b.X-a.X, b.Y-a.Y)
+}
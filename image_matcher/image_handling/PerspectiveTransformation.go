@@ -0,0 +1,145 @@
+package image_handling
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Corner is a point of a quadrilateral, quads are always ordered top-left, top-right, bottom-right, bottom-left
+type Corner struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// homography maps points of the source plane onto the destination plane
+type homography [9]float64
+
+// WarpPerspective maps the whole image onto the destination quad of a new transparent image of the given size
+func WarpPerspective(img *image.Image, destination [4]Corner, width, height int) (*image.NRGBA, error) {
+	bounds := (*img).Bounds()
+	source := [4]Corner{
+		{0, 0},
+		{float64(bounds.Dx()), 0},
+		{float64(bounds.Dx()), float64(bounds.Dy())},
+		{0, float64(bounds.Dy())},
+	}
+
+	// every pixel of the result is looked up in the source, so the inverse mapping is needed
+	inverse, err := computeHomography(destination, source)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceNRGBA := imaging.Clone(*img)
+	warpedImage := imaging.New(width, height, color.Transparent)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sourceX, sourceY := inverse.apply(float64(x)+0.5, float64(y)+0.5)
+			if sourceX < 0 || sourceY < 0 || sourceX >= float64(bounds.Dx()) || sourceY >= float64(bounds.Dy()) {
+				continue
+			}
+			warpedImage.SetNRGBA(x, y, sampleBilinear(sourceNRGBA, sourceX-0.5, sourceY-0.5))
+		}
+	}
+
+	return warpedImage, nil
+}
+
+// computeHomography solves the eight linear equations given by the four point correspondences
+func computeHomography(source [4]Corner, destination [4]Corner) (*homography, error) {
+	var system [8][9]float64
+	for i := 0; i < 4; i++ {
+		x, y := source[i].X, source[i].Y
+		u, v := destination[i].X, destination[i].Y
+		system[2*i] = [9]float64{x, y, 1, 0, 0, 0, -u * x, -u * y, u}
+		system[2*i+1] = [9]float64{0, 0, 0, x, y, 1, -v * x, -v * y, v}
+	}
+
+	// gaussian elimination with partial pivoting
+	for column := 0; column < 8; column++ {
+		pivot := column
+		for row := column + 1; row < 8; row++ {
+			if math.Abs(system[row][column]) > math.Abs(system[pivot][column]) {
+				pivot = row
+			}
+		}
+		if math.Abs(system[pivot][column]) < 1e-12 {
+			return nil, errors.New("quad is degenerated, can't compute perspective transformation")
+		}
+		system[column], system[pivot] = system[pivot], system[column]
+
+		for row := 0; row < 8; row++ {
+			if row == column {
+				continue
+			}
+			factor := system[row][column] / system[column][column]
+			for k := column; k < 9; k++ {
+				system[row][k] -= factor * system[column][k]
+			}
+		}
+	}
+
+	var result homography
+	for i := 0; i < 8; i++ {
+		result[i] = system[i][8] / system[i][i]
+	}
+	result[8] = 1
+
+	return &result, nil
+}
+
+func (h *homography) apply(x, y float64) (float64, float64) {
+	w := h[6]*x + h[7]*y + h[8]
+	return (h[0]*x + h[1]*y + h[2]) / w, (h[3]*x + h[4]*y + h[5]) / w
+}
+
+func sampleBilinear(img *image.NRGBA, x, y float64) color.NRGBA {
+	bounds := img.Bounds()
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	dx, dy := x-float64(x0), y-float64(y0)
+
+	pixel := func(px, py int) [4]float64 {
+		px = clampInt(px, bounds.Min.X, bounds.Max.X-1)
+		py = clampInt(py, bounds.Min.Y, bounds.Max.Y-1)
+		c := img.NRGBAAt(px, py)
+		// premultiply, so that transparent neighbours don't bleed their colour into the edges
+		alpha := float64(c.A) / 255
+		return [4]float64{float64(c.R) * alpha, float64(c.G) * alpha, float64(c.B) * alpha, float64(c.A)}
+	}
+
+	topLeft, topRight := pixel(x0, y0), pixel(x0+1, y0)
+	bottomLeft, bottomRight := pixel(x0, y0+1), pixel(x0+1, y0+1)
+
+	var result [4]float64
+	for channel := 0; channel < 4; channel++ {
+		top := topLeft[channel]*(1-dx) + topRight[channel]*dx
+		bottom := bottomLeft[channel]*(1-dx) + bottomRight[channel]*dx
+		result[channel] = top*(1-dy) + bottom*dy
+	}
+
+	if result[3] == 0 {
+		return color.NRGBA{}
+	}
+	alpha := result[3] / 255
+	return color.NRGBA{
+		R: uint8(math.Round(math.Min(255, result[0]/alpha))),
+		G: uint8(math.Round(math.Min(255, result[1]/alpha))),
+		B: uint8(math.Round(math.Min(255, result[2]/alpha))),
+		A: uint8(math.Round(result[3])),
+	}
+}
+
+func clampInt(value, minimum, maximum int) int {
+	if value < minimum {
+		return minimum
+	}
+	if value > maximum {
+		return maximum
+	}
+	return value
+}
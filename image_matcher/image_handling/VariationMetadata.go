@@ -0,0 +1,170 @@
+package image_handling
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+)
+
+// ModificationParameters describes a single modification that was applied to an image.
+// Only the parameters belonging to the modifier are set. The numeric parameters are stored even if they are 0, since
+// 0 is a valid value, e.g. an angle of 0.
+type ModificationParameters struct {
+	Modifier            string           `json:"modifier"`
+	Angle               float64          `json:"angle"`
+	ScaleFactor         int              `json:"scaleFactor"`
+	Axis                string           `json:"axis,omitempty"`
+	Offset              *Offset          `json:"offset,omitempty"`
+	CanvasFactor        float64          `json:"canvasFactor"`
+	Background          *BackgroundColor `json:"background,omitempty"`
+	Quality             int              `json:"quality"`
+	NoiseDeviation      float64          `json:"noiseDeviation"`
+	BlurSigma           float64          `json:"blurSigma"`
+	CropFraction        float64          `json:"cropFraction"`
+	HueShift            float64          `json:"hueShift"`
+	SaturationShift     float64          `json:"saturationShift"`
+	ContrastChange      float64          `json:"contrastChange"`
+	StretchFactor       float64          `json:"stretchFactor"`
+	PerspectiveStrength float64          `json:"perspectiveStrength"`
+	Template            string           `json:"template,omitempty"`
+	// Quad are the corners of the original image in the modified image, it is the ground truth for localization
+	Quad []Corner `json:"quad,omitempty"`
+}
+
+// Offset is the position the motive was pasted at in the new image
+type Offset struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type BackgroundColor struct {
+	R uint8 `json:"r"`
+	G uint8 `json:"g"`
+	B uint8 `json:"b"`
+}
+
+// VariationMetadata is persisted as json in the notes of a search image
+type VariationMetadata struct {
+	Modifications []ModificationParameters `json:"modifications"`
+	Seed          int64                    `json:"seed"`
+	ImageSeed     int64                    `json:"imageSeed"`
+	// HardNegative is set for search images that are registered forbidden images confusable with another one
+	HardNegative *HardNegative `json:"hardNegative,omitempty"`
+}
+
+// HardNegative is a pair of forbidden images that are near but not identical. The query is searched for and must
+// not match the reference, matches with its own registration are ignored.
+type HardNegative struct {
+	Query         string `json:"query"`
+	Reference     string `json:"reference"`
+	PHashDistance int    `json:"pHashDistance"`
+	// OrbMatches is 0 for pairs that are near by their hashes, orb isn't compared for them
+	OrbMatches int `json:"orbMatches"`
+}
+
+func newOffset(point image.Point) *Offset {
+	return &Offset{X: point.X, Y: point.Y}
+}
+
+func (o *Offset) Distance() float64 {
+	return math.Sqrt(float64(o.X*o.X + o.Y*o.Y))
+}
+
+func newBackgroundColor(c color.Color) *BackgroundColor {
+	r, g, b, _ := c.RGBA()
+	return &BackgroundColor{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8)}
+}
+
+// Values returns the parameters of the modifier by name, a parameter of 0 is a value like any other. Continuous random
+// parameters like the offset and the background colour are bucketed, so that results can be grouped by them.
+func (p *ModificationParameters) Values() map[string]string {
+	values := make(map[string]string)
+
+	switch p.Modifier {
+	case SCALED, UPSCALED:
+		values["scale factor"] = strconv.Itoa(p.ScaleFactor)
+	case ROTATED:
+		values["angle"] = fmt.Sprintf("%.0f", p.Angle)
+	case MIRRORED:
+		values["axis"] = p.Axis
+	case MOVED:
+		values["canvas factor"] = formatParameter(p.CanvasFactor)
+	case JPEG:
+		values["quality"] = strconv.Itoa(p.Quality)
+	case NOISE:
+		values["noise deviation"] = formatParameter(p.NoiseDeviation)
+	case BLURRED:
+		values["blur sigma"] = formatParameter(p.BlurSigma)
+	case CROPPED:
+		values["crop fraction"] = formatParameter(p.CropFraction)
+	case COLOUR:
+		values["hue shift"] = formatParameter(p.HueShift)
+		values["saturation shift"] = formatParameter(p.SaturationShift)
+	case CONTRAST:
+		values["contrast change"] = formatParameter(p.ContrastChange)
+	case STRETCHED:
+		values["stretch factor"] = formatParameter(p.StretchFactor)
+	case PERSPECTIVE:
+		values["perspective strength"] = formatParameter(p.PerspectiveStrength)
+	case MOCKUP:
+		values["template"] = p.Template
+	}
+
+	if p.Offset != nil {
+		lowerBound := int(p.Offset.Distance()/100) * 100
+		values["offset distance"] = fmt.Sprintf("%d-%d", lowerBound, lowerBound+99)
+	}
+	if p.Background != nil {
+		luminance := 0.299*float64(p.Background.R) + 0.587*float64(p.Background.G) + 0.114*float64(p.Background.B)
+		switch {
+		case luminance < 85:
+			values["background"] = "dark"
+		case luminance < 170:
+			values["background"] = "medium"
+		default:
+			values["background"] = "light"
+		}
+	}
+
+	return values
+}
+
+// Values returns the distances of the pair by name, the orb matches are bucketed
+func (h *HardNegative) Values() map[string]string {
+	lowerBound := h.OrbMatches / 25 * 25
+	return map[string]string{
+		"phash distance": strconv.Itoa(h.PHashDistance),
+		"orb matches":    fmt.Sprintf("%d-%d", lowerBound, lowerBound+24),
+	}
+}
+
+func formatParameter(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func (v *ImageVariation) Metadata() VariationMetadata {
+	return VariationMetadata{Modifications: v.Modifications, Seed: v.Seed, ImageSeed: v.ImageSeed}
+}
+
+func EncodeVariationMetadata(metadata VariationMetadata) string {
+	encodedMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		return ""
+	}
+	return string(encodedMetadata)
+}
+
+// DecodeVariationMetadata parses the notes of a search image, search images that were generated before the
+// metadata was introduced only contain the modification info and can't be decoded
+func DecodeVariationMetadata(notes string) (*VariationMetadata, error) {
+	var metadata VariationMetadata
+	err := json.Unmarshal([]byte(notes), &metadata)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't decode variation metadata %s: %s", notes, err.Error()))
+	}
+	return &metadata, nil
+}
@@ -0,0 +1,466 @@
+package image_handling
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+)
+
+const DefaultVariationSpecPath = "variation-spec.json"
+
+const (
+	GridSampling   = "grid"
+	RandomSampling = "random"
+)
+
+// parameters that are stored as integers, sampled values are rounded
+var integerParameters = map[string]bool{"scaleFactor": true, "quality": true}
+
+// VariationSpec declares which variations are generated for the search set
+type VariationSpec struct {
+	Modifiers  []ModifierSpec `json:"modifiers"`
+	Duplicates DuplicateSpec  `json:"duplicates"`
+	Uniques    UniqueSpec     `json:"uniques"`
+	Mixed      MixedSpec      `json:"mixed"`
+	// Scenarios are user-defined scenarios in addition to the scenario of every modifier
+	Scenarios []ScenarioSpec `json:"scenarios,omitempty"`
+	// Hash identifies the spec, it is stored with every search image generated from it
+	Hash string `json:"-"`
+}
+
+// ModifierSpec declares the parameters of a modifier. Parameters are named like the json fields of
+// ModificationParameters. With grid sampling a duplicate is generated for every combination of the parameter values,
+// with random sampling count duplicates are generated with parameters drawn from the values or the range.
+// Instead of the combinations of the parameters the grid can be listed explicitly.
+type ModifierSpec struct {
+	Modifier   string                    `json:"modifier"`
+	Sampling   string                    `json:"sampling,omitempty"`
+	Count      int                       `json:"count,omitempty"`
+	Parameters map[string]ParameterRange `json:"parameters,omitempty"`
+	Grid       []map[string]interface{}  `json:"grid,omitempty"`
+}
+
+// ParameterRange are either discrete values or a range between min and max, ranges can only be sampled randomly
+type ParameterRange struct {
+	Values []interface{} `json:"values,omitempty"`
+	Min    *float64      `json:"min,omitempty"`
+	Max    *float64      `json:"max,omitempty"`
+}
+
+type DuplicateSpec struct {
+	// Mixed is the number of mixed duplicates per original
+	Mixed int `json:"mixed"`
+}
+
+type UniqueSpec struct {
+	// Count is the number of uniques per original and modifier
+	Count int `json:"count"`
+	Mixed int `json:"mixed"`
+}
+
+// MixedSpec declares the modifiers a mixed variation is chained from, their parameters are sampled randomly
+type MixedSpec struct {
+	Modifiers    []string `json:"modifiers"`
+	MinModifiers int      `json:"minModifiers"`
+	MaxModifiers int      `json:"maxModifiers"`
+}
+
+// ScenarioSpec is a named scenario whose variations are generated by applying the chain of modifiers in order. The
+// parameters of a step are sampled like those of a randomly sampled modifier, a single value fixes the parameter.
+type ScenarioSpec struct {
+	Name  string         `json:"name"`
+	Chain []ModifierSpec `json:"chain"`
+	// Count is the number of duplicates per original, uniques are generated uniques.count times
+	Count int `json:"count,omitempty"`
+}
+
+// reserved scenario names that can't be declared in a spec
+var reservedScenarioNames = map[string]bool{"all": true, "mixed": true, "hard-negative": true}
+
+const maxScenarioNameLength = 64
+
+func LoadVariationSpec(path string) (*VariationSpec, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read variation spec %s: %s", path, err.Error()))
+	}
+
+	var spec VariationSpec
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&spec)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't decode variation spec %s: %s", path, err.Error()))
+	}
+
+	for index := range spec.Modifiers {
+		if spec.Modifiers[index].Sampling == "" {
+			spec.Modifiers[index].Sampling = GridSampling
+		}
+		if spec.Modifiers[index].Count == 0 {
+			spec.Modifiers[index].Count = 1
+		}
+	}
+	for index := range spec.Scenarios {
+		if spec.Scenarios[index].Count == 0 {
+			spec.Scenarios[index].Count = 1
+		}
+		for stepIndex := range spec.Scenarios[index].Chain {
+			spec.Scenarios[index].Chain[stepIndex].Sampling = RandomSampling
+		}
+	}
+
+	err = spec.validate()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid variation spec %s: %s", path, err.Error()))
+	}
+
+	// the hash is calculated from the decoded spec, so that formatting doesn't change it
+	encodedSpec, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(encodedSpec)
+	spec.Hash = hex.EncodeToString(hash[:])
+
+	return &spec, nil
+}
+
+// Scenario returns the user-defined scenario with the given name
+func (s *VariationSpec) Scenario(name string) *ScenarioSpec {
+	for index := range s.Scenarios {
+		if s.Scenarios[index].Name == name {
+			return &s.Scenarios[index]
+		}
+	}
+	return nil
+}
+
+// ModifierSpec returns the spec of the modifier, mixed variations use it to sample the parameters
+func (s *VariationSpec) ModifierSpec(modifier string) *ModifierSpec {
+	for index := range s.Modifiers {
+		if s.Modifiers[index].Modifier == modifier {
+			return &s.Modifiers[index]
+		}
+	}
+	return nil
+}
+
+func (s *VariationSpec) validate() error {
+	for _, modifierSpec := range s.Modifiers {
+		if !isModifier(modifierSpec.Modifier) {
+			return errors.New(fmt.Sprintf("unknown modifier %s", modifierSpec.Modifier))
+		}
+		if modifierSpec.Sampling != GridSampling && modifierSpec.Sampling != RandomSampling {
+			return errors.New(fmt.Sprintf("unknown sampling %s of %s", modifierSpec.Sampling, modifierSpec.Modifier))
+		}
+		if modifierSpec.Count < 0 {
+			return errors.New(fmt.Sprintf("negative count for %s", modifierSpec.Modifier))
+		}
+		if len(modifierSpec.Grid) > 0 && len(modifierSpec.Parameters) > 0 {
+			return errors.New(fmt.Sprintf("%s declares parameters and a grid", modifierSpec.Modifier))
+		}
+
+		for name, parameterRange := range modifierSpec.Parameters {
+			if len(parameterRange.Values) > 0 {
+				continue
+			}
+			if parameterRange.Min == nil || parameterRange.Max == nil || *parameterRange.Min > *parameterRange.Max {
+				return errors.New(fmt.Sprintf("%s of %s needs values or a valid range", name, modifierSpec.Modifier))
+			}
+			if modifierSpec.Sampling == GridSampling {
+				return errors.New(
+					fmt.Sprintf("range of %s of %s can only be sampled randomly", name, modifierSpec.Modifier),
+				)
+			}
+		}
+
+		// decoding the parameters reports parameters that don't exist
+		_, err := modifierSpec.grid()
+		if err != nil {
+			return err
+		}
+		_, err = modifierSpec.sample(rand.New(rand.NewSource(0)))
+		if err != nil {
+			return err
+		}
+		err = modifierSpec.validateValues()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, modifier := range s.Mixed.Modifiers {
+		if s.ModifierSpec(modifier) == nil {
+			return errors.New(fmt.Sprintf("mixed modifier %s isn't declared in the modifiers", modifier))
+		}
+	}
+	if s.Mixed.MinModifiers < 0 || s.Mixed.MinModifiers > s.Mixed.MaxModifiers ||
+		s.Mixed.MaxModifiers > len(s.Mixed.Modifiers) {
+		return errors.New("mixed needs 0 <= minModifiers <= maxModifiers <= number of mixed modifiers")
+	}
+	if s.Duplicates.Mixed < 0 || s.Uniques.Count < 0 || s.Uniques.Mixed < 0 {
+		return errors.New("counts can't be negative")
+	}
+
+	for index, scenario := range s.Scenarios {
+		err := scenario.validate()
+		if err != nil {
+			return err
+		}
+		if isModifier(scenario.Name) {
+			return errors.New(fmt.Sprintf("scenario %s is named like a modifier", scenario.Name))
+		}
+		if s.Scenario(scenario.Name) != &s.Scenarios[index] {
+			return errors.New(fmt.Sprintf("scenario %s is declared twice", scenario.Name))
+		}
+	}
+
+	return nil
+}
+
+// validate checks the chain and that the name can be used as identifier in the search set and in file paths
+func (s *ScenarioSpec) validate() error {
+	if s.Name == "" || len(s.Name) > maxScenarioNameLength || strings.ContainsAny(s.Name, "/\\ ") {
+		return errors.New(fmt.Sprintf(
+			"scenario name %q needs 1 to %d characters without slashes and spaces", s.Name, maxScenarioNameLength,
+		))
+	}
+	if reservedScenarioNames[s.Name] {
+		return errors.New(fmt.Sprintf("scenario name %s is reserved", s.Name))
+	}
+	if len(s.Chain) == 0 {
+		return errors.New(fmt.Sprintf("scenario %s needs a chain of modifiers", s.Name))
+	}
+	if s.Count < 0 {
+		return errors.New(fmt.Sprintf("negative count for scenario %s", s.Name))
+	}
+
+	for _, step := range s.Chain {
+		if !isModifier(step.Modifier) {
+			return errors.New(fmt.Sprintf("unknown modifier %s in scenario %s", step.Modifier, s.Name))
+		}
+		if len(step.Grid) > 0 && len(step.Parameters) > 0 {
+			return errors.New(fmt.Sprintf("%s of scenario %s declares parameters and a grid", step.Modifier, s.Name))
+		}
+		for name, parameterRange := range step.Parameters {
+			if len(parameterRange.Values) == 0 &&
+				(parameterRange.Min == nil || parameterRange.Max == nil || *parameterRange.Min > *parameterRange.Max) {
+				return errors.New(
+					fmt.Sprintf("%s of %s in scenario %s needs values or a valid range", name, step.Modifier, s.Name),
+				)
+			}
+		}
+		// decoding the parameters reports parameters that don't exist
+		_, err := step.sample(rand.New(rand.NewSource(0)))
+		if err != nil {
+			return err
+		}
+		err = step.validateValues()
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s in scenario %s", err.Error(), s.Name))
+		}
+	}
+	return nil
+}
+
+// validateValues checks that every value the modifier can be applied with is valid. The values of a parameter are
+// valid within bounds, so the bounds of a range are checked instead of the values between them.
+func (s *ModifierSpec) validateValues() error {
+	for index, gridPoint := range s.Grid {
+		if len(gridPoint) == 0 {
+			return errors.New(fmt.Sprintf("grid point %d of %s has no parameters", index+1, s.Modifier))
+		}
+	}
+
+	boundaries, err := s.combine(func(name string, parameterRange ParameterRange) []interface{} {
+		if len(parameterRange.Values) > 0 {
+			return parameterRange.Values
+		}
+		lower, upper := *parameterRange.Min, *parameterRange.Max
+		if integerParameters[name] {
+			lower, upper = math.Round(lower), math.Round(upper)
+		}
+		return []interface{}{lower, upper}
+	})
+	if err != nil {
+		return err
+	}
+	for _, parameters := range boundaries {
+		err = validateParameters(parameters)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateParameters checks the values the modifications can't be applied with, e.g. a scale factor of 0 divides by
+// zero. A canvas factor of 0 is the default canvas factor.
+func validateParameters(parameters ModificationParameters) error {
+	invalid := func(name string, requirement string, value float64) error {
+		return errors.New(fmt.Sprintf(
+			"%s of %s needs to be %s, got %s", name, parameters.Modifier, requirement, formatParameter(value),
+		))
+	}
+
+	switch parameters.Modifier {
+	case SCALED, UPSCALED:
+		if parameters.ScaleFactor < 1 {
+			return invalid("scaleFactor", "at least 1", float64(parameters.ScaleFactor))
+		}
+	case MOVED:
+		if parameters.CanvasFactor != 0 && parameters.CanvasFactor < 1 {
+			return invalid("canvasFactor", "at least 1", parameters.CanvasFactor)
+		}
+	case JPEG:
+		if parameters.Quality < 1 || parameters.Quality > 100 {
+			return invalid("quality", "between 1 and 100", float64(parameters.Quality))
+		}
+	case NOISE:
+		if parameters.NoiseDeviation < 0 {
+			return invalid("noiseDeviation", "at least 0", parameters.NoiseDeviation)
+		}
+	case BLURRED:
+		if parameters.BlurSigma < 0 {
+			return invalid("blurSigma", "at least 0", parameters.BlurSigma)
+		}
+	case CROPPED:
+		if parameters.CropFraction <= 0 || parameters.CropFraction > 1 {
+			return invalid("cropFraction", "above 0 and at most 1", parameters.CropFraction)
+		}
+	case COLOUR:
+		if parameters.SaturationShift < -100 || parameters.SaturationShift > 100 {
+			return invalid("saturationShift", "between -100 and 100", parameters.SaturationShift)
+		}
+	case CONTRAST:
+		if parameters.ContrastChange < -100 || parameters.ContrastChange > 100 {
+			return invalid("contrastChange", "between -100 and 100", parameters.ContrastChange)
+		}
+	case STRETCHED:
+		if parameters.StretchFactor <= 0 {
+			return invalid("stretchFactor", "above 0", parameters.StretchFactor)
+		}
+	case PERSPECTIVE:
+		if parameters.PerspectiveStrength < 0 || parameters.PerspectiveStrength >= 1 {
+			return invalid("perspectiveStrength", "at least 0 and below 1", parameters.PerspectiveStrength)
+		}
+	}
+	return nil
+}
+
+// grid returns the parameters of all grid points, a modifier without parameters has a single grid point
+func (s *ModifierSpec) grid() ([]ModificationParameters, error) {
+	return s.combine(func(name string, parameterRange ParameterRange) []interface{} {
+		return parameterRange.Values
+	})
+}
+
+// combine returns the parameters of the explicit grid points or of every combination of the values of the
+// parameters
+func (s *ModifierSpec) combine(
+	valuesOf func(name string, parameterRange ParameterRange) []interface{},
+) ([]ModificationParameters, error) {
+	var gridPoints []map[string]interface{}
+
+	if len(s.Grid) > 0 {
+		gridPoints = s.Grid
+	} else {
+		gridPoints = []map[string]interface{}{{}}
+		for _, name := range s.parameterNames() {
+			var combinations []map[string]interface{}
+			for _, gridPoint := range gridPoints {
+				for _, value := range valuesOf(name, s.Parameters[name]) {
+					combination := map[string]interface{}{name: value}
+					for existingName, existingValue := range gridPoint {
+						combination[existingName] = existingValue
+					}
+					combinations = append(combinations, combination)
+				}
+			}
+			gridPoints = combinations
+		}
+	}
+
+	grid := make([]ModificationParameters, len(gridPoints))
+	for index, gridPoint := range gridPoints {
+		parameters, err := s.decodeParameters(gridPoint)
+		if err != nil {
+			return nil, err
+		}
+		grid[index] = parameters
+	}
+	return grid, nil
+}
+
+// sample draws random parameters, an explicit grid is sampled by choosing one of its points
+func (s *ModifierSpec) sample(random *rand.Rand) (ModificationParameters, error) {
+	if len(s.Grid) > 0 {
+		return s.decodeParameters(s.Grid[random.Intn(len(s.Grid))])
+	}
+
+	values := make(map[string]interface{})
+	for _, name := range s.parameterNames() {
+		parameterRange := s.Parameters[name]
+		if len(parameterRange.Values) == 1 {
+			values[name] = parameterRange.Values[0]
+			continue
+		}
+		if len(parameterRange.Values) > 1 {
+			values[name] = parameterRange.Values[random.Intn(len(parameterRange.Values))]
+			continue
+		}
+
+		value := *parameterRange.Min + random.Float64()*(*parameterRange.Max-*parameterRange.Min)
+		if integerParameters[name] {
+			value = math.Round(value)
+		}
+		values[name] = value
+	}
+	return s.decodeParameters(values)
+}
+
+// parameterNames are sorted, so that the parameters are always sampled in the same order
+func (s *ModifierSpec) parameterNames() []string {
+	var names []string
+	for name := range s.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *ModifierSpec) decodeParameters(values map[string]interface{}) (ModificationParameters, error) {
+	parameters := ModificationParameters{Modifier: s.Modifier}
+
+	encodedValues, err := json.Marshal(values)
+	if err != nil {
+		return parameters, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encodedValues))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&parameters)
+	if err != nil {
+		return parameters, errors.New(fmt.Sprintf("invalid parameters for %s: %s", s.Modifier, err.Error()))
+	}
+	parameters.Modifier = s.Modifier
+
+	return parameters, nil
+}
+
+func isModifier(modifier string) bool {
+	for _, existingModifier := range Modifiers {
+		if existingModifier == modifier {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package image_handling
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadDefaultVariationSpec(t *testing.T) {
+	spec, err := LoadVariationSpec(filepath.Join("..", "..", DefaultVariationSpecPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Hash == "" {
+		t.Error("default spec has no hash")
+	}
+}
+
+func TestLoadVariationSpecValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		error string
+	}{
+		{"valid", `{"modifiers": [{"modifier": "scaled", "parameters": {"scaleFactor": {"values": [2]}}}]}`, ""},
+		{"unknown field", `{"modifier": []}`, "unknown field"},
+		{"unknown modifier", `{"modifiers": [{"modifier": "sheared"}]}`, "unknown modifier sheared"},
+		{"unknown parameter", `{"modifiers": [{"modifier": "scaled", "parameters": {"factor": {"values": [2]}}}]}`,
+			"invalid parameters for scaled"},
+		{"scaled without factor", `{"modifiers": [{"modifier": "scaled"}]}`,
+			"scaleFactor of scaled needs to be at least 1"},
+		{"crop fraction above 1", `{"modifiers": [{"modifier": "cropped",
+			"parameters": {"cropFraction": {"values": [1.5]}}}]}`, "cropFraction of cropped"},
+		{"canvas factor below 1", `{"modifiers": [{"modifier": "moved",
+			"parameters": {"canvasFactor": {"values": [0.5]}}}]}`, "canvasFactor of moved"},
+		{"range bound", `{"modifiers": [{"modifier": "noise", "sampling": "random",
+			"parameters": {"noiseDeviation": {"min": -1, "max": 5}}}]}`, "noiseDeviation of noise"},
+		{"range with grid sampling", `{"modifiers": [{"modifier": "noise",
+			"parameters": {"noiseDeviation": {"min": 1, "max": 5}}}]}`, "can only be sampled randomly"},
+		{"empty grid point", `{"modifiers": [{"modifier": "colour", "grid": [{"hueShift": 30}, {}]}]}`,
+			"grid point 2 of colour has no parameters"},
+		{"parameters and grid", `{"modifiers": [{"modifier": "colour", "grid": [{"hueShift": 30}],
+			"parameters": {"hueShift": {"values": [90]}}}]}`, "declares parameters and a grid"},
+		{"undeclared mixed modifier", `{"mixed": {"modifiers": ["noise"], "maxModifiers": 1}}`,
+			"mixed modifier noise isn't declared"},
+		{"jpeg quality in scenario", `{"scenarios": [{"name": "recompressed",
+			"chain": [{"modifier": "jpeg", "parameters": {"quality": {"values": [0]}}}]}]}`,
+			"quality of jpeg needs to be between 1 and 100, got 0 in scenario recompressed"},
+		{"reserved scenario name", `{"scenarios": [{"name": "mixed", "chain": [{"modifier": "identical"}]}]}`,
+			"scenario name mixed is reserved"},
+		{"scenario named like modifier", `{"scenarios": [{"name": "noise", "chain": [{"modifier": "identical"}]}]}`,
+			"named like a modifier"},
+		{"scenario without chain", `{"scenarios": [{"name": "empty"}]}`, "needs a chain of modifiers"},
+		{"duplicate scenario", `{"scenarios": [{"name": "twice", "chain": [{"modifier": "identical"}]},
+			{"name": "twice", "chain": [{"modifier": "identical"}]}]}`, "scenario twice is declared twice"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadVariationSpec(writeSpec(t, test.spec))
+			if test.error == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("error %v, want an error containing %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestVariationSpecHashIgnoresFormatting(t *testing.T) {
+	compact, err := LoadVariationSpec(
+		writeSpec(t, `{"modifiers":[{"modifier":"noise","parameters":{"noiseDeviation":{"values":[5]}}}]}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indented, err := LoadVariationSpec(writeSpec(t, `{
+  "modifiers": [
+    {"modifier": "noise", "parameters": {"noiseDeviation": {"values": [5]}}}
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := LoadVariationSpec(
+		writeSpec(t, `{"modifiers":[{"modifier":"noise","parameters":{"noiseDeviation":{"values":[6]}}}]}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if compact.Hash != indented.Hash {
+		t.Error("formatting changed the hash")
+	}
+	if compact.Hash == changed.Hash {
+		t.Error("changed values kept the hash")
+	}
+}
+
+func TestModifierSpecGrid(t *testing.T) {
+	spec := ModifierSpec{
+		Modifier: COLOUR,
+		Sampling: GridSampling,
+		Parameters: map[string]ParameterRange{
+			"hueShift":        {Values: []interface{}{30.0, 90.0}},
+			"saturationShift": {Values: []interface{}{-50.0, 50.0, 0.0}},
+		},
+	}
+	grid, err := spec.grid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grid) != 6 {
+		t.Fatalf("got %d grid points, want 6", len(grid))
+	}
+
+	combinations := make(map[[2]float64]bool)
+	for _, parameters := range grid {
+		if parameters.Modifier != COLOUR {
+			t.Errorf("grid point has modifier %s", parameters.Modifier)
+		}
+		combinations[[2]float64{parameters.HueShift, parameters.SaturationShift}] = true
+	}
+	if len(combinations) != 6 {
+		t.Errorf("grid points %v aren't distinct", grid)
+	}
+
+	empty := ModifierSpec{Modifier: IDENTICAL, Sampling: GridSampling}
+	grid, err = empty.grid()
+	if err != nil || len(grid) != 1 {
+		t.Errorf("modifier without parameters has grid %v and error %v, want a single grid point", grid, err)
+	}
+}
+
+func TestModifierSpecSample(t *testing.T) {
+	minimum, maximum := 2.4, 2.6
+	spec := ModifierSpec{
+		Modifier: SCALED,
+		Sampling: RandomSampling,
+		Parameters: map[string]ParameterRange{
+			"scaleFactor": {Min: &minimum, Max: &maximum},
+			"angle":       {Values: []interface{}{5.0, 10.0}},
+		},
+	}
+
+	first := rand.New(rand.NewSource(7))
+	second := rand.New(rand.NewSource(7))
+	for draw := 0; draw < 50; draw++ {
+		parameters, err := spec.sample(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repeated, err := spec.sample(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parameters, repeated) {
+			t.Errorf("sampling with the same seed returned %+v and %+v", parameters, repeated)
+		}
+		// the integer scale factor is rounded from the range
+		if parameters.ScaleFactor < 2 || parameters.ScaleFactor > 3 {
+			t.Errorf("scale factor %d is outside of the rounded range", parameters.ScaleFactor)
+		}
+		if parameters.Angle != 5 && parameters.Angle != 10 {
+			t.Errorf("angle %g isn't one of the values", parameters.Angle)
+		}
+	}
+}
+
+func TestModifierSpecSampleGrid(t *testing.T) {
+	spec := ModifierSpec{
+		Modifier: COLOUR,
+		Sampling: RandomSampling,
+		Grid:     []map[string]interface{}{{"hueShift": 30.0}, {"saturationShift": 50.0}},
+	}
+	random := rand.New(rand.NewSource(1))
+	for draw := 0; draw < 20; draw++ {
+		parameters, err := spec.sample(random)
+		if err != nil {
+			t.Fatal(err)
+		}
+		isFirst := parameters.HueShift == 30 && parameters.SaturationShift == 0
+		isSecond := parameters.HueShift == 0 && parameters.SaturationShift == 50
+		if !isFirst && !isSecond {
+			t.Errorf("sampled %+v, want one of the grid points", parameters)
+		}
+	}
+}
+
+func writeSpec(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "variation-spec.json")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -1,6 +1,7 @@
 package image_matching
 
 import (
+	"context"
 	"gocv.io/x/gocv"
 	"image_matcher/image_analyzer"
 	"image_matcher/image_database"
@@ -8,56 +9,118 @@ import (
 	"time"
 )
 
-const matchedHammingDistance = 12
+// MatchedHammingDistance is the hash distance up to which the hybrid matcher matches without comparing descriptors
+const MatchedHammingDistance = 12
 const matchingPoolHammingDistance = 16
 const similarityThreshold = 0.45
 
+// HybridCandidate is a forbidden image the hybrid matcher compares the search image with
+type HybridCandidate struct {
+	ExternalReference string
+	OrientedHash      uint64
+	RegularHash       uint64
+	// SiftDescriptors are already decoded descriptors, they are owned by the caller. If they are nil the descriptor
+	// bytes are decoded when the candidate is added to the matching pool.
+	SiftDescriptors     *gocv.Mat
+	SiftDescriptorBytes []byte
+	Metadata            image_database.ForbiddenImageMetadata
+}
+
+// HybridCandidates applies the function to every forbidden image
+type HybridCandidates func(applyFunction func(candidate HybridCandidate)) error
+
+// DatabaseHybridCandidates retrieves the candidates from the database in chunks
+func DatabaseHybridCandidates(applyFunction func(candidate HybridCandidate)) error {
+	return image_database.ApplyChunkedHybridRetrievalOperation(
+		context.Background(),
+		func(databaseImage image_database.HybridEntity) error {
+			applyFunction(HybridCandidate{
+				ExternalReference:   databaseImage.ExternalReference,
+				OrientedHash:        databaseImage.OrientedHash,
+				RegularHash:         databaseImage.RegularHash,
+				SiftDescriptorBytes: databaseImage.SiftDescriptors,
+				Metadata:            databaseImage.Metadata,
+			})
+			return nil
+		},
+	)
+}
+
+// HybridImageMatcher returns the matched references, the size of the matching pool, the time spent building the
+// pool from the hashes and the time spent matching the descriptors of the pool
 func HybridImageMatcher(
 	orientedHashes []uint64, regularHash uint64, searchImageDescriptors *gocv.Mat, debug bool,
-) (*[]string, int, time.Duration) {
-	matchingPool, matchedImages, matchingTime := buildMatchingPool(orientedHashes, regularHash, debug)
+) (*[]string, int, time.Duration, time.Duration) {
+	return HybridImageMatcherWithCandidates(
+		orientedHashes, regularHash, searchImageDescriptors, DatabaseHybridCandidates, debug,
+	)
+}
+
+func HybridImageMatcherWithCandidates(
+	orientedHashes []uint64,
+	regularHash uint64,
+	searchImageDescriptors *gocv.Mat,
+	candidates HybridCandidates,
+	debug bool,
+) (*[]string, int, time.Duration, time.Duration) {
+	matchingPool, matchedImages, poolBuildTime := buildMatchingPool(orientedHashes, regularHash, candidates, debug)
+	if matchingPool == nil {
+		return nil, 0, poolBuildTime, 0
+	}
 	bfm := MatcherMapping[BFMatcher]
 
 	totalMatchedImages := *matchedImages
 	start := time.Now()
-	for searchImageReference, descriptorBytes := range *matchingPool {
-		originalImageDescriptors, _ :=
-			image_handling.ConvertByteArrayToDescriptorMat(&descriptorBytes, image_analyzer.SIFT)
-		matches := bfm.FindMatches(searchImageDescriptors, originalImageDescriptors)
+	for _, candidate := range *matchingPool {
+		originalImageDescriptors := candidate.SiftDescriptors
+		var matches [][]gocv.DMatch
+		if originalImageDescriptors == nil {
+			decodedDescriptors, _ :=
+				image_handling.ConvertByteArrayToDescriptorMat(&candidate.SiftDescriptorBytes, image_analyzer.SIFT)
+			if decodedDescriptors == nil {
+				continue
+			}
+			// the decoded descriptors are closed right away, so that only one of them is alive at a time
+			matches = bfm.FindMatches(searchImageDescriptors, decodedDescriptors)
+			decodedDescriptors.Close()
+		} else {
+			matches = bfm.FindMatches(searchImageDescriptors, originalImageDescriptors)
+		}
 		isMatch, _, _ := DetermineSimilarity(matches, similarityThreshold, false)
 		if isMatch {
-			totalMatchedImages = append(totalMatchedImages, searchImageReference)
+			totalMatchedImages = append(totalMatchedImages, candidate.ExternalReference)
 		}
 	}
-	return &totalMatchedImages, len(*matchingPool), time.Since(start) + matchingTime
+	return &totalMatchedImages, len(*matchingPool), poolBuildTime, time.Since(start)
 }
 
-func buildMatchingPool(orientedHashes []uint64, regularHash uint64, debug bool) (*map[string][]byte, *[]string,
-	time.Duration) {
+func buildMatchingPool(orientedHashes []uint64, regularHash uint64, candidates HybridCandidates, debug bool) (
+	*[]HybridCandidate, *[]string, time.Duration,
+) {
 	var matchedImages []string
 	var totalMatchingTime time.Duration
-	matchingPool := make(map[string][]byte)
+	var matchingPool []HybridCandidate
 
-	err := image_database.ApplyChunkedHybridRetrievalOperation(func(databaseImage image_database.HybridEntity) {
+	err := candidates(func(candidate HybridCandidate) {
 		if debug {
-			println("Comparing to " + databaseImage.ExternalReference)
+			println("Comparing to " + candidate.ExternalReference)
 		}
 
 		isMatch, hammingDistance, matchingTime :=
-			HashesAreMatch(databaseImage.RegularHash, regularHash, matchingPoolHammingDistance, false)
+			HashesAreMatch(candidate.RegularHash, regularHash, matchingPoolHammingDistance, false)
 
 		if !isMatch {
 			orientedMatch, _, orientedHammingDistance, orientedMatchingTime :=
-				MatchOrientedHashes(databaseImage.OrientedHash, orientedHashes, matchingPoolHammingDistance)
+				MatchOrientedHashes(candidate.OrientedHash, orientedHashes, matchingPoolHammingDistance)
 			isMatch, hammingDistance = orientedMatch, orientedHammingDistance
 			matchingTime += orientedMatchingTime
 		}
 
 		if isMatch {
-			if hammingDistance <= matchedHammingDistance {
-				matchedImages = append(matchedImages, databaseImage.ExternalReference)
+			if hammingDistance <= MatchedHammingDistance {
+				matchedImages = append(matchedImages, candidate.ExternalReference)
 			} else {
-				matchingPool[databaseImage.ExternalReference] = databaseImage.SiftDescriptors
+				matchingPool = append(matchingPool, candidate)
 			}
 		}
 		totalMatchingTime += matchingTime
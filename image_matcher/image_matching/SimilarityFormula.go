@@ -1,16 +1,35 @@
 package image_matching
 
 import (
+	"errors"
 	"fmt"
 	"gocv.io/x/gocv"
 	"log"
 )
 
+// the similarity formulas combine the average normalized distance and the ratio of the matches that pass the ratio test
+const (
+	WeightedFormula   = "weighted"
+	MatchRatioFormula = "match-ratio"
+	DistanceFormula   = "distance"
+)
+
+var SimilarityFormulas = []string{WeightedFormula, MatchRatioFormula, DistanceFormula}
+
+func ValidateSimilarityFormula(formula string) error {
+	for _, similarityFormula := range SimilarityFormulas {
+		if formula == similarityFormula {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("unknown similarity formula %s", formula))
+}
+
 func FindDescriptorMatchesPerThreshold(
-	matches [][]gocv.DMatch, matchedPerThreshold *map[float64][]string, originalReference string,
+	matches [][]gocv.DMatch, matchedPerThreshold *map[float64][]string, originalReference string, formula string,
 ) {
 	for threshold, matchedImages := range *matchedPerThreshold {
-		isMatch, _, _ := DetermineSimilarity(matches, threshold, false)
+		isMatch, _, _ := DetermineSimilarityWithFormula(matches, threshold, formula, false)
 		if isMatch {
 			matchedImages = append(matchedImages, originalReference)
 			(*matchedPerThreshold)[threshold] = matchedImages
@@ -22,6 +41,14 @@ func DetermineSimilarity(matches [][]gocv.DMatch, similarityThreshold float64, d
 	bool,
 	float64,
 	*[]gocv.DMatch,
+) {
+	return DetermineSimilarityWithFormula(matches, similarityThreshold, WeightedFormula, debug)
+}
+
+func DetermineSimilarityWithFormula(matches [][]gocv.DMatch, similarityThreshold float64, formula string, debug bool) (
+	bool,
+	float64,
+	*[]gocv.DMatch,
 ) {
 	filteredMatches, maxDist := filterMatches(&matches)
 
@@ -44,7 +71,15 @@ func DetermineSimilarity(matches [][]gocv.DMatch, similarityThreshold float64, d
 		normalizedDistanceSum := distanceSum / maxDist
 		averageNormalizedDistance = normalizedDistanceSum / float64(len(*filteredMatches))
 	}
-	similarityScore := 0.5*(1.0-averageNormalizedDistance) + 0.5*filteredMatchRatio
+	var similarityScore float64
+	switch formula {
+	case MatchRatioFormula:
+		similarityScore = filteredMatchRatio
+	case DistanceFormula:
+		similarityScore = 1.0 - averageNormalizedDistance
+	default:
+		similarityScore = 0.5*(1.0-averageNormalizedDistance) + 0.5*filteredMatchRatio
+	}
 
 	if debug {
 		println(fmt.Sprintf("Similarity score: %.2f", similarityScore))
@@ -57,6 +92,12 @@ func DetermineSimilarity(matches [][]gocv.DMatch, similarityThreshold float64, d
 	return similarityScore >= similarityThreshold, similarityScore, filteredMatches
 }
 
+// CountGoodMatches is the number of matches that pass the ratio test
+func CountGoodMatches(matches [][]gocv.DMatch) int {
+	filteredMatches, _ := filterMatches(&matches)
+	return len(*filteredMatches)
+}
+
 // applying ratio test according to D. Lowe
 func filterMatches(matches *[][]gocv.DMatch) (*[]gocv.DMatch, float64) {
 	var filteredMatches []gocv.DMatch
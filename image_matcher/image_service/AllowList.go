@@ -0,0 +1,401 @@
+package image_service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image_matcher/image_analyzer"
+	"image_matcher/image_database"
+	"image_matcher/image_handling"
+	"image_matcher/image_matching"
+	"log"
+)
+
+// what happens to the forbidden matches of a search image that matches an allow-listed image more strongly
+const (
+	// SuppressMode removes the forbidden matches
+	SuppressMode = "suppress"
+	// DowngradeMode keeps the forbidden matches but marks them as downgraded
+	DowngradeMode = "downgrade"
+)
+
+// the decisions of the allow-list about the forbidden matches of a search image
+const (
+	// AllowListKept means the best forbidden match is at least as strong as the best allow-listed match
+	AllowListKept = "kept"
+	// AllowListSuppressed means the forbidden matches were removed
+	AllowListSuppressed = "suppressed"
+	// AllowListDowngraded means the forbidden matches were kept but an allow-listed image matched more strongly
+	AllowListDowngraded = "downgraded"
+)
+
+// the measures the matches are compared by
+const (
+	hammingDistanceMeasure = "hamming distance"
+	similarityMeasure      = "similarity"
+)
+
+// AllowList holds the hashes and the decoded descriptors of the known-good images in memory, the allow-list is
+// expected to be small compared to the forbidden set
+type AllowList struct {
+	mode    string
+	entries []*indexEntry
+}
+
+var activeAllowList *AllowList
+
+// UseAllowList makes the match functions of the callers apply the allow-list, nil disables the allow-list
+func UseAllowList(allowList *AllowList) {
+	activeAllowList = allowList
+}
+
+// LoadAllowList loads the allow-list with the descriptors of all analyzers, the mode is SuppressMode or DowngradeMode
+func LoadAllowList(mode string) (*AllowList, error) {
+	if mode != SuppressMode && mode != DowngradeMode {
+		return nil, errors.New(fmt.Sprintf("allow-list mode must be %s or %s, got %s", SuppressMode, DowngradeMode, mode))
+	}
+	allowList := AllowList{mode: mode}
+	err := image_database.ApplyChunkedAllowedImageRetrievalOperation(
+		context.Background(),
+		func(allowedImage image_database.AllowedImageEntity) error {
+			allowList.entries = append(allowList.entries, newIndexEntry(allowedImage, allDescriptorAnalyzers()))
+			return nil
+		},
+	)
+	if err != nil {
+		allowList.Close()
+		return nil, err
+	}
+	log.Println(fmt.Sprintf("Loaded %d images into the allow-list", len(allowList.entries)))
+	return &allowList, nil
+}
+
+// Close releases the descriptors of the allow-list
+func (a *AllowList) Close() {
+	for _, entry := range a.entries {
+		closeEntries(map[string]*indexEntry{entry.externalReference: entry})
+	}
+	a.entries = nil
+}
+
+// AllowImages registers the images in the allow-list, images that are already allow-listed are replaced
+func AllowImages(rawImages []*image_handling.RawImage) error {
+	var err error
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		for _, rawImage := range rawImages {
+			err = image_database.UpsertImageIntoAllowList(databaseConnection, analyzeDatabaseImage(rawImage))
+			if err != nil {
+				return
+			}
+		}
+	})
+	if databaseErr != nil {
+		return databaseErr
+	}
+	return err
+}
+
+// DisallowImage removes the image from the allow-list
+func DisallowImage(externalReference string) error {
+	var err error
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		err = image_database.DeleteImageFromAllowList(databaseConnection, externalReference)
+	})
+	if databaseErr != nil {
+		return databaseErr
+	}
+	return err
+}
+
+// ListAllowedImages returns the references of the allow-listed images in order
+func ListAllowedImages() (*[]string, error) {
+	var references []string
+	err := image_database.ApplyChunkedAllowedImageRetrievalOperation(
+		context.Background(),
+		func(allowedImage image_database.AllowedImageEntity) error {
+			references = append(references, allowedImage.ExternalReference)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &references, nil
+}
+
+// AllowListDecision explains what the allow-list did with the forbidden matches of a search image, an empty decision
+// means no allow-listed image matched
+type AllowListDecision struct {
+	Decision           string
+	Measure            string
+	ForbiddenReference string
+	ForbiddenScore     float64
+	AllowedReference   string
+	AllowedScore       float64
+}
+
+// String explains the decision for the console
+func (d AllowListDecision) String() string {
+	switch d.Decision {
+	case "":
+		return "no allow-listed image matched"
+	case AllowListKept:
+		return fmt.Sprintf(
+			"forbidden match %s kept, its %s of %.2f is at least as strong as allow-listed %s with %.2f",
+			d.ForbiddenReference, d.Measure, d.ForbiddenScore, d.AllowedReference, d.AllowedScore,
+		)
+	default:
+		return fmt.Sprintf(
+			"forbidden matches %s, allow-listed %s has a %s of %.2f, the best forbidden match %s has %.2f",
+			d.Decision, d.AllowedReference, d.Measure, d.AllowedScore, d.ForbiddenReference, d.ForbiddenScore,
+		)
+	}
+}
+
+// AllowListScores are the scores of a search image against the allow-list and against its forbidden matches, they
+// are determined once and decided per threshold
+type AllowListScores struct {
+	mode             string
+	measure          string
+	lowerIsStronger  bool
+	forbiddenScores  map[string]float64
+	allowedReference string
+	allowedScore     float64
+}
+
+// ScoreAllowList scores the search image against the active allow-list and the forbidden images it matched with the
+// analyzer. The scores are nil if no allow-list is used or there is nothing to decide.
+func ScoreAllowList(
+	searchImage *image_handling.RawImage, analyzer, matcher, formula string, matchedReferences []string,
+) (*AllowListScores, error) {
+	allowList := activeAllowList
+	if allowList == nil || len(allowList.entries) == 0 || len(matchedReferences) == 0 {
+		return nil, nil
+	}
+
+	scorer, err := newAllowListScorer(searchImage, analyzer, matcher, formula)
+	if err != nil {
+		return nil, err
+	}
+	defer scorer.close()
+
+	scores := AllowListScores{
+		mode:            allowList.mode,
+		measure:         scorer.measure,
+		lowerIsStronger: scorer.lowerIsStronger,
+		forbiddenScores: make(map[string]float64),
+	}
+	for _, entry := range allowList.entries {
+		score, scored := scorer.score(entry)
+		if scored && (scores.allowedReference == "" || scores.stronger(score, scores.allowedScore)) {
+			scores.allowedReference, scores.allowedScore = entry.externalReference, score
+		}
+	}
+	if scores.allowedReference == "" {
+		return nil, nil
+	}
+
+	err = withForbiddenEntries(matchedReferences, analyzer, func(entries []*indexEntry) {
+		for _, entry := range entries {
+			score, scored := scorer.score(entry)
+			if scored {
+				scores.forbiddenScores[entry.externalReference] = score
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &scores, nil
+}
+
+// Decide applies the allow-list to the references matched at the threshold, the allow-listed image needs to pass the
+// threshold itself and match more strongly than the best forbidden match. Nil scores keep the matches.
+func (s *AllowListScores) Decide(threshold float64, matchedReferences []string) ([]string, AllowListDecision) {
+	if s == nil || len(matchedReferences) == 0 || !s.passes(s.allowedScore, threshold) {
+		return matchedReferences, AllowListDecision{}
+	}
+
+	decision := AllowListDecision{
+		Measure:          s.measure,
+		AllowedReference: s.allowedReference,
+		AllowedScore:     s.allowedScore,
+	}
+	for _, externalReference := range matchedReferences {
+		score, scored := s.forbiddenScores[externalReference]
+		if scored && (decision.ForbiddenReference == "" || s.stronger(score, decision.ForbiddenScore)) {
+			decision.ForbiddenReference, decision.ForbiddenScore = externalReference, score
+		}
+	}
+	if decision.ForbiddenReference == "" {
+		return matchedReferences, AllowListDecision{}
+	}
+
+	if !s.stronger(s.allowedScore, decision.ForbiddenScore) {
+		decision.Decision = AllowListKept
+		return matchedReferences, decision
+	}
+	if s.mode == DowngradeMode {
+		decision.Decision = AllowListDowngraded
+		return matchedReferences, decision
+	}
+	decision.Decision = AllowListSuppressed
+	return []string{}, decision
+}
+
+func (s *AllowListScores) passes(score float64, threshold float64) bool {
+	if s.lowerIsStronger {
+		return score <= threshold
+	}
+	return score >= threshold
+}
+
+func (s *AllowListScores) stronger(score float64, otherScore float64) bool {
+	if s.lowerIsStronger {
+		return score < otherScore
+	}
+	return score > otherScore
+}
+
+// allowListScorer scores the search image against an allow-listed or forbidden image with the measure of the analyzer
+type allowListScorer struct {
+	measure         string
+	lowerIsStronger bool
+	score           func(entry *indexEntry) (float64, bool)
+	close           func()
+}
+
+func newAllowListScorer(searchImage *image_handling.RawImage, analyzer, matcher, formula string) (
+	*allowListScorer, error,
+) {
+	switch analyzer {
+	case image_analyzer.PHASH:
+		searchImageHash, _ := image_analyzer.GetPHashValueCached(&searchImage.Data)
+		return &allowListScorer{
+			measure:         hammingDistanceMeasure,
+			lowerIsStronger: true,
+			score: func(entry *indexEntry) (float64, bool) {
+				return hashDistance(searchImageHash, entry.pHash)
+			},
+			close: func() {},
+		}, nil
+	case image_analyzer.NewAnalyzer:
+		regularHash, _ := image_analyzer.GetPHashValueCached(&searchImage.Data)
+		orientedHashes, _ := image_analyzer.CalculateOrientedHashesCached(&searchImage.Data)
+		for _, mirrorX := range []bool{true, false} {
+			mirrored, _ := image_handling.MirrorImage(&searchImage.Data, mirrorX)
+			mirroredHashes, _ := image_analyzer.CalculateOrientedHashesCached(&mirrored)
+			orientedHashes = append(orientedHashes, mirroredHashes...)
+		}
+		return &allowListScorer{
+			measure:         hammingDistanceMeasure,
+			lowerIsStronger: true,
+			score: func(entry *indexEntry) (float64, bool) {
+				bestDistance, scored := hashDistance(regularHash, entry.pHash)
+				for _, orientedHash := range orientedHashes {
+					distance, orientedScored := hashDistance(orientedHash, entry.rotationHash)
+					if orientedScored && (!scored || distance < bestDistance) {
+						bestDistance, scored = distance, true
+					}
+				}
+				return bestDistance, scored
+			},
+			close: func() {},
+		}, nil
+	default:
+		_, imageMatcher, err := getAnalyzerAndMatcher(analyzer, matcher)
+		if err != nil {
+			return nil, err
+		}
+		_, searchImageDescriptors, _, err :=
+			image_analyzer.ExtractKeypointsAndDescriptorsCached(&searchImage.Data, analyzer)
+		if err != nil {
+			return nil, err
+		}
+		return &allowListScorer{
+			measure:         similarityMeasure,
+			lowerIsStronger: false,
+			score: func(entry *indexEntry) (float64, bool) {
+				descriptors := entry.descriptors[analyzer]
+				if descriptors == nil {
+					return 0, false
+				}
+				matches := (*imageMatcher).FindMatches(&searchImageDescriptors, descriptors)
+				_, similarityScore, _ := image_matching.DetermineSimilarityWithFormula(matches, 0, formula, false)
+				return similarityScore, true
+			},
+			close: func() { searchImageDescriptors.Close() },
+		}, nil
+	}
+}
+
+// hashDistance is the hamming distance of the hashes, missing hashes aren't scored
+func hashDistance(hash1 uint64, hash2 uint64) (float64, bool) {
+	if hash1 == 0 || hash2 == 0 {
+		return 0, false
+	}
+	_, distance, _ := image_matching.HashesAreMatch(hash1, hash2, 64, false)
+	return float64(distance), true
+}
+
+// withForbiddenEntries applies the function to the referenced forbidden images, from the index if it contains the
+// descriptors of the analyzer. The entries must not be used after the function returned.
+func withForbiddenEntries(
+	externalReferences []string, analyzer string, applyFunction func(entries []*indexEntry),
+) error {
+	index := activeForbiddenIndex
+	if index != nil && (descriptorMapping[analyzer] == "" || index.HasAnalyzer(analyzer)) {
+		index.read(func(indexedEntries []*indexEntry) {
+			referenced := make(map[string]bool)
+			for _, externalReference := range externalReferences {
+				referenced[externalReference] = true
+			}
+			var entries []*indexEntry
+			for _, entry := range indexedEntries {
+				if referenced[entry.externalReference] {
+					entries = append(entries, entry)
+				}
+			}
+			applyFunction(entries)
+		})
+		return nil
+	}
+
+	var analyzers []string
+	if descriptorMapping[analyzer] != "" {
+		analyzers = []string{analyzer}
+	}
+	entries := make(map[string]*indexEntry)
+	var err error
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		for _, externalReference := range externalReferences {
+			var databaseImage *image_database.ForbiddenImageEntity
+			databaseImage, err = image_database.RetrieveForbiddenImage(databaseConnection, externalReference)
+			if err != nil {
+				return
+			}
+			entries[externalReference] = newIndexEntry(*databaseImage, analyzers)
+		}
+	})
+	defer closeEntries(entries)
+	if databaseErr != nil {
+		return databaseErr
+	}
+	if err != nil {
+		return err
+	}
+
+	entryList := make([]*indexEntry, 0, len(entries))
+	for _, externalReference := range externalReferences {
+		if entry, exists := entries[externalReference]; exists {
+			entryList = append(entryList, entry)
+		}
+	}
+	applyFunction(entryList)
+	return nil
+}
+
+func allDescriptorAnalyzers() []string {
+	return []string{image_analyzer.SIFT, image_analyzer.ORB, image_analyzer.BRISK}
+}
@@ -20,76 +20,105 @@ var descriptorMapping = map[string]string{
 	image_analyzer.BRISK: "brisk_descriptor",
 }
 
-func AnalyzeAndSaveDatabaseImage(rawImages []*image_handling.RawImage) error {
-	var err error
+// AnalyzeAndSaveDatabaseImage registers the images with the metadata in the forbidden set, images that are already
+// registered are replaced and deleted images are restored. It stops at the first image that can't be registered.
+func AnalyzeAndSaveDatabaseImage(
+	rawImages []*image_handling.RawImage, metadata image_database.ForbiddenImageMetadata,
+) error {
+	err := image_database.ValidateMetadata(metadata)
+	if err != nil {
+		return err
+	}
 
-	err = image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
 		for _, rawImage := range rawImages {
-
-			sift := image_analyzer.AnalyzerMapping[image_analyzer.SIFT]
-			_, siftDesc, _ := image_analyzer.ExtractKeypointsAndDescriptors(&rawImage.Data, &sift)
-
-			orb := image_analyzer.AnalyzerMapping[image_analyzer.ORB]
-			_, orbDesc, _ := image_analyzer.ExtractKeypointsAndDescriptors(&rawImage.Data, &orb)
-
-			brisk := image_analyzer.AnalyzerMapping[image_analyzer.BRISK]
-			_, briskDesc, _ := image_analyzer.ExtractKeypointsAndDescriptors(&rawImage.Data, &brisk)
-
-			pHash, _ := image_analyzer.GetPHashValue(&rawImage.Data)
-			rotationInvariantHash, _ := image_analyzer.CalculateOrientedPHash(&rawImage.Data)
-
-			err = image_database.InsertImageIntoDatabaseSet(
-				databaseConnection,
-				image_database.ForbiddenImageCreation{
-					ExternalReference:     rawImage.ExternalReference,
-					SiftDescriptor:        image_handling.ConvertImageMatToByteArray(siftDesc),
-					OrbDescriptor:         image_handling.ConvertImageMatToByteArray(orbDesc),
-					BriskDescriptor:       image_handling.ConvertImageMatToByteArray(briskDesc),
-					PHash:                 pHash,
-					RotationInvariantHash: rotationInvariantHash,
-				},
-			)
+			databaseSetImage := analyzeDatabaseImage(rawImage)
+			databaseSetImage.Metadata = metadata
+			logExactDuplicates(databaseConnection, databaseSetImage)
+			_, err = image_database.UpsertImageIntoDatabaseSet(databaseConnection, databaseSetImage)
+			if err == nil && activeForbiddenIndex != nil {
+				err = activeForbiddenIndex.addFromDatabase(databaseConnection, rawImage.ExternalReference)
+			}
+			if err != nil {
+				err = errors.New(fmt.Sprintf("couldn't register %s: %s", rawImage.ExternalReference, err.Error()))
+				return
+			}
 		}
 	})
-
+	if databaseErr != nil {
+		return databaseErr
+	}
 	return err
 }
 
+func analyzeDatabaseImage(rawImage *image_handling.RawImage) image_database.ForbiddenImageCreation {
+	sift := image_analyzer.AnalyzerMapping[image_analyzer.SIFT]
+	_, siftDesc, _ := image_analyzer.ExtractKeypointsAndDescriptors(&rawImage.Data, &sift)
+
+	orb := image_analyzer.AnalyzerMapping[image_analyzer.ORB]
+	_, orbDesc, _ := image_analyzer.ExtractKeypointsAndDescriptors(&rawImage.Data, &orb)
+
+	brisk := image_analyzer.AnalyzerMapping[image_analyzer.BRISK]
+	_, briskDesc, _ := image_analyzer.ExtractKeypointsAndDescriptors(&rawImage.Data, &brisk)
+
+	pHash, _ := image_analyzer.GetPHashValue(&rawImage.Data)
+	rotationInvariantHash, _ := image_analyzer.CalculateOrientedPHash(&rawImage.Data)
+
+	return image_database.ForbiddenImageCreation{
+		ExternalReference:     rawImage.ExternalReference,
+		SiftDescriptor:        image_handling.ConvertImageMatToByteArray(siftDesc),
+		OrbDescriptor:         image_handling.ConvertImageMatToByteArray(orbDesc),
+		BriskDescriptor:       image_handling.ConvertImageMatToByteArray(briskDesc),
+		PHash:                 pHash,
+		RotationInvariantHash: rotationInvariantHash,
+		FileDigest:            rawImage.FileDigest,
+		PixelDigest:           image_handling.PixelDigest(&rawImage.Data),
+	}
+}
+
 func MatchImageAgainstDatabaseHybrid(searchImage *image_handling.RawImage, debug bool) (
 	*[]string,
 	int,
 	error,
 	time.Duration,
 	time.Duration,
+	time.Duration,
 ) {
-	regularHash, extractionTime1 := image_analyzer.GetPHashValue(&searchImage.Data)
+	exactReferences, digestTime := matchExactly(searchImage, debug)
+	if exactReferences != nil {
+		return exactReferences, 0, nil, digestTime, 0, 0
+	}
+
+	regularHash, extractionTime1 := image_analyzer.GetPHashValueCached(&searchImage.Data)
 
 	start := time.Now()
 	mirroredX, _ := image_handling.MirrorImage(&searchImage.Data, true)
 	mirroredY, _ := image_handling.MirrorImage(&searchImage.Data, false)
 	totalExtractionTime := time.Since(start)
 
-	hashes, _ := image_analyzer.CalculateOrientedHashes(&searchImage.Data)
-	mirroredXHashes, extractionTime2 := image_analyzer.CalculateOrientedHashes(&mirroredX)
-	mirroredYHashes, extractionTime3 := image_analyzer.CalculateOrientedHashes(&mirroredY)
+	hashes, extractionTime2 := image_analyzer.CalculateOrientedHashesCached(&searchImage.Data)
+	mirroredXHashes, extractionTime3 := image_analyzer.CalculateOrientedHashesCached(&mirroredX)
+	mirroredYHashes, extractionTime4 := image_analyzer.CalculateOrientedHashesCached(&mirroredY)
 
-	sift := image_analyzer.AnalyzerMapping[image_analyzer.SIFT]
-
-	_, searchImageDescriptors, extractionTime4 := image_analyzer.ExtractKeypointsAndDescriptors(&mirroredX, &sift)
+	_, searchImageDescriptors, extractionTime5, err :=
+		image_analyzer.ExtractKeypointsAndDescriptorsCached(&mirroredX, image_analyzer.SIFT)
+	if err != nil {
+		return nil, 0, err, 0, 0, 0
+	}
 
 	hashes = append(hashes, mirroredXHashes...)
 	hashes = append(hashes, mirroredYHashes...)
 
-	matchedReferences, poolSize, matchingTime :=
-		image_matching.HybridImageMatcher(
+	matchedReferences, poolSize, poolBuildTime, descriptorMatchingTime :=
+		matchHybrid(
 			hashes,
 			regularHash,
 			&searchImageDescriptors,
 			debug,
 		)
-	totalExtractionTime =
-		totalExtractionTime + time.Duration(extractionTime1)*time.Second + extractionTime2 + extractionTime3 + extractionTime4
-	return matchedReferences, poolSize, nil, totalExtractionTime, matchingTime
+	totalExtractionTime = totalExtractionTime + digestTime +
+		extractionTime1 + extractionTime2 + extractionTime3 + extractionTime4 + extractionTime5
+	return matchedReferences, poolSize, nil, totalExtractionTime, poolBuildTime, descriptorMatchingTime
 }
 
 func MatchImageAgainstDatabasePHash(searchImage *image_handling.RawImage, maxHammingDistance int, debug bool) (
@@ -98,20 +127,26 @@ func MatchImageAgainstDatabasePHash(searchImage *image_handling.RawImage, maxHam
 	time.Duration,
 	time.Duration,
 ) {
+	exactReferences, digestTime := matchExactly(searchImage, debug)
+	if exactReferences != nil {
+		return exactReferences, nil, digestTime, 0
+	}
+
 	var totalMatchingTime time.Duration
-	searchImageHash, extractionTime := image_analyzer.GetPHashValue(&searchImage.Data)
+	searchImageHash, extractionTime := image_analyzer.GetPHashValueCached(&searchImage.Data)
+	extractionTime += digestTime
 	var matchedImages []string
 
-	err := image_database.ApplyChunkedPHashRetrievalOperation(func(databaseImage image_database.PHashImageEntity) {
+	err := forEachForbiddenPHash(func(externalReference string, hash uint64) {
 		if debug {
-			println("\nComparing to " + databaseImage.ExternalReference)
+			println("\nComparing to " + externalReference)
 		}
 		isMatch, _, matchingTime :=
-			image_matching.HashesAreMatch(searchImageHash, databaseImage.Hash, maxHammingDistance, debug)
+			image_matching.HashesAreMatch(searchImageHash, hash, maxHammingDistance, debug)
 		totalMatchingTime += matchingTime
 
 		if isMatch {
-			matchedImages = append(matchedImages, databaseImage.ExternalReference)
+			matchedImages = append(matchedImages, externalReference)
 		}
 	})
 
@@ -129,41 +164,40 @@ func MatchAgainstDatabaseFeatureBased(
 	similarityThreshold float64,
 	debug bool,
 ) (*[]string, error, *gocv.Mat, time.Duration, time.Duration) {
-	imageAnalyzer, imageMatcher, err := getAnalyzerAndMatcher(analyzer, matcher)
+	_, imageMatcher, err := getAnalyzerAndMatcher(analyzer, matcher)
 	if err != nil {
 		return nil, err, nil, 0, 0
 	}
 
-	_, searchImageDescriptor, extractionTime := image_analyzer.ExtractKeypointsAndDescriptors(
-		&searchImage.Data,
-		imageAnalyzer,
-	)
+	exactReferences, digestTime := matchExactly(searchImage, debug)
+	if exactReferences != nil {
+		return exactReferences, nil, nil, digestTime, 0
+	}
+
+	_, searchImageDescriptor, extractionTime, err :=
+		image_analyzer.ExtractKeypointsAndDescriptorsCached(&searchImage.Data, analyzer)
+	if err != nil {
+		return nil, err, nil, 0, 0
+	}
+	extractionTime += digestTime
 
 	var matchedImages []string
 	var totalMatchingTime time.Duration
 
-	err = image_database.ApplyChunkedFeatureBasedRetrievalOperation(func(databaseImage image_database.FeatureImageEntity) {
+	err = forEachForbiddenDescriptors(analyzer, func(externalReference string, databaseImageDescriptor *gocv.Mat) {
 		if debug {
-			println("\nComparing to " + databaseImage.ExternalReference)
-		}
-		databaseImageDescriptor, err :=
-			image_handling.ConvertByteArrayToDescriptorMat(&databaseImage.Descriptors, analyzer)
-
-		if databaseImageDescriptor == nil || err != nil {
-			println("Descriptor was empty", databaseImage.ExternalReference)
-			return
+			println("\nComparing to " + externalReference)
 		}
 
 		matchingStart := time.Now()
 		matches := (*imageMatcher).FindMatches(&searchImageDescriptor, databaseImageDescriptor)
 		totalMatchingTime += time.Since(matchingStart)
-		databaseImageDescriptor.Close()
 
 		isMatch, _, _ := image_matching.DetermineSimilarity(matches, similarityThreshold, debug)
 		if isMatch {
-			matchedImages = append(matchedImages, databaseImage.ExternalReference)
+			matchedImages = append(matchedImages, externalReference)
 		}
-	}, descriptorMapping[analyzer])
+	})
 
 	if err != nil {
 		return nil, err, nil, time.Duration(0), time.Duration(0)
@@ -173,17 +207,28 @@ func MatchAgainstDatabaseFeatureBased(
 }
 
 func MatchAgainstDatabaseFeatureBasedWithMultipleThresholds(
-	searchImage *image_handling.RawImage, analyzer, matcher string, thresholds *[]float64,
+	searchImage *image_handling.RawImage, analyzer, matcher string, thresholds *[]float64, formula string,
 ) (*map[float64][]string, error, *gocv.Mat, time.Duration, time.Duration) {
-	imageAnalyzer, imageMatcher, err := getAnalyzerAndMatcher(analyzer, matcher)
+	_, imageMatcher, err := getAnalyzerAndMatcher(analyzer, matcher)
 	if err != nil {
 		log.Println(err)
 	}
 
-	_, searchImageDescriptor, extractionTime := image_analyzer.ExtractKeypointsAndDescriptors(
-		&searchImage.Data,
-		imageAnalyzer,
-	)
+	exactReferences, digestTime := matchExactly(searchImage, false)
+	if exactReferences != nil {
+		exactMatchesPerThreshold := make(map[float64][]string)
+		for _, threshold := range *thresholds {
+			exactMatchesPerThreshold[threshold] = append([]string{}, *exactReferences...)
+		}
+		return &exactMatchesPerThreshold, nil, nil, digestTime, 0
+	}
+
+	_, searchImageDescriptor, extractionTime, err :=
+		image_analyzer.ExtractKeypointsAndDescriptorsCached(&searchImage.Data, analyzer)
+	if err != nil {
+		return nil, err, nil, 0, 0
+	}
+	extractionTime += digestTime
 
 	var totalMatchingTime time.Duration
 	matchedImagesPerThreshold := make(map[float64][]string)
@@ -192,24 +237,15 @@ func MatchAgainstDatabaseFeatureBasedWithMultipleThresholds(
 		matchedImagesPerThreshold[threshold] = []string{}
 	}
 
-	err = image_database.ApplyChunkedFeatureBasedRetrievalOperation(func(databaseImage image_database.FeatureImageEntity) {
-		databaseImageDescriptor, err :=
-			image_handling.ConvertByteArrayToDescriptorMat(&databaseImage.Descriptors, analyzer)
-
-		if databaseImageDescriptor == nil || err != nil {
-			println("Descriptor was empty", databaseImage.ExternalReference)
-			return
-		}
-
+	err = forEachForbiddenDescriptors(analyzer, func(externalReference string, databaseImageDescriptor *gocv.Mat) {
 		matchingStart := time.Now()
 		matches := (*imageMatcher).FindMatches(&searchImageDescriptor, databaseImageDescriptor)
 		totalMatchingTime += time.Since(matchingStart)
-		databaseImageDescriptor.Close()
 
 		image_matching.FindDescriptorMatchesPerThreshold(
-			matches, &matchedImagesPerThreshold, databaseImage.ExternalReference,
+			matches, &matchedImagesPerThreshold, externalReference, formula,
 		)
-	}, descriptorMapping[analyzer])
+	})
 	if err != nil {
 		return nil, err, nil, time.Duration(0), time.Duration(0)
 	}
@@ -223,18 +259,27 @@ func MatchImageAgainstDatabasePHashWithMultipleThresholds(searchImage *image_han
 	time.Duration,
 	time.Duration,
 ) {
+	exactReferences, digestTime := matchExactly(searchImage, false)
+	if exactReferences != nil {
+		exactMatchesPerThreshold := make(map[int][]string)
+		for _, threshold := range *thresholds {
+			exactMatchesPerThreshold[threshold] = append([]string{}, *exactReferences...)
+		}
+		return &exactMatchesPerThreshold, nil, digestTime, 0
+	}
 
 	var totalMatchingTime time.Duration
-	searchImageHash, extractionTime := image_analyzer.GetPHashValue(&searchImage.Data)
+	searchImageHash, extractionTime := image_analyzer.GetPHashValueCached(&searchImage.Data)
+	extractionTime += digestTime
 	matchedImagesPerThreshold := make(map[int][]string)
 
 	for _, threshold := range *thresholds {
 		matchedImagesPerThreshold[threshold] = []string{}
 	}
 
-	err := image_database.ApplyChunkedPHashRetrievalOperation(func(databaseImage image_database.PHashImageEntity) {
+	err := forEachForbiddenPHash(func(externalReference string, hash uint64) {
 		matchingTime := image_matching.FindHashMatchesPerThreshold(
-			searchImageHash, databaseImage.Hash, &matchedImagesPerThreshold, databaseImage.ExternalReference,
+			searchImageHash, hash, &matchedImagesPerThreshold, externalReference,
 		)
 		totalMatchingTime += matchingTime
 	})
@@ -0,0 +1,159 @@
+package image_service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"image_matcher/image_database"
+	"image_matcher/image_dataset"
+	"image_matcher/image_handling"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VariationPath is the path the generated search images are saved at
+func VariationPath(scenario string, externalReference string) string {
+	return fmt.Sprintf("images/variations/%s/%s.png", scenario, externalReference)
+}
+
+// createVariationDirectory creates the directory the search images of the scenario are saved in, user-defined and
+// imported scenarios don't have one in the repository
+func createVariationDirectory(scenario string) error {
+	return os.MkdirAll(filepath.Dir(VariationPath(scenario, "")), 0755)
+}
+
+// ExportSearchSet copies the search images of the scenarios into the output directory and writes a manifest with
+// their ground truth, so that the dataset can be used without the database
+func ExportSearchSet(scenarios []string, outputDirectory string) (*image_dataset.Manifest, error) {
+	manifest := image_dataset.Manifest{Directory: outputDirectory}
+
+	for _, scenario := range scenarios {
+		searchImages := GetSearchImages(scenario)
+		if searchImages == nil {
+			return nil, errors.New(fmt.Sprintf("couldn't retrieve search images of %s", scenario))
+		}
+
+		for _, searchImage := range *searchImages {
+			file := filepath.Join(scenario, searchImage.ExternalReference+".png")
+			err := copyFile(
+				VariationPath(scenario, searchImage.ExternalReference), filepath.Join(outputDirectory, file),
+			)
+			if err != nil {
+				log.Println("Skipping search image that can't be exported: ", err)
+				continue
+			}
+			manifest.Entries = append(manifest.Entries, image_dataset.NewManifestEntry(searchImage, file))
+		}
+	}
+
+	err := image_dataset.WriteManifest(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// ImportManifest inserts the entries of the manifest into the search set and copies the images to the variation
+// directory, so that scenarios can be run from the database
+func ImportManifest(manifest *image_dataset.Manifest) error {
+	var importError error
+
+	err := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		for _, entry := range manifest.Entries {
+			err := copyFile(manifest.ImagePath(&entry), VariationPath(entry.Scenario, entry.ExternalReference))
+			if err != nil {
+				importError = err
+				return
+			}
+
+			searchImage := entry.SearchImage()
+			err = image_database.InsertImageIntoSearchSet(
+				databaseConnection,
+				image_database.SearchImageCreation{
+					ExternalReference: searchImage.ExternalReference,
+					OriginalReference: searchImage.OriginalReference,
+					Scenario:          searchImage.Scenario,
+					Notes:             searchImage.Notes,
+					SpecHash:          searchImage.SpecHash,
+				},
+			)
+			if err != nil {
+				importError = err
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return importError
+}
+
+func copyFile(sourcePath string, destinationPath string) error {
+	content, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't read %s: %s", sourcePath, err.Error()))
+	}
+
+	err = os.MkdirAll(filepath.Dir(destinationPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(destinationPath, content, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't write %s: %s", destinationPath, err.Error()))
+	}
+	return nil
+}
+
+// ImportExternalDataset registers the references of the dataset in the forbidden set and inserts the queries as
+// search images of the scenario. The queries are saved as png in the variation directory of the scenario.
+func ImportExternalDataset(dataset *image_dataset.ExternalDataset, scenario string, source string) error {
+	const chunkSize = 10
+
+	for offset := 0; offset < len(dataset.ReferencePaths); offset += chunkSize {
+		limit := offset + chunkSize
+		if limit > len(dataset.ReferencePaths) {
+			limit = len(dataset.ReferencePaths)
+		}
+		references := image_handling.LoadImagesFromDirectory(dataset.ReferencePaths[offset:limit])
+		err := AnalyzeAndSaveDatabaseImage(references, image_database.ForbiddenImageMetadata{})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := createVariationDirectory(scenario)
+	if err != nil {
+		return err
+	}
+
+	return image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		for _, query := range dataset.Queries {
+			rawImage := image_handling.LoadRawImage(query.Path)
+			if rawImage == nil {
+				log.Println("Skipping query that isn't an image: ", query.Path)
+				continue
+			}
+			image_handling.SaveImageToDisk(
+				strings.TrimSuffix(VariationPath(scenario, query.ExternalReference), ".png"), rawImage.Data,
+			)
+
+			err := image_database.InsertImageIntoSearchSet(
+				databaseConnection,
+				image_database.SearchImageCreation{
+					ExternalReference: query.ExternalReference,
+					OriginalReference: query.OriginalReference,
+					Scenario:          scenario,
+					Notes:             "imported from " + source,
+				},
+			)
+			if err != nil {
+				log.Println("failed to insert ", query.ExternalReference, err)
+			}
+		}
+	})
+}
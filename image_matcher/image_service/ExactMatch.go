@@ -0,0 +1,110 @@
+package image_service
+
+import (
+	"database/sql"
+	"image_matcher/image_database"
+	"image_matcher/image_handling"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FindExactMatches returns the forbidden images in the active scope whose file or decoded pixels are identical to the
+// search image, from the index if one is used, and the time spent computing the digests
+func FindExactMatches(searchImage *image_handling.RawImage) (*[]image_database.DigestMatch, time.Duration, error) {
+	start := time.Now()
+	fileDigest := searchImage.FileDigest
+	pixelDigest := image_handling.PixelDigest(&searchImage.Data)
+	digestTime := time.Since(start)
+
+	includes := scopeIncludes(time.Now())
+	var matches []image_database.DigestMatch
+	index := activeForbiddenIndex
+	if index == nil {
+		var digestMatches *[]image_database.DigestMatch
+		var err error
+		databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+			digestMatches, err = image_database.RetrieveDigestMatches(databaseConnection, fileDigest, pixelDigest)
+		})
+		if databaseErr != nil {
+			return nil, digestTime, databaseErr
+		}
+		if err != nil {
+			return nil, digestTime, err
+		}
+		for _, match := range *digestMatches {
+			if includes(match.Metadata) {
+				matches = append(matches, match)
+			}
+		}
+		return &matches, digestTime, nil
+	}
+
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	matched := make(map[string]bool)
+	for _, digest := range []string{fileDigest, pixelDigest} {
+		if digest == "" {
+			continue
+		}
+		for _, entry := range index.digests[digest] {
+			if matched[entry.externalReference] || !includes(entry.metadata) {
+				continue
+			}
+			matched[entry.externalReference] = true
+			matches = append(matches, image_database.DigestMatch{
+				ExternalReference: entry.externalReference,
+				FileMatch:         fileDigest != "" && entry.fileDigest == fileDigest,
+				Metadata:          entry.metadata,
+			})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ExternalReference < matches[j].ExternalReference })
+	return &matches, digestTime, nil
+}
+
+// matchExactly returns the references of the identical forbidden images, nil if there are none besides the ignored
+// reference of the search image so that it is matched by its features. The digest time is returned in both cases.
+func matchExactly(searchImage *image_handling.RawImage, debug bool) (*[]string, time.Duration) {
+	matches, digestTime, err := FindExactMatches(searchImage)
+	if err != nil {
+		log.Println("couldn't look up exact matches of", searchImage.ExternalReference, err)
+		return nil, digestTime
+	}
+	var matchedReferences []string
+	for _, match := range *matches {
+		if match.ExternalReference != searchImage.IgnoredReference {
+			matchedReferences = append(matchedReferences, match.ExternalReference)
+		}
+	}
+	if len(matchedReferences) == 0 {
+		return nil, digestTime
+	}
+	if debug {
+		println("Exact duplicate of " + strings.Join(matchedReferences, ", "))
+	}
+	return &matchedReferences, digestTime
+}
+
+// logExactDuplicates logs the forbidden images with other references that the image is an exact duplicate of, so
+// that re-uploads are noticed when they are registered
+func logExactDuplicates(databaseConnection *sql.DB, databaseSetImage image_database.ForbiddenImageCreation) {
+	matches, err := image_database.RetrieveDigestMatches(
+		databaseConnection, databaseSetImage.FileDigest, databaseSetImage.PixelDigest,
+	)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, match := range *matches {
+		if match.ExternalReference == databaseSetImage.ExternalReference {
+			continue
+		}
+		kind := "pixel"
+		if match.FileMatch {
+			kind = "byte"
+		}
+		log.Println(databaseSetImage.ExternalReference, "is a", kind+"-identical duplicate of", match.ExternalReference)
+	}
+}
@@ -0,0 +1,116 @@
+package image_service
+
+import (
+	"context"
+	"database/sql"
+	"image_matcher/image_database"
+	"image_matcher/image_handling"
+)
+
+// ListForbiddenImages returns the summaries of the registered images ordered by reference
+func ListForbiddenImages(includeDeleted bool) (*[]image_database.ForbiddenImageSummary, error) {
+	var summaries []image_database.ForbiddenImageSummary
+	err := image_database.ApplyChunkedForbiddenImageListOperation(
+		context.Background(),
+		includeDeleted,
+		func(summary image_database.ForbiddenImageSummary) error {
+			summaries = append(summaries, summary)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &summaries, nil
+}
+
+// ShowForbiddenImage returns the summary and the audit trail of a registered or deleted image
+func ShowForbiddenImage(externalReference string) (
+	*image_database.ForbiddenImageSummary, *[]image_database.AuditEntry, error,
+) {
+	var summary *image_database.ForbiddenImageSummary
+	var auditTrail *[]image_database.AuditEntry
+	var err error
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		summary, err = image_database.RetrieveForbiddenImageSummary(databaseConnection, externalReference)
+		if err != nil {
+			return
+		}
+		auditTrail, err = image_database.RetrieveAuditTrail(databaseConnection, externalReference)
+	})
+	if databaseErr != nil {
+		return nil, nil, databaseErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return summary, auditTrail, nil
+}
+
+// ReplaceForbiddenImage replaces the features of the registered image with the features of the given image
+func ReplaceForbiddenImage(externalReference string, rawImage *image_handling.RawImage) error {
+	databaseSetImage := analyzeDatabaseImage(rawImage)
+	databaseSetImage.ExternalReference = externalReference
+
+	var err error
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		err = image_database.ReplaceImageInDatabaseSet(databaseConnection, databaseSetImage)
+		if err == nil && activeForbiddenIndex != nil {
+			err = activeForbiddenIndex.addFromDatabase(databaseConnection, externalReference)
+		}
+	})
+	if databaseErr != nil {
+		return databaseErr
+	}
+	return err
+}
+
+// AnnotateForbiddenImage replaces the metadata of the registered image
+func AnnotateForbiddenImage(externalReference string, metadata image_database.ForbiddenImageMetadata) error {
+	err := image_database.ValidateMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		err = image_database.UpdateMetadataInDatabaseSet(databaseConnection, externalReference, metadata)
+		if err == nil && activeForbiddenIndex != nil {
+			err = activeForbiddenIndex.addFromDatabase(databaseConnection, externalReference)
+		}
+	})
+	if databaseErr != nil {
+		return databaseErr
+	}
+	return err
+}
+
+// DeleteForbiddenImage soft deletes the image, the reason is recorded in the audit trail
+func DeleteForbiddenImage(externalReference string, reason string) error {
+	var err error
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		err = image_database.DeleteImageFromDatabaseSet(databaseConnection, externalReference, reason)
+	})
+	if databaseErr != nil {
+		return databaseErr
+	}
+	if err == nil && activeForbiddenIndex != nil {
+		activeForbiddenIndex.Remove(externalReference)
+	}
+	return err
+}
+
+// RenameForbiddenImage changes the reference of the registered image
+func RenameForbiddenImage(externalReference string, newReference string) error {
+	var err error
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		err = image_database.RenameImageInDatabaseSet(databaseConnection, externalReference, newReference)
+		if err == nil && activeForbiddenIndex != nil {
+			activeForbiddenIndex.Remove(externalReference)
+			err = activeForbiddenIndex.addFromDatabase(databaseConnection, newReference)
+		}
+	})
+	if databaseErr != nil {
+		return databaseErr
+	}
+	return err
+}
@@ -0,0 +1,419 @@
+package image_service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gocv.io/x/gocv"
+	"image_matcher/image_analyzer"
+	"image_matcher/image_database"
+	"image_matcher/image_handling"
+	"image_matcher/image_matching"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultIndexMemoryBudget is the number of descriptor bytes the forbidden index may hold
+const DefaultIndexMemoryBudget = 2 << 30
+
+// ForbiddenIndex holds the hashes and the decoded descriptors of the forbidden set in memory, so that matching doesn't
+// retrieve and decode the whole forbidden set for every search image. Only the descriptors of the indexed analyzers
+// are loaded, the descriptors of all indexed images need to fit into the memory budget.
+type ForbiddenIndex struct {
+	analyzers    []string
+	memoryBudget int64
+	mutex        sync.RWMutex
+	entries      map[string]*indexEntry
+	// references are the sorted keys of the entries, so that the forbidden set is always matched in the same order
+	references []string
+	// digests are the entries by their file and pixel digest in the order of the references
+	digests map[string][]*indexEntry
+	memory  int64
+}
+
+type indexEntry struct {
+	externalReference string
+	pHash             uint64
+	rotationHash      uint64
+	fileDigest        string
+	pixelDigest       string
+	descriptors       map[string]*gocv.Mat
+	metadata          image_database.ForbiddenImageMetadata
+	memory            int64
+}
+
+var activeForbiddenIndex *ForbiddenIndex
+
+// UseForbiddenIndex makes the match functions use the index instead of the database, nil switches back to the database
+func UseForbiddenIndex(index *ForbiddenIndex) {
+	activeForbiddenIndex = index
+}
+
+// LoadForbiddenIndex loads the forbidden set with the descriptors of the given analyzers
+func LoadForbiddenIndex(analyzers []string, memoryBudget int64) (*ForbiddenIndex, error) {
+	for _, analyzer := range analyzers {
+		if descriptorMapping[analyzer] == "" {
+			return nil, errors.New(fmt.Sprintf("analyzer %s has no descriptors", analyzer))
+		}
+	}
+	index := ForbiddenIndex{analyzers: analyzers, memoryBudget: memoryBudget, entries: make(map[string]*indexEntry)}
+	err := index.Reload(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// Reload loads the forbidden set from the repository again and replaces the index once it is loaded completely, the
+// index keeps serving the previous forbidden set while it reloads and if the reload fails or is cancelled
+func (i *ForbiddenIndex) Reload(ctx context.Context) error {
+	entries := make(map[string]*indexEntry)
+	var memory int64
+	err := image_database.ApplyChunkedForbiddenImageRetrievalOperation(
+		ctx,
+		func(databaseImage image_database.ForbiddenImageEntity) error {
+			entry := i.newEntry(databaseImage)
+			memory += entry.memory
+			entries[entry.externalReference] = entry
+			if memory > i.memoryBudget {
+				return errors.New(fmt.Sprintf(
+					"forbidden index exceeds its memory budget of %d bytes", i.memoryBudget,
+				))
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		closeEntries(entries)
+		return err
+	}
+
+	i.mutex.Lock()
+	previousEntries := i.entries
+	i.entries = entries
+	i.memory = memory
+	i.rebuildLookups()
+	i.mutex.Unlock()
+
+	// no match holds the read lock anymore, so the previous descriptors aren't used
+	closeEntries(previousEntries)
+	log.Println(fmt.Sprintf("Loaded %d forbidden images into the index (%d descriptor bytes)", len(entries), memory))
+	return nil
+}
+
+// ReloadPeriodically reloads the index in the given interval until the returned function is called, which also
+// cancels a running reload
+func (i *ForbiddenIndex) ReloadPeriodically(interval time.Duration) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := i.Reload(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Println("couldn't reload forbidden index:", err)
+				}
+			}
+		}
+	}()
+	return cancel
+}
+
+// Add loads the forbidden image from the repository into the index, an indexed image with the same reference is
+// replaced
+func (i *ForbiddenIndex) Add(externalReference string) error {
+	var err error
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		err = i.addFromDatabase(databaseConnection, externalReference)
+	})
+	if databaseErr != nil {
+		return databaseErr
+	}
+	return err
+}
+
+func (i *ForbiddenIndex) addFromDatabase(databaseConnection *sql.DB, externalReference string) error {
+	databaseImage, err := image_database.RetrieveForbiddenImage(databaseConnection, externalReference)
+	if err != nil {
+		return err
+	}
+	return i.add(*databaseImage)
+}
+
+func (i *ForbiddenIndex) add(databaseImage image_database.ForbiddenImageEntity) error {
+	entry := i.newEntry(databaseImage)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	previousEntry, exists := i.entries[entry.externalReference]
+	memory := i.memory + entry.memory
+	if exists {
+		memory -= previousEntry.memory
+	}
+	if memory > i.memoryBudget {
+		closeEntries(map[string]*indexEntry{entry.externalReference: entry})
+		return errors.New(fmt.Sprintf(
+			"adding %s exceeds the memory budget of the forbidden index", entry.externalReference,
+		))
+	}
+
+	if exists {
+		closeEntries(map[string]*indexEntry{previousEntry.externalReference: previousEntry})
+	}
+	i.entries[entry.externalReference] = entry
+	i.memory = memory
+	i.rebuildLookups()
+	return nil
+}
+
+// Remove removes the forbidden image from the index, removing an image that isn't indexed does nothing
+func (i *ForbiddenIndex) Remove(externalReference string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	entry, exists := i.entries[externalReference]
+	if !exists {
+		return
+	}
+	delete(i.entries, externalReference)
+	i.memory -= entry.memory
+	i.rebuildLookups()
+	closeEntries(map[string]*indexEntry{externalReference: entry})
+}
+
+// Statistics returns the number of indexed images and their descriptor bytes
+func (i *ForbiddenIndex) Statistics() (int, int64) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return len(i.entries), i.memory
+}
+
+// Metadata returns the metadata of the indexed images among the references
+func (i *ForbiddenIndex) Metadata(externalReferences []string) map[string]image_database.ForbiddenImageMetadata {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	metadataByReference := make(map[string]image_database.ForbiddenImageMetadata)
+	for _, externalReference := range externalReferences {
+		entry, exists := i.entries[externalReference]
+		if exists {
+			metadataByReference[externalReference] = entry.metadata
+		}
+	}
+	return metadataByReference
+}
+
+// HasAnalyzer returns whether the descriptors of the analyzer are indexed
+func (i *ForbiddenIndex) HasAnalyzer(analyzer string) bool {
+	for _, indexedAnalyzer := range i.analyzers {
+		if indexedAnalyzer == analyzer {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *ForbiddenIndex) newEntry(databaseImage image_database.ForbiddenImageEntity) *indexEntry {
+	return newIndexEntry(databaseImage, i.analyzers)
+}
+
+// newIndexEntry decodes the descriptors of the given analyzers, the descriptors need to be closed with closeEntries
+func newIndexEntry(databaseImage image_database.ForbiddenImageEntity, analyzers []string) *indexEntry {
+	entry := indexEntry{
+		externalReference: databaseImage.ExternalReference,
+		pHash:             databaseImage.PHash,
+		rotationHash:      databaseImage.RotationHash,
+		fileDigest:        databaseImage.FileDigest,
+		pixelDigest:       databaseImage.PixelDigest,
+		descriptors:       make(map[string]*gocv.Mat),
+		metadata:          databaseImage.Metadata,
+	}
+	descriptorBytes := map[string][]byte{
+		image_analyzer.SIFT:  databaseImage.SiftDescriptor,
+		image_analyzer.ORB:   databaseImage.OrbDescriptor,
+		image_analyzer.BRISK: databaseImage.BriskDescriptor,
+	}
+	for _, analyzer := range analyzers {
+		analyzerBytes := descriptorBytes[analyzer]
+		if len(analyzerBytes) == 0 {
+			continue
+		}
+		descriptors, err := image_handling.ConvertByteArrayToDescriptorMat(&analyzerBytes, analyzer)
+		if descriptors == nil || err != nil {
+			log.Println("Descriptor was empty", databaseImage.ExternalReference)
+			continue
+		}
+		entry.descriptors[analyzer] = descriptors
+		entry.memory += int64(len(analyzerBytes))
+	}
+	return &entry
+}
+
+// rebuildLookups sorts the references and indexes the entries by their digests after the entries changed
+func (i *ForbiddenIndex) rebuildLookups() {
+	references := make([]string, 0, len(i.entries))
+	for reference := range i.entries {
+		references = append(references, reference)
+	}
+	sort.Strings(references)
+	i.references = references
+
+	digests := make(map[string][]*indexEntry)
+	for _, reference := range references {
+		entry := i.entries[reference]
+		if entry.fileDigest != "" {
+			digests[entry.fileDigest] = append(digests[entry.fileDigest], entry)
+		}
+		if entry.pixelDigest != "" && entry.pixelDigest != entry.fileDigest {
+			digests[entry.pixelDigest] = append(digests[entry.pixelDigest], entry)
+		}
+	}
+	i.digests = digests
+}
+
+// read applies the function while holding the read lock, the entries and their descriptors must not be used after
+// the function returned
+func (i *ForbiddenIndex) read(applyFunction func(entries []*indexEntry)) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	entries := make([]*indexEntry, len(i.references))
+	for index, reference := range i.references {
+		entries[index] = i.entries[reference]
+	}
+	applyFunction(entries)
+}
+
+func closeEntries(entries map[string]*indexEntry) {
+	for _, entry := range entries {
+		for _, descriptors := range entry.descriptors {
+			descriptors.Close()
+		}
+	}
+}
+
+// forEachForbiddenPHash applies the function to the phash of every forbidden image in the active scope, from the
+// index if one is used
+func forEachForbiddenPHash(applyFunction func(externalReference string, hash uint64)) error {
+	includes := scopeIncludes(time.Now())
+	index := activeForbiddenIndex
+	if index == nil {
+		return image_database.ApplyChunkedPHashRetrievalOperation(
+			context.Background(),
+			func(databaseImage image_database.PHashImageEntity) error {
+				if includes(databaseImage.Metadata) {
+					applyFunction(databaseImage.ExternalReference, databaseImage.Hash)
+				}
+				return nil
+			},
+		)
+	}
+	index.read(func(entries []*indexEntry) {
+		for _, entry := range entries {
+			if includes(entry.metadata) {
+				applyFunction(entry.externalReference, entry.pHash)
+			}
+		}
+	})
+	return nil
+}
+
+// forEachForbiddenDescriptors applies the function to the decoded descriptors of every forbidden image in the active
+// scope, from the index if it contains the descriptors of the analyzer. The descriptors are closed after the function
+// returned.
+func forEachForbiddenDescriptors(
+	analyzer string, applyFunction func(externalReference string, descriptors *gocv.Mat),
+) error {
+	includes := scopeIncludes(time.Now())
+	index := activeForbiddenIndex
+	if index == nil || !index.HasAnalyzer(analyzer) {
+		return image_database.ApplyChunkedFeatureBasedRetrievalOperation(
+			context.Background(),
+			func(databaseImage image_database.FeatureImageEntity) error {
+				if !includes(databaseImage.Metadata) {
+					return nil
+				}
+				descriptors, err := image_handling.ConvertByteArrayToDescriptorMat(&databaseImage.Descriptors, analyzer)
+				if descriptors == nil || err != nil {
+					println("Descriptor was empty", databaseImage.ExternalReference)
+					return nil
+				}
+				applyFunction(databaseImage.ExternalReference, descriptors)
+				descriptors.Close()
+				return nil
+			},
+			descriptorMapping[analyzer],
+		)
+	}
+	index.read(func(entries []*indexEntry) {
+		for _, entry := range entries {
+			descriptors, exists := entry.descriptors[analyzer]
+			if !exists || !includes(entry.metadata) {
+				continue
+			}
+			applyFunction(entry.externalReference, descriptors)
+		}
+	})
+	return nil
+}
+
+// matchHybrid runs the hybrid matcher against the forbidden images in the active scope, from the index if it contains
+// the sift descriptors
+func matchHybrid(
+	orientedHashes []uint64, regularHash uint64, searchImageDescriptors *gocv.Mat, debug bool,
+) (*[]string, int, time.Duration, time.Duration) {
+	includes := scopeIncludes(time.Now())
+	index := activeForbiddenIndex
+	if index == nil || !index.HasAnalyzer(image_analyzer.SIFT) {
+		return image_matching.HybridImageMatcherWithCandidates(
+			orientedHashes,
+			regularHash,
+			searchImageDescriptors,
+			scopedCandidates(image_matching.DatabaseHybridCandidates, includes),
+			debug,
+		)
+	}
+
+	var matchedReferences *[]string
+	var poolSize int
+	var poolBuildTime, descriptorMatchingTime time.Duration
+	index.read(func(entries []*indexEntry) {
+		candidates := func(applyFunction func(candidate image_matching.HybridCandidate)) error {
+			for _, entry := range entries {
+				descriptors := entry.descriptors[image_analyzer.SIFT]
+				if descriptors == nil {
+					continue
+				}
+				applyFunction(image_matching.HybridCandidate{
+					ExternalReference: entry.externalReference,
+					OrientedHash:      entry.rotationHash,
+					RegularHash:       entry.pHash,
+					SiftDescriptors:   descriptors,
+					Metadata:          entry.metadata,
+				})
+			}
+			return nil
+		}
+		matchedReferences, poolSize, poolBuildTime, descriptorMatchingTime =
+			image_matching.HybridImageMatcherWithCandidates(
+				orientedHashes, regularHash, searchImageDescriptors, scopedCandidates(candidates, includes), debug,
+			)
+	})
+	return matchedReferences, poolSize, poolBuildTime, descriptorMatchingTime
+}
+
+func scopedCandidates(
+	candidates image_matching.HybridCandidates, includes func(metadata image_database.ForbiddenImageMetadata) bool,
+) image_matching.HybridCandidates {
+	return func(applyFunction func(candidate image_matching.HybridCandidate)) error {
+		return candidates(func(candidate image_matching.HybridCandidate) {
+			if includes(candidate.Metadata) {
+				applyFunction(candidate)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package image_service
+
+import (
+	"context"
+	"image_matcher/image_analyzer"
+	"image_matcher/image_database"
+	"image_matcher/image_handling"
+	"image_matcher/statistics"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// DoctorAnalyzers are the analyzers the doctor checks whether the forbidden images can be matched by
+var DoctorAnalyzers = []string{
+	image_analyzer.SIFT, image_analyzer.ORB, image_analyzer.BRISK, image_analyzer.PHASH, image_analyzer.NewAnalyzer,
+}
+
+// ForbiddenSetDiagnosis describes the integrity and the statistics of the forbidden images that aren't deleted
+type ForbiddenSetDiagnosis struct {
+	Images             int
+	ZeroPHashes        int
+	ZeroRotationHashes int
+	MissingDigests     int
+	// EmptyDescriptors counts the images per analyzer whose descriptors are null or empty
+	EmptyDescriptors map[string]int
+	// MisalignedDescriptors counts the images per analyzer whose descriptor bytes aren't a multiple of the size of a
+	// descriptor, the trailing bytes are ignored when they are decoded
+	MisalignedDescriptors map[string]int
+	// InvalidDescriptors counts the images per analyzer whose descriptors can't be decoded
+	InvalidDescriptors map[string]int
+	// DescriptorCounts are the distributions of the number of decoded descriptors per image and analyzer
+	DescriptorCounts       map[string]statistics.CountSummary
+	PHashBitBalance        BitBalance
+	RotationHashBitBalance BitBalance
+	// the collision clusters are images with the same non-zero hash or pixel digest, the largest clusters first
+	PHashCollisions        []CollisionCluster
+	RotationHashCollisions []CollisionCluster
+	DigestCollisions       []CollisionCluster
+	// Unmatchable are the references per analyzer of the images that analyzer can never match
+	Unmatchable map[string][]string
+}
+
+// BitBalance is the fraction of the non-zero hashes that have the bit set, per bit from the least significant bit,
+// a bit that is set in about half of the hashes distinguishes the most images
+type BitBalance struct {
+	Hashes int
+	Ones   [64]float64
+}
+
+type CollisionCluster struct {
+	Value      string
+	References []string
+}
+
+// DiagnoseForbiddenSet scans the forbidden set and decodes every descriptor blob like the matchers do
+func DiagnoseForbiddenSet() (*ForbiddenSetDiagnosis, error) {
+	diagnosis := ForbiddenSetDiagnosis{
+		EmptyDescriptors:      make(map[string]int),
+		MisalignedDescriptors: make(map[string]int),
+		InvalidDescriptors:    make(map[string]int),
+		DescriptorCounts:      make(map[string]statistics.CountSummary),
+		Unmatchable:           make(map[string][]string),
+	}
+	descriptorCounts := make(map[string][]int)
+	pHashes := make(map[string][]string)
+	rotationHashes := make(map[string][]string)
+	digests := make(map[string][]string)
+	var pHashBits, rotationHashBits [64]int
+
+	err := image_database.ApplyChunkedForbiddenImageRetrievalOperation(
+		context.Background(),
+		func(databaseImage image_database.ForbiddenImageEntity) error {
+			diagnosis.Images++
+			reference := databaseImage.ExternalReference
+
+			descriptorBytes := map[string][]byte{
+				image_analyzer.SIFT:  databaseImage.SiftDescriptor,
+				image_analyzer.ORB:   databaseImage.OrbDescriptor,
+				image_analyzer.BRISK: databaseImage.BriskDescriptor,
+			}
+			validDescriptors := make(map[string]bool)
+			for _, analyzer := range allDescriptorAnalyzers() {
+				rows, valid := diagnosis.checkDescriptors(descriptorBytes[analyzer], analyzer)
+				validDescriptors[analyzer] = valid
+				if valid {
+					descriptorCounts[analyzer] = append(descriptorCounts[analyzer], rows)
+				} else {
+					diagnosis.Unmatchable[analyzer] = append(diagnosis.Unmatchable[analyzer], reference)
+				}
+			}
+
+			if databaseImage.PHash == 0 {
+				diagnosis.ZeroPHashes++
+				diagnosis.Unmatchable[image_analyzer.PHASH] = append(diagnosis.Unmatchable[image_analyzer.PHASH], reference)
+			} else {
+				countBits(databaseImage.PHash, &pHashBits)
+				key := strconv.FormatUint(databaseImage.PHash, 10)
+				pHashes[key] = append(pHashes[key], reference)
+			}
+			if databaseImage.RotationHash == 0 {
+				diagnosis.ZeroRotationHashes++
+			} else {
+				countBits(databaseImage.RotationHash, &rotationHashBits)
+				key := strconv.FormatUint(databaseImage.RotationHash, 10)
+				rotationHashes[key] = append(rotationHashes[key], reference)
+			}
+			// the hybrid retrieval skips images without either hash and the hybrid matcher needs their sift
+			// descriptors, a hash that is null in the database is read as zero
+			if databaseImage.PHash == 0 || databaseImage.RotationHash == 0 || !validDescriptors[image_analyzer.SIFT] {
+				diagnosis.Unmatchable[image_analyzer.NewAnalyzer] =
+					append(diagnosis.Unmatchable[image_analyzer.NewAnalyzer], reference)
+			}
+
+			if databaseImage.FileDigest == "" || databaseImage.PixelDigest == "" {
+				diagnosis.MissingDigests++
+			}
+			if databaseImage.PixelDigest != "" {
+				digests[databaseImage.PixelDigest] = append(digests[databaseImage.PixelDigest], reference)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for analyzer, counts := range descriptorCounts {
+		diagnosis.DescriptorCounts[analyzer] = statistics.SummarizeCounts(counts)
+	}
+	diagnosis.PHashBitBalance = newBitBalance(pHashBits, diagnosis.Images-diagnosis.ZeroPHashes)
+	diagnosis.RotationHashBitBalance = newBitBalance(rotationHashBits, diagnosis.Images-diagnosis.ZeroRotationHashes)
+	diagnosis.PHashCollisions = collisionClusters(pHashes)
+	diagnosis.RotationHashCollisions = collisionClusters(rotationHashes)
+	diagnosis.DigestCollisions = collisionClusters(digests)
+	return &diagnosis, nil
+}
+
+// checkDescriptors counts the problems of the descriptor bytes and returns the number of decoded descriptors and
+// whether they can be matched
+func (d *ForbiddenSetDiagnosis) checkDescriptors(descriptorBytes []byte, analyzer string) (int, bool) {
+	if len(descriptorBytes) == 0 {
+		d.EmptyDescriptors[analyzer]++
+		return 0, false
+	}
+	if len(descriptorBytes)%image_handling.DescriptorByteLength(analyzer) != 0 {
+		d.MisalignedDescriptors[analyzer]++
+	}
+	descriptors, err := image_handling.ConvertByteArrayToDescriptorMat(&descriptorBytes, analyzer)
+	if descriptors == nil || err != nil {
+		d.InvalidDescriptors[analyzer]++
+		return 0, false
+	}
+	defer descriptors.Close()
+	return descriptors.Rows(), true
+}
+
+// MostUnbalancedBits returns the bits whose fraction deviates the most from one half, the most unbalanced first
+func (b BitBalance) MostUnbalancedBits(count int) []int {
+	bits := make([]int, 64)
+	for bit := range bits {
+		bits[bit] = bit
+	}
+	sort.SliceStable(bits, func(i, j int) bool {
+		return math.Abs(b.Ones[bits[i]]-0.5) > math.Abs(b.Ones[bits[j]]-0.5)
+	})
+	if count > len(bits) {
+		count = len(bits)
+	}
+	return bits[:count]
+}
+
+// MeanDeviation is the mean absolute deviation of the fractions from one half, 0 for perfectly balanced hashes and
+// 0.5 for constant hashes
+func (b BitBalance) MeanDeviation() float64 {
+	if b.Hashes == 0 {
+		return 0
+	}
+	deviation := 0.0
+	for _, ones := range b.Ones {
+		deviation += math.Abs(ones - 0.5)
+	}
+	return deviation / 64
+}
+
+func newBitBalance(bitCounts [64]int, hashes int) BitBalance {
+	balance := BitBalance{Hashes: hashes}
+	if hashes == 0 {
+		return balance
+	}
+	for bit, count := range bitCounts {
+		balance.Ones[bit] = float64(count) / float64(hashes)
+	}
+	return balance
+}
+
+func countBits(hash uint64, bitCounts *[64]int) {
+	for bit := 0; bit < 64; bit++ {
+		if hash&(1<<bit) != 0 {
+			bitCounts[bit]++
+		}
+	}
+}
+
+func collisionClusters(referencesByValue map[string][]string) []CollisionCluster {
+	var clusters []CollisionCluster
+	for value, references := range referencesByValue {
+		if len(references) > 1 {
+			clusters = append(clusters, CollisionCluster{Value: value, References: references})
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].References) != len(clusters[j].References) {
+			return len(clusters[i].References) > len(clusters[j].References)
+		}
+		return clusters[i].Value < clusters[j].Value
+	})
+	return clusters
+}
@@ -0,0 +1,170 @@
+package image_service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gocv.io/x/gocv"
+	"image_matcher/image_analyzer"
+	"image_matcher/image_database"
+	"image_matcher/image_handling"
+	"image_matcher/image_matching"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// orbCandidateHashDistance limits the orb search to pairs whose pHashes differ by at most this many bits, the hashes
+// of unrelated images differ by about half of their 64 bits
+const orbCandidateHashDistance = 24
+
+// FindHardNegatives searches the forbidden set for pairs of images that are near but not identical: their pHashes
+// differ by at most maxHashDistance bits or their orb descriptors have at least minOrbMatches good matches. Pairs
+// with identical hashes are skipped, they are duplicates within the forbidden set. The hash distance is checked
+// first, orb only compares the pairs it doesn't decide that are within orbCandidateHashDistance. A minOrbMatches of 0
+// disables the orb search. Every pair is returned in both directions, so that each image is searched for once.
+func FindHardNegatives(maxHashDistance int, minOrbMatches int) (*[]image_handling.HardNegative, error) {
+	var hashImages []image_database.PHashImageEntity
+	err := image_database.ApplyChunkedPHashRetrievalOperation(
+		context.Background(),
+		func(databaseImage image_database.PHashImageEntity) error {
+			hashImages = append(hashImages, databaseImage)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	orbDescriptors := make(map[string]*gocv.Mat)
+	if minOrbMatches > 0 {
+		err = image_database.ApplyChunkedFeatureBasedRetrievalOperation(
+			context.Background(),
+			func(databaseImage image_database.FeatureImageEntity) error {
+				descriptors, err :=
+					image_handling.ConvertByteArrayToDescriptorMat(&databaseImage.Descriptors, image_analyzer.ORB)
+				if descriptors == nil || err != nil {
+					log.Println("Descriptor was empty", databaseImage.ExternalReference)
+					return nil
+				}
+				orbDescriptors[databaseImage.ExternalReference] = descriptors
+				return nil
+			},
+			descriptorMapping[image_analyzer.ORB],
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			for _, descriptors := range orbDescriptors {
+				descriptors.Close()
+			}
+		}()
+	}
+
+	imageMatcher := image_matching.MatcherMapping[image_matching.BFMatcher]
+	var hardNegatives []image_handling.HardNegative
+
+	for i := 0; i < len(hashImages); i++ {
+		for j := i + 1; j < len(hashImages); j++ {
+			image1 := hashImages[i]
+			image2 := hashImages[j]
+
+			isHashMatch, hashDistance, _ :=
+				image_matching.HashesAreMatch(image1.Hash, image2.Hash, maxHashDistance, false)
+			if hashDistance == 0 {
+				continue
+			}
+
+			orbMatches := 0
+			if !isHashMatch {
+				if minOrbMatches == 0 || hashDistance > orbCandidateHashDistance {
+					continue
+				}
+				descriptors1, exists1 := orbDescriptors[image1.ExternalReference]
+				descriptors2, exists2 := orbDescriptors[image2.ExternalReference]
+				if !exists1 || !exists2 {
+					continue
+				}
+				orbMatches = image_matching.CountGoodMatches(imageMatcher.FindMatches(descriptors1, descriptors2))
+				if orbMatches < minOrbMatches {
+					continue
+				}
+			}
+
+			hardNegatives = append(
+				hardNegatives,
+				image_handling.HardNegative{
+					Query:         image1.ExternalReference,
+					Reference:     image2.ExternalReference,
+					PHashDistance: hashDistance,
+					OrbMatches:    orbMatches,
+				},
+				image_handling.HardNegative{
+					Query:         image2.ExternalReference,
+					Reference:     image1.ExternalReference,
+					PHashDistance: hashDistance,
+					OrbMatches:    orbMatches,
+				},
+			)
+		}
+	}
+
+	return &hardNegatives, nil
+}
+
+// InsertHardNegativeSearchImages inserts the query of every pair as search image without original reference. The
+// queries are loaded from the directory of the originals the forbidden set was registered from.
+func InsertHardNegativeSearchImages(hardNegatives *[]image_handling.HardNegative, originalsDirectory string) error {
+	originalPaths := make(map[string]string)
+	for _, path := range image_handling.GetFilePathsFromDirectory(originalsDirectory) {
+		if !image_handling.IsImageFile(path) {
+			continue
+		}
+		fileName := filepath.Base(path)
+		originalPaths[strings.TrimSuffix(fileName, filepath.Ext(fileName))] = path
+	}
+	if len(originalPaths) == 0 {
+		return errors.New(fmt.Sprintf("couldn't find originals in %s", originalsDirectory))
+	}
+
+	err := createVariationDirectory(HARD_NEGATIVE)
+	if err != nil {
+		return err
+	}
+
+	return image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		for _, hardNegative := range *hardNegatives {
+			path, exists := originalPaths[hardNegative.Query]
+			if !exists {
+				log.Println("Skipping hard negative without original: ", hardNegative.Query)
+				continue
+			}
+			rawImage := image_handling.LoadRawImage(path)
+			if rawImage == nil {
+				log.Println("Skipping original that isn't an image: ", path)
+				continue
+			}
+
+			externalReference := fmt.Sprintf("%s-%s-%s", hardNegative.Query, HARD_NEGATIVE, hardNegative.Reference)
+			image_handling.SaveImageToDisk(
+				strings.TrimSuffix(VariationPath(HARD_NEGATIVE, externalReference), ".png"), rawImage.Data,
+			)
+
+			metadata := image_handling.VariationMetadata{HardNegative: &hardNegative}
+			err := image_database.InsertImageIntoSearchSet(
+				databaseConnection,
+				image_database.SearchImageCreation{
+					ExternalReference: externalReference,
+					OriginalReference: "",
+					Scenario:          HARD_NEGATIVE,
+					Notes:             image_handling.EncodeVariationMetadata(metadata),
+				},
+			)
+			if err != nil {
+				log.Println("failed to insert ", externalReference, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package image_service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"image_matcher/image_database"
+	"strings"
+	"time"
+)
+
+// MatchScope restricts the forbidden images a search image is matched against by their metadata
+type MatchScope struct {
+	// Reasons are the reasons the matched images need to be registered for, all images if empty
+	Reasons []string
+	// Tags are the tags of which the matched images need at least one, all images if empty
+	Tags []string
+	// IgnoreExpired excludes the images whose expiry date has passed
+	IgnoreExpired bool
+}
+
+// ForbiddenImageMatch is a matched forbidden image with its metadata
+type ForbiddenImageMatch struct {
+	ExternalReference string
+	Metadata          image_database.ForbiddenImageMetadata
+}
+
+var activeMatchScope *MatchScope
+
+// UseMatchScope restricts the match functions to the forbidden images in the scope, nil matches all images
+func UseMatchScope(scope *MatchScope) {
+	activeMatchScope = scope
+}
+
+// ParseMatchScope parses scope arguments of the form reason=<reasons>, tags=<tags> and expired=ignore, multiple
+// reasons and tags are separated by commas
+func ParseMatchScope(arguments []string) (*MatchScope, error) {
+	var scope MatchScope
+	for _, argument := range arguments {
+		key, value, found := strings.Cut(argument, "=")
+		if !found {
+			return nil, errors.New(fmt.Sprintf("scope argument %s isn't of the form key=value", argument))
+		}
+		switch key {
+		case "reason":
+			scope.Reasons = strings.Split(value, ",")
+			for _, reason := range scope.Reasons {
+				if !image_database.IsReason(reason) {
+					return nil, errors.New(fmt.Sprintf(
+						"unknown reason %s, the reasons are %s", reason, strings.Join(image_database.Reasons, ", "),
+					))
+				}
+			}
+		case "tags":
+			scope.Tags = image_database.NormalizeTags(strings.Split(value, ","))
+		case "expired":
+			if value != "ignore" && value != "include" {
+				return nil, errors.New(fmt.Sprintf("expired must be ignore or include, got %s", value))
+			}
+			scope.IgnoreExpired = value == "ignore"
+		default:
+			return nil, errors.New(fmt.Sprintf("unknown scope %s, the scopes are reason, tags and expired", key))
+		}
+	}
+	return &scope, nil
+}
+
+// Includes returns whether an image with the metadata is matched on the given day, a nil scope includes every image
+func (s *MatchScope) Includes(metadata image_database.ForbiddenImageMetadata, now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	if s.IgnoreExpired && metadata.Expired(now) {
+		return false
+	}
+	if len(s.Reasons) > 0 && !containsString(s.Reasons, metadata.Reason) {
+		return false
+	}
+	if len(s.Tags) == 0 {
+		return true
+	}
+	for _, tag := range s.Tags {
+		if metadata.HasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the scope for the console
+func (s *MatchScope) String() string {
+	if s == nil {
+		return "all forbidden images"
+	}
+	var restrictions []string
+	if len(s.Reasons) > 0 {
+		restrictions = append(restrictions, "reason "+strings.Join(s.Reasons, " or "))
+	}
+	if len(s.Tags) > 0 {
+		restrictions = append(restrictions, "tagged "+strings.Join(s.Tags, " or "))
+	}
+	if s.IgnoreExpired {
+		restrictions = append(restrictions, "not expired")
+	}
+	if len(restrictions) == 0 {
+		return "all forbidden images"
+	}
+	return "forbidden images with " + strings.Join(restrictions, ", ")
+}
+
+// DescribeMatches adds the metadata to the matched references, from the index if one is used
+func DescribeMatches(matchedReferences *[]string) (*[]ForbiddenImageMatch, error) {
+	var matches []ForbiddenImageMatch
+	if matchedReferences == nil {
+		return &matches, nil
+	}
+
+	var metadataByReference map[string]image_database.ForbiddenImageMetadata
+	index := activeForbiddenIndex
+	if index != nil {
+		metadataByReference = index.Metadata(*matchedReferences)
+	} else {
+		var err error
+		databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+			metadataByReference, err =
+				image_database.RetrieveForbiddenImageMetadata(databaseConnection, *matchedReferences)
+		})
+		if databaseErr != nil {
+			return nil, databaseErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, externalReference := range *matchedReferences {
+		matches = append(matches, ForbiddenImageMatch{
+			ExternalReference: externalReference,
+			Metadata:          metadataByReference[externalReference],
+		})
+	}
+	return &matches, nil
+}
+
+// scopeIncludes applies the active scope, the day is determined once per match so that an image doesn't expire
+// while a search image is matched
+func scopeIncludes(now time.Time) func(metadata image_database.ForbiddenImageMetadata) bool {
+	scope := activeMatchScope
+	return func(metadata image_database.ForbiddenImageMetadata) bool {
+		return scope.Includes(metadata, now)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,304 @@
+package image_service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image_matcher/image_analyzer"
+	"image_matcher/image_database"
+	"image_matcher/image_handling"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DigestFeature recomputes the file and pixel digests, the other features are named like their analyzer and new
+// recomputes the rotation hash
+const DigestFeature = "digest"
+
+const DefaultOriginalsDirectory = "images/originals"
+
+// ReindexFeatures are the features the reindex can recompute
+var ReindexFeatures = []string{
+	image_analyzer.SIFT,
+	image_analyzer.ORB,
+	image_analyzer.BRISK,
+	image_analyzer.PHASH,
+	image_analyzer.NewAnalyzer,
+	DigestFeature,
+}
+
+// originalExtensions are tried in order to find the original of a reference
+var originalExtensions = []string{".png", ".jpg", ".jpeg"}
+
+// ReindexOptions select the features that are recomputed and the registered images they are recomputed for
+type ReindexOptions struct {
+	Features           []string
+	OriginalsDirectory string
+	// Scope selects the images by their metadata, nil selects all images
+	Scope *MatchScope
+	// ReferencePattern selects the images whose reference matches the glob pattern, all images if empty
+	ReferencePattern string
+	// OnlyMissing selects the images that lack at least one of the features
+	OnlyMissing bool
+	// DryRun computes the features without writing them
+	DryRun  bool
+	Workers int
+}
+
+// ReindexReport counts the selected and the reindexed images and lists the images that couldn't be reindexed
+type ReindexReport struct {
+	Selected         int
+	Reindexed        int
+	MissingOriginals []string
+	// Corrupt are the images whose original can't be read or decoded
+	Corrupt []string
+	// Skipped are the images that were deleted while they were reindexed
+	Skipped []string
+	// Failed are the images of the batches that couldn't be written
+	Failed []string
+}
+
+// Reindex recomputes the features of the selected images from their originals in parallel and writes them in
+// transactions of image_database.ChunkSize images. Images without original or with a corrupt original are reported
+// and skipped.
+func Reindex(options ReindexOptions) (*ReindexReport, error) {
+	err := validateReindexOptions(&options)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries, err := selectReindexImages(options)
+	if err != nil {
+		return nil, err
+	}
+	report := ReindexReport{Selected: len(summaries)}
+	log.Println(fmt.Sprintf("Reindexing %s of %d images", strings.Join(options.Features, ", "), len(summaries)))
+
+	type reindexResult struct {
+		externalReference string
+		update            *image_database.FeatureUpdate
+		err               error
+	}
+	references := make(chan string)
+	results := make(chan reindexResult, options.Workers)
+	var workers sync.WaitGroup
+	for worker := 0; worker < options.Workers; worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for externalReference := range references {
+				update, err := recomputeFeatures(externalReference, options)
+				results <- reindexResult{externalReference: externalReference, update: update, err: err}
+			}
+		}()
+	}
+	go func() {
+		for _, summary := range summaries {
+			references <- summary.ExternalReference
+		}
+		close(references)
+		workers.Wait()
+		close(results)
+	}()
+
+	var batch []image_database.FeatureUpdate
+	writeBatch := func(databaseConnection *sql.DB) {
+		if len(batch) == 0 {
+			return
+		}
+		skippedReferences, writeErr := image_database.UpdateFeaturesInDatabaseSet(databaseConnection, batch)
+		if writeErr != nil {
+			log.Println(writeErr)
+			for _, update := range batch {
+				report.Failed = append(report.Failed, update.ExternalReference)
+			}
+		} else {
+			report.Reindexed += len(batch) - len(*skippedReferences)
+			report.Skipped = append(report.Skipped, *skippedReferences...)
+		}
+		batch = nil
+	}
+
+	databaseErr := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
+		completed := 0
+		for result := range results {
+			completed++
+			if result.err != nil {
+				report.Corrupt = append(report.Corrupt, result.externalReference)
+				log.Println(fmt.Sprintf("[%d/%d] corrupt original of %s: %s",
+					completed, len(summaries), result.externalReference, result.err.Error(),
+				))
+				continue
+			}
+			if result.update == nil {
+				report.MissingOriginals = append(report.MissingOriginals, result.externalReference)
+				log.Println(fmt.Sprintf("[%d/%d] no original of %s", completed, len(summaries), result.externalReference))
+				continue
+			}
+			log.Println(fmt.Sprintf("[%d/%d] recomputed %s", completed, len(summaries), result.externalReference))
+			if options.DryRun {
+				report.Reindexed++
+				continue
+			}
+			batch = append(batch, *result.update)
+			if len(batch) >= image_database.ChunkSize {
+				writeBatch(databaseConnection)
+			}
+		}
+		writeBatch(databaseConnection)
+	})
+	if databaseErr != nil {
+		return nil, databaseErr
+	}
+
+	sort.Strings(report.MissingOriginals)
+	sort.Strings(report.Corrupt)
+	sort.Strings(report.Skipped)
+	sort.Strings(report.Failed)
+	return &report, nil
+}
+
+func validateReindexOptions(options *ReindexOptions) error {
+	if len(options.Features) == 0 {
+		return errors.New("no features to reindex")
+	}
+	for _, feature := range options.Features {
+		if !containsString(ReindexFeatures, feature) {
+			return errors.New(fmt.Sprintf(
+				"unknown feature %s, the features are %s", feature, strings.Join(ReindexFeatures, ", "),
+			))
+		}
+	}
+	if options.ReferencePattern != "" {
+		_, err := path.Match(options.ReferencePattern, "")
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid reference pattern %s: %s", options.ReferencePattern, err.Error()))
+		}
+	}
+	fileInfo, err := os.Stat(options.OriginalsDirectory)
+	if err != nil || !fileInfo.IsDir() {
+		return errors.New(fmt.Sprintf("originals directory %s doesn't exist", options.OriginalsDirectory))
+	}
+	if options.Workers < 1 {
+		options.Workers = runtime.NumCPU()
+	}
+	return nil
+}
+
+// selectReindexImages returns the summaries of the registered images that match the filters of the options
+func selectReindexImages(options ReindexOptions) ([]image_database.ForbiddenImageSummary, error) {
+	now := time.Now()
+	var summaries []image_database.ForbiddenImageSummary
+	err := image_database.ApplyChunkedForbiddenImageListOperation(
+		context.Background(),
+		false,
+		func(summary image_database.ForbiddenImageSummary) error {
+			if !options.Scope.Includes(summary.Metadata, now) {
+				return nil
+			}
+			if options.ReferencePattern != "" {
+				matched, _ := path.Match(options.ReferencePattern, summary.ExternalReference)
+				if !matched {
+					return nil
+				}
+			}
+			if options.OnlyMissing && !lacksFeature(summary, options.Features) {
+				return nil
+			}
+			summaries = append(summaries, summary)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// lacksFeature returns whether one of the features is empty, a zero hash counts as missing
+func lacksFeature(summary image_database.ForbiddenImageSummary, features []string) bool {
+	for _, feature := range features {
+		switch feature {
+		case image_analyzer.SIFT:
+			if summary.SiftBytes == 0 {
+				return true
+			}
+		case image_analyzer.ORB:
+			if summary.OrbBytes == 0 {
+				return true
+			}
+		case image_analyzer.BRISK:
+			if summary.BriskBytes == 0 {
+				return true
+			}
+		case image_analyzer.PHASH:
+			if summary.PHash == 0 {
+				return true
+			}
+		case image_analyzer.NewAnalyzer:
+			if summary.RotationHash == 0 {
+				return true
+			}
+		case DigestFeature:
+			if summary.FileDigest == "" || summary.PixelDigest == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recomputeFeatures computes the features from the original of the reference, nil if there is no original and an
+// error if the original can't be read or decoded
+func recomputeFeatures(
+	externalReference string, options ReindexOptions,
+) (*image_database.FeatureUpdate, error) {
+	originalPath := findOriginal(options.OriginalsDirectory, externalReference)
+	if originalPath == "" {
+		return nil, nil
+	}
+	rawImage, err := image_handling.ReadRawImage(originalPath)
+	if err != nil {
+		return nil, err
+	}
+
+	update := image_database.FeatureUpdate{ExternalReference: externalReference, Columns: make(map[string]interface{})}
+	for _, feature := range options.Features {
+		switch feature {
+		case image_analyzer.SIFT, image_analyzer.ORB, image_analyzer.BRISK:
+			imageAnalyzer := image_analyzer.AnalyzerMapping[feature]
+			_, descriptors, _ := image_analyzer.ExtractKeypointsAndDescriptors(&rawImage.Data, &imageAnalyzer)
+			update.Columns[descriptorMapping[feature]] = image_handling.ConvertImageMatToByteArray(descriptors)
+			descriptors.Close()
+		case image_analyzer.PHASH:
+			update.Columns["p_hash"], _ = image_analyzer.GetPHashValue(&rawImage.Data)
+		case image_analyzer.NewAnalyzer:
+			update.Columns["rotation_hash"], _ = image_analyzer.CalculateOrientedPHash(&rawImage.Data)
+		case DigestFeature:
+			update.Columns["file_sha256"] = rawImage.FileDigest
+			update.Columns["pixel_sha256"] = image_handling.PixelDigest(&rawImage.Data)
+		}
+	}
+	return &update, nil
+}
+
+// findOriginal returns the path of the original of the reference with the first extension that exists, empty if
+// there is none
+func findOriginal(originalsDirectory string, externalReference string) string {
+	for _, extension := range originalExtensions {
+		originalPath := filepath.Join(originalsDirectory, externalReference+extension)
+		fileInfo, err := os.Stat(originalPath)
+		if err == nil && !fileInfo.IsDir() {
+			return originalPath
+		}
+	}
+	return ""
+}
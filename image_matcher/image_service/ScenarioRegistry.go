@@ -0,0 +1,41 @@
+package image_service
+
+import (
+	"image_matcher/image_handling"
+	"log"
+)
+
+const (
+	// MIXED chains a random number of the mixed modifiers of the variation spec
+	MIXED = "mixed"
+	// HARD_NEGATIVE are registered images that are confusable with another registered image
+	HARD_NEGATIVE = "hard-negative"
+)
+
+// Scenarios are the built-in scenarios, every modifier is a scenario of its own
+var Scenarios = append(append([]string{}, image_handling.Modifiers...), MIXED, HARD_NEGATIVE)
+
+// RegisteredScenarios returns the built-in scenarios followed by the user-defined scenarios of the spec. Scenarios
+// are free-form identifiers in the search set, so any scenario of the database can be run by name, the registry
+// determines which scenarios are run and reported together.
+func RegisteredScenarios(spec *image_handling.VariationSpec) []string {
+	scenarios := append([]string{}, Scenarios...)
+	if spec == nil {
+		return scenarios
+	}
+	for _, scenario := range spec.Scenarios {
+		scenarios = append(scenarios, scenario.Name)
+	}
+	return scenarios
+}
+
+// LoadRegisteredScenarios registers the user-defined scenarios of the default variation spec, only the built-in
+// scenarios are returned if it can't be loaded
+func LoadRegisteredScenarios() []string {
+	spec, err := image_handling.LoadVariationSpec(image_handling.DefaultVariationSpecPath)
+	if err != nil {
+		log.Println("Only built-in scenarios are registered: ", err)
+		return RegisteredScenarios(nil)
+	}
+	return RegisteredScenarios(spec)
+}
@@ -1,6 +1,7 @@
 package image_service
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"image_matcher/image_database"
@@ -8,46 +9,17 @@ import (
 	"log"
 )
 
-const (
-	IDENTICAL  = "identical"
-	SCALED     = "scaled"
-	ROTATED    = "rotated"
-	MIRRORED   = "mirrored"
-	MOVED      = "moved"
-	BACKGROUND = "background"
-	PART       = "part"
-	MIXED      = "mixed"
-)
-
-var Scenarios = []string{IDENTICAL, SCALED, ROTATED, MIRRORED, MOVED, BACKGROUND, PART, MIXED}
-
 func GetSearchImages(scenario string) *[]image_database.SearchImageEntity {
 	var searchSetImages []image_database.SearchImageEntity
 
-	err := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
-		offset := 0
-		for {
-			retrievedImages, err := image_database.RetrieveChunkFromSearchSet(
-				databaseConnection,
-				scenario,
-				offset,
-				image_database.MaxChunkSize+1,
-			)
-			if err != nil {
-				log.Println("Error while retrieving chunk from search images: ", err)
-			}
-
-			numberOfRetrievedImages := len(retrievedImages)
-			if numberOfRetrievedImages > 0 {
-				searchSetImages = append(searchSetImages, retrievedImages[:numberOfRetrievedImages]...)
-			}
-
-			if len(retrievedImages) < image_database.MaxChunkSize+1 {
-				break
-			}
-			offset += image_database.MaxChunkSize
-		}
-	})
+	err := image_database.ApplyChunkedSearchImageRetrievalOperation(
+		context.Background(),
+		scenario,
+		func(searchImage image_database.SearchImageEntity) error {
+			searchSetImages = append(searchSetImages, searchImage)
+			return nil
+		},
+	)
 	if err != nil {
 		log.Println("Error while retrieving chunk from search images: ", err)
 		return nil
@@ -58,7 +30,11 @@ func GetSearchImages(scenario string) *[]image_database.SearchImageEntity {
 
 func InsertDuplicateSearchImage(variations *[]image_handling.ImageVariation, originalReference string, scenario string) {
 	var externalReference = fmt.Sprintf("%s-%s", originalReference, scenario)
-	var err error
+	err := createVariationDirectory(scenario)
+	if err != nil {
+		log.Println("Failed to create directory for searchImages: ", err)
+		return
+	}
 
 	err = image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
 		for _, variation := range *variations {
@@ -72,7 +48,8 @@ func InsertDuplicateSearchImage(variations *[]image_handling.ImageVariation, ori
 					ExternalReference: imageReference,
 					OriginalReference: originalReference,
 					Scenario:          scenario,
-					ModificationInfo:  variation.ModificationInfo,
+					Notes:             image_handling.EncodeVariationMetadata(variation.Metadata()),
+					SpecHash:          variation.SpecHash,
 				},
 			)
 			if err != nil {
@@ -85,22 +62,46 @@ func InsertDuplicateSearchImage(variations *[]image_handling.ImageVariation, ori
 	}
 }
 
-func GenerateAndInsertUniqueSearchImages(originalImage *image_handling.RawImage) {
+func GenerateAndInsertUniqueSearchImages(
+	originalImage *image_handling.RawImage, spec *image_handling.VariationSpec, seed int64,
+) {
 	err := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
-		for _, scenario := range Scenarios {
-			var variation *image_handling.ImageVariation
-			if scenario == MIXED {
-				variation = image_handling.GenerateMixedVariation(originalImage)
-			} else {
-				variation = image_handling.GenerateUniqueVariation(originalImage, scenario)
+		for _, modifierSpec := range spec.Modifiers {
+			for index := 0; index < spec.Uniques.Count; index++ {
+				variation, err := image_handling.GenerateUniqueVariation(
+					originalImage, &modifierSpec, spec.Hash, seed, index,
+				)
+				if err != nil {
+					logSkippedVariation(originalImage.ExternalReference, modifierSpec.Modifier, err)
+					continue
+				}
+				insertUniqueSearchImage(
+					databaseConnection,
+					variation,
+					originalImage.ExternalReference,
+					modifierSpec.Modifier,
+				)
+			}
+		}
+		for index := 0; index < spec.Uniques.Mixed; index++ {
+			variation, err := image_handling.GenerateMixedVariation(originalImage, spec, seed, true, index)
+			if err != nil {
+				logSkippedVariation(originalImage.ExternalReference, MIXED, err)
+				continue
+			}
+			insertUniqueSearchImage(databaseConnection, variation, originalImage.ExternalReference, MIXED)
+		}
+		for _, scenario := range spec.Scenarios {
+			for index := 0; index < spec.Uniques.Count; index++ {
+				variation, err := image_handling.GenerateScenarioVariation(
+					originalImage, &scenario, spec.Hash, seed, true, index,
+				)
+				if err != nil {
+					logSkippedVariation(originalImage.ExternalReference, scenario.Name, err)
+					continue
+				}
+				insertUniqueSearchImage(databaseConnection, variation, originalImage.ExternalReference, scenario.Name)
 			}
-
-			insertUniqueSearchImage(
-				databaseConnection,
-				variation,
-				originalImage.ExternalReference,
-				scenario,
-			)
 		}
 	})
 	if err != nil {
@@ -108,6 +109,12 @@ func GenerateAndInsertUniqueSearchImages(originalImage *image_handling.RawImage)
 	}
 }
 
+// logSkippedVariation logs a variation whose modification failed, it isn't inserted so that the search set only
+// contains images that were actually modified
+func logSkippedVariation(originalReference string, scenario string, err error) {
+	log.Println("Skipping", scenario, "variation of", originalReference+":", err)
+}
+
 func insertUniqueSearchImage(
 	databaseConnection *sql.DB,
 	uniqueVariation *image_handling.ImageVariation,
@@ -116,15 +123,21 @@ func insertUniqueSearchImage(
 ) {
 	externalReference := fmt.Sprintf("%s-%s-%s", originalReference, scenario, uniqueVariation.ModificationInfo)
 
+	err := createVariationDirectory(scenario)
+	if err != nil {
+		log.Println("Failed to create directory for searchImages: ", err)
+		return
+	}
 	image_handling.SaveImageToDisk(fmt.Sprintf("images/variations/%s/%s", scenario, externalReference), uniqueVariation.ModifiedImage)
 
-	err := image_database.InsertImageIntoSearchSet(
+	err = image_database.InsertImageIntoSearchSet(
 		databaseConnection,
 		image_database.SearchImageCreation{
 			ExternalReference: externalReference,
 			OriginalReference: "",
 			Scenario:          scenario,
-			ModificationInfo:  uniqueVariation.ModificationInfo,
+			Notes:             image_handling.EncodeVariationMetadata(uniqueVariation.Metadata()),
+			SpecHash:          uniqueVariation.SpecHash,
 		},
 	)
 	if err != nil {
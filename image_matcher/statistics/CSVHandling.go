@@ -2,14 +2,28 @@ package statistics
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"image_matcher/image_analyzer"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
-	"time"
 )
 
+const DefaultCSVOutputDirectory = "test-output/csv-files"
+
+var csvOutputDirectory = DefaultCSVOutputDirectory
+
+// SetCSVOutputDirectory changes the directory the evaluations are written to, e.g. the directory of an experiment
+func SetCSVOutputDirectory(directory string) {
+	csvOutputDirectory = directory
+}
+
+func CSVOutputDirectory() string {
+	return csvOutputDirectory
+}
+
 type SearchImagePHashEval struct {
 	Threshold         string
 	ExternalReference string
@@ -40,40 +54,74 @@ func WriteOverallEvalToCSV(
 	analyzer string,
 	matcher string,
 	threshold string,
+	specHash string,
 	classEval *ClassificationEvaluation,
-	extractionTime time.Duration,
-	matchingTime time.Duration,
+	latencies *LatencyDistribution,
 ) {
-	data := [][]string{
-		{
-			"threshold", "tp", "tn", "fp", "fn", "recall", "specificity",
-			"balanced accuracy", "extraction time", "matching time",
-		},
-		{
-			threshold,
-			strconv.Itoa(classEval.TP),
-			strconv.Itoa(classEval.TN),
-			strconv.Itoa(classEval.FP),
-			strconv.Itoa(classEval.FN),
-			fmt.Sprintf("%.2f", classEval.Recall()),
-			fmt.Sprintf("%.2f", classEval.Specificity()),
-			fmt.Sprintf("%.2f", classEval.BalancedAccuracy()),
-			extractionTime.String(),
-			matchingTime.String(),
-		},
+	header := []string{
+		"threshold", "tp", "tn", "fp", "fn", "recall", "specificity",
+		"balanced accuracy", "extraction time", "matching time", "spec hash",
 	}
-	var filename string
-	if analyzer == image_analyzer.PHASH {
-		filename = fmt.Sprintf("%s/%s-overall-evaluation", analyzer, scenario)
-	} else {
-		filename = fmt.Sprintf("%s/%s-%s-overall-evaluation", analyzer, scenario, matcher)
+	row := []string{
+		threshold,
+		strconv.Itoa(classEval.TP),
+		strconv.Itoa(classEval.TN),
+		strconv.Itoa(classEval.FP),
+		strconv.Itoa(classEval.FN),
+		fmt.Sprintf("%.2f", classEval.Recall()),
+		fmt.Sprintf("%.2f", classEval.Specificity()),
+		fmt.Sprintf("%.2f", classEval.BalancedAccuracy()),
+		latencies.Total(ExtractionStage, CachedExtractionStage).String(),
+		latencies.Total(latencies.MatchingStages()...).String(),
+		specHash,
+	}
+
+	for _, stage := range latencies.Stages() {
+		summary := latencies.Summarize(stage)
+		header = append(
+			header, stage+" mean", stage+" p50", stage+" p90", stage+" p95", stage+" p99", stage+" max",
+		)
+		row = append(
+			row,
+			summary.Mean.String(),
+			summary.P50.String(),
+			summary.P90.String(),
+			summary.P95.String(),
+			summary.P99.String(),
+			summary.Max.String(),
+		)
 	}
+
+	intervals := classEval.ConfidenceIntervals()
+	header = append(
+		header,
+		"recall ci lower", "recall ci upper", "specificity ci lower", "specificity ci upper",
+		"balanced accuracy ci lower", "balanced accuracy ci upper",
+	)
+	row = append(
+		row,
+		fmt.Sprintf("%.4f", intervals.Recall.Lower),
+		fmt.Sprintf("%.4f", intervals.Recall.Upper),
+		fmt.Sprintf("%.4f", intervals.Specificity.Lower),
+		fmt.Sprintf("%.4f", intervals.Specificity.Upper),
+		fmt.Sprintf("%.4f", intervals.BalancedAccuracy.Lower),
+		fmt.Sprintf("%.4f", intervals.BalancedAccuracy.Upper),
+	)
+
+	data := [][]string{header, row}
 	appendToCSV(
-		filename,
+		evaluationFileName(scenario, analyzer, matcher, "overall-evaluation"),
 		&data,
 	)
 }
 
+func evaluationFileName(scenario string, analyzer string, matcher string, evaluationType string) string {
+	if analyzer == image_analyzer.PHASH {
+		return fmt.Sprintf("%s/%s-%s", analyzer, scenario, evaluationType)
+	}
+	return fmt.Sprintf("%s/%s-%s-%s", analyzer, scenario, matcher, evaluationType)
+}
+
 func WriteHybridImageEvalToCSV(scenario string, imageEval SearchImageHybridEval) {
 	data := [][]string{
 		{"image reference", "classification", "pool size", "extraction time", "matching time"},
@@ -88,7 +136,7 @@ func WriteHybridImageEvalToCSV(scenario string, imageEval SearchImageHybridEval)
 			imageEval.MatchingTime,
 		},
 	)
-	appendToCSV(fmt.Sprintf("hybrid/%s-detail-evaluation", scenario), &data)
+	appendToCSV(detailEvaluationFileName(scenario, hybridAnalyzer, ""), &data)
 }
 
 func WritePHashImageEvalToCSV(scenario string, imageEvaluations *[]SearchImagePHashEval) {
@@ -107,7 +155,7 @@ func WritePHashImageEvalToCSV(scenario string, imageEvaluations *[]SearchImagePH
 			},
 		)
 	}
-	appendToCSV(fmt.Sprintf("phash/%s-detail-evaluation", scenario), &data)
+	appendToCSV(detailEvaluationFileName(scenario, image_analyzer.PHASH, ""), &data)
 }
 
 func WriteFeatureBasedImageEvalToCSV(
@@ -118,6 +166,7 @@ func WriteFeatureBasedImageEvalToCSV(
 ) {
 	data := [][]string{
 		{
+			"threshold",
 			"image reference",
 			"classification",
 			"number of descriptors",
@@ -138,19 +187,27 @@ func WriteFeatureBasedImageEvalToCSV(
 			},
 		)
 	}
-	appendToCSV(
-		fmt.Sprintf("%s/%s-%s-detail-evaluation", analyzer, scenario, matcher),
-		&data,
-	)
+	appendToCSV(detailEvaluationFileName(scenario, analyzer, matcher), &data)
 }
 
 func appendToCSV(fileName string, data *[][]string) {
-	filePath := "test-output/csv-files/" + fileName + ".csv"
-	_, err := os.Stat(filePath)
+	filePath := filepath.Join(csvOutputDirectory, fileName+".csv")
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		log.Fatal("Error creating csv directory", err)
+	}
+	_, err = os.Stat(filePath)
 
 	fileExists := err == nil
 	err = nil
 
+	if fileExists && len(*data) > 0 {
+		err = migrateCSVHeader(filePath, (*data)[0])
+		if err != nil {
+			log.Fatal("Error migrating csv", err)
+		}
+	}
+
 	var file *os.File
 	if fileExists {
 		file, err = os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
@@ -158,7 +215,7 @@ func appendToCSV(fileName string, data *[][]string) {
 			log.Fatal("Error writing csv", err)
 		}
 	} else {
-		file, err = os.Create("test-output/csv-files/" + fileName + ".csv")
+		file, err = os.Create(filePath)
 		if err != nil {
 			log.Fatal("Error writing csv", err)
 		}
@@ -178,3 +235,163 @@ func appendToCSV(fileName string, data *[][]string) {
 		}
 	}
 }
+
+// DetailEvaluationRows returns the number of rows of the detail evaluation csv including its header, 0 if it doesn't
+// exist yet
+func DetailEvaluationRows(scenario string, analyzer string, matcher string) (int, error) {
+	filePath := filepath.Join(csvOutputDirectory, detailEvaluationFileName(scenario, analyzer, matcher)+".csv")
+	rows, err := readCSVRows(filePath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// TruncateDetailEvaluation removes the rows after the first rows of the detail evaluation csv, the rows a resumed
+// scenario run appended after its last checkpoint
+func TruncateDetailEvaluation(scenario string, analyzer string, matcher string, rows int) error {
+	filePath := filepath.Join(csvOutputDirectory, detailEvaluationFileName(scenario, analyzer, matcher)+".csv")
+	existingRows, err := readCSVRows(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(existingRows) <= rows {
+		return nil
+	}
+	if rows == 0 {
+		return os.Remove(filePath)
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	csvWriter := csv.NewWriter(file)
+	err = csvWriter.WriteAll(existingRows[:rows])
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't truncate csv %s: %s", filePath, err.Error()))
+	}
+	return nil
+}
+
+func readCSVRows(filePath string) ([][]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read csv %s: %s", filePath, err.Error()))
+	}
+	return rows, nil
+}
+
+// migrateCSVHeader rewrites an existing csv whose header differs from the header of the new rows. Rows of the same
+// length as the old header are mapped to the new columns by name, so that columns added to an evaluation, like the
+// latency and confidence interval columns, don't shift the rows of earlier runs. Rows of the length of the new header
+// are kept as they are. Rows of any other length were appended under a header they don't match, they are kept as well
+// but counted in the log, since their columns can't be mapped by name.
+func migrateCSVHeader(filePath string, header []string) error {
+	rows, err := readCSVRows(filePath)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 || equalRows(rows[0], header) {
+		return nil
+	}
+
+	oldHeader := rows[0]
+	migratedRows := [][]string{header}
+	unmappedRows := 0
+	for _, row := range rows[1:] {
+		if len(row) != len(oldHeader) {
+			if len(row) != len(header) {
+				unmappedRows++
+			}
+			migratedRows = append(migratedRows, row)
+			continue
+		}
+		values := make(map[string]string)
+		for index, column := range oldHeader {
+			values[column] = row[index]
+		}
+		migratedRow := make([]string, len(header))
+		for index, column := range header {
+			migratedRow[index] = values[column]
+		}
+		migratedRows = append(migratedRows, migratedRow)
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	csvWriter := csv.NewWriter(file)
+	err = csvWriter.WriteAll(migratedRows)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't rewrite csv %s: %s", filePath, err.Error()))
+	}
+	log.Println("Migrated the columns of", filePath)
+	if unmappedRows > 0 {
+		log.Println(unmappedRows, "rows of", filePath, "don't match the old or the new header and are kept unmapped")
+	}
+	return nil
+}
+
+func equalRows(first []string, second []string) bool {
+	if len(first) != len(second) {
+		return false
+	}
+	for index := range first {
+		if first[index] != second[index] {
+			return false
+		}
+	}
+	return true
+}
+
+// readCSV returns every row after the header as a map from column name to value
+func readCSV(filePath string) (*[]map[string]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read csv %s: %s", filePath, err.Error()))
+	}
+
+	var records []map[string]string
+	if len(rows) == 0 {
+		return &records, nil
+	}
+
+	header := rows[0]
+	for _, row := range rows[1:] {
+		record := make(map[string]string)
+		for index, column := range header {
+			if index < len(row) {
+				record[column] = row[index]
+			}
+		}
+		records = append(records, record)
+	}
+	return &records, nil
+}
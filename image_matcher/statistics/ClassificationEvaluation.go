@@ -4,6 +4,10 @@ import "fmt"
 
 type ClassificationEvaluation struct {
 	TP, TN, FP, FN int
+	// intervals are the confidence intervals of the counts in intervalCounts, the bootstrap is only repeated when the
+	// counts changed
+	intervals      *MetricIntervals
+	intervalCounts [4]int
 }
 
 func (c *ClassificationEvaluation) Recall() float64 {
@@ -42,16 +46,21 @@ func (c *ClassificationEvaluation) EvaluateClassification(matchedRefs *[]string,
 	return ""
 }
 
+// String contains the metrics with their bootstrap confidence intervals
 func (c *ClassificationEvaluation) String() string {
+	intervals := c.ConfidenceIntervals()
 	return fmt.Sprintf(
-		"TP: %d, FP: %d, TN: %d, FN: %d, Recall: %.2f, Specificity: %.2f, balanced-acc: %.2f",
+		"TP: %d, FP: %d, TN: %d, FN: %d, Recall: %.2f %s, Specificity: %.2f %s, balanced-acc: %.2f %s",
 		c.TP,
 		c.FP,
 		c.TN,
 		c.FN,
 		c.Recall(),
+		intervals.Recall.String(),
 		c.Specificity(),
+		intervals.Specificity.String(),
 		c.BalancedAccuracy(),
+		intervals.BalancedAccuracy.String(),
 	)
 }
 
@@ -0,0 +1,100 @@
+package statistics
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+const BootstrapIterations = 1000
+
+const ConfidenceLevel = 0.95
+
+// the bootstrap is seeded, so that the same counts always yield the same intervals
+const bootstrapSeed = 1
+
+type ConfidenceInterval struct {
+	Lower float64
+	Upper float64
+}
+
+// MetricIntervals are the confidence intervals of the metrics of a classification evaluation
+type MetricIntervals struct {
+	Recall           ConfidenceInterval
+	Specificity      ConfidenceInterval
+	BalancedAccuracy ConfidenceInterval
+}
+
+func (i ConfidenceInterval) String() string {
+	return fmt.Sprintf("[%.2f, %.2f]", i.Lower, i.Upper)
+}
+
+// ConfidenceIntervals are the percentile bootstrap intervals of the metrics at the confidence level, they are
+// computed once per counts
+func (c *ClassificationEvaluation) ConfidenceIntervals() MetricIntervals {
+	counts := [4]int{c.TP, c.TN, c.FP, c.FN}
+	if c.intervals == nil || c.intervalCounts != counts {
+		intervals := c.Bootstrap(BootstrapIterations, rand.New(rand.NewSource(bootstrapSeed)))
+		c.intervals = &intervals
+		c.intervalCounts = counts
+	}
+	return *c.intervals
+}
+
+// Bootstrap resamples the search images with replacement. The metrics only depend on the number of search images per
+// class, so a resample draws the class of every search image from the observed class frequencies. The search images
+// with and without original are resampled separately with their observed counts, so that every resample has as many
+// positives and negatives as the evaluation and recall and specificity aren't computed from empty resamples.
+func (c *ClassificationEvaluation) Bootstrap(iterations int, random *rand.Rand) MetricIntervals {
+	total := c.TP + c.TN + c.FP + c.FN
+	if total == 0 || iterations <= 0 {
+		recall, specificity, balancedAccuracy := c.Recall(), c.Specificity(), c.BalancedAccuracy()
+		return MetricIntervals{
+			Recall:           ConfidenceInterval{Lower: recall, Upper: recall},
+			Specificity:      ConfidenceInterval{Lower: specificity, Upper: specificity},
+			BalancedAccuracy: ConfidenceInterval{Lower: balancedAccuracy, Upper: balancedAccuracy},
+		}
+	}
+
+	recalls := make([]float64, iterations)
+	specificities := make([]float64, iterations)
+	balancedAccuracies := make([]float64, iterations)
+	for iteration := 0; iteration < iterations; iteration++ {
+		var resample ClassificationEvaluation
+		resample.TP, resample.FN = resampleStratum(c.TP, c.FN, random)
+		resample.TN, resample.FP = resampleStratum(c.TN, c.FP, random)
+		recalls[iteration] = resample.Recall()
+		specificities[iteration] = resample.Specificity()
+		balancedAccuracies[iteration] = resample.BalancedAccuracy()
+	}
+
+	return MetricIntervals{
+		Recall:           percentileInterval(recalls),
+		Specificity:      percentileInterval(specificities),
+		BalancedAccuracy: percentileInterval(balancedAccuracies),
+	}
+}
+
+// resampleStratum draws as many search images as the stratum has and returns how many of them were correct
+// and incorrect
+func resampleStratum(correct int, incorrect int, random *rand.Rand) (int, int) {
+	size := correct + incorrect
+	resampledCorrect := 0
+	for draw := 0; draw < size; draw++ {
+		if random.Intn(size) < correct {
+			resampledCorrect++
+		}
+	}
+	return resampledCorrect, size - resampledCorrect
+}
+
+func percentileInterval(values []float64) ConfidenceInterval {
+	sort.Float64s(values)
+	tail := (1 - ConfidenceLevel) / 2
+	lowerIndex := int(tail * float64(len(values)))
+	upperIndex := int((1-tail)*float64(len(values))) - 1
+	if upperIndex < lowerIndex {
+		upperIndex = lowerIndex
+	}
+	return ConfidenceInterval{Lower: values[lowerIndex], Upper: values[upperIndex]}
+}
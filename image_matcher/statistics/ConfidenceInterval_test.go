@@ -0,0 +1,78 @@
+package statistics
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestBootstrapContainsPointEstimate(t *testing.T) {
+	tests := []struct {
+		name       string
+		evaluation ClassificationEvaluation
+	}{
+		{"balanced", ClassificationEvaluation{TP: 40, FN: 10, TN: 45, FP: 5}},
+		{"perfect", ClassificationEvaluation{TP: 20, TN: 20}},
+		{"few positives", ClassificationEvaluation{TP: 1, FN: 1, TN: 90, FP: 8}},
+		{"no negatives", ClassificationEvaluation{TP: 30, FN: 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			intervals := test.evaluation.Bootstrap(BootstrapIterations, rand.New(rand.NewSource(bootstrapSeed)))
+			assertContains(t, "recall", intervals.Recall, test.evaluation.Recall())
+			assertContains(t, "specificity", intervals.Specificity, test.evaluation.Specificity())
+			assertContains(t, "balanced accuracy", intervals.BalancedAccuracy, test.evaluation.BalancedAccuracy())
+		})
+	}
+}
+
+func TestBootstrapKeepsStrata(t *testing.T) {
+	// with a single positive the recall of every resample is 0 or 1, and the specificity is never computed from an
+	// empty resample of the negatives
+	evaluation := ClassificationEvaluation{TP: 1, TN: 0, FP: 50}
+	intervals := evaluation.Bootstrap(BootstrapIterations, rand.New(rand.NewSource(bootstrapSeed)))
+	if intervals.Recall.Lower != 1 || intervals.Recall.Upper != 1 {
+		t.Errorf("recall interval %s, want [1.00, 1.00]", intervals.Recall)
+	}
+	if intervals.Specificity.Lower != 0 || intervals.Specificity.Upper != 0 {
+		t.Errorf("specificity interval %s, want [0.00, 0.00]", intervals.Specificity)
+	}
+}
+
+func TestBootstrapIsDeterministic(t *testing.T) {
+	evaluation := ClassificationEvaluation{TP: 12, FN: 7, TN: 30, FP: 4}
+	first := evaluation.Bootstrap(BootstrapIterations, rand.New(rand.NewSource(bootstrapSeed)))
+	second := evaluation.Bootstrap(BootstrapIterations, rand.New(rand.NewSource(bootstrapSeed)))
+	if first != second {
+		t.Errorf("bootstrap with the same seed returned %+v and %+v", first, second)
+	}
+}
+
+func TestBootstrapWithoutSearchImages(t *testing.T) {
+	var evaluation ClassificationEvaluation
+	intervals := evaluation.Bootstrap(BootstrapIterations, rand.New(rand.NewSource(bootstrapSeed)))
+	point := ConfidenceInterval{Lower: 1, Upper: 1}
+	if intervals.Recall != point || intervals.Specificity != point || intervals.BalancedAccuracy != point {
+		t.Errorf("intervals without search images %+v, want the point estimates", intervals)
+	}
+}
+
+func TestConfidenceIntervalsFollowCounts(t *testing.T) {
+	evaluation := ClassificationEvaluation{TP: 5, FN: 5, TN: 10}
+	before := evaluation.ConfidenceIntervals()
+	if cached := evaluation.ConfidenceIntervals(); cached != before {
+		t.Errorf("repeated intervals %+v differ from %+v", cached, before)
+	}
+
+	evaluation.TP, evaluation.FN = 10, 0
+	after := evaluation.ConfidenceIntervals()
+	if after.Recall.Lower != 1 || after.Recall.Upper != 1 {
+		t.Errorf("recall interval %s after the counts changed, want [1.00, 1.00]", after.Recall)
+	}
+}
+
+func assertContains(t *testing.T, metric string, interval ConfidenceInterval, value float64) {
+	t.Helper()
+	if interval.Lower > value || interval.Upper < value {
+		t.Errorf("%s interval %s doesn't contain %.2f", metric, interval, value)
+	}
+}
@@ -0,0 +1,51 @@
+package statistics
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CountSummary summarizes a distribution of counts, e.g. the number of descriptors per image
+type CountSummary struct {
+	Count int
+	Mean  float64
+	Min   int
+	P10   int
+	P50   int
+	P90   int
+	P99   int
+	Max   int
+}
+
+func SummarizeCounts(counts []int) CountSummary {
+	if len(counts) == 0 {
+		return CountSummary{}
+	}
+
+	sorted := make([]int, len(counts))
+	copy(sorted, counts)
+	sort.Ints(sorted)
+
+	total := 0
+	for _, count := range sorted {
+		total += count
+	}
+
+	return CountSummary{
+		Count: len(sorted),
+		Mean:  float64(total) / float64(len(sorted)),
+		Min:   sorted[0],
+		P10:   percentile(sorted, 10),
+		P50:   percentile(sorted, 50),
+		P90:   percentile(sorted, 90),
+		P99:   percentile(sorted, 99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+func (s CountSummary) String() string {
+	return fmt.Sprintf(
+		"n: %d, mean: %.1f, min: %d, p10: %d, p50: %d, p90: %d, p99: %d, max: %d",
+		s.Count, s.Mean, s.Min, s.P10, s.P50, s.P90, s.P99, s.Max,
+	)
+}
@@ -0,0 +1,573 @@
+package statistics
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"image_matcher/image_analyzer"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const overallEvaluationSuffix = "-overall-evaluation.csv"
+
+const hybridAnalyzer = "hybrid"
+
+// thresholds used for the scenario comparison charts, all other configurations fall back to their best threshold
+var standardThresholds = map[string]float64{
+	image_analyzer.PHASH: 4,
+	hybridAnalyzer:       0,
+}
+
+const standardFeatureBasedThreshold = 0.4
+
+type OverallEvaluation struct {
+	Scenario       string
+	Analyzer       string
+	Matcher        string
+	Threshold      float64
+	ThresholdLabel string
+	ClassEval      ClassificationEvaluation
+	ExtractionTime time.Duration
+	MatchingTime   time.Duration
+	// SpecHash identifies the variation specs the search images were generated from
+	SpecHash string
+	// per image latency summaries per stage, only available for runs that recorded latency distributions
+	Latencies map[string]LatencySummary
+	// Intervals are read from the csv file, they are only bootstrapped for files without confidence interval columns
+	Intervals MetricIntervals
+}
+
+func (e *OverallEvaluation) Configuration() string {
+	if e.Matcher == "" || e.Matcher == e.Analyzer {
+		return e.Analyzer
+	}
+	return e.Analyzer + "-" + e.Matcher
+}
+
+func (e *OverallEvaluation) NumberOfImages() int {
+	return e.ClassEval.TP + e.ClassEval.TN + e.ClassEval.FP + e.ClassEval.FN
+}
+
+func (e *OverallEvaluation) AverageExtractionTime() time.Duration {
+	if e.NumberOfImages() == 0 {
+		return 0
+	}
+	return e.ExtractionTime / time.Duration(e.NumberOfImages())
+}
+
+func (e *OverallEvaluation) AverageMatchingTime() time.Duration {
+	if e.NumberOfImages() == 0 {
+		return 0
+	}
+	return e.MatchingTime / time.Duration(e.NumberOfImages())
+}
+
+// LoadOverallEvaluations reads all overall evaluation csv files written by WriteOverallEvalToCSV.
+// Runs that were repeated for the same threshold are appended to the same file, only the latest row is kept.
+func LoadOverallEvaluations(csvDirectory string) (*[]OverallEvaluation, error) {
+	var evaluations []OverallEvaluation
+
+	analyzerDirectories, err := os.ReadDir(csvDirectory)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read csv directory %s: %s", csvDirectory, err.Error()))
+	}
+
+	for _, analyzerDirectory := range analyzerDirectories {
+		if !analyzerDirectory.IsDir() {
+			continue
+		}
+		analyzer := analyzerDirectory.Name()
+
+		files, err := filepath.Glob(filepath.Join(csvDirectory, analyzer, "*"+overallEvaluationSuffix))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			scenario, matcher := parseOverallEvaluationFileName(filepath.Base(file), analyzer)
+
+			records, err := readCSV(file)
+			if err != nil {
+				return nil, err
+			}
+
+			latestPerThreshold := make(map[string]OverallEvaluation)
+			var thresholdOrder []string
+			for _, record := range *records {
+				evaluation, err := parseOverallEvaluationRecord(record)
+				if err != nil {
+					continue
+				}
+				evaluation.Scenario = scenario
+				evaluation.Analyzer = analyzer
+				evaluation.Matcher = matcher
+
+				if _, exists := latestPerThreshold[evaluation.ThresholdLabel]; !exists {
+					thresholdOrder = append(thresholdOrder, evaluation.ThresholdLabel)
+				}
+				latestPerThreshold[evaluation.ThresholdLabel] = *evaluation
+			}
+
+			for _, threshold := range thresholdOrder {
+				evaluations = append(evaluations, latestPerThreshold[threshold])
+			}
+		}
+	}
+
+	sort.SliceStable(evaluations, func(i, j int) bool {
+		return evaluations[i].Threshold < evaluations[j].Threshold
+	})
+
+	return &evaluations, nil
+}
+
+// parseOverallEvaluationFileName splits the file name into the scenario and the matcher. The matcher follows the last
+// "-" before the similarity formula, which is appended with "+" and can contain "-" itself, e.g. bfm+match-ratio.
+func parseOverallEvaluationFileName(fileName string, analyzer string) (string, string) {
+	name := strings.TrimSuffix(fileName, overallEvaluationSuffix)
+	if analyzer == image_analyzer.PHASH {
+		return name, ""
+	}
+	formulaIndex := strings.Index(name, "+")
+	if formulaIndex < 0 {
+		formulaIndex = len(name)
+	}
+	separatorIndex := strings.LastIndex(name[:formulaIndex], "-")
+	if separatorIndex < 0 {
+		return name, ""
+	}
+	return name[:separatorIndex], name[separatorIndex+1:]
+}
+
+func parseOverallEvaluationRecord(record map[string]string) (*OverallEvaluation, error) {
+	threshold, err := strconv.ParseFloat(record["threshold"], 64)
+	if err != nil {
+		return nil, err
+	}
+
+	var evaluation = OverallEvaluation{Threshold: threshold, ThresholdLabel: record["threshold"]}
+
+	counts := []*int{&evaluation.ClassEval.TP, &evaluation.ClassEval.TN, &evaluation.ClassEval.FP, &evaluation.ClassEval.FN}
+	for index, column := range []string{"tp", "tn", "fp", "fn"} {
+		*counts[index], err = strconv.Atoi(record[column])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	evaluation.ExtractionTime, _ = time.ParseDuration(record["extraction time"])
+	evaluation.MatchingTime, _ = time.ParseDuration(record["matching time"])
+	evaluation.SpecHash = record["spec hash"]
+
+	evaluation.Latencies = make(map[string]LatencySummary)
+	for _, stage := range latencyStages {
+		if _, exists := record[stage+" mean"]; !exists {
+			continue
+		}
+		var summary LatencySummary
+		summary.Mean, _ = time.ParseDuration(record[stage+" mean"])
+		summary.P50, _ = time.ParseDuration(record[stage+" p50"])
+		summary.P90, _ = time.ParseDuration(record[stage+" p90"])
+		summary.P95, _ = time.ParseDuration(record[stage+" p95"])
+		summary.P99, _ = time.ParseDuration(record[stage+" p99"])
+		summary.Max, _ = time.ParseDuration(record[stage+" max"])
+		evaluation.Latencies[stage] = summary
+	}
+
+	evaluation.Intervals, err = parseConfidenceIntervals(record)
+	if err != nil {
+		evaluation.Intervals = evaluation.ClassEval.ConfidenceIntervals()
+	}
+
+	return &evaluation, nil
+}
+
+func parseConfidenceIntervals(record map[string]string) (MetricIntervals, error) {
+	var intervals MetricIntervals
+	bounds := map[string]*float64{
+		"recall ci lower":            &intervals.Recall.Lower,
+		"recall ci upper":            &intervals.Recall.Upper,
+		"specificity ci lower":       &intervals.Specificity.Lower,
+		"specificity ci upper":       &intervals.Specificity.Upper,
+		"balanced accuracy ci lower": &intervals.BalancedAccuracy.Lower,
+		"balanced accuracy ci upper": &intervals.BalancedAccuracy.Upper,
+	}
+	for column, bound := range bounds {
+		var err error
+		*bound, err = strconv.ParseFloat(record[column], 64)
+		if err != nil {
+			return intervals, err
+		}
+	}
+	return intervals, nil
+}
+
+type reportChart struct {
+	Title string
+	Chart template.HTML
+}
+
+type reportTable struct {
+	Title string
+	Rows  []OverallEvaluation
+}
+
+type reportLatencyRow struct {
+	Configuration string
+	Scenario      string
+	Stage         string
+	Summary       LatencySummary
+}
+
+type reportData struct {
+	GeneratedAt     string
+	Summary         []reportChart
+	Timing          []reportChart
+	Latencies       []reportLatencyRow
+	ThresholdCurves []reportChart
+	Tables          []reportTable
+	Significance    []ConfigurationComparison
+}
+
+// WriteHTMLReport renders a self-contained html page with svg charts for the given evaluations.
+// scenarioOrder defines the order of the scenarios on the x-axis, unknown scenarios are appended. The detail
+// evaluations in the csv directory are used to test the differences between the configurations for significance.
+func WriteHTMLReport(
+	evaluations *[]OverallEvaluation, scenarioOrder []string, csvDirectory string, outputPath string,
+) error {
+	if len(*evaluations) == 0 {
+		return errors.New("no evaluations found to generate a report from")
+	}
+
+	scenarios := orderScenarios(evaluations, scenarioOrder)
+	configurations := collectConfigurations(evaluations)
+	standardEvaluations := selectStandardEvaluations(evaluations)
+
+	data := reportData{GeneratedAt: time.Now().Format(time.RFC1123)}
+
+	metrics := []struct {
+		name  string
+		value func(evaluation *OverallEvaluation) float64
+	}{
+		{"Recall", func(e *OverallEvaluation) float64 { return e.ClassEval.Recall() }},
+		{"Specificity", func(e *OverallEvaluation) float64 { return e.ClassEval.Specificity() }},
+		{"Balanced accuracy", func(e *OverallEvaluation) float64 { return e.ClassEval.BalancedAccuracy() }},
+	}
+
+	for _, metric := range metrics {
+		var series []chartSeries
+		for index, configuration := range configurations {
+			values := make([]float64, len(scenarios))
+			for scenarioIndex, scenario := range scenarios {
+				values[scenarioIndex] = math.NaN()
+				if evaluation, exists := standardEvaluations[configuration][scenario]; exists {
+					values[scenarioIndex] = metric.value(&evaluation)
+				}
+			}
+			series = append(series, chartSeries{Name: configuration, Values: values, Color: chartColor(index)})
+		}
+		data.Summary = append(data.Summary, reportChart{
+			Title: metric.name,
+			Chart: renderBarChart(metric.name+" per scenario", metric.name, scenarios, series, 1),
+		})
+	}
+
+	timings := []struct {
+		name  string
+		value func(evaluation *OverallEvaluation) time.Duration
+	}{
+		{"Extraction time", func(e *OverallEvaluation) time.Duration { return e.AverageExtractionTime() }},
+		{"Matching time", func(e *OverallEvaluation) time.Duration { return e.AverageMatchingTime() }},
+	}
+
+	for _, timing := range timings {
+		var series []chartSeries
+		maxValue := 0.0
+		for index, configuration := range configurations {
+			values := make([]float64, len(scenarios))
+			for scenarioIndex, scenario := range scenarios {
+				values[scenarioIndex] = math.NaN()
+				if evaluation, exists := standardEvaluations[configuration][scenario]; exists {
+					milliseconds := float64(timing.value(&evaluation)) / float64(time.Millisecond)
+					values[scenarioIndex] = milliseconds
+					maxValue = math.Max(maxValue, milliseconds)
+				}
+			}
+			series = append(series, chartSeries{Name: configuration, Values: values, Color: chartColor(index)})
+		}
+		data.Timing = append(data.Timing, reportChart{
+			Title: timing.name,
+			Chart: renderBarChart(
+				"Average "+strings.ToLower(timing.name)+" per image", "milliseconds", scenarios, series,
+				niceUpperBound(maxValue),
+			),
+		})
+	}
+
+	for _, configuration := range configurations {
+		for _, scenario := range scenarios {
+			evaluation, exists := standardEvaluations[configuration][scenario]
+			if !exists {
+				continue
+			}
+			for _, stage := range latencyStages {
+				if summary, recorded := evaluation.Latencies[stage]; recorded {
+					data.Latencies = append(data.Latencies, reportLatencyRow{
+						Configuration: configuration, Scenario: scenario, Stage: stage, Summary: summary,
+					})
+				}
+			}
+		}
+	}
+
+	for _, configuration := range configurations {
+		for _, scenario := range scenarios {
+			curve := filterEvaluations(evaluations, configuration, scenario)
+			if len(curve) == 0 {
+				continue
+			}
+
+			thresholds := make([]float64, len(curve))
+			recall := make([]float64, len(curve))
+			specificity := make([]float64, len(curve))
+			balancedAccuracy := make([]float64, len(curve))
+			for index, evaluation := range curve {
+				thresholds[index] = evaluation.Threshold
+				recall[index] = evaluation.ClassEval.Recall()
+				specificity[index] = evaluation.ClassEval.Specificity()
+				balancedAccuracy[index] = evaluation.ClassEval.BalancedAccuracy()
+			}
+
+			xLabel := "similarity score threshold"
+			if curve[0].Analyzer == image_analyzer.PHASH {
+				xLabel = "hamming distance threshold"
+			}
+
+			title := fmt.Sprintf("%s - %s", configuration, scenario)
+			data.ThresholdCurves = append(data.ThresholdCurves, reportChart{
+				Title: title,
+				Chart: renderLineChart(title, xLabel, "score", thresholds, []chartSeries{
+					{Name: "Recall", Values: recall, Color: chartColor(0)},
+					{Name: "Specificity", Values: specificity, Color: chartColor(1)},
+					{Name: "Balanced accuracy", Values: balancedAccuracy, Color: chartColor(2), Dashed: true},
+				}, 1),
+			})
+		}
+
+		var rows []OverallEvaluation
+		for _, scenario := range scenarios {
+			rows = append(rows, filterEvaluations(evaluations, configuration, scenario)...)
+		}
+		data.Tables = append(data.Tables, reportTable{Title: configuration, Rows: rows})
+	}
+
+	for _, scenario := range scenarios {
+		data.Significance = append(data.Significance, CompareConfigurations(evaluations, csvDirectory, scenario)...)
+	}
+
+	reportFile, err := os.Create(outputPath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't create report file %s: %s", outputPath, err.Error()))
+	}
+	defer reportFile.Close()
+
+	return reportTemplate.Execute(reportFile, data)
+}
+
+func orderScenarios(evaluations *[]OverallEvaluation, scenarioOrder []string) []string {
+	present := make(map[string]bool)
+	for _, evaluation := range *evaluations {
+		present[evaluation.Scenario] = true
+	}
+
+	var scenarios []string
+	for _, scenario := range scenarioOrder {
+		if present[scenario] {
+			scenarios = append(scenarios, scenario)
+			delete(present, scenario)
+		}
+	}
+
+	var remaining []string
+	for scenario := range present {
+		remaining = append(remaining, scenario)
+	}
+	sort.Strings(remaining)
+
+	return append(scenarios, remaining...)
+}
+
+func collectConfigurations(evaluations *[]OverallEvaluation) []string {
+	present := make(map[string]bool)
+	var configurations []string
+	for _, evaluation := range *evaluations {
+		configuration := evaluation.Configuration()
+		if !present[configuration] {
+			present[configuration] = true
+			configurations = append(configurations, configuration)
+		}
+	}
+	sort.Strings(configurations)
+	return configurations
+}
+
+func filterEvaluations(evaluations *[]OverallEvaluation, configuration string, scenario string) []OverallEvaluation {
+	var filtered []OverallEvaluation
+	for _, evaluation := range *evaluations {
+		if evaluation.Configuration() == configuration && evaluation.Scenario == scenario {
+			filtered = append(filtered, evaluation)
+		}
+	}
+	return filtered
+}
+
+// selectStandardEvaluations picks one evaluation per configuration and scenario. The standard threshold of the
+// analyzer is used if it was evaluated, otherwise the threshold with the highest balanced accuracy.
+func selectStandardEvaluations(evaluations *[]OverallEvaluation) map[string]map[string]OverallEvaluation {
+	selected := make(map[string]map[string]OverallEvaluation)
+
+	for _, evaluation := range *evaluations {
+		configuration := evaluation.Configuration()
+		if selected[configuration] == nil {
+			selected[configuration] = make(map[string]OverallEvaluation)
+		}
+
+		standardThreshold, exists := standardThresholds[evaluation.Analyzer]
+		if !exists {
+			standardThreshold = standardFeatureBasedThreshold
+		}
+
+		current, hasCurrent := selected[configuration][evaluation.Scenario]
+		if !hasCurrent {
+			selected[configuration][evaluation.Scenario] = evaluation
+			continue
+		}
+
+		currentIsStandard := math.Abs(current.Threshold-standardThreshold) < 1e-9
+		evaluationIsStandard := math.Abs(evaluation.Threshold-standardThreshold) < 1e-9
+		if currentIsStandard {
+			continue
+		}
+		if evaluationIsStandard || evaluation.ClassEval.BalancedAccuracy() > current.ClassEval.BalancedAccuracy() {
+			selected[configuration][evaluation.Scenario] = evaluation
+		}
+	}
+
+	return selected
+}
+
+func niceUpperBound(value float64) float64 {
+	if value <= 0 {
+		return 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(value)))
+	for _, step := range []float64{1, 2, 5, 10} {
+		if value <= step*magnitude {
+			return step * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+// shortHashes abbreviates the space separated spec hashes for the tables, the full hashes are shown on hover
+func shortHashes(hashes string) string {
+	var shortened []string
+	for _, hash := range strings.Fields(hashes) {
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		shortened = append(shortened, hash)
+	}
+	return strings.Join(shortened, " ")
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percentage":  func(value float64) string { return fmt.Sprintf("%.2f", value) },
+	"shortHashes": shortHashes,
+	"pValue":      func(value float64) string { return fmt.Sprintf("%.4f", value) },
+	"significant": func(value float64) bool { return value < 1-ConfidenceLevel },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Image matcher evaluation report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h2 { border-bottom: 1px solid #ccc; padding-bottom: 0.2em; margin-top: 2em; }
+.charts { display: flex; flex-wrap: wrap; gap: 1em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; font-size: 0.9em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.6em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<h1>Image matcher evaluation report</h1>
+<p>Generated at {{.GeneratedAt}}</p>
+
+<h2>Scenario comparison</h2>
+<div class="charts">{{range .Summary}}{{.Chart}}{{end}}</div>
+
+<h2>Timing comparison</h2>
+<div class="charts">{{range .Timing}}{{.Chart}}{{end}}</div>
+{{if .Latencies}}
+<h3>Latency distributions per image</h3>
+<table>
+<tr><th>configuration</th><th>scenario</th><th>stage</th><th>mean</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>max</th></tr>
+{{range .Latencies}}<tr>
+<td>{{.Configuration}}</td><td>{{.Scenario}}</td><td>{{.Stage}}</td><td>{{.Summary.Mean}}</td>
+<td>{{.Summary.P50}}</td><td>{{.Summary.P90}}</td><td>{{.Summary.P95}}</td><td>{{.Summary.P99}}</td><td>{{.Summary.Max}}</td>
+</tr>
+{{end}}</table>
+{{end}}
+
+<h2>Threshold curves</h2>
+<div class="charts">{{range .ThresholdCurves}}{{.Chart}}{{end}}</div>
+
+<h2>Results</h2>
+{{range .Tables}}
+<h3>{{.Title}}</h3>
+<table>
+<tr>
+<th>scenario</th><th>threshold</th><th>tp</th><th>tn</th><th>fp</th><th>fn</th>
+<th>recall</th><th>specificity</th><th>balanced accuracy</th>
+<th>recall ci</th><th>specificity ci</th><th>balanced accuracy ci</th><th>extraction time</th><th>matching time</th>
+<th>spec</th>
+</tr>
+{{range .Rows}}<tr>
+<td>{{.Scenario}}</td><td>{{.ThresholdLabel}}</td>
+<td>{{.ClassEval.TP}}</td><td>{{.ClassEval.TN}}</td><td>{{.ClassEval.FP}}</td><td>{{.ClassEval.FN}}</td>
+<td>{{percentage .ClassEval.Recall}}</td><td>{{percentage .ClassEval.Specificity}}</td>
+<td>{{percentage .ClassEval.BalancedAccuracy}}</td>
+{{with .Intervals}}<td>{{.Recall}}</td><td>{{.Specificity}}</td><td>{{.BalancedAccuracy}}</td>{{end}}
+<td>{{.ExtractionTime}}</td><td>{{.MatchingTime}}</td>
+<td title="{{.SpecHash}}">{{shortHashes .SpecHash}}</td>
+</tr>
+{{end}}</table>
+{{end}}
+<p>Confidence intervals are 95% percentile bootstrap intervals over the search images, the search images with and
+without original are resampled separately.</p>
+{{if .Significance}}
+<h2>Significance</h2>
+<p>McNemar's test between the configurations at the thresholds of the scenario comparison, on the search images both
+configurations classified. The exact binomial test is used for less than 25 discordant search images.</p>
+<table>
+<tr>
+<th>scenario</th><th>first</th><th>second</th><th>paired images</th><th>only first correct</th>
+<th>only second correct</th><th>p value</th><th>significant</th>
+</tr>
+{{range .Significance}}<tr>
+<td>{{.Scenario}}</td><td>{{.First}} ({{.FirstThreshold}})</td><td>{{.Second}} ({{.SecondThreshold}})</td>
+<td>{{.Result.PairedImages}}</td><td>{{.Result.FirstOnly}}</td><td>{{.Result.SecondOnly}}</td>
+<td>{{pValue .Result.PValue}}</td><td>{{if significant .Result.PValue}}yes{{else}}no{{end}}</td>
+</tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,136 @@
+package statistics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ExtractionStage = "extraction"
+	// CachedExtractionStage is the extraction of runs with the feature cache, its hits only measure the lookup, so it
+	// isn't comparable with the extraction of runs without cache
+	CachedExtractionStage = "cached extraction"
+	HashMatchStage        = "hash match"
+	PoolBuildStage        = "pool build"
+	DescriptorMatchStage  = "descriptor match"
+)
+
+// latencyStages are all stages in the order they are reported in
+var latencyStages = []string{
+	ExtractionStage, CachedExtractionStage, HashMatchStage, PoolBuildStage, DescriptorMatchStage,
+}
+
+// LatencyDistribution collects the per-image latencies of every stage of a scenario run
+type LatencyDistribution struct {
+	stages  []string
+	samples map[string][]time.Duration
+}
+
+type LatencySummary struct {
+	Count int
+	Total time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func NewLatencyDistribution(stages ...string) *LatencyDistribution {
+	return &LatencyDistribution{stages: stages, samples: make(map[string][]time.Duration)}
+}
+
+func (d *LatencyDistribution) Add(stage string, latency time.Duration) {
+	if !d.hasStage(stage) {
+		d.stages = append(d.stages, stage)
+	}
+	d.samples[stage] = append(d.samples[stage], latency)
+}
+
+func (d *LatencyDistribution) Stages() []string {
+	return d.stages
+}
+
+// Total sums the latencies of all given stages
+func (d *LatencyDistribution) Total(stages ...string) time.Duration {
+	var total time.Duration
+	for _, stage := range stages {
+		total += d.Summarize(stage).Total
+	}
+	return total
+}
+
+// MatchingStages returns all recorded stages except the extraction
+func (d *LatencyDistribution) MatchingStages() []string {
+	var matchingStages []string
+	for _, stage := range d.stages {
+		if stage != ExtractionStage && stage != CachedExtractionStage {
+			matchingStages = append(matchingStages, stage)
+		}
+	}
+	return matchingStages
+}
+
+func (d *LatencyDistribution) Summarize(stage string) LatencySummary {
+	samples := d.samples[stage]
+	if len(samples) == 0 {
+		return LatencySummary{}
+	}
+
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, sample := range sorted {
+		total += sample
+	}
+
+	return LatencySummary{
+		Count: len(sorted),
+		Total: total,
+		Mean:  total / time.Duration(len(sorted)),
+		P50:   percentile(sorted, 50),
+		P90:   percentile(sorted, 90),
+		P95:   percentile(sorted, 95),
+		P99:   percentile(sorted, 99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+func (d *LatencyDistribution) String() string {
+	var lines []string
+	for _, stage := range d.stages {
+		lines = append(lines, fmt.Sprintf("%s: %s", stage, d.Summarize(stage).String()))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s LatencySummary) String() string {
+	return fmt.Sprintf(
+		"n: %d, mean: %s, p50: %s, p90: %s, p95: %s, p99: %s, max: %s",
+		s.Count, s.Mean, s.P50, s.P90, s.P95, s.P99, s.Max,
+	)
+}
+
+func (d *LatencyDistribution) hasStage(stage string) bool {
+	for _, existingStage := range d.stages {
+		if existingStage == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// nearest-rank percentile of an ascending sorted slice, shared by the latency and the count distributions
+func percentile[Value any](sorted []Value, percent float64) Value {
+	rank := int(math.Ceil(percent / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
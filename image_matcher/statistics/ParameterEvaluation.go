@@ -0,0 +1,143 @@
+package statistics
+
+import (
+	"fmt"
+	"image_matcher/image_handling"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParameterEvaluation breaks the classifications of a scenario run down by the parameters of the modifications
+// that were applied to the search images
+type ParameterEvaluation struct {
+	evaluations map[parameterKey]*ClassificationEvaluation
+}
+
+type parameterKey struct {
+	Threshold string
+	Modifier  string
+	Parameter string
+	Value     string
+}
+
+func NewParameterEvaluation() *ParameterEvaluation {
+	return &ParameterEvaluation{evaluations: make(map[parameterKey]*ClassificationEvaluation)}
+}
+
+// Add counts the classification of a search image for every parameter of its modifications.
+// Search images without decodable metadata are skipped.
+func (p *ParameterEvaluation) Add(threshold string, notes string, classification string) {
+	metadata, err := image_handling.DecodeVariationMetadata(notes)
+	if err != nil {
+		return
+	}
+
+	for _, modification := range metadata.Modifications {
+		values := modification.Values()
+		if len(values) == 0 {
+			values = map[string]string{"parameters": "none"}
+		}
+		p.add(threshold, modification.Modifier, values, classification)
+	}
+	if metadata.HardNegative != nil {
+		p.add(threshold, "hard-negative", metadata.HardNegative.Values(), classification)
+	}
+}
+
+func (p *ParameterEvaluation) add(threshold string, modifier string, values map[string]string, classification string) {
+	for parameter, value := range values {
+		key := parameterKey{Threshold: threshold, Modifier: modifier, Parameter: parameter, Value: value}
+		evaluation, exists := p.evaluations[key]
+		if !exists {
+			evaluation = &ClassificationEvaluation{}
+			p.evaluations[key] = evaluation
+		}
+		evaluation.countClassification(classification)
+	}
+}
+
+func (p *ParameterEvaluation) WriteToCSV(scenario string, analyzer string, matcher string) {
+	data := [][]string{
+		{"threshold", "modifier", "parameter", "value", "tp", "tn", "fp", "fn", "recall", "specificity"},
+	}
+	for _, key := range p.sortedKeys() {
+		evaluation := p.evaluations[key]
+		data = append(data, []string{
+			key.Threshold,
+			key.Modifier,
+			key.Parameter,
+			key.Value,
+			strconv.Itoa(evaluation.TP),
+			strconv.Itoa(evaluation.TN),
+			strconv.Itoa(evaluation.FP),
+			strconv.Itoa(evaluation.FN),
+			fmt.Sprintf("%.2f", evaluation.Recall()),
+			fmt.Sprintf("%.2f", evaluation.Specificity()),
+		})
+	}
+	appendToCSV(evaluationFileName(scenario, analyzer, matcher, "parameter-evaluation"), &data)
+}
+
+// String lists the recall per parameter value for the given threshold
+func (p *ParameterEvaluation) String(threshold string) string {
+	var lines []string
+	for _, key := range p.sortedKeys() {
+		if key.Threshold != threshold {
+			continue
+		}
+		evaluation := p.evaluations[key]
+		if evaluation.TP+evaluation.FN == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(
+			"%s %s %s: recall %.2f (%d/%d)",
+			key.Modifier, key.Parameter, key.Value, evaluation.Recall(), evaluation.TP, evaluation.TP+evaluation.FN,
+		))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *ParameterEvaluation) sortedKeys() []parameterKey {
+	var keys []parameterKey
+	for key := range p.evaluations {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		first, second := keys[i], keys[j]
+		if first.Threshold != second.Threshold {
+			return first.Threshold < second.Threshold
+		}
+		if first.Modifier != second.Modifier {
+			return first.Modifier < second.Modifier
+		}
+		if first.Parameter != second.Parameter {
+			return first.Parameter < second.Parameter
+		}
+		return compareParameterValues(first.Value, second.Value)
+	})
+	return keys
+}
+
+// numeric parameter values and ranges are sorted by their (lower) value instead of lexicographically
+func compareParameterValues(first string, second string) bool {
+	firstNumber, firstErr := strconv.ParseFloat(strings.SplitN(first, "-", 2)[0], 64)
+	secondNumber, secondErr := strconv.ParseFloat(strings.SplitN(second, "-", 2)[0], 64)
+	if firstErr == nil && secondErr == nil {
+		return firstNumber < secondNumber
+	}
+	return first < second
+}
+
+func (c *ClassificationEvaluation) countClassification(classification string) {
+	switch classification {
+	case "true-positive":
+		c.TP++
+	case "true-negative":
+		c.TN++
+	case "false-positive":
+		c.FP++
+	case "false-negative":
+		c.FN++
+	}
+}
@@ -0,0 +1,202 @@
+package statistics
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strings"
+)
+
+const chartWidth = 720
+const chartHeight = 340
+const chartMarginLeft = 60
+const chartMarginRight = 20
+const chartMarginTop = 40
+const chartMarginBottom = 70
+
+var chartColors = []string{
+	"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf",
+}
+
+type chartSeries struct {
+	Name   string
+	Values []float64
+	Color  string
+	Dashed bool
+}
+
+// missing values are represented as NaN and are left out of the chart
+func renderBarChart(title string, yLabel string, categories []string, series []chartSeries, yMax float64) template.HTML {
+	var svg strings.Builder
+	plotWidth := float64(chartWidth - chartMarginLeft - chartMarginRight)
+	plotHeight := float64(chartHeight - chartMarginTop - chartMarginBottom)
+
+	writeChartFrame(&svg, title, yLabel, yMax)
+
+	if len(categories) > 0 && len(series) > 0 {
+		groupWidth := plotWidth / float64(len(categories))
+		barWidth := groupWidth * 0.8 / float64(len(series))
+
+		for categoryIndex, category := range categories {
+			groupStart := float64(chartMarginLeft) + float64(categoryIndex)*groupWidth + groupWidth*0.1
+
+			for seriesIndex, currentSeries := range series {
+				value := currentSeries.Values[categoryIndex]
+				if math.IsNaN(value) {
+					continue
+				}
+				barHeight := math.Max(0, value) / yMax * plotHeight
+				svg.WriteString(fmt.Sprintf(
+					`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s %s: %s</title></rect>`,
+					groupStart+float64(seriesIndex)*barWidth,
+					float64(chartMarginTop)+plotHeight-barHeight,
+					barWidth,
+					barHeight,
+					currentSeries.Color,
+					template.HTMLEscapeString(currentSeries.Name),
+					template.HTMLEscapeString(category),
+					formatChartValue(value),
+				))
+			}
+
+			svg.WriteString(fmt.Sprintf(
+				`<text x="%.1f" y="%d" font-size="11" text-anchor="end" transform="rotate(-35 %.1f %d)">%s</text>`,
+				groupStart+groupWidth*0.4,
+				chartMarginTop+int(plotHeight)+16,
+				groupStart+groupWidth*0.4,
+				chartMarginTop+int(plotHeight)+16,
+				template.HTMLEscapeString(category),
+			))
+		}
+	}
+
+	writeChartLegend(&svg, series)
+	svg.WriteString("</svg>")
+
+	return template.HTML(svg.String())
+}
+
+func renderLineChart(
+	title string, xLabel string, yLabel string, xValues []float64, series []chartSeries, yMax float64,
+) template.HTML {
+	var svg strings.Builder
+	plotWidth := float64(chartWidth - chartMarginLeft - chartMarginRight)
+	plotHeight := float64(chartHeight - chartMarginTop - chartMarginBottom)
+
+	writeChartFrame(&svg, title, yLabel, yMax)
+
+	if len(xValues) > 0 {
+		xMin, xMax := xValues[0], xValues[0]
+		for _, x := range xValues {
+			xMin = math.Min(xMin, x)
+			xMax = math.Max(xMax, x)
+		}
+		xRange := xMax - xMin
+		if xRange == 0 {
+			xRange = 1
+		}
+		xPosition := func(x float64) float64 {
+			return float64(chartMarginLeft) + (x-xMin)/xRange*plotWidth
+		}
+
+		for _, x := range xValues {
+			svg.WriteString(fmt.Sprintf(
+				`<text x="%.1f" y="%d" font-size="11" text-anchor="middle">%s</text>`,
+				xPosition(x),
+				chartMarginTop+int(plotHeight)+16,
+				formatChartValue(x),
+			))
+		}
+
+		for _, currentSeries := range series {
+			var points []string
+			for index, value := range currentSeries.Values {
+				if math.IsNaN(value) {
+					continue
+				}
+				points = append(points, fmt.Sprintf(
+					"%.1f,%.1f", xPosition(xValues[index]), float64(chartMarginTop)+plotHeight-value/yMax*plotHeight,
+				))
+			}
+			dashArray := ""
+			if currentSeries.Dashed {
+				dashArray = ` stroke-dasharray="6 4"`
+			}
+			svg.WriteString(fmt.Sprintf(
+				`<polyline points="%s" fill="none" stroke="%s" stroke-width="2"%s/>`,
+				strings.Join(points, " "),
+				currentSeries.Color,
+				dashArray,
+			))
+		}
+	}
+
+	svg.WriteString(fmt.Sprintf(
+		`<text x="%.1f" y="%d" font-size="12" text-anchor="middle">%s</text>`,
+		float64(chartMarginLeft)+plotWidth/2,
+		chartHeight-chartMarginBottom+36,
+		template.HTMLEscapeString(xLabel),
+	))
+	writeChartLegend(&svg, series)
+	svg.WriteString("</svg>")
+
+	return template.HTML(svg.String())
+}
+
+func writeChartFrame(svg *strings.Builder, title string, yLabel string, yMax float64) {
+	plotWidth := float64(chartWidth - chartMarginLeft - chartMarginRight)
+	plotHeight := float64(chartHeight - chartMarginTop - chartMarginBottom)
+
+	svg.WriteString(fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif">`,
+		chartWidth, chartHeight, chartWidth, chartHeight,
+	))
+	svg.WriteString(fmt.Sprintf(
+		`<text x="%d" y="20" font-size="15" text-anchor="middle">%s</text>`,
+		chartWidth/2,
+		template.HTMLEscapeString(title),
+	))
+
+	tickAmount := 5
+	for tick := 0; tick <= tickAmount; tick++ {
+		value := yMax * float64(tick) / float64(tickAmount)
+		y := float64(chartMarginTop) + plotHeight - float64(tick)/float64(tickAmount)*plotHeight
+		svg.WriteString(fmt.Sprintf(
+			`<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/>`,
+			chartMarginLeft, y, float64(chartMarginLeft)+plotWidth, y,
+		))
+		svg.WriteString(fmt.Sprintf(
+			`<text x="%d" y="%.1f" font-size="11" text-anchor="end">%s</text>`,
+			chartMarginLeft-6, y+4, formatChartValue(value),
+		))
+	}
+
+	svg.WriteString(fmt.Sprintf(
+		`<text x="14" y="%.1f" font-size="12" text-anchor="middle" transform="rotate(-90 14 %.1f)">%s</text>`,
+		float64(chartMarginTop)+plotHeight/2,
+		float64(chartMarginTop)+plotHeight/2,
+		template.HTMLEscapeString(yLabel),
+	))
+}
+
+func writeChartLegend(svg *strings.Builder, series []chartSeries) {
+	x := chartMarginLeft
+	for _, currentSeries := range series {
+		svg.WriteString(fmt.Sprintf(
+			`<rect x="%d" y="%d" width="10" height="10" fill="%s"/><text x="%d" y="%d" font-size="11">%s</text>`,
+			x, chartHeight-22, currentSeries.Color, x+14, chartHeight-13, template.HTMLEscapeString(currentSeries.Name),
+		))
+		x += 24 + 7*len(currentSeries.Name)
+	}
+}
+
+func formatChartValue(value float64) string {
+	if value == math.Trunc(value) {
+		return fmt.Sprintf("%.0f", value)
+	}
+	return fmt.Sprintf("%.2f", value)
+}
+
+func chartColor(index int) string {
+	return chartColors[index%len(chartColors)]
+}
@@ -0,0 +1,242 @@
+package statistics
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image_matcher/image_analyzer"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// below this number of discordant pairs the exact binomial test is used instead of the chi-squared approximation
+const exactMcNemarLimit = 25
+
+// McNemarResult compares the classifications of two configurations on the same search images. Only the search
+// images that one configuration classifies correctly and the other doesn't are evidence for a difference.
+type McNemarResult struct {
+	PairedImages int
+	BothCorrect  int
+	FirstOnly    int
+	SecondOnly   int
+	BothWrong    int
+	// Statistic is the continuity corrected chi-squared statistic, it isn't used by the exact test
+	Statistic float64
+	PValue    float64
+	Exact     bool
+}
+
+// ConfigurationComparison is the McNemar test between two configurations on a scenario
+type ConfigurationComparison struct {
+	Scenario        string
+	First           string
+	FirstThreshold  string
+	Second          string
+	SecondThreshold string
+	Result          McNemarResult
+}
+
+// McNemarTest pairs the classifications by the external reference of the search images, search images that were
+// only classified by one configuration are skipped
+func McNemarTest(first map[string]string, second map[string]string) McNemarResult {
+	var result McNemarResult
+	for reference, firstClassification := range first {
+		secondClassification, paired := second[reference]
+		if !paired {
+			continue
+		}
+		result.PairedImages++
+
+		firstCorrect := isCorrect(firstClassification)
+		secondCorrect := isCorrect(secondClassification)
+		switch {
+		case firstCorrect && secondCorrect:
+			result.BothCorrect++
+		case firstCorrect:
+			result.FirstOnly++
+		case secondCorrect:
+			result.SecondOnly++
+		default:
+			result.BothWrong++
+		}
+	}
+
+	discordant := result.FirstOnly + result.SecondOnly
+	if discordant == 0 {
+		result.PValue = 1
+		return result
+	}
+
+	difference := math.Abs(float64(result.FirstOnly-result.SecondOnly)) - 1
+	if difference < 0 {
+		difference = 0
+	}
+	result.Statistic = difference * difference / float64(discordant)
+
+	if discordant < exactMcNemarLimit {
+		result.Exact = true
+		result.PValue = exactBinomialPValue(discordant, minInt(result.FirstOnly, result.SecondOnly))
+	} else {
+		// survival function of the chi-squared distribution with one degree of freedom
+		result.PValue = math.Erfc(math.Sqrt(result.Statistic / 2))
+	}
+	return result
+}
+
+// exactBinomialPValue is the two-sided p-value of observing at most k successes in n trials with probability 0.5
+func exactBinomialPValue(n int, k int) float64 {
+	probability := 0.0
+	for successes := 0; successes <= k; successes++ {
+		probability += math.Exp(logBinomialCoefficient(n, successes) - float64(n)*math.Ln2)
+	}
+	return math.Min(1, 2*probability)
+}
+
+func logBinomialCoefficient(n int, k int) float64 {
+	logN, _ := math.Lgamma(float64(n + 1))
+	logK, _ := math.Lgamma(float64(k + 1))
+	logNK, _ := math.Lgamma(float64(n - k + 1))
+	return logN - logK - logNK
+}
+
+func isCorrect(classification string) bool {
+	return classification == "true-positive" || classification == "true-negative"
+}
+
+func minInt(first int, second int) int {
+	if first < second {
+		return first
+	}
+	return second
+}
+
+// LoadImageClassifications reads the classification of every search image at the threshold from the detail
+// evaluation csv of the configuration. Repeated runs are appended to the same file, the latest classification is kept.
+func LoadImageClassifications(
+	csvDirectory string, scenario string, analyzer string, matcher string, threshold string,
+) (map[string]string, error) {
+	filePath := filepath.Join(csvDirectory, detailEvaluationFileName(scenario, analyzer, matcher)+".csv")
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't open detail evaluation %s: %s", filePath, err.Error()))
+	}
+	defer file.Close()
+
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read csv %s: %s", filePath, err.Error()))
+	}
+
+	classifications := make(map[string]string)
+	for index, row := range rows {
+		if index == 0 {
+			continue
+		}
+		// the hybrid detail evaluation has no threshold column, its overall evaluation uses threshold 0
+		if analyzer == hybridAnalyzer && len(row) >= 2 {
+			if threshold == fmt.Sprintf("%.2f", 0.0) {
+				classifications[row[0]] = row[1]
+			}
+			continue
+		}
+		if len(row) >= 3 && row[0] == threshold {
+			classifications[row[1]] = row[2]
+		}
+	}
+	if len(classifications) == 0 {
+		return nil, errors.New(fmt.Sprintf("no classifications for threshold %s in %s", threshold, filePath))
+	}
+	return classifications, nil
+}
+
+// CompareConfigurations runs the McNemar test between every pair of configurations of the scenario. Every
+// configuration is compared at the threshold that is shown in the report.
+func CompareConfigurations(
+	evaluations *[]OverallEvaluation, csvDirectory string, scenario string,
+) []ConfigurationComparison {
+	standardEvaluations := selectStandardEvaluations(evaluations)
+	var scenarioEvaluations []OverallEvaluation
+	var classifications []map[string]string
+	for _, configuration := range collectConfigurations(evaluations) {
+		evaluation, exists := standardEvaluations[configuration][scenario]
+		if !exists {
+			continue
+		}
+		imageClassifications, err := LoadImageClassifications(
+			csvDirectory, scenario, evaluation.Analyzer, evaluation.Matcher, evaluation.ThresholdLabel,
+		)
+		if err != nil {
+			continue
+		}
+		scenarioEvaluations = append(scenarioEvaluations, evaluation)
+		classifications = append(classifications, imageClassifications)
+	}
+
+	var comparisons []ConfigurationComparison
+	for i := 0; i < len(scenarioEvaluations); i++ {
+		for j := i + 1; j < len(scenarioEvaluations); j++ {
+			result := McNemarTest(classifications[i], classifications[j])
+			if result.PairedImages == 0 {
+				continue
+			}
+			comparisons = append(comparisons, ConfigurationComparison{
+				Scenario:        scenario,
+				First:           scenarioEvaluations[i].Configuration(),
+				FirstThreshold:  scenarioEvaluations[i].ThresholdLabel,
+				Second:          scenarioEvaluations[j].Configuration(),
+				SecondThreshold: scenarioEvaluations[j].ThresholdLabel,
+				Result:          result,
+			})
+		}
+	}
+	return comparisons
+}
+
+func WriteComparisonsToCSV(scenario string, comparisons []ConfigurationComparison) {
+	data := [][]string{
+		{
+			"first", "first threshold", "second", "second threshold", "paired images", "both correct",
+			"first only", "second only", "both wrong", "statistic", "p value", "test",
+		},
+	}
+	for _, comparison := range comparisons {
+		test := "chi-squared"
+		if comparison.Result.Exact {
+			test = "exact"
+		}
+		data = append(data, []string{
+			comparison.First,
+			comparison.FirstThreshold,
+			comparison.Second,
+			comparison.SecondThreshold,
+			strconv.Itoa(comparison.Result.PairedImages),
+			strconv.Itoa(comparison.Result.BothCorrect),
+			strconv.Itoa(comparison.Result.FirstOnly),
+			strconv.Itoa(comparison.Result.SecondOnly),
+			strconv.Itoa(comparison.Result.BothWrong),
+			fmt.Sprintf("%.3f", comparison.Result.Statistic),
+			fmt.Sprintf("%.4f", comparison.Result.PValue),
+			test,
+		})
+	}
+	appendToCSV(fmt.Sprintf("significance/%s-significance", scenario), &data)
+}
+
+func (c *ConfigurationComparison) String() string {
+	return fmt.Sprintf(
+		"%s (%s) vs %s (%s): %d paired, %d only first correct, %d only second correct, p = %.4f",
+		c.First, c.FirstThreshold, c.Second, c.SecondThreshold, c.Result.PairedImages, c.Result.FirstOnly,
+		c.Result.SecondOnly, c.Result.PValue,
+	)
+}
+
+func detailEvaluationFileName(scenario string, analyzer string, matcher string) string {
+	if analyzer == image_analyzer.PHASH || analyzer == hybridAnalyzer {
+		return fmt.Sprintf("%s/%s-detail-evaluation", analyzer, scenario)
+	}
+	return fmt.Sprintf("%s/%s-%s-detail-evaluation", analyzer, scenario, matcher)
+}
@@ -0,0 +1,113 @@
+package statistics
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMcNemarTest(t *testing.T) {
+	tests := []struct {
+		name       string
+		firstOnly  int
+		secondOnly int
+		statistic  float64
+		pValue     float64
+		exact      bool
+	}{
+		{"no discordant pairs", 0, 0, 0, 1, false},
+		{"exact one-sided", 10, 0, 8.1, 2.0 / 1024, true},
+		{"exact balanced", 2, 3, 0, 1, true},
+		{"chi-squared", 30, 10, 9.025, math.Erfc(math.Sqrt(9.025 / 2)), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, second := pairedClassifications(test.firstOnly, test.secondOnly)
+			result := McNemarTest(first, second)
+			if result.FirstOnly != test.firstOnly || result.SecondOnly != test.secondOnly {
+				t.Errorf("discordant pairs %d and %d, want %d and %d",
+					result.FirstOnly, result.SecondOnly, test.firstOnly, test.secondOnly)
+			}
+			if result.BothCorrect != 3 || result.BothWrong != 2 {
+				t.Errorf("concordant pairs %d and %d, want 3 and 2", result.BothCorrect, result.BothWrong)
+			}
+			if math.Abs(result.Statistic-test.statistic) > 1e-9 {
+				t.Errorf("statistic %g, want %g", result.Statistic, test.statistic)
+			}
+			if math.Abs(result.PValue-test.pValue) > 1e-9 {
+				t.Errorf("p value %g, want %g", result.PValue, test.pValue)
+			}
+			if result.Exact != test.exact {
+				t.Errorf("exact %t, want %t", result.Exact, test.exact)
+			}
+		})
+	}
+}
+
+func TestMcNemarTestSkipsUnpairedImages(t *testing.T) {
+	first := map[string]string{"a": "true-positive", "b": "false-negative"}
+	second := map[string]string{"a": "false-negative", "c": "true-negative"}
+	result := McNemarTest(first, second)
+	if result.PairedImages != 1 || result.FirstOnly != 1 {
+		t.Errorf("got %d paired images and %d only first correct, want 1 and 1", result.PairedImages, result.FirstOnly)
+	}
+}
+
+func TestLoadImageClassifications(t *testing.T) {
+	directory := t.TempDir()
+	writeTestFile(t, filepath.Join(directory, "sift", "scaled-bf-detail-evaluation.csv"),
+		"threshold,reference,classification\n"+
+			"0.10,a.jpg,true-positive\n"+
+			"0.20,a.jpg,false-negative\n"+
+			"0.10,b.jpg,true-negative\n"+
+			"0.10,a.jpg,false-negative\n")
+
+	classifications, err := LoadImageClassifications(directory, "scaled", "sift", "bf", "0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(classifications) != 2 || classifications["b.jpg"] != "true-negative" {
+		t.Errorf("classifications %v, want a.jpg and b.jpg", classifications)
+	}
+	if classifications["a.jpg"] != "false-negative" {
+		t.Errorf("classification of a.jpg is %s, want the latest false-negative", classifications["a.jpg"])
+	}
+
+	_, err = LoadImageClassifications(directory, "scaled", "sift", "bf", "0.30")
+	if err == nil {
+		t.Error("no error for a threshold without classifications")
+	}
+}
+
+// pairedClassifications returns the classifications of two configurations with the given discordant pairs, 3 search
+// images both classify correctly and 2 both classify wrongly
+func pairedClassifications(firstOnly int, secondOnly int) (map[string]string, map[string]string) {
+	first := make(map[string]string)
+	second := make(map[string]string)
+	add := func(prefix string, count int, firstClassification string, secondClassification string) {
+		for index := 0; index < count; index++ {
+			reference := fmt.Sprintf("%s-%d", prefix, index)
+			first[reference] = firstClassification
+			second[reference] = secondClassification
+		}
+	}
+	add("both-correct", 3, "true-positive", "true-negative")
+	add("both-wrong", 2, "false-positive", "false-negative")
+	add("first-only", firstOnly, "true-positive", "false-negative")
+	add("second-only", secondOnly, "false-positive", "true-negative")
+	return first, second
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,274 @@
+package statistics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const snapshotDirectory = "test-output/snapshots/"
+
+const DefaultTolerancesPath = "regression-tolerances.json"
+
+// Snapshot is a named copy of the overall evaluations of a run, so that later runs can be compared against it
+type Snapshot struct {
+	Name      string          `json:"name"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Entries   []SnapshotEntry `json:"entries"`
+}
+
+type SnapshotEntry struct {
+	Scenario  string                    `json:"scenario"`
+	Analyzer  string                    `json:"analyzer"`
+	Matcher   string                    `json:"matcher"`
+	Threshold string                    `json:"threshold"`
+	ClassEval ClassificationEvaluation  `json:"classEval"`
+	SpecHash  string                    `json:"specHash,omitempty"`
+	Latencies map[string]LatencySummary `json:"latencies,omitempty"`
+}
+
+// RegressionTolerances are the regressions that are allowed between two snapshots, metrics without tolerance aren't
+// checked. The metric tolerances are absolute decreases, the latency tolerance is a relative increase of the p95
+// latency of every stage.
+type RegressionTolerances struct {
+	Recall           *float64 `json:"recall,omitempty"`
+	Specificity      *float64 `json:"specificity,omitempty"`
+	BalancedAccuracy *float64 `json:"balancedAccuracy,omitempty"`
+	LatencyP95       *float64 `json:"latencyP95,omitempty"`
+}
+
+// SnapshotDifference is the change of a metric of an entry that is in both snapshots
+type SnapshotDifference struct {
+	Key        string
+	Metric     string
+	Baseline   float64
+	Candidate  float64
+	Regression bool
+}
+
+type SnapshotComparison struct {
+	Differences []SnapshotDifference
+	// Missing are the entries of the baseline the candidate doesn't contain, Added the entries only the candidate has
+	Missing []string
+	Added   []string
+	// Incomparable are the entries of both snapshots whose metrics can't be compared with the reason, their search
+	// images were generated from other variation specs or a stage with latency tolerance is missing in the candidate
+	Incomparable []string
+}
+
+func NewSnapshot(name string, evaluations *[]OverallEvaluation) *Snapshot {
+	snapshot := Snapshot{Name: name, CreatedAt: time.Now().UTC()}
+	for _, evaluation := range *evaluations {
+		snapshot.Entries = append(snapshot.Entries, SnapshotEntry{
+			Scenario:  evaluation.Scenario,
+			Analyzer:  evaluation.Analyzer,
+			Matcher:   evaluation.Matcher,
+			Threshold: evaluation.ThresholdLabel,
+			ClassEval: evaluation.ClassEval,
+			SpecHash:  evaluation.SpecHash,
+			Latencies: evaluation.Latencies,
+		})
+	}
+	return &snapshot
+}
+
+// SaveSnapshot writes the snapshot into the snapshot directory, an existing snapshot with the same name is replaced
+func SaveSnapshot(snapshot *Snapshot) (string, error) {
+	if snapshot.Name == "" || strings.ContainsAny(snapshot.Name, "/\\") {
+		return "", errors.New(fmt.Sprintf("invalid snapshot name %q", snapshot.Name))
+	}
+	err := os.MkdirAll(snapshotDirectory, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(snapshotDirectory, snapshot.Name+".json")
+	err = os.WriteFile(path, content, 0644)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("couldn't write snapshot %s: %s", path, err.Error()))
+	}
+	return path, nil
+}
+
+// LoadSnapshot reads the snapshot with the given name from the snapshot directory or from the given path
+func LoadSnapshot(nameOrPath string) (*Snapshot, error) {
+	path := nameOrPath
+	if _, err := os.Stat(path); err != nil {
+		path = filepath.Join(snapshotDirectory, nameOrPath+".json")
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read snapshot %s: %s", nameOrPath, err.Error()))
+	}
+	var snapshot Snapshot
+	err = json.Unmarshal(content, &snapshot)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't decode snapshot %s: %s", path, err.Error()))
+	}
+	return &snapshot, nil
+}
+
+func LoadRegressionTolerances(path string) (*RegressionTolerances, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read tolerances %s: %s", path, err.Error()))
+	}
+
+	var tolerances RegressionTolerances
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&tolerances)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't decode tolerances %s: %s", path, err.Error()))
+	}
+	return &tolerances, nil
+}
+
+// CompareSnapshots diffs the entries of both snapshots per scenario, configuration and threshold. Entries whose spec
+// hashes are both known and differ aren't diffed, they are incomparable.
+func CompareSnapshots(baseline *Snapshot, candidate *Snapshot, tolerances *RegressionTolerances) SnapshotComparison {
+	var comparison SnapshotComparison
+
+	candidateEntries := make(map[string]SnapshotEntry)
+	for _, entry := range candidate.Entries {
+		candidateEntries[entry.key()] = entry
+	}
+	baselineKeys := make(map[string]bool)
+
+	for _, baselineEntry := range baseline.Entries {
+		key := baselineEntry.key()
+		baselineKeys[key] = true
+		candidateEntry, exists := candidateEntries[key]
+		if !exists {
+			comparison.Missing = append(comparison.Missing, key)
+			continue
+		}
+		if baselineEntry.SpecHash != "" && candidateEntry.SpecHash != "" &&
+			baselineEntry.SpecHash != candidateEntry.SpecHash {
+			comparison.Incomparable = append(comparison.Incomparable, fmt.Sprintf(
+				"%s: spec hash %s differs from %s", key, candidateEntry.SpecHash, baselineEntry.SpecHash,
+			))
+			continue
+		}
+
+		metrics := []struct {
+			name      string
+			tolerance *float64
+			value     func(evaluation *ClassificationEvaluation) float64
+		}{
+			{"recall", tolerances.Recall, (*ClassificationEvaluation).Recall},
+			{"specificity", tolerances.Specificity, (*ClassificationEvaluation).Specificity},
+			{"balanced accuracy", tolerances.BalancedAccuracy, (*ClassificationEvaluation).BalancedAccuracy},
+		}
+		for _, metric := range metrics {
+			baselineValue := metric.value(&baselineEntry.ClassEval)
+			candidateValue := metric.value(&candidateEntry.ClassEval)
+			comparison.Differences = append(comparison.Differences, SnapshotDifference{
+				Key:        key,
+				Metric:     metric.name,
+				Baseline:   baselineValue,
+				Candidate:  candidateValue,
+				Regression: metric.tolerance != nil && baselineValue-candidateValue > *metric.tolerance,
+			})
+		}
+
+		for _, stage := range sortedStages(baselineEntry.Latencies) {
+			baselineLatency := baselineEntry.Latencies[stage].P95
+			candidateSummary, recorded := candidateEntry.Latencies[stage]
+			if !recorded && tolerances.LatencyP95 != nil {
+				comparison.Incomparable = append(
+					comparison.Incomparable, fmt.Sprintf("%s: stage %s is missing in candidate", key, stage),
+				)
+				continue
+			}
+			if !recorded || baselineLatency == 0 {
+				continue
+			}
+			comparison.Differences = append(comparison.Differences, SnapshotDifference{
+				Key:       key,
+				Metric:    stage + " p95 ms",
+				Baseline:  float64(baselineLatency) / float64(time.Millisecond),
+				Candidate: float64(candidateSummary.P95) / float64(time.Millisecond),
+				Regression: tolerances.LatencyP95 != nil &&
+					float64(candidateSummary.P95) > float64(baselineLatency)*(1+*tolerances.LatencyP95),
+			})
+		}
+	}
+
+	for _, entry := range candidate.Entries {
+		if !baselineKeys[entry.key()] {
+			comparison.Added = append(comparison.Added, entry.key())
+		}
+	}
+	return comparison
+}
+
+func (c *SnapshotComparison) Regressions() []SnapshotDifference {
+	var regressions []SnapshotDifference
+	for _, difference := range c.Differences {
+		if difference.Regression {
+			regressions = append(regressions, difference)
+		}
+	}
+	return regressions
+}
+
+// String lists the changed metrics, unchanged metrics are left out
+func (c *SnapshotComparison) String() string {
+	var lines []string
+	for _, difference := range c.Differences {
+		if difference.Baseline == difference.Candidate {
+			continue
+		}
+		marker := ""
+		if difference.Regression {
+			marker = "  REGRESSION"
+		}
+		lines = append(lines, fmt.Sprintf(
+			"%s %s: %.4f -> %.4f (%+.4f)%s",
+			difference.Key, difference.Metric, difference.Baseline, difference.Candidate,
+			difference.Candidate-difference.Baseline, marker,
+		))
+	}
+	for _, key := range c.Missing {
+		lines = append(lines, key+": missing in candidate")
+	}
+	for _, key := range c.Added {
+		lines = append(lines, key+": only in candidate")
+	}
+	for _, reason := range c.Incomparable {
+		lines = append(lines, reason+", incomparable")
+	}
+	if len(lines) == 0 {
+		return "no differences"
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *SnapshotEntry) key() string {
+	configuration := e.Analyzer
+	if e.Matcher != "" && e.Matcher != e.Analyzer {
+		configuration += "-" + e.Matcher
+	}
+	return fmt.Sprintf("%s/%s@%s", e.Scenario, configuration, e.Threshold)
+}
+
+func sortedStages(latencies map[string]LatencySummary) []string {
+	var stages []string
+	for stage := range latencies {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	return stages
+}
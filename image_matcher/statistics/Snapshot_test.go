@@ -0,0 +1,202 @@
+package statistics
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompareSnapshotsTolerances(t *testing.T) {
+	baseline := ClassificationEvaluation{TP: 90, FN: 10, TN: 95, FP: 5}
+	tests := []struct {
+		name        string
+		candidate   ClassificationEvaluation
+		tolerances  RegressionTolerances
+		regressions []string
+	}{
+		{"unchanged", baseline, RegressionTolerances{Recall: float(0)}, nil},
+		{"improved", ClassificationEvaluation{TP: 100, TN: 100}, RegressionTolerances{Recall: float(0)}, nil},
+		{
+			"decrease within tolerance",
+			ClassificationEvaluation{TP: 88, FN: 12, TN: 95, FP: 5},
+			RegressionTolerances{Recall: float(0.05)},
+			nil,
+		},
+		{
+			"decrease beyond tolerance",
+			ClassificationEvaluation{TP: 80, FN: 20, TN: 95, FP: 5},
+			RegressionTolerances{Recall: float(0.05), BalancedAccuracy: float(0.01)},
+			[]string{"recall", "balanced accuracy"},
+		},
+		{
+			"decrease without tolerance",
+			ClassificationEvaluation{TP: 50, FN: 50, TN: 50, FP: 50},
+			RegressionTolerances{},
+			nil,
+		},
+		{
+			"specificity",
+			ClassificationEvaluation{TP: 90, FN: 10, TN: 80, FP: 20},
+			RegressionTolerances{Recall: float(0), Specificity: float(0.1)},
+			[]string{"specificity"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			comparison := CompareSnapshots(
+				snapshotOf(SnapshotEntry{Scenario: "scaled", Analyzer: "sift", ClassEval: baseline}),
+				snapshotOf(SnapshotEntry{Scenario: "scaled", Analyzer: "sift", ClassEval: test.candidate}),
+				&test.tolerances,
+			)
+			if len(comparison.Differences) != 3 {
+				t.Fatalf("got %d differences, want one per metric", len(comparison.Differences))
+			}
+			assertRegressions(t, &comparison, test.regressions)
+		})
+	}
+}
+
+func TestCompareSnapshotsLatencies(t *testing.T) {
+	latencies := func(p95 time.Duration) map[string]LatencySummary {
+		return map[string]LatencySummary{ExtractionStage: {P95: p95}}
+	}
+	tests := []struct {
+		name        string
+		candidate   time.Duration
+		tolerance   *float64
+		regressions []string
+	}{
+		{"faster", 50 * time.Millisecond, float(0.1), nil},
+		{"slower within tolerance", 105 * time.Millisecond, float(0.1), nil},
+		{"slower beyond tolerance", 120 * time.Millisecond, float(0.1), []string{"extraction p95 ms"}},
+		{"slower without tolerance", time.Second, nil, nil},
+	}
+	baseline := snapshotOf(
+		SnapshotEntry{Scenario: "scaled", Analyzer: "phash", Latencies: latencies(100 * time.Millisecond)},
+	)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			comparison := CompareSnapshots(
+				baseline,
+				snapshotOf(SnapshotEntry{Scenario: "scaled", Analyzer: "phash", Latencies: latencies(test.candidate)}),
+				&RegressionTolerances{LatencyP95: test.tolerance},
+			)
+			assertRegressions(t, &comparison, test.regressions)
+		})
+	}
+}
+
+func TestCompareSnapshotsMissingStage(t *testing.T) {
+	baseline := snapshotOf(SnapshotEntry{
+		Scenario:  "scaled",
+		Analyzer:  "phash",
+		Latencies: map[string]LatencySummary{ExtractionStage: {P95: time.Millisecond}},
+	})
+	candidate := snapshotOf(SnapshotEntry{
+		Scenario:  "scaled",
+		Analyzer:  "phash",
+		Latencies: map[string]LatencySummary{CachedExtractionStage: {P95: time.Millisecond}},
+	})
+
+	withoutTolerance := CompareSnapshots(baseline, candidate, &RegressionTolerances{})
+	if len(withoutTolerance.Incomparable) != 0 {
+		t.Errorf("incomparable %v without latency tolerance", withoutTolerance.Incomparable)
+	}
+
+	withTolerance := CompareSnapshots(baseline, candidate, &RegressionTolerances{LatencyP95: float(0.1)})
+	if len(withTolerance.Incomparable) != 1 {
+		t.Errorf("incomparable %v, want the missing extraction stage", withTolerance.Incomparable)
+	}
+}
+
+func TestCompareSnapshotsSpecHashes(t *testing.T) {
+	tests := []struct {
+		name         string
+		baseline     string
+		candidate    string
+		incomparable bool
+	}{
+		{"same hash", "a", "a", false},
+		{"other hash", "a", "b", true},
+		{"unknown baseline hash", "", "b", false},
+		{"unknown candidate hash", "a", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			comparison := CompareSnapshots(
+				snapshotOf(SnapshotEntry{Scenario: "scaled", Analyzer: "phash", SpecHash: test.baseline}),
+				snapshotOf(SnapshotEntry{Scenario: "scaled", Analyzer: "phash", SpecHash: test.candidate}),
+				&RegressionTolerances{},
+			)
+			if (len(comparison.Incomparable) > 0) != test.incomparable {
+				t.Errorf("incomparable %v, want incomparable %t", comparison.Incomparable, test.incomparable)
+			}
+			if test.incomparable && len(comparison.Differences) > 0 {
+				t.Errorf("incomparable entry has %d differences", len(comparison.Differences))
+			}
+		})
+	}
+}
+
+func TestCompareSnapshotsMissingAndAdded(t *testing.T) {
+	baseline := snapshotOf(
+		SnapshotEntry{Scenario: "scaled", Analyzer: "sift", Matcher: "bf", Threshold: "0.10"},
+		SnapshotEntry{Scenario: "rotated", Analyzer: "phash", Matcher: "phash", Threshold: "8"},
+	)
+	candidate := snapshotOf(
+		SnapshotEntry{Scenario: "scaled", Analyzer: "sift", Matcher: "bf", Threshold: "0.10"},
+		SnapshotEntry{Scenario: "scaled", Analyzer: "sift", Matcher: "bf", Threshold: "0.20"},
+	)
+
+	comparison := CompareSnapshots(baseline, candidate, &RegressionTolerances{})
+	if len(comparison.Missing) != 1 || comparison.Missing[0] != "rotated/phash@8" {
+		t.Errorf("missing %v, want rotated/phash@8", comparison.Missing)
+	}
+	if len(comparison.Added) != 1 || comparison.Added[0] != "scaled/sift-bf@0.20" {
+		t.Errorf("added %v, want scaled/sift-bf@0.20", comparison.Added)
+	}
+}
+
+func TestLoadRegressionTolerances(t *testing.T) {
+	directory := t.TempDir()
+	validPath := filepath.Join(directory, "valid.json")
+	writeTestFile(t, validPath, `{"recall": 0.02, "latencyP95": 0.5}`)
+	tolerances, err := LoadRegressionTolerances(validPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tolerances.Recall == nil || *tolerances.Recall != 0.02 || tolerances.LatencyP95 == nil {
+		t.Errorf("tolerances %+v, want recall and latency tolerance", tolerances)
+	}
+	if tolerances.Specificity != nil || tolerances.BalancedAccuracy != nil {
+		t.Errorf("tolerances %+v, want no specificity and balanced accuracy tolerance", tolerances)
+	}
+
+	misspelledPath := filepath.Join(directory, "misspelled.json")
+	writeTestFile(t, misspelledPath, `{"recal": 0.02}`)
+	_, err = LoadRegressionTolerances(misspelledPath)
+	if err == nil {
+		t.Error("no error for an unknown tolerance")
+	}
+}
+
+func snapshotOf(entries ...SnapshotEntry) *Snapshot {
+	return &Snapshot{Name: "test", Entries: entries}
+}
+
+func float(value float64) *float64 {
+	return &value
+}
+
+func assertRegressions(t *testing.T, comparison *SnapshotComparison, metrics []string) {
+	t.Helper()
+	regressions := comparison.Regressions()
+	if len(regressions) != len(metrics) {
+		t.Fatalf("regressions %+v, want %v", regressions, metrics)
+	}
+	for index, regression := range regressions {
+		if regression.Metric != metrics[index] {
+			t.Errorf("regression of %s, want %s", regression.Metric, metrics[index])
+		}
+	}
+}
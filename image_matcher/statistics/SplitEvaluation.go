@@ -0,0 +1,192 @@
+package statistics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SplitEvaluation collects the classifications of a scenario run per split, fold and threshold, so that the
+// threshold can be selected on other search images than those it is reported on
+type SplitEvaluation struct {
+	evaluations map[splitKey]*ClassificationEvaluation
+}
+
+type splitKey struct {
+	Split     string
+	Fold      int
+	Threshold string
+}
+
+// SplitResult is the threshold selected on the validation split and its evaluation on the validation and test split
+type SplitResult struct {
+	Threshold  string
+	Validation ClassificationEvaluation
+	Test       ClassificationEvaluation
+	// Folds are the results of the cross-validation, empty if it is disabled
+	Folds []FoldResult
+}
+
+// FoldResult is the threshold selected on all other folds and its evaluation on the fold
+type FoldResult struct {
+	Fold       int
+	Threshold  string
+	Evaluation ClassificationEvaluation
+}
+
+func NewSplitEvaluation() *SplitEvaluation {
+	return &SplitEvaluation{evaluations: make(map[splitKey]*ClassificationEvaluation)}
+}
+
+func (s *SplitEvaluation) Add(split string, fold int, threshold string, classification string) {
+	key := splitKey{Split: split, Fold: fold, Threshold: threshold}
+	evaluation, exists := s.evaluations[key]
+	if !exists {
+		evaluation = &ClassificationEvaluation{}
+		s.evaluations[key] = evaluation
+	}
+	evaluation.countClassification(classification)
+}
+
+// Evaluate selects the threshold with the best balanced accuracy on the validation split and evaluates it on the test
+// split. With more than one fold every fold of the train and validation split is evaluated with the threshold
+// selected on the remaining folds.
+func (s *SplitEvaluation) Evaluate(validationSplit string, testSplit string, folds int) SplitResult {
+	isValidation := func(key splitKey) bool { return key.Split == validationSplit }
+	threshold, validation := s.selectThreshold(isValidation)
+	result := SplitResult{
+		Threshold:  threshold,
+		Validation: validation,
+		Test:       s.evaluation(func(key splitKey) bool { return key.Split == testSplit }, threshold),
+	}
+
+	for fold := 0; folds > 1 && fold < folds; fold++ {
+		currentFold := fold
+		foldThreshold, _ := s.selectThreshold(func(key splitKey) bool {
+			return key.Split != testSplit && key.Fold != currentFold
+		})
+		result.Folds = append(result.Folds, FoldResult{
+			Fold:      fold,
+			Threshold: foldThreshold,
+			Evaluation: s.evaluation(func(key splitKey) bool {
+				return key.Split != testSplit && key.Fold == currentFold
+			}, foldThreshold),
+		})
+	}
+	return result
+}
+
+// selectThreshold returns the threshold with the best balanced accuracy on the included search images, the lowest
+// threshold wins ties
+func (s *SplitEvaluation) selectThreshold(include func(key splitKey) bool) (string, ClassificationEvaluation) {
+	bestThreshold := ""
+	var bestEvaluation ClassificationEvaluation
+	for _, threshold := range s.thresholds() {
+		evaluation := s.evaluation(include, threshold)
+		if evaluation.TP+evaluation.TN+evaluation.FP+evaluation.FN == 0 {
+			continue
+		}
+		if bestThreshold == "" || evaluation.BalancedAccuracy() > bestEvaluation.BalancedAccuracy() {
+			bestThreshold = threshold
+			bestEvaluation = evaluation
+		}
+	}
+	return bestThreshold, bestEvaluation
+}
+
+func (s *SplitEvaluation) evaluation(include func(key splitKey) bool, threshold string) ClassificationEvaluation {
+	var sum ClassificationEvaluation
+	for key, evaluation := range s.evaluations {
+		if key.Threshold != threshold || !include(key) {
+			continue
+		}
+		sum.TP += evaluation.TP
+		sum.TN += evaluation.TN
+		sum.FP += evaluation.FP
+		sum.FN += evaluation.FN
+	}
+	return sum
+}
+
+func (s *SplitEvaluation) thresholds() []string {
+	var thresholds []string
+	seen := make(map[string]bool)
+	for key := range s.evaluations {
+		if !seen[key.Threshold] {
+			seen[key.Threshold] = true
+			thresholds = append(thresholds, key.Threshold)
+		}
+	}
+	sort.Slice(thresholds, func(i, j int) bool {
+		return compareParameterValues(thresholds[i], thresholds[j])
+	})
+	return thresholds
+}
+
+// MeanFoldBalancedAccuracy is the mean and standard deviation of the balanced accuracy over the folds
+func (r *SplitResult) MeanFoldBalancedAccuracy() (float64, float64) {
+	if len(r.Folds) == 0 {
+		return 0, 0
+	}
+	var values []float64
+	for _, fold := range r.Folds {
+		values = append(values, fold.Evaluation.BalancedAccuracy())
+	}
+	mean := 0.0
+	for _, value := range values {
+		mean += value
+	}
+	mean /= float64(len(values))
+
+	variance := 0.0
+	for _, value := range values {
+		variance += (value - mean) * (value - mean)
+	}
+	variance /= float64(len(values))
+	return mean, math.Sqrt(variance)
+}
+
+func (r *SplitResult) String() string {
+	lines := []string{
+		"threshold selected on validation: " + r.Threshold,
+		"validation: " + r.Validation.String(),
+		"test: " + r.Test.String(),
+	}
+	for _, fold := range r.Folds {
+		lines = append(lines, fmt.Sprintf("fold %d (threshold %s): %s", fold.Fold, fold.Threshold, fold.Evaluation.String()))
+	}
+	if len(r.Folds) > 0 {
+		mean, deviation := r.MeanFoldBalancedAccuracy()
+		lines = append(lines, fmt.Sprintf("cross-validation balanced-acc: %.3f ± %.3f", mean, deviation))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func WriteSplitResultToCSV(scenario string, analyzer string, matcher string, result *SplitResult) {
+	data := [][]string{
+		{"split", "fold", "threshold", "tp", "tn", "fp", "fn", "recall", "specificity", "balanced accuracy"},
+	}
+	data = append(data, splitResultRow("validation", "", result.Threshold, &result.Validation))
+	data = append(data, splitResultRow("test", "", result.Threshold, &result.Test))
+	for _, fold := range result.Folds {
+		data = append(data, splitResultRow("fold", strconv.Itoa(fold.Fold), fold.Threshold, &fold.Evaluation))
+	}
+	appendToCSV(evaluationFileName(scenario, analyzer, matcher, "split-evaluation"), &data)
+}
+
+func splitResultRow(split string, fold string, threshold string, evaluation *ClassificationEvaluation) []string {
+	return []string{
+		split,
+		fold,
+		threshold,
+		strconv.Itoa(evaluation.TP),
+		strconv.Itoa(evaluation.TN),
+		strconv.Itoa(evaluation.FP),
+		strconv.Itoa(evaluation.FN),
+		fmt.Sprintf("%.2f", evaluation.Recall()),
+		fmt.Sprintf("%.2f", evaluation.Specificity()),
+		fmt.Sprintf("%.2f", evaluation.BalancedAccuracy()),
+	}
+}
@@ -0,0 +1,81 @@
+package statistics
+
+import "testing"
+
+func TestEvaluateSelectsThresholdOnValidationSplit(t *testing.T) {
+	evaluation := NewSplitEvaluation()
+	// 0.5 is perfect on the validation split, 0.7 is perfect on the test split
+	addClassifications(evaluation, "validation", 0, "0.5", "true-positive", "true-negative")
+	addClassifications(evaluation, "validation", 0, "0.7", "false-negative", "true-negative")
+	addClassifications(evaluation, "test", 0, "0.5", "true-positive", "false-positive")
+	addClassifications(evaluation, "test", 0, "0.7", "true-positive", "true-negative")
+
+	result := evaluation.Evaluate("validation", "test", 0)
+	if result.Threshold != "0.5" {
+		t.Errorf("selected threshold %s, want 0.5", result.Threshold)
+	}
+	if result.Validation.TP != 1 || result.Validation.TN != 1 {
+		t.Errorf("validation evaluation %+v, want 1 true positive and 1 true negative", result.Validation)
+	}
+	if result.Test.TP != 1 || result.Test.FP != 1 {
+		t.Errorf("test evaluation %+v, want 1 true positive and 1 false positive", result.Test)
+	}
+	if len(result.Folds) != 0 {
+		t.Errorf("got %d folds without cross-validation", len(result.Folds))
+	}
+}
+
+func TestEvaluateLowestThresholdWinsTies(t *testing.T) {
+	evaluation := NewSplitEvaluation()
+	// thresholds are compared by their numeric value, 10 sorts after 9
+	for _, threshold := range []string{"10", "9", "20"} {
+		addClassifications(evaluation, "validation", 0, threshold, "true-positive", "true-negative")
+	}
+
+	if result := evaluation.Evaluate("validation", "test", 0); result.Threshold != "9" {
+		t.Errorf("selected threshold %s, want 9", result.Threshold)
+	}
+}
+
+func TestEvaluateFolds(t *testing.T) {
+	evaluation := NewSplitEvaluation()
+	// fold 0 prefers threshold 1, fold 1 prefers threshold 2, so each fold is evaluated with the other's threshold
+	addClassifications(evaluation, "train", 0, "1", "true-positive", "true-negative")
+	addClassifications(evaluation, "train", 0, "2", "false-negative", "true-negative")
+	addClassifications(evaluation, "validation", 1, "1", "true-positive", "false-positive")
+	addClassifications(evaluation, "validation", 1, "2", "true-positive", "true-negative")
+	// the test split never influences the fold thresholds
+	addClassifications(evaluation, "test", 0, "1", "false-negative", "false-positive")
+
+	result := evaluation.Evaluate("validation", "test", 2)
+	if len(result.Folds) != 2 {
+		t.Fatalf("got %d folds, want 2", len(result.Folds))
+	}
+	if result.Folds[0].Threshold != "2" || result.Folds[1].Threshold != "1" {
+		t.Errorf("fold thresholds %s and %s, want 2 and 1", result.Folds[0].Threshold, result.Folds[1].Threshold)
+	}
+	if accuracy := result.Folds[0].Evaluation.BalancedAccuracy(); accuracy != 0.5 {
+		t.Errorf("balanced accuracy of fold 0 is %g, want 0.5", accuracy)
+	}
+
+	mean, _ := result.MeanFoldBalancedAccuracy()
+	if mean != 0.5 {
+		t.Errorf("mean fold balanced accuracy is %g, want 0.5", mean)
+	}
+}
+
+func TestEvaluateWithoutValidationImages(t *testing.T) {
+	evaluation := NewSplitEvaluation()
+	addClassifications(evaluation, "test", 0, "0.5", "true-positive")
+
+	if result := evaluation.Evaluate("validation", "test", 0); result.Threshold != "" {
+		t.Errorf("selected threshold %s without validation images", result.Threshold)
+	}
+}
+
+func addClassifications(evaluation *SplitEvaluation, split string, fold int, threshold string,
+	classifications ...string) {
+	for _, classification := range classifications {
+		evaluation.Add(split, fold, threshold, classification)
+	}
+}
@@ -4,15 +4,24 @@ import (
 	"fmt"
 	"gocv.io/x/gocv"
 	"image_matcher/image_analyzer"
+	"image_matcher/image_database"
+	"image_matcher/image_dataset"
 	"image_matcher/image_handling"
+	"image_matcher/image_matching"
 	"image_matcher/image_service"
+	"image_matcher/statistics"
 	"log"
+	"os"
 	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
 const SimilarityThreshold = 0.4
 
+const csvDirectory = "test-output/csv-files"
+
 var CommandMapping = map[string]func([]string){
 	"register":  registerImages,
 	"compare":   compareTwoImages,
@@ -20,25 +29,79 @@ var CommandMapping = map[string]func([]string){
 	"scenario":  runScenario,
 	"duplicate": duplicate,
 	"uniques":   uniques,
-	"runAll":    runAllScenariosPerAlgorithm,
-	"update":    updateDatabaseWithNewHash,
+	"runAll":    runExperiments,
+	"report":    generateReport,
+
+	"export-manifest": exportManifest,
+	"import-manifest": importManifest,
+	"import-dataset":  importDataset,
+	"hard-negatives":  hardNegatives,
+	"split":           createSplits,
+	"tune":            tuneThresholds,
+	"significance":    testSignificance,
+	"snapshot":        saveSnapshot,
+	"compare-runs":    compareRuns,
+
+	"list":     listForbiddenImages,
+	"show":     showForbiddenImage,
+	"annotate": annotateForbiddenImage,
+	"delete":   deleteForbiddenImage,
+	"replace":  replaceForbiddenImage,
+	"rename":   renameForbiddenImage,
+	"reindex":  reindexForbiddenImages,
+	"doctor":   diagnoseForbiddenSet,
+	"stats":    diagnoseForbiddenSet,
+
+	"allow":    allowImages,
+	"disallow": disallowImage,
+	"allowed":  listAllowedImages,
 }
 
 func duplicate(arguments []string) {
 	if len(arguments) < 1 {
 		log.Fatal("Need a directory of images!")
 	}
-	populateDatabase(arguments[0])
+	populateDatabase(arguments[0], parseVariationSpec(arguments[1:]), parseSeed(arguments[1:]))
 }
 
 func uniques(arguments []string) {
 	if len(arguments) < 1 {
 		log.Fatal("Need a directory of images!")
 	}
-	generateUniques(arguments[0])
+	generateUniques(arguments[0], parseVariationSpec(arguments[1:]), parseSeed(arguments[1:]))
+}
+
+// parseSeed uses the first argument as seed or a time based seed if there is none, the seed is logged so that
+// the generated search set can be reproduced
+func parseSeed(arguments []string) int64 {
+	seed := time.Now().UnixNano()
+	if len(arguments) > 0 {
+		var err error
+		seed, err = strconv.ParseInt(arguments[0], 10, 64)
+		if err != nil {
+			log.Fatal("invalid seed value", err)
+		}
+	}
+	log.Println("generating variations with seed", seed)
+	return seed
+}
+
+// parseVariationSpec loads the spec given as second argument or the default spec
+func parseVariationSpec(arguments []string) *image_handling.VariationSpec {
+	specPath := image_handling.DefaultVariationSpecPath
+	if len(arguments) > 1 {
+		specPath = arguments[1]
+	}
+	spec, err := image_handling.LoadVariationSpec(specPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("generating variations from spec", specPath, "with hash", spec.Hash)
+	return spec
 }
 
 func registerImages(arguments []string) {
+	arguments, metadataArguments := splitKeyValueArguments(arguments)
 	if len(arguments) < 1 {
 		log.Fatal("not enough arguments!")
 	}
@@ -46,12 +109,358 @@ func registerImages(arguments []string) {
 	imagePath := arguments[0]
 
 	images := image_handling.LoadImagesFromPath(imagePath)
-	err := image_service.AnalyzeAndSaveDatabaseImage(images)
+	err := image_service.AnalyzeAndSaveDatabaseImage(images, parseMetadata(metadataArguments))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// splitKeyValueArguments separates the key=value arguments from the positional arguments
+func splitKeyValueArguments(arguments []string) ([]string, []string) {
+	var positionalArguments, keyValueArguments []string
+	for _, argument := range arguments {
+		if strings.Contains(argument, "=") {
+			keyValueArguments = append(keyValueArguments, argument)
+		} else {
+			positionalArguments = append(positionalArguments, argument)
+		}
+	}
+	return positionalArguments, keyValueArguments
+}
+
+// parseMetadata parses the metadata arguments by=<user>, reason=<reason>, tags=<tags>, expires=<yyyy-mm-dd> and
+// source=<url>, tags are separated by commas
+func parseMetadata(arguments []string) image_database.ForbiddenImageMetadata {
+	var metadata image_database.ForbiddenImageMetadata
+	for _, argument := range arguments {
+		key, value, _ := strings.Cut(argument, "=")
+		switch key {
+		case "by":
+			metadata.RegisteredBy = value
+		case "reason":
+			metadata.Reason = value
+		case "tags":
+			metadata.Tags = image_database.NormalizeTags(strings.Split(value, ","))
+		case "expires":
+			metadata.ExpiresAt = value
+		case "source":
+			metadata.SourceURL = value
+		default:
+			log.Fatal("unknown metadata ", key, ", the metadata are by, reason, tags, expires and source")
+		}
+	}
+	err := image_database.ValidateMetadata(metadata)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return metadata
+}
+
+// describeMetadata formats the metadata of a matched or listed image for the console
+func describeMetadata(metadata image_database.ForbiddenImageMetadata) string {
+	var fields []string
+	if metadata.Reason != "" {
+		fields = append(fields, "reason: "+metadata.Reason)
+	}
+	if len(metadata.Tags) > 0 {
+		fields = append(fields, "tags: "+strings.Join(metadata.Tags, ","))
+	}
+	if metadata.ExpiresAt != "" {
+		fields = append(fields, "expires: "+metadata.ExpiresAt)
+	}
+	if metadata.RegisteredBy != "" {
+		fields = append(fields, "registered by: "+metadata.RegisteredBy)
+	}
+	if metadata.SourceURL != "" {
+		fields = append(fields, "source: "+metadata.SourceURL)
+	}
+	return strings.Join(fields, ", ")
+}
+
+// listForbiddenImages prints the registered images, "all" includes the deleted images
+func listForbiddenImages(arguments []string) {
+	includeDeleted := len(arguments) > 0 && arguments[0] == "all"
+	summaries, err := image_service.ListForbiddenImages(includeDeleted)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(
+		writer, "reference\tphash\trotation hash\tsift\torb\tbrisk\treason\ttags\texpires\tdeleted at",
+	)
+	for _, summary := range *summaries {
+		fmt.Fprintf(
+			writer, "%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n", summary.ExternalReference, summary.PHash,
+			summary.RotationHash, summary.SiftBytes, summary.OrbBytes, summary.BriskBytes, summary.Metadata.Reason,
+			strings.Join(summary.Metadata.Tags, ","), summary.Metadata.ExpiresAt, summary.DeletedAt,
+		)
+	}
+	writer.Flush()
+	println(fmt.Sprintf("%d images", len(*summaries)))
+}
+
+func showForbiddenImage(arguments []string) {
+	if len(arguments) < 1 {
+		log.Fatal("Need the reference of a registered image!")
+	}
+	summary, auditTrail, err := image_service.ShowForbiddenImage(arguments[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	println("reference:", summary.ExternalReference)
+	println("phash:", strconv.FormatUint(summary.PHash, 10))
+	println("rotation hash:", strconv.FormatUint(summary.RotationHash, 10))
+	println(fmt.Sprintf(
+		"descriptor bytes: sift %d, orb %d, brisk %d", summary.SiftBytes, summary.OrbBytes, summary.BriskBytes,
+	))
+	println("file sha-256:", summary.FileDigest)
+	println("pixel sha-256:", summary.PixelDigest)
+	if metadata := describeMetadata(summary.Metadata); metadata != "" {
+		println(metadata)
+	}
+	if summary.DeletedAt != "" {
+		println("deleted at:", summary.DeletedAt)
+	}
+	println("audit trail:")
+	for _, entry := range *auditTrail {
+		line := fmt.Sprintf("  %s %s by %s", entry.CreatedAt, entry.Action, entry.Actor)
+		if entry.Details != "" {
+			line += ": " + entry.Details
+		}
+		println(line)
+	}
+}
+
+func annotateForbiddenImage(arguments []string) {
+	arguments, metadataArguments := splitKeyValueArguments(arguments)
+	if len(arguments) < 1 {
+		log.Fatal("Need the reference of a registered image!")
+	}
+	err := image_service.AnnotateForbiddenImage(arguments[0], parseMetadata(metadataArguments))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func deleteForbiddenImage(arguments []string) {
+	if len(arguments) < 1 {
+		log.Fatal("Need the reference of a registered image!")
+	}
+	err := image_service.DeleteForbiddenImage(arguments[0], strings.Join(arguments[1:], " "))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func replaceForbiddenImage(arguments []string) {
+	if len(arguments) < 2 {
+		log.Fatal("Need the reference of a registered image and the path of the replacing image!")
+	}
+	image := image_handling.LoadRawImage(arguments[1])
+	if image == nil {
+		log.Fatal("Couldn't load image: ", arguments[1])
+	}
+	err := image_service.ReplaceForbiddenImage(arguments[0], image)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func renameForbiddenImage(arguments []string) {
+	if len(arguments) < 2 {
+		log.Fatal("Need the reference of a registered image and its new reference!")
+	}
+	err := image_service.RenameForbiddenImage(arguments[0], arguments[1])
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// reindexForbiddenImages recomputes features of the forbidden set from the originals, the arguments are the comma
+// separated features or all, the originals directory, dry-run, missing and the filters reference=<glob>, reason=,
+// tags= and expired=
+func reindexForbiddenImages(arguments []string) {
+	arguments, filterArguments := splitKeyValueArguments(arguments)
+	if len(arguments) < 1 {
+		log.Fatal("Need the features to reindex!")
+	}
+
+	options := image_service.ReindexOptions{
+		Features:           strings.Split(arguments[0], ","),
+		OriginalsDirectory: image_service.DefaultOriginalsDirectory,
+	}
+	if arguments[0] == "all" {
+		options.Features = image_service.ReindexFeatures
+	}
+	for _, argument := range arguments[1:] {
+		switch argument {
+		case "dry-run":
+			options.DryRun = true
+		case "missing":
+			options.OnlyMissing = true
+		default:
+			options.OriginalsDirectory = argument
+		}
+	}
+
+	var scopeArguments []string
+	for _, argument := range filterArguments {
+		pattern, found := strings.CutPrefix(argument, "reference=")
+		if found {
+			options.ReferencePattern = pattern
+		} else {
+			scopeArguments = append(scopeArguments, argument)
+		}
+	}
+	if len(scopeArguments) > 0 {
+		scope, err := image_service.ParseMatchScope(scopeArguments)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options.Scope = scope
+	}
+
+	report, err := image_service.Reindex(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	println("----------------------------------------------------")
+	if options.DryRun {
+		println(fmt.Sprintf("Dry run, %d of %d selected images would be reindexed", report.Reindexed, report.Selected))
+	} else {
+		println(fmt.Sprintf("Reindexed %d of %d selected images", report.Reindexed, report.Selected))
+	}
+	if len(report.MissingOriginals) > 0 {
+		println(fmt.Sprintf("%d images have no original in %s:", len(report.MissingOriginals), options.OriginalsDirectory))
+		for _, reference := range report.MissingOriginals {
+			println("  " + reference)
+		}
+	}
+	if len(report.Corrupt) > 0 {
+		println(fmt.Sprintf("%d images have an original that can't be read:", len(report.Corrupt)))
+		for _, reference := range report.Corrupt {
+			println("  " + reference)
+		}
+	}
+	if len(report.Skipped) > 0 {
+		println("Deleted while reindexing:", strings.Join(report.Skipped, ", "))
+	}
+	if len(report.Failed) > 0 {
+		println("Couldn't be written:", strings.Join(report.Failed, ", "))
+		log.Fatal(fmt.Sprintf("reindex failed for %d images", len(report.Failed)))
+	}
+}
+
+// doctorListLimit is the number of collision clusters and unmatchable images the doctor lists per kind, all of them
+// are listed for the analyzer given as argument
+const doctorListLimit = 10
+
+// diagnoseForbiddenSet prints the integrity problems and the statistics of the forbidden set, the optional argument
+// is the analyzer whose unmatchable images are listed completely
+func diagnoseForbiddenSet(arguments []string) {
+	var listedAnalyzer string
+	if len(arguments) > 0 {
+		listedAnalyzer = arguments[0]
+		if !containsArgument(image_service.DoctorAnalyzers, listedAnalyzer) {
+			log.Fatal(
+				"unknown analyzer ", listedAnalyzer, ", the analyzers are ",
+				strings.Join(image_service.DoctorAnalyzers, ", "),
+			)
+		}
+	}
+
+	diagnosis, err := image_service.DiagnoseForbiddenSet()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	println(fmt.Sprintf("%d forbidden images", diagnosis.Images))
+	println(fmt.Sprintf(
+		"zero phash: %d, zero rotation hash: %d, missing digests: %d",
+		diagnosis.ZeroPHashes, diagnosis.ZeroRotationHashes, diagnosis.MissingDigests,
+	))
+
+	println("descriptors:")
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "  analyzer\tempty\tmisaligned\tinvalid\tdescriptors per image")
+	for _, analyzer := range []string{image_analyzer.SIFT, image_analyzer.ORB, image_analyzer.BRISK} {
+		fmt.Fprintf(
+			writer, "  %s\t%d\t%d\t%d\t%s\n", analyzer, diagnosis.EmptyDescriptors[analyzer],
+			diagnosis.MisalignedDescriptors[analyzer], diagnosis.InvalidDescriptors[analyzer],
+			diagnosis.DescriptorCounts[analyzer].String(),
+		)
+	}
+	writer.Flush()
+
+	printBitBalance("phash", diagnosis.PHashBitBalance)
+	printBitBalance("rotation hash", diagnosis.RotationHashBitBalance)
+
+	printCollisionClusters("phash", diagnosis.PHashCollisions)
+	printCollisionClusters("rotation hash", diagnosis.RotationHashCollisions)
+	printCollisionClusters("pixel digest", diagnosis.DigestCollisions)
+
+	println("never matched:")
+	for _, analyzer := range image_service.DoctorAnalyzers {
+		unmatchable := diagnosis.Unmatchable[analyzer]
+		println(fmt.Sprintf("  %s: %d images", analyzer, len(unmatchable)))
+		limit := doctorListLimit
+		if analyzer == listedAnalyzer {
+			limit = len(unmatchable)
+		} else if listedAnalyzer != "" {
+			continue
+		}
+		for index, reference := range unmatchable {
+			if index == limit {
+				println(fmt.Sprintf("    ... %d more", len(unmatchable)-limit))
+				break
+			}
+			println("    " + reference)
+		}
+	}
+}
+
+func printBitBalance(hashName string, balance image_service.BitBalance) {
+	if balance.Hashes == 0 {
+		println(hashName, "bit balance: no hashes")
+		return
+	}
+	var unbalancedBits []string
+	for _, bit := range balance.MostUnbalancedBits(5) {
+		unbalancedBits = append(unbalancedBits, fmt.Sprintf("%d (%.2f)", bit, balance.Ones[bit]))
+	}
+	println(fmt.Sprintf(
+		"%s bit balance of %d hashes: mean deviation from 0.5 is %.3f, most unbalanced bits %s",
+		hashName, balance.Hashes, balance.MeanDeviation(), strings.Join(unbalancedBits, ", "),
+	))
+}
+
+func printCollisionClusters(kind string, clusters []image_service.CollisionCluster) {
+	collidingImages := 0
+	for _, cluster := range clusters {
+		collidingImages += len(cluster.References)
+	}
+	println(fmt.Sprintf("%s collisions: %d clusters of %d images", kind, len(clusters), collidingImages))
+	for index, cluster := range clusters {
+		if index == doctorListLimit {
+			println(fmt.Sprintf("  ... %d more", len(clusters)-doctorListLimit))
+			break
+		}
+		println(fmt.Sprintf("  %s: %s", cluster.Value, strings.Join(cluster.References, ", ")))
+	}
+}
+
+func containsArgument(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
 func compareTwoImages(arguments []string) {
 	if len(arguments) < 3 {
 		log.Fatal("not enough arguments!")
@@ -124,10 +533,82 @@ func compareTwoImages(arguments []string) {
 	}
 }
 
+func allowImages(arguments []string) {
+	if len(arguments) < 1 {
+		log.Fatal("Need a directory or an image!")
+	}
+	images := image_handling.LoadImagesFromPath(arguments[0])
+	err := image_service.AllowImages(images)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func disallowImage(arguments []string) {
+	if len(arguments) < 1 {
+		log.Fatal("Need the reference of an allow-listed image!")
+	}
+	err := image_service.DisallowImage(arguments[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func listAllowedImages(arguments []string) {
+	references, err := image_service.ListAllowedImages()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, reference := range *references {
+		println(reference)
+	}
+	println(fmt.Sprintf("%d images", len(*references)))
+}
+
+// allowListOff is the allow=off argument, it disables the allow-list
+const allowListOff = "off"
+
+// splitAllowListArgument separates the allow=<mode> argument from the other key=value arguments, the mode is the
+// default mode if the argument isn't given and off disables the allow-list
+func splitAllowListArgument(arguments []string, defaultMode string) ([]string, string) {
+	mode := defaultMode
+	var remainingArguments []string
+	for _, argument := range arguments {
+		value, found := strings.CutPrefix(argument, "allow=")
+		if found {
+			mode = value
+		} else {
+			remainingArguments = append(remainingArguments, argument)
+		}
+	}
+	return remainingArguments, mode
+}
+
+// enableAllowList loads the allow-list with the mode, matching continues without allow-list if it can't be loaded
+func enableAllowList(mode string) {
+	if mode == allowListOff {
+		return
+	}
+	allowList, err := image_service.LoadAllowList(mode)
+	if err != nil {
+		log.Println("running without allow-list:", err)
+		return
+	}
+	image_service.UseAllowList(allowList)
+}
+
 func matchToDatabase(arguments []string) {
+	arguments, scopeArguments := splitKeyValueArguments(arguments)
 	if len(arguments) < 2 {
 		log.Fatal("not enough arguments!")
 	}
+	scopeArguments, allowListMode := splitAllowListArgument(scopeArguments, image_service.SuppressMode)
+	scope, err := image_service.ParseMatchScope(scopeArguments)
+	if err != nil {
+		log.Fatal(err)
+	}
+	image_service.UseMatchScope(scope)
+	enableAllowList(allowListMode)
 
 	imagePath := arguments[0]
 	imageAnalyzer := arguments[1]
@@ -137,8 +618,9 @@ func matchToDatabase(arguments []string) {
 	}
 
 	var matchReferences *[]string
-	var err error
 	var extractionTime, matchingTime time.Duration
+	var imageMatcher string
+	var allowListThreshold float64
 	if imageAnalyzer == image_analyzer.PHASH {
 		threshold := 4
 		if len(arguments) > 2 {
@@ -152,16 +634,20 @@ func matchToDatabase(arguments []string) {
 			threshold,
 			true,
 		)
+		allowListThreshold = float64(threshold)
 	} else if imageAnalyzer == image_analyzer.NewAnalyzer {
-		matchReferences, _, err, extractionTime, matchingTime =
+		var poolBuildTime, descriptorMatchingTime time.Duration
+		matchReferences, _, err, extractionTime, poolBuildTime, descriptorMatchingTime =
 			image_service.MatchImageAgainstDatabaseHybrid(image, true)
+		matchingTime = poolBuildTime + descriptorMatchingTime
+		allowListThreshold = image_matching.MatchedHammingDistance
 	} else {
 		if len(arguments) < 3 {
 			log.Fatal("not enough arguments!")
 		}
-		imageMatcher := arguments[2]
+		imageMatcher = arguments[2]
 
-		threshold := 0.4
+		threshold := SimilarityThreshold
 		if len(arguments) > 3 {
 			threshold, err = strconv.ParseFloat(arguments[3], 64)
 			if err != nil || threshold < 0 || threshold > 1 {
@@ -172,9 +658,10 @@ func matchToDatabase(arguments []string) {
 			image,
 			imageAnalyzer,
 			imageMatcher,
-			SimilarityThreshold,
+			threshold,
 			true,
 		)
+		allowListThreshold = threshold
 	}
 
 	if err != nil {
@@ -185,14 +672,33 @@ func matchToDatabase(arguments []string) {
 		return
 	}
 
+	allowListScores, err := image_service.ScoreAllowList(
+		image, imageAnalyzer, imageMatcher, image_matching.WeightedFormula, *matchReferences,
+	)
+	if err != nil {
+		log.Println("couldn't apply allow-list:", err)
+	}
+	decidedReferences, allowListDecision := allowListScores.Decide(allowListThreshold, *matchReferences)
+	matchReferences = &decidedReferences
+
 	println("----------------------------------------------------")
 	println("Time taken for extracting Descriptors from search image:", extractionTime.String())
 	println("Time taken for matching search image with all database images:", matchingTime.String())
+	println("Matched against", scope.String())
+	println("Allow-list:", allowListDecision.String())
 
 	if len(*matchReferences) > 0 {
+		matches, err := image_service.DescribeMatches(matchReferences)
+		if err != nil {
+			log.Fatal(err)
+		}
 		println("Search image matched to database images: ")
-		for _, match := range *matchReferences {
-			println(match)
+		for _, match := range *matches {
+			if metadata := describeMetadata(match.Metadata); metadata != "" {
+				println(match.ExternalReference, "("+metadata+")")
+			} else {
+				println(match.ExternalReference)
+			}
 		}
 	} else {
 		println("Image did not match")
@@ -200,21 +706,31 @@ func matchToDatabase(arguments []string) {
 }
 
 func runScenario(arguments []string) {
+	arguments, keyValueArguments :=
+		splitKeyValueArguments(splitFeatureCacheArgument(splitIndexBudgetArgument(arguments)))
+	if len(arguments) < 2 {
+		log.Fatal("not enough arguments!")
+	}
+	_, allowListMode := splitAllowListArgument(keyValueArguments, allowListOff)
+	enableScenarioAllowList(allowListMode)
 	scenario := arguments[0]
 	analyzingAlgorithm := arguments[1]
 	var thresholdString string
 	var matchingAlgorithm string
+	var optionalArguments []string
 	if analyzingAlgorithm == image_analyzer.PHASH || analyzingAlgorithm == image_analyzer.NewAnalyzer {
 		if len(arguments) < 3 {
 			log.Fatal("not enough arguments!")
 		}
 		thresholdString = arguments[2]
+		optionalArguments = arguments[3:]
 	} else {
 		if len(arguments) < 4 {
 			log.Fatal("not enough arguments!")
 		}
 		matchingAlgorithm = arguments[2]
 		thresholdString = arguments[3]
+		optionalArguments = arguments[4:]
 	}
 
 	threshold, err := strconv.ParseFloat(thresholdString, 64)
@@ -222,9 +738,385 @@ func runScenario(arguments []string) {
 		log.Println("threshold is not valid")
 	}
 
-	if scenario == "all" {
+	var manifest *image_dataset.Manifest
+	if len(optionalArguments) > 0 {
+		manifest, err = image_dataset.ReadManifest(optionalArguments[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if scenario == "all" && manifest != nil {
+		for _, manifestScenario := range manifest.Scenarios() {
+			runSingleScenario(
+				manifestScenario, analyzingAlgorithm, matchingAlgorithm, image_matching.WeightedFormula,
+				&[]float64{threshold}, manifest, nil, false,
+			)
+		}
+	} else if scenario == "all" {
 		runAllScenarios(analyzingAlgorithm, matchingAlgorithm, &[]float64{threshold})
 	} else {
-		runSingleScenario(scenario, analyzingAlgorithm, matchingAlgorithm, &[]float64{threshold}, false)
+		runSingleScenario(
+			scenario, analyzingAlgorithm, matchingAlgorithm, image_matching.WeightedFormula, &[]float64{threshold},
+			manifest, nil, false,
+		)
+	}
+}
+
+func createSplits(arguments []string) {
+	if len(arguments) < 3 {
+		log.Fatal("Need a seed, a validation fraction and a test fraction!")
+	}
+	seed, err := strconv.ParseInt(arguments[0], 10, 64)
+	if err != nil {
+		log.Fatal("invalid seed value", err)
+	}
+	validationFraction, err := strconv.ParseFloat(arguments[1], 64)
+	if err != nil {
+		log.Fatal("invalid validation fraction", err)
+	}
+	testFraction, err := strconv.ParseFloat(arguments[2], 64)
+	if err != nil {
+		log.Fatal("invalid test fraction", err)
+	}
+	folds := 0
+	if len(arguments) > 3 {
+		folds, err = strconv.Atoi(arguments[3])
+		if err != nil {
+			log.Fatal("invalid number of folds", err)
+		}
+	}
+	splitsPath := image_dataset.DefaultSplitsPath
+	if len(arguments) > 4 {
+		splitsPath = arguments[4]
+	}
+
+	_, err = os.Stat(splitsPath)
+	if err == nil {
+		log.Fatal("splits ", splitsPath, " already exist, delete them to create new splits")
+	}
+	splits, err := image_dataset.NewSplits(seed, validationFraction, testFraction, folds)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, scenario := range image_service.LoadRegisteredScenarios() {
+		searchImages := image_service.GetSearchImages(scenario)
+		if searchImages == nil {
+			continue
+		}
+		for _, searchImage := range *searchImages {
+			splits.Assign(image_dataset.Design(searchImage))
+		}
+	}
+
+	err = image_dataset.WriteSplits(splits, splitsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("designs per split:", splits.Count())
+}
+
+// tuneThresholds evaluates the threshold grid of the analyzer, selects the threshold on the validation split and
+// reports it on the test split
+func tuneThresholds(arguments []string) {
+	arguments = splitFeatureCacheArgument(splitIndexBudgetArgument(arguments))
+	if len(arguments) < 2 {
+		log.Fatal("not enough arguments!")
+	}
+	scenario := arguments[0]
+	analyzingAlgorithm := arguments[1]
+	var matchingAlgorithm string
+	var optionalArguments []string
+	thresholds := featureBaseThresholds
+	if analyzingAlgorithm == image_analyzer.PHASH {
+		thresholds = phashThresholds
+		optionalArguments = arguments[2:]
+	} else if analyzingAlgorithm == image_analyzer.NewAnalyzer {
+		log.Fatal("the new algorithm has no thresholds to tune")
+	} else {
+		if len(arguments) < 3 {
+			log.Fatal("not enough arguments!")
+		}
+		matchingAlgorithm = arguments[2]
+		optionalArguments = arguments[3:]
+	}
+
+	splitsPath := image_dataset.DefaultSplitsPath
+	if len(optionalArguments) > 0 {
+		splitsPath = optionalArguments[0]
+	}
+	splits, err := image_dataset.LoadSplits(splitsPath)
+	if err != nil {
+		log.Fatal(err, ", create the splits with the split command")
+	}
+	var manifest *image_dataset.Manifest
+	if len(optionalArguments) > 1 {
+		manifest, err = image_dataset.ReadManifest(optionalArguments[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	scenarios := []string{scenario}
+	if scenario == "all" && manifest != nil {
+		scenarios = manifest.Scenarios()
+	} else if scenario == "all" {
+		scenarios = image_service.LoadRegisteredScenarios()
+	}
+
+	for _, tunedScenario := range scenarios {
+		split := newSplitRun(splits)
+		runSingleScenario(
+			tunedScenario, analyzingAlgorithm, matchingAlgorithm, image_matching.WeightedFormula, &thresholds, manifest,
+			split, false,
+		)
+
+		result := split.evaluation.Evaluate(image_dataset.ValidationSplit, image_dataset.TestSplit, splits.Folds)
+		statistics.WriteSplitResultToCSV(tunedScenario, analyzingAlgorithm, matchingAlgorithm, &result)
+		println("Splits:\n" + result.String())
+
+		// designs that weren't in the search set when the splits were created are persisted with their assignment
+		err = image_dataset.WriteSplits(splits, splitsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func exportManifest(arguments []string) {
+	if len(arguments) < 1 {
+		log.Fatal("Need an output directory!")
+	}
+	scenarios := image_service.LoadRegisteredScenarios()
+	if len(arguments) > 1 && arguments[1] != "all" {
+		scenarios = []string{arguments[1]}
+	}
+
+	manifest, err := image_service.ExportSearchSet(scenarios, arguments[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("exported", len(manifest.Entries), "search images to", arguments[0])
+}
+
+func importManifest(arguments []string) {
+	if len(arguments) < 1 {
+		log.Fatal("Need a manifest!")
+	}
+
+	manifest, err := image_dataset.ReadManifest(arguments[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = image_service.ImportManifest(manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("imported", len(manifest.Entries), "search images from", arguments[0])
+}
+
+func importDataset(arguments []string) {
+	if len(arguments) < 2 {
+		log.Fatal("Need a dataset directory and a scenario name!")
+	}
+	datasetDirectory := arguments[0]
+	scenario := arguments[1]
+	if scenario == "all" || strings.ContainsAny(scenario, "/\\") {
+		log.Fatal("invalid scenario name ", scenario)
+	}
+	groundTruthPath := ""
+	if len(arguments) > 2 {
+		groundTruthPath = arguments[2]
+	}
+
+	dataset, err := image_dataset.LoadExternalDataset(datasetDirectory, groundTruthPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(
+		"importing", len(dataset.ReferencePaths), "references and", len(dataset.Queries), "queries as scenario", scenario,
+	)
+
+	err = image_service.ImportExternalDataset(dataset, scenario, datasetDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func hardNegatives(arguments []string) {
+	originalsDirectory := "images/originals"
+	if len(arguments) > 0 {
+		originalsDirectory = arguments[0]
+	}
+	maxHashDistance := 8
+	minOrbMatches := 0
+	var err error
+	if len(arguments) > 1 {
+		maxHashDistance, err = strconv.Atoi(arguments[1])
+		if err != nil || maxHashDistance < 0 {
+			log.Fatal("invalid hash distance value", err)
+		}
+	}
+	if len(arguments) > 2 {
+		minOrbMatches, err = strconv.Atoi(arguments[2])
+		if err != nil || minOrbMatches < 0 {
+			log.Fatal("invalid orb matches value", err)
+		}
+	}
+
+	hardNegatives, err := image_service.FindHardNegatives(maxHashDistance, minOrbMatches)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("found", len(*hardNegatives), "hard negatives")
+
+	err = image_service.InsertHardNegativeSearchImages(hardNegatives, originalsDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func generateReport(arguments []string) {
+	outputPath := "test-output/report.html"
+	if len(arguments) > 0 {
+		outputPath = arguments[0]
+	}
+	evaluationDirectory := csvDirectory
+	if len(arguments) > 1 {
+		evaluationDirectory = arguments[1]
+	}
+
+	evaluations, err := statistics.LoadOverallEvaluations(evaluationDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = statistics.WriteHTMLReport(
+		evaluations, image_service.LoadRegisteredScenarios(), evaluationDirectory, outputPath,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("report written to", outputPath)
+}
+
+// testSignificance compares every pair of configurations that ran the scenario with McNemar's test
+func testSignificance(arguments []string) {
+	if len(arguments) < 1 {
+		log.Fatal("Need a scenario!")
+	}
+	scenarios := []string{arguments[0]}
+	if arguments[0] == "all" {
+		scenarios = image_service.LoadRegisteredScenarios()
+	}
+
+	evaluations, err := statistics.LoadOverallEvaluations(csvDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, scenario := range scenarios {
+		comparisons := statistics.CompareConfigurations(evaluations, csvDirectory, scenario)
+		if len(comparisons) == 0 {
+			continue
+		}
+		statistics.WriteComparisonsToCSV(scenario, comparisons)
+		for _, comparison := range comparisons {
+			println(scenario + ": " + comparison.String())
+		}
+	}
+}
+
+func saveSnapshot(arguments []string) {
+	if len(arguments) < 1 {
+		log.Fatal("Need a snapshot name!")
+	}
+	evaluationDirectory := csvDirectory
+	if len(arguments) > 1 {
+		evaluationDirectory = arguments[1]
+	}
+	evaluations, err := statistics.LoadOverallEvaluations(evaluationDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path, err := statistics.SaveSnapshot(statistics.NewSnapshot(arguments[0], evaluations))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("saved", len(*evaluations), "evaluations to", path)
+}
+
+// compareRuns exits with status 1 if the candidate regresses beyond the tolerances, the candidate "current" are the
+// evaluations in the csv files
+// allowMissingArgument lets compare-runs pass when entries of the baseline are missing in the candidate
+const allowMissingArgument = "allow-missing"
+
+func compareRuns(arguments []string) {
+	allowMissing := containsArgument(arguments, allowMissingArgument)
+	var positionalArguments []string
+	for _, argument := range arguments {
+		if argument != allowMissingArgument {
+			positionalArguments = append(positionalArguments, argument)
+		}
+	}
+	arguments = positionalArguments
+	if len(arguments) < 2 {
+		log.Fatal("Need a baseline and a candidate snapshot!")
+	}
+	tolerancesPath := statistics.DefaultTolerancesPath
+	if len(arguments) > 2 {
+		tolerancesPath = arguments[2]
+	}
+	tolerances, err := statistics.LoadRegressionTolerances(tolerancesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	baseline, err := statistics.LoadSnapshot(arguments[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	var candidate *statistics.Snapshot
+	if arguments[1] == "current" {
+		evaluations, err := statistics.LoadOverallEvaluations(csvDirectory)
+		if err != nil {
+			log.Fatal(err)
+		}
+		candidate = statistics.NewSnapshot("current", evaluations)
+	} else {
+		candidate, err = statistics.LoadSnapshot(arguments[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	comparison := statistics.CompareSnapshots(baseline, candidate, tolerances)
+	println(comparison.String())
+
+	regressions := comparison.Regressions()
+	failed := false
+	if len(regressions) > 0 {
+		println(fmt.Sprintf("%d metrics of %s regressed against %s", len(regressions), candidate.Name, baseline.Name))
+		failed = true
+	}
+	// a candidate that dropped a configuration of the baseline must not pass the gate unnoticed
+	if len(comparison.Missing) > 0 && !allowMissing {
+		println(fmt.Sprintf(
+			"%d entries of %s are missing in %s, pass %s to accept them",
+			len(comparison.Missing), baseline.Name, candidate.Name, allowMissingArgument,
+		))
+		failed = true
+	}
+	if len(comparison.Incomparable) > 0 {
+		println(fmt.Sprintf(
+			"%d entries of %s can't be compared with %s", len(comparison.Incomparable), candidate.Name, baseline.Name,
+		))
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
 	}
+	println(fmt.Sprintf("%s doesn't regress against %s", candidate.Name, baseline.Name))
 }
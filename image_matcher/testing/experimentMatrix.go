@@ -0,0 +1,300 @@
+package testing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image_matcher/image_analyzer"
+	"image_matcher/image_matching"
+	"image_matcher/image_service"
+	"image_matcher/statistics"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const DefaultExperimentsPath = "experiments.json"
+
+const experimentOutputDirectory = "test-output/experiments"
+
+// ExperimentMatrix is the experiment definition file, the experiments are run in the order they are listed
+type ExperimentMatrix struct {
+	Experiments []Experiment `json:"experiments"`
+}
+
+// Experiment runs every combination of its analyzers, matchers, similarity formulas and scenarios with the threshold
+// grid of the analyzer. Matchers and formulas only apply to the feature based analyzers, the hybrid analyzer has no
+// thresholds.
+type Experiment struct {
+	Name      string   `json:"name"`
+	Analyzers []string `json:"analyzers"`
+	Matchers  []string `json:"matchers,omitempty"`
+	Formulas  []string `json:"formulas,omitempty"`
+	// Thresholds are the threshold grids per analyzer, analyzers without grid use the default grid
+	Thresholds map[string][]float64 `json:"thresholds,omitempty"`
+	// Scenarios default to all registered scenarios, "all" can also be listed explicitly
+	Scenarios []string `json:"scenarios,omitempty"`
+}
+
+// experimentRun is a single combination of the matrix
+type experimentRun struct {
+	Scenario   string    `json:"scenario"`
+	Analyzer   string    `json:"analyzer"`
+	Matcher    string    `json:"matcher,omitempty"`
+	Formula    string    `json:"formula,omitempty"`
+	Thresholds []float64 `json:"thresholds,omitempty"`
+}
+
+// resolvedExperiment is written next to the results of an experiment, so that they can be traced back to the exact
+// configuration
+type resolvedExperiment struct {
+	Experiment Experiment      `json:"experiment"`
+	Runs       []experimentRun `json:"runs"`
+}
+
+func LoadExperimentMatrix(path string) (*ExperimentMatrix, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't read experiments %s: %s", path, err.Error()))
+	}
+
+	var matrix ExperimentMatrix
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&matrix)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't decode experiments %s: %s", path, err.Error()))
+	}
+
+	names := make(map[string]bool)
+	for index := range matrix.Experiments {
+		experiment := &matrix.Experiments[index]
+		err = experiment.validate()
+		if err != nil {
+			return nil, err
+		}
+		if names[experiment.Name] {
+			return nil, errors.New(fmt.Sprintf("experiment %s is defined twice", experiment.Name))
+		}
+		names[experiment.Name] = true
+	}
+	return &matrix, nil
+}
+
+func (e *Experiment) validate() error {
+	if e.Name == "" || strings.ContainsAny(e.Name, "/\\") {
+		return errors.New(fmt.Sprintf("invalid experiment name %q", e.Name))
+	}
+	if len(e.Analyzers) == 0 {
+		return errors.New(fmt.Sprintf("experiment %s has no analyzers", e.Name))
+	}
+	for _, analyzer := range e.Analyzers {
+		if !isExperimentAnalyzer(analyzer) {
+			return errors.New(fmt.Sprintf("experiment %s: unknown analyzer %s", e.Name, analyzer))
+		}
+	}
+	for _, matcher := range e.Matchers {
+		if image_matching.MatcherMapping[matcher] == nil {
+			return errors.New(fmt.Sprintf("experiment %s: unknown matcher %s", e.Name, matcher))
+		}
+	}
+	for _, formula := range e.Formulas {
+		err := image_matching.ValidateSimilarityFormula(formula)
+		if err != nil {
+			return errors.New(fmt.Sprintf("experiment %s: %s", e.Name, err.Error()))
+		}
+	}
+	for analyzer, thresholds := range e.Thresholds {
+		if len(thresholds) == 0 {
+			return errors.New(fmt.Sprintf("experiment %s: empty threshold grid for %s", e.Name, analyzer))
+		}
+	}
+	return nil
+}
+
+func isExperimentAnalyzer(analyzer string) bool {
+	return analyzer == image_analyzer.PHASH || analyzer == image_analyzer.NewAnalyzer ||
+		image_analyzer.AnalyzerMapping[analyzer] != nil
+}
+
+// resolve fills in the defaults and expands the matrix into its runs
+func (e *Experiment) resolve(registeredScenarios []string) resolvedExperiment {
+	resolved := Experiment{
+		Name:       e.Name,
+		Analyzers:  e.Analyzers,
+		Matchers:   e.Matchers,
+		Formulas:   e.Formulas,
+		Thresholds: make(map[string][]float64),
+	}
+	if len(resolved.Matchers) == 0 {
+		resolved.Matchers = []string{image_matching.BFMatcher}
+	}
+	if len(resolved.Formulas) == 0 {
+		resolved.Formulas = []string{image_matching.WeightedFormula}
+	}
+	for _, scenario := range e.Scenarios {
+		if scenario == "all" {
+			resolved.Scenarios = append(resolved.Scenarios, registeredScenarios...)
+		} else {
+			resolved.Scenarios = append(resolved.Scenarios, scenario)
+		}
+	}
+	if len(e.Scenarios) == 0 {
+		resolved.Scenarios = registeredScenarios
+	}
+	for _, analyzer := range resolved.Analyzers {
+		thresholds, defined := e.Thresholds[analyzer]
+		switch {
+		case defined:
+			resolved.Thresholds[analyzer] = thresholds
+		case analyzer == image_analyzer.PHASH:
+			resolved.Thresholds[analyzer] = phashThresholds
+		case analyzer != image_analyzer.NewAnalyzer:
+			resolved.Thresholds[analyzer] = featureBaseThresholds
+		}
+	}
+
+	var runs []experimentRun
+	for _, analyzer := range resolved.Analyzers {
+		for _, scenario := range resolved.Scenarios {
+			switch analyzer {
+			case image_analyzer.PHASH:
+				runs = append(runs, experimentRun{
+					Scenario: scenario, Analyzer: analyzer, Thresholds: resolved.Thresholds[analyzer],
+				})
+			case image_analyzer.NewAnalyzer:
+				runs = append(runs, experimentRun{Scenario: scenario, Analyzer: analyzer})
+			default:
+				for _, matcher := range resolved.Matchers {
+					for _, formula := range resolved.Formulas {
+						runs = append(runs, experimentRun{
+							Scenario:   scenario,
+							Analyzer:   analyzer,
+							Matcher:    matcher,
+							Formula:    formula,
+							Thresholds: resolved.Thresholds[analyzer],
+						})
+					}
+				}
+			}
+		}
+	}
+	return resolvedExperiment{Experiment: resolved, Runs: runs}
+}
+
+// key identifies the run in the completed runs of an experiment, changing the threshold grid runs it again
+func (r *experimentRun) key() string {
+	var thresholds []string
+	for _, threshold := range r.Thresholds {
+		thresholds = append(thresholds, fmt.Sprintf("%g", threshold))
+	}
+	return fmt.Sprintf("%s/%s/%s/%s/%s", r.Scenario, r.Analyzer, r.Matcher, r.Formula, strings.Join(thresholds, ","))
+}
+
+// runExperiments runs the experiments of the definition file, or only the experiment with the given name
+func runExperiments(arguments []string) {
+	arguments = splitFeatureCacheArgument(splitIndexBudgetArgument(arguments))
+	experimentsPath := DefaultExperimentsPath
+	if len(arguments) > 0 {
+		experimentsPath = arguments[0]
+	}
+	matrix, err := LoadExperimentMatrix(experimentsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	experimentFound := false
+	for _, experiment := range matrix.Experiments {
+		if len(arguments) > 1 && experiment.Name != arguments[1] {
+			continue
+		}
+		experimentFound = true
+		runExperiment(&experiment)
+	}
+	if !experimentFound && len(arguments) > 1 {
+		log.Fatal("no experiment ", arguments[1], " in ", experimentsPath)
+	}
+}
+
+func runExperiment(experiment *Experiment) {
+	outputDirectory := filepath.Join(experimentOutputDirectory, experiment.Name)
+	err := os.MkdirAll(outputDirectory, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	resolved := experiment.resolve(image_service.LoadRegisteredScenarios())
+	err = writeJSON(filepath.Join(outputDirectory, "experiment.json"), resolved)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	completedPath := filepath.Join(outputDirectory, "completed.json")
+	completed, err := loadCompletedRuns(completedPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	statistics.SetCSVOutputDirectory(filepath.Join(outputDirectory, "csv-files"))
+	defer statistics.SetCSVOutputDirectory(statistics.DefaultCSVOutputDirectory)
+
+	for index, run := range resolved.Runs {
+		key := run.key()
+		if completed[key] {
+			log.Println("Skipping completed run", key)
+			continue
+		}
+		log.Println(fmt.Sprintf("Experiment %s run %d/%d: %s", experiment.Name, index+1, len(resolved.Runs), key))
+
+		thresholds := run.Thresholds
+		runSingleScenario(run.Scenario, run.Analyzer, run.Matcher, run.Formula, &thresholds, nil, nil, false)
+
+		completed[key] = true
+		err = writeCompletedRuns(completedPath, completed)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Println("Experiment", experiment.Name, "written to", outputDirectory)
+}
+
+func loadCompletedRuns(path string) (map[string]bool, error) {
+	completed := make(map[string]bool)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return completed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	err = json.Unmarshal(content, &keys)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("couldn't decode completed runs %s: %s", path, err.Error()))
+	}
+	for _, key := range keys {
+		completed[key] = true
+	}
+	return completed, nil
+}
+
+func writeCompletedRuns(path string, completed map[string]bool) error {
+	var keys []string
+	for key := range completed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return writeJSON(path, keys)
+}
+
+func writeJSON(path string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
@@ -0,0 +1,210 @@
+package testing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image_matcher/statistics"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// ScenarioWorkers is the number of search images that are matched in parallel. The latencies are measured per search
+// image, with more workers than cores they include the time the workers wait for each other.
+var ScenarioWorkers = runtime.NumCPU()
+
+const checkpointDirectory = "checkpoints"
+
+// scenarioCheckpoint records the results of the search images a scenario run completed, so that an interrupted run
+// resumes with the next search image. The detail evaluation is truncated to its size before the interrupted run and
+// the recorded results are written again, so a resumed run neither loses nor duplicates rows.
+type scenarioCheckpoint struct {
+	path    string
+	header  checkpointHeader
+	results map[string]json.RawMessage
+	file    *os.File
+}
+
+// checkpointHeader identifies the run the checkpoint belongs to, DetailRows is the number of rows the detail
+// evaluation had before the run
+type checkpointHeader struct {
+	Scenario   string   `json:"scenario"`
+	Analyzer   string   `json:"analyzer"`
+	Matcher    string   `json:"matcher"`
+	Thresholds []string `json:"thresholds"`
+	AllowList  string   `json:"allowList"`
+	DetailRows int      `json:"detailRows"`
+}
+
+type checkpointEntry struct {
+	Reference string          `json:"reference"`
+	Result    json.RawMessage `json:"result"`
+}
+
+func openCheckpointOrFail(scenario string, analyzer string, matcher string, thresholds []string) *scenarioCheckpoint {
+	checkpoint, err := openScenarioCheckpoint(scenario, analyzer, matcher, thresholds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return checkpoint
+}
+
+// openScenarioCheckpoint resumes the checkpoint of an interrupted run with the same thresholds and allow-list mode or
+// starts a new one. The checkpoint of an interrupted run with others is discarded together with the rows it wrote.
+func openScenarioCheckpoint(
+	scenario string, analyzer string, matcher string, thresholds []string,
+) (*scenarioCheckpoint, error) {
+	name := scenario
+	if matcher != "" {
+		name += "-" + matcher
+	}
+	checkpoint := scenarioCheckpoint{
+		path: filepath.Join(
+			statistics.CSVOutputDirectory(), checkpointDirectory, analyzer, name+".jsonl",
+		),
+		header: checkpointHeader{
+			Scenario:   scenario,
+			Analyzer:   analyzer,
+			Matcher:    matcher,
+			Thresholds: thresholds,
+			AllowList:  scenarioAllowListMode,
+		},
+		results: make(map[string]json.RawMessage),
+	}
+
+	previousHeader, entries, err := readCheckpoint(checkpoint.path)
+	switch {
+	case err == nil:
+		err = statistics.TruncateDetailEvaluation(scenario, analyzer, matcher, previousHeader.DetailRows)
+		if err != nil {
+			return nil, err
+		}
+		checkpoint.header.DetailRows = previousHeader.DetailRows
+		if equalThresholds(previousHeader.Thresholds, thresholds) && previousHeader.AllowList == scenarioAllowListMode {
+			for _, entry := range entries {
+				checkpoint.results[entry.Reference] = entry.Result
+			}
+			log.Println("Resuming", scenario, analyzer, matcher, "after", len(checkpoint.results), "search images")
+		} else {
+			entries = nil
+			log.Println("Discarding the checkpoint of", scenario, analyzer, matcher, "with other thresholds or allow-list")
+		}
+	case os.IsNotExist(err):
+		entries = nil
+		checkpoint.header.DetailRows, err = statistics.DetailEvaluationRows(scenario, analyzer, matcher)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	// the checkpoint is rewritten, so that a line that was cut off by the interruption is dropped
+	err = checkpoint.create(entries)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func readCheckpoint(path string) (checkpointHeader, []checkpointEntry, error) {
+	var header checkpointHeader
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return header, nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil {
+		return header, nil, errors.New(fmt.Sprintf("checkpoint %s has no valid header", path))
+	}
+	var entries []checkpointEntry
+	for scanner.Scan() {
+		var entry checkpointEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return header, entries, nil
+}
+
+func (c *scenarioCheckpoint) create(entries []checkpointEntry) error {
+	err := os.MkdirAll(filepath.Dir(c.path), 0755)
+	if err != nil {
+		return err
+	}
+	c.file, err = os.Create(c.path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't create checkpoint %s: %s", c.path, err.Error()))
+	}
+
+	err = c.writeLine(c.header)
+	for _, entry := range entries {
+		if err != nil {
+			break
+		}
+		err = c.writeLine(entry)
+	}
+	return err
+}
+
+func (c *scenarioCheckpoint) completed(reference string) bool {
+	_, exists := c.results[reference]
+	return exists
+}
+
+func (c *scenarioCheckpoint) result(reference string, result interface{}) error {
+	err := json.Unmarshal(c.results[reference], result)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't decode the checkpoint of %s: %s", reference, err.Error()))
+	}
+	return nil
+}
+
+// complete appends the result of the search image to the checkpoint
+func (c *scenarioCheckpoint) complete(reference string, result interface{}) error {
+	encodedResult, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return c.writeLine(checkpointEntry{Reference: reference, Result: encodedResult})
+}
+
+func (c *scenarioCheckpoint) writeLine(value interface{}) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = c.file.Write(append(line, '\n'))
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't write checkpoint %s: %s", c.path, err.Error()))
+	}
+	return nil
+}
+
+// finish removes the checkpoint once the overall evaluation of the run is written
+func (c *scenarioCheckpoint) finish() {
+	c.file.Close()
+	err := os.Remove(c.path)
+	if err != nil {
+		log.Println("couldn't remove checkpoint", c.path, err)
+	}
+}
+
+func equalThresholds(first []string, second []string) bool {
+	if len(first) != len(second) {
+		return false
+	}
+	for index := range first {
+		if first[index] != second[index] {
+			return false
+		}
+	}
+	return true
+}
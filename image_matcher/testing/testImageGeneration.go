@@ -1,16 +1,12 @@
 package testing
 
 import (
-	"database/sql"
-	"fmt"
-	"image_matcher/image_analyzer"
-	"image_matcher/image_database"
 	"image_matcher/image_handling"
 	"image_matcher/image_service"
 	"log"
 )
 
-func populateDatabase(directoryPath string) {
+func populateDatabase(directoryPath string, spec *image_handling.VariationSpec, seed int64) {
 	paths := image_handling.GetFilePathsFromDirectory(directoryPath)
 	var chunkSize = 10
 
@@ -26,18 +22,39 @@ func populateDatabase(directoryPath string) {
 		originals := image_handling.LoadImagesFromDirectory(paths[offset:limit])
 
 		for _, original := range originals {
-			for _, modifier := range image_handling.Modifiers {
-				variations := image_handling.GenerateDuplicateVariations(original, modifier)
-				image_service.InsertDuplicateSearchImage(variations, original.ExternalReference, modifier)
+			for _, modifierSpec := range spec.Modifiers {
+				variations := image_handling.GenerateDuplicateVariations(original, &modifierSpec, spec.Hash, seed)
+				image_service.InsertDuplicateSearchImage(variations, original.ExternalReference, modifierSpec.Modifier)
 				variations = nil
 			}
-			variation := image_handling.GenerateMixedVariation(original)
-			image_service.InsertDuplicateSearchImage(
-				&[]image_handling.ImageVariation{*variation},
-				original.ExternalReference,
-				"mixed",
-			)
-			variation = nil
+			for index := 0; index < spec.Duplicates.Mixed; index++ {
+				variation, err := image_handling.GenerateMixedVariation(original, spec, seed, false, index)
+				if err != nil {
+					log.Println("Skipping", image_service.MIXED, "variation of", original.ExternalReference+":", err)
+					continue
+				}
+				image_service.InsertDuplicateSearchImage(
+					&[]image_handling.ImageVariation{*variation},
+					original.ExternalReference,
+					image_service.MIXED,
+				)
+				variation = nil
+			}
+			for _, scenario := range spec.Scenarios {
+				for index := 0; index < scenario.Count; index++ {
+					variation, err := image_handling.GenerateScenarioVariation(
+						original, &scenario, spec.Hash, seed, false, index,
+					)
+					if err != nil {
+						log.Println("Skipping", scenario.Name, "variation of", original.ExternalReference+":", err)
+						continue
+					}
+					image_service.InsertDuplicateSearchImage(
+						&[]image_handling.ImageVariation{*variation}, original.ExternalReference, scenario.Name,
+					)
+					variation = nil
+				}
+			}
 		}
 
 		if len(originals) < chunkSize {
@@ -48,7 +65,7 @@ func populateDatabase(directoryPath string) {
 }
 
 // create uniques for search sets
-func generateUniques(directoryPath string) {
+func generateUniques(directoryPath string, spec *image_handling.VariationSpec, seed int64) {
 
 	paths := image_handling.GetFilePathsFromDirectory(directoryPath)
 	var chunkSize = 10
@@ -61,7 +78,7 @@ func generateUniques(directoryPath string) {
 		originals := image_handling.LoadImagesFromDirectory(paths[index:limit])
 
 		for _, original := range originals {
-			image_service.GenerateAndInsertUniqueSearchImages(original)
+			image_service.GenerateAndInsertUniqueSearchImages(original, spec, seed)
 		}
 
 		originals = nil
@@ -69,26 +86,3 @@ func generateUniques(directoryPath string) {
 
 	paths = nil
 }
-
-func updateDatabaseWithNewHash([]string) {
-	err := image_database.ApplyDatabaseOperation(func(databaseConnection *sql.DB) {
-		references, err := image_database.GetForbiddenReferences(databaseConnection)
-		if err != nil {
-			log.Println(err)
-		}
-		println(len(*references))
-		for _, reference := range *references {
-			rawImage := image_handling.LoadRawImage(fmt.Sprintf("images/originals/%s.png", reference))
-			hash, _ := image_analyzer.CalculateOrientedPHash(&rawImage.Data)
-			err := image_database.InsertRotationHashIntoDatabase(databaseConnection, reference, hash)
-			if err != nil {
-				log.Println(err)
-			}
-		}
-
-	})
-	if err != nil {
-		log.Println(err)
-	}
-
-}
@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"image_matcher/image_analyzer"
 	"image_matcher/image_database"
+	"image_matcher/image_dataset"
 	"image_matcher/image_handling"
 	"image_matcher/image_matching"
 	"image_matcher/image_service"
 	"image_matcher/statistics"
 	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,30 +21,198 @@ var featureBaseThresholds = []float64{0.2, 0.25, 0.3, 0.35, 0.4, 0.45, 0.5, 0.55
 
 var phashThresholds = []float64{4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24}
 
-func runAllScenariosPerAlgorithm([]string) {
-	runAllScenarios(image_analyzer.PHASH, "", &phashThresholds)
+func runAllScenarios(analyzingAlgorithm string, matchingAlgorithm string, threshold *[]float64) {
+	for _, scenario := range image_service.LoadRegisteredScenarios() {
+		runSingleScenario(
+			scenario, analyzingAlgorithm, matchingAlgorithm, image_matching.WeightedFormula, threshold, nil, nil, false,
+		)
+	}
+}
 
-	runAllScenarios(image_analyzer.SIFT, image_matching.BFMatcher, &featureBaseThresholds)
-	runAllScenarios(image_analyzer.BRISK, image_matching.BFMatcher, &featureBaseThresholds)
-	runAllScenarios(image_analyzer.ORB, image_matching.BFMatcher, &featureBaseThresholds)
+var featureCache *image_analyzer.FeatureCache
 
-	runFeatureBasedScenario("mixed", image_analyzer.SIFT, image_matching.FlannMatcher, &featureBaseThresholds)
-	runFeatureBasedScenario("mixed", image_analyzer.BRISK, image_matching.FlannMatcher, &featureBaseThresholds)
-	runFeatureBasedScenario("mixed", image_analyzer.ORB, image_matching.FlannMatcher, &featureBaseThresholds)
+var featureCacheOnce sync.Once
+
+// featureCacheEnabled is set by the feature-cache=on argument, the cache is off by default so that the extraction
+// latencies are measured
+var featureCacheEnabled = false
+
+// splitFeatureCacheArgument enables the feature cache with the feature-cache=on argument and returns the other
+// arguments
+func splitFeatureCacheArgument(arguments []string) []string {
+	var remainingArguments []string
+	for _, argument := range arguments {
+		value, found := strings.CutPrefix(argument, "feature-cache=")
+		if !found {
+			remainingArguments = append(remainingArguments, argument)
+			continue
+		}
+		if value != "on" && value != "off" {
+			log.Fatal("feature cache must be on or off, got ", value)
+		}
+		featureCacheEnabled = value == "on"
+	}
+	return remainingArguments
 }
 
-func runAllScenarios(analyzingAlgorithm string, matchingAlgorithm string, threshold *[]float64) {
-	for _, scenario := range image_service.Scenarios {
-		runSingleScenario(scenario, analyzingAlgorithm, matchingAlgorithm, threshold, false)
+// extractionStage is the stage the extraction latencies are recorded in, runs with the feature cache record them
+// separately, so that they aren't compared with the extraction of runs without cache
+func extractionStage() string {
+	if featureCache != nil {
+		return statistics.CachedExtractionStage
 	}
+	return statistics.ExtractionStage
 }
 
+// enableFeatureCache opens the feature cache that is shared by all scenario runs if it is enabled, the runs continue
+// without cache if it can't be opened
+func enableFeatureCache() {
+	if !featureCacheEnabled {
+		return
+	}
+	featureCacheOnce.Do(func() {
+		cache, err := image_analyzer.OpenFeatureCache(
+			image_analyzer.DefaultFeatureCacheDirectory, image_analyzer.DefaultFeatureCacheSize,
+		)
+		if err != nil {
+			log.Println("running without feature cache:", err)
+			return
+		}
+		featureCache = cache
+		image_analyzer.UseFeatureCache(cache)
+	})
+}
+
+var forbiddenIndexOnce sync.Once
+
+// forbiddenIndexBudget is the memory budget of the forbidden index in bytes, it is set by the index-budget argument
+var forbiddenIndexBudget int64 = image_service.DefaultIndexMemoryBudget
+
+// splitIndexBudgetArgument sets the memory budget of the forbidden index from the index-budget=<MiB> argument and
+// returns the other arguments
+func splitIndexBudgetArgument(arguments []string) []string {
+	var remainingArguments []string
+	for _, argument := range arguments {
+		value, found := strings.CutPrefix(argument, "index-budget=")
+		if !found {
+			remainingArguments = append(remainingArguments, argument)
+			continue
+		}
+		budget, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || budget < 0 {
+			log.Fatal("index budget must be a number of MiB, got ", value)
+		}
+		forbiddenIndexBudget = budget << 20
+	}
+	return remainingArguments
+}
+
+// enableForbiddenIndex loads the forbidden set into memory once for all scenario runs, the runs match against the
+// database if it doesn't fit into the memory budget
+func enableForbiddenIndex() {
+	forbiddenIndexOnce.Do(func() {
+		index, err := image_service.LoadForbiddenIndex(
+			[]string{image_analyzer.SIFT, image_analyzer.ORB, image_analyzer.BRISK}, forbiddenIndexBudget,
+		)
+		if err != nil {
+			log.Println("running without forbidden index:", err)
+			return
+		}
+		image_service.UseForbiddenIndex(index)
+	})
+}
+
+// scenarioAllowListMode is the allow-list mode of the scenario runs. The runs only apply the allow-list if the scenario
+// command enables it, so that their results don't depend on the content of the allow-list.
+var scenarioAllowListMode = allowListOff
+
+// enableScenarioAllowList loads the allow-list for the scenario runs of the command, the command fails if it can't be
+// loaded so that a run never silently runs without the allow-list it was asked for
+func enableScenarioAllowList(mode string) {
+	if mode == allowListOff {
+		return
+	}
+	allowList, err := image_service.LoadAllowList(mode)
+	if err != nil {
+		log.Fatal("couldn't load allow-list: ", err)
+	}
+	image_service.UseAllowList(allowList)
+	scenarioAllowListMode = mode
+}
+
+// applyAllowList scores the search image against the allow-list once and applies it to the matches of every threshold
+func applyAllowList[Threshold int | float64](
+	searchImage image_database.SearchImageEntity,
+	rawImage *image_handling.RawImage,
+	analyzer string,
+	matcher string,
+	formula string,
+	matchedPerThreshold map[Threshold][]string,
+) {
+	if scenarioAllowListMode == allowListOff {
+		return
+	}
+	var matchedReferences []string
+	seen := make(map[string]bool)
+	for _, references := range matchedPerThreshold {
+		for _, reference := range references {
+			if !seen[reference] {
+				seen[reference] = true
+				matchedReferences = append(matchedReferences, reference)
+			}
+		}
+	}
+	scores, err := image_service.ScoreAllowList(rawImage, analyzer, matcher, formula, matchedReferences)
+	if err != nil {
+		log.Println("couldn't apply allow-list to", searchImage.ExternalReference, err)
+		return
+	}
+	for threshold, references := range matchedPerThreshold {
+		decidedReferences, decision := scores.Decide(float64(threshold), references)
+		if decision.Decision == image_service.AllowListSuppressed {
+			log.Println(searchImage.ExternalReference, "at threshold", threshold, decision.String())
+		}
+		matchedPerThreshold[threshold] = decidedReferences
+	}
+}
+
+// splitRun assigns the search images to the split of their design and collects their classifications per split
+type splitRun struct {
+	splits     *image_dataset.Splits
+	evaluation *statistics.SplitEvaluation
+}
+
+func newSplitRun(splits *image_dataset.Splits) *splitRun {
+	return &splitRun{splits: splits, evaluation: statistics.NewSplitEvaluation()}
+}
+
+func (r *splitRun) add(searchImage image_database.SearchImageEntity, threshold string, classification string) {
+	if r == nil {
+		return
+	}
+	assignment := r.splits.Assign(image_dataset.Design(searchImage))
+	r.evaluation.Add(assignment.Split, assignment.Fold, threshold, classification)
+}
+
+// runSingleScenario runs the scenario with the search images of the manifest or with the search set of the database
+// if no manifest is given. The classifications are collected per split if a split run is given.
 func runSingleScenario(
-	scenario string, analyzingAlgorithm string, matchingAlgorithm string, thresholds *[]float64, debug bool,
+	scenario string,
+	analyzingAlgorithm string,
+	matchingAlgorithm string,
+	formula string,
+	thresholds *[]float64,
+	manifest *image_dataset.Manifest,
+	split *splitRun,
+	debug bool,
 ) {
-	var scenarioRuntime, extractionTime, matchingTime time.Duration
+	var scenarioRuntime time.Duration
+	var latencies *statistics.LatencyDistribution
+	var parameterEvaluation *statistics.ParameterEvaluation
 	var classEvalPhash *map[int]statistics.ClassificationEvaluation
 	var classEvalFeatureBased *map[float64]statistics.ClassificationEvaluation
+	enableFeatureCache()
+	enableForbiddenIndex()
 
 	if analyzingAlgorithm == image_analyzer.PHASH {
 		thresholdsInt := make([]int, len(*thresholds))
@@ -48,199 +220,459 @@ func runSingleScenario(
 			thresholdsInt[i] = int(threshold)
 		}
 		startTime := time.Now()
-		classEvalPhash, extractionTime, matchingTime = runPHashScenario(scenario, &thresholdsInt)
+		classEvalPhash, latencies, parameterEvaluation = runPHashScenario(scenario, &thresholdsInt, manifest, split)
 		scenarioRuntime = time.Since(startTime)
 	} else if analyzingAlgorithm == image_analyzer.NewAnalyzer {
 		startTime := time.Now()
-		classEvalFeatureBased, extractionTime, matchingTime = runHybridScenario(scenario)
+		classEvalFeatureBased, latencies, parameterEvaluation = runHybridScenario(scenario, manifest, split)
 		scenarioRuntime = time.Since(startTime)
 	} else {
 		startTime := time.Now()
-		classEvalFeatureBased, extractionTime, matchingTime =
-			runFeatureBasedScenario(scenario, analyzingAlgorithm, matchingAlgorithm, thresholds)
+		classEvalFeatureBased, latencies, parameterEvaluation =
+			runFeatureBasedScenario(scenario, analyzingAlgorithm, matchingAlgorithm, formula, thresholds, manifest, split)
 		scenarioRuntime = time.Since(startTime)
 	}
 
 	println("\n---------------------------------")
 	println("Scenario ran for", scenarioRuntime.String())
-	println("ExtractionTime", extractionTime.String())
-	println("MatchingTime", matchingTime.String())
+	println("ExtractionTime", latencies.Total(extractionStage()).String())
+	println("MatchingTime", latencies.Total(latencies.MatchingStages()...).String())
+	println("Latencies per image:\n" + latencies.String())
+	println("Allow-list:", scenarioAllowListMode)
+	if featureCache != nil {
+		hits, misses, size := featureCache.Statistics()
+		println(fmt.Sprintf("Feature cache: %d hits, %d misses, %.1f MB", hits, misses, float64(size)/(1<<20)))
+	}
 	if analyzingAlgorithm == image_analyzer.PHASH {
 		evaluation := (*classEvalPhash)[int((*thresholds)[0])]
 		println("Eval: ", evaluation.String())
+		println("Recall per parameter:\n" + parameterEvaluation.String(strconv.Itoa(int((*thresholds)[0]))))
 	} else if analyzingAlgorithm == image_analyzer.NewAnalyzer {
-		evaluation := (*classEvalFeatureBased)[(*thresholds)[0]]
+		evaluation := (*classEvalFeatureBased)[0]
 		println("Eval: ", evaluation.String())
+		println("Recall per parameter:\n" + parameterEvaluation.String(fmt.Sprintf("%.2f", 0.0)))
 	} else {
 		evaluation := (*classEvalFeatureBased)[(*thresholds)[0]]
 		println("Eval: ", evaluation.String())
+		println("Recall per parameter:\n" + parameterEvaluation.String(fmt.Sprintf("%.2f", (*thresholds)[0])))
 	}
 }
 
+// pHashImageResult is the result of matching a search image, it is stored in the checkpoint of the run
+type pHashImageResult struct {
+	MatchedPerThreshold map[int][]string `json:"matchedPerThreshold"`
+	ExtractionTime      time.Duration    `json:"extractionTime"`
+	MatchingTime        time.Duration    `json:"matchingTime"`
+}
+
 func runPHashScenario(
 	scenario string,
 	thresholds *[]int,
-) (*map[int]statistics.ClassificationEvaluation, time.Duration, time.Duration) {
-	var totalExtractionTime, totalMatchingTime time.Duration
+	manifest *image_dataset.Manifest,
+	split *splitRun,
+) (*map[int]statistics.ClassificationEvaluation, *statistics.LatencyDistribution, *statistics.ParameterEvaluation) {
+	latencies := statistics.NewLatencyDistribution(extractionStage(), statistics.HashMatchStage)
+	parameterEvaluation := statistics.NewParameterEvaluation()
 
 	classificationMap := make(map[int]statistics.ClassificationEvaluation)
 
+	var thresholdLabels []string
 	for _, threshold := range *thresholds {
 		classificationMap[threshold] = statistics.ClassificationEvaluation{}
+		thresholdLabels = append(thresholdLabels, strconv.Itoa(threshold))
 	}
+	checkpoint := openCheckpointOrFail(scenario, image_analyzer.PHASH, "", thresholdLabels)
 
-	applyScenarioRun(func(searchImage image_database.SearchImageEntity, rawImage *image_handling.RawImage) {
+	match := func(searchImage image_database.SearchImageEntity, rawImage *image_handling.RawImage) pHashImageResult {
 		matchedPerThreshold, err, extractionTime, matchingTime :=
 			image_service.MatchImageAgainstDatabasePHashWithMultipleThresholds(rawImage, thresholds)
-		if err != nil {
+		if err != nil || matchedPerThreshold == nil {
 			log.Println("error while matching", searchImage.ExternalReference, "against database!")
+			matchedPerThreshold = &map[int][]string{}
+		}
+		applyAllowList(searchImage, rawImage, image_analyzer.PHASH, "", "", *matchedPerThreshold)
+		return pHashImageResult{
+			MatchedPerThreshold: *matchedPerThreshold,
+			ExtractionTime:      extractionTime,
+			MatchingTime:        matchingTime,
 		}
-		totalExtractionTime += extractionTime
-		totalMatchingTime += matchingTime
+	}
+
+	record := func(searchImage image_database.SearchImageEntity, result pHashImageResult) {
+		latencies.Add(extractionStage(), result.ExtractionTime)
+		latencies.Add(statistics.HashMatchStage, result.MatchingTime)
 
 		imageEvaluations := evaluateClassificationsPHash(
-			&classificationMap, matchedPerThreshold, &searchImage.OriginalReference, &searchImage.ExternalReference,
-			extractionTime, matchingTime,
+			&classificationMap, &result.MatchedPerThreshold, &searchImage.OriginalReference,
+			&searchImage.ExternalReference, ignoredReference(searchImage.Notes), result.ExtractionTime,
+			result.MatchingTime,
 		)
 		statistics.WritePHashImageEvalToCSV(scenario, imageEvaluations)
+		for _, imageEvaluation := range *imageEvaluations {
+			parameterEvaluation.Add(imageEvaluation.Threshold, searchImage.Notes, imageEvaluation.ClassEval)
+			split.add(searchImage, imageEvaluation.Threshold, imageEvaluation.ClassEval)
+		}
+	}
 
-		matchedPerThreshold = nil
-	}, scenario)
+	specHash := applyScenarioRun(match, record, scenario, manifest, checkpoint)
 
 	for threshold, evaluation := range classificationMap {
 		statistics.WriteOverallEvalToCSV(
-			scenario, image_analyzer.PHASH, "", strconv.Itoa(threshold), &evaluation, totalExtractionTime,
-			totalMatchingTime,
+			scenario, image_analyzer.PHASH, "", strconv.Itoa(threshold), specHash, &evaluation, latencies,
 		)
 	}
+	parameterEvaluation.WriteToCSV(scenario, image_analyzer.PHASH, "")
+	checkpoint.finish()
+
+	return &classificationMap, latencies, parameterEvaluation
+}
 
-	return &classificationMap, totalExtractionTime, totalMatchingTime
+// featureBasedImageResult is the result of matching a search image, it is stored in the checkpoint of the run. The
+// matches are stored per formatted threshold, json has no float keys.
+type featureBasedImageResult struct {
+	MatchedPerThreshold map[string][]string `json:"matchedPerThreshold"`
+	NumberOfDescriptors int                 `json:"numberOfDescriptors"`
+	ExtractionTime      time.Duration       `json:"extractionTime"`
+	MatchingTime        time.Duration       `json:"matchingTime"`
 }
 
 func runFeatureBasedScenario(
 	scenario string,
 	analyzingAlgorithm string,
 	matchingAlgorithm string,
+	formula string,
 	thresholds *[]float64,
-) (*map[float64]statistics.ClassificationEvaluation, time.Duration, time.Duration) {
-	var totalExtractionTime, totalMatchingTime time.Duration
+	manifest *image_dataset.Manifest,
+	split *splitRun,
+) (*map[float64]statistics.ClassificationEvaluation, *statistics.LatencyDistribution, *statistics.ParameterEvaluation) {
+	latencies := statistics.NewLatencyDistribution(extractionStage(), statistics.DescriptorMatchStage)
+	parameterEvaluation := statistics.NewParameterEvaluation()
 	classificationMap := make(map[float64]statistics.ClassificationEvaluation)
+	matcherLabel := formulaMatcherLabel(matchingAlgorithm, formula)
 
+	var thresholdLabels []string
 	for _, threshold := range *thresholds {
 		classificationMap[threshold] = statistics.ClassificationEvaluation{}
+		thresholdLabels = append(thresholdLabels, thresholdKey(threshold))
 	}
+	checkpoint := openCheckpointOrFail(scenario, analyzingAlgorithm, matcherLabel, thresholdLabels)
 
-	applyScenarioRun(func(searchImage image_database.SearchImageEntity, rawImage *image_handling.RawImage) {
+	match := func(
+		searchImage image_database.SearchImageEntity, rawImage *image_handling.RawImage,
+	) featureBasedImageResult {
 		matchedPerThreshold, err, searchImageDescriptors, extractionTime, matchingTime :=
 			image_service.MatchAgainstDatabaseFeatureBasedWithMultipleThresholds(
 				rawImage,
 				analyzingAlgorithm,
 				matchingAlgorithm,
 				thresholds,
+				formula,
 			)
 		if err != nil {
 			log.Println("error while matching", searchImage.ExternalReference, "against database!")
 		}
 
-		totalExtractionTime += extractionTime
-		totalMatchingTime += matchingTime
+		result := featureBasedImageResult{
+			MatchedPerThreshold: make(map[string][]string),
+			ExtractionTime:      extractionTime,
+			MatchingTime:        matchingTime,
+		}
+		if matchedPerThreshold != nil {
+			applyAllowList(searchImage, rawImage, analyzingAlgorithm, matchingAlgorithm, formula, *matchedPerThreshold)
+			for threshold, matchedRefs := range *matchedPerThreshold {
+				result.MatchedPerThreshold[thresholdKey(threshold)] = matchedRefs
+			}
+		}
+		if searchImageDescriptors != nil {
+			result.NumberOfDescriptors = searchImageDescriptors.Rows()
+			searchImageDescriptors.Close()
+		}
+		return result
+	}
 
+	record := func(searchImage image_database.SearchImageEntity, result featureBasedImageResult) {
+		latencies.Add(extractionStage(), result.ExtractionTime)
+		latencies.Add(statistics.DescriptorMatchStage, result.MatchingTime)
+
+		matchedPerThreshold := make(map[float64][]string)
+		for _, threshold := range *thresholds {
+			matchedPerThreshold[threshold] = result.MatchedPerThreshold[thresholdKey(threshold)]
+		}
 		imageEvaluations := evaluateClassificationsFeatureBased(
-			&classificationMap, matchedPerThreshold, &searchImage.OriginalReference, &searchImage.ExternalReference,
-			searchImageDescriptors.Rows(), extractionTime, matchingTime,
+			&classificationMap, &matchedPerThreshold, &searchImage.OriginalReference, &searchImage.ExternalReference,
+			ignoredReference(searchImage.Notes), result.NumberOfDescriptors, result.ExtractionTime,
+			result.MatchingTime,
 		)
-		statistics.WriteFeatureBasedImageEvalToCSV(scenario, analyzingAlgorithm, matchingAlgorithm, imageEvaluations)
+		statistics.WriteFeatureBasedImageEvalToCSV(scenario, analyzingAlgorithm, matcherLabel, imageEvaluations)
+		for _, imageEvaluation := range *imageEvaluations {
+			parameterEvaluation.Add(imageEvaluation.Threshold, searchImage.Notes, imageEvaluation.ClassEval)
+			split.add(searchImage, imageEvaluation.Threshold, imageEvaluation.ClassEval)
+		}
+	}
 
-		matchedPerThreshold = nil
-		searchImageDescriptors.Close()
-	}, scenario)
+	specHash := applyScenarioRun(match, record, scenario, manifest, checkpoint)
 
 	for threshold, evaluation := range classificationMap {
 		statistics.WriteOverallEvalToCSV(
-			scenario, analyzingAlgorithm, matchingAlgorithm, fmt.Sprintf("%.2f", threshold), &evaluation,
-			totalExtractionTime,
-			totalMatchingTime,
+			scenario, analyzingAlgorithm, matcherLabel, fmt.Sprintf("%.2f", threshold), specHash, &evaluation, latencies,
 		)
 	}
+	parameterEvaluation.WriteToCSV(scenario, analyzingAlgorithm, matcherLabel)
+	checkpoint.finish()
+
+	return &classificationMap, latencies, parameterEvaluation
+}
 
-	return &classificationMap, totalExtractionTime, totalMatchingTime
+// hybridImageResult is the result of matching a search image, it is stored in the checkpoint of the run
+type hybridImageResult struct {
+	MatchedRefs            []string      `json:"matchedRefs"`
+	Matched                bool          `json:"matched"`
+	PoolSize               int           `json:"poolSize"`
+	ExtractionTime         time.Duration `json:"extractionTime"`
+	PoolBuildTime          time.Duration `json:"poolBuildTime"`
+	DescriptorMatchingTime time.Duration `json:"descriptorMatchingTime"`
 }
 
-func runHybridScenario(scenario string) (*map[float64]statistics.ClassificationEvaluation, time.Duration, time.Duration) {
-	var totalExtractionTime, totalMatchingTime time.Duration
+func runHybridScenario(scenario string, manifest *image_dataset.Manifest, split *splitRun) (
+	*map[float64]statistics.ClassificationEvaluation, *statistics.LatencyDistribution, *statistics.ParameterEvaluation,
+) {
+	latencies := statistics.NewLatencyDistribution(
+		extractionStage(), statistics.PoolBuildStage, statistics.DescriptorMatchStage,
+	)
+	parameterEvaluation := statistics.NewParameterEvaluation()
 	classificationMap := make(map[float64]statistics.ClassificationEvaluation)
 	classificationMap[0] = statistics.ClassificationEvaluation{}
+	checkpoint := openCheckpointOrFail(scenario, "hybrid", "", nil)
 
-	applyScenarioRun(func(searchImage image_database.SearchImageEntity, rawImage *image_handling.RawImage) {
-		matchedRefs, poolSize, err, extractionTime, matchingTime :=
+	match := func(searchImage image_database.SearchImageEntity, rawImage *image_handling.RawImage) hybridImageResult {
+		matchedRefs, poolSize, err, extractionTime, poolBuildTime, descriptorMatchingTime :=
 			image_service.MatchImageAgainstDatabaseHybrid(rawImage, false)
 		if err != nil {
 			log.Println("error while matching", searchImage.ExternalReference, "against database!")
 		}
 
-		totalExtractionTime += extractionTime
-		totalMatchingTime += matchingTime
+		result := hybridImageResult{
+			PoolSize:               poolSize,
+			ExtractionTime:         extractionTime,
+			PoolBuildTime:          poolBuildTime,
+			DescriptorMatchingTime: descriptorMatchingTime,
+		}
+		if matchedRefs != nil {
+			matchedPerDistance := map[int][]string{image_matching.MatchedHammingDistance: *matchedRefs}
+			applyAllowList(searchImage, rawImage, image_analyzer.NewAnalyzer, "", "", matchedPerDistance)
+			result.Matched = true
+			result.MatchedRefs = matchedPerDistance[image_matching.MatchedHammingDistance]
+		}
+		return result
+	}
+
+	record := func(searchImage image_database.SearchImageEntity, result hybridImageResult) {
+		latencies.Add(extractionStage(), result.ExtractionTime)
+		latencies.Add(statistics.PoolBuildStage, result.PoolBuildTime)
+		latencies.Add(statistics.DescriptorMatchStage, result.DescriptorMatchingTime)
 
+		var matchedRefs *[]string
+		if result.Matched {
+			matchedRefs = withoutReference(&result.MatchedRefs, ignoredReference(searchImage.Notes))
+		}
 		eval := classificationMap[0]
 		class := eval.EvaluateClassification(matchedRefs, &searchImage.OriginalReference)
 		classificationMap[0] = eval
+		parameterEvaluation.Add(fmt.Sprintf("%.2f", 0.0), searchImage.Notes, class)
+		split.add(searchImage, fmt.Sprintf("%.2f", 0.0), class)
 
 		statistics.WriteHybridImageEvalToCSV(
 			scenario,
 			statistics.SearchImageHybridEval{
 				ExternalReference: searchImage.ExternalReference,
 				ClassEval:         class,
-				PoolSize:          poolSize,
-				ExtractionTime:    extractionTime.String(),
-				MatchingTime:      matchingTime.String(),
+				PoolSize:          result.PoolSize,
+				ExtractionTime:    result.ExtractionTime.String(),
+				MatchingTime:      (result.PoolBuildTime + result.DescriptorMatchingTime).String(),
 			},
 		)
-	}, scenario)
+	}
+
+	specHash := applyScenarioRun(match, record, scenario, manifest, checkpoint)
 
 	for threshold, evaluation := range classificationMap {
 		statistics.WriteOverallEvalToCSV(
-			scenario, "hybrid", "hybrid", fmt.Sprintf("%.2f", threshold), &evaluation,
-			totalExtractionTime,
-			totalMatchingTime,
+			scenario, "hybrid", "hybrid", fmt.Sprintf("%.2f", threshold), specHash, &evaluation, latencies,
 		)
 	}
+	parameterEvaluation.WriteToCSV(scenario, "hybrid", "hybrid")
+	checkpoint.finish()
 
-	return &classificationMap, totalExtractionTime, totalMatchingTime
+	return &classificationMap, latencies, parameterEvaluation
 }
 
-func applyScenarioRun(
-	applyFunction func(searchImage image_database.SearchImageEntity, rawImage *image_handling.RawImage),
+// applyScenarioRun matches the search images with a pool of workers and records the results in the order of the
+// search images, so that the detail evaluations are written in the same order as by a single worker. The results of
+// the search images the checkpoint already contains are recorded from the checkpoint instead of matching them again.
+// It returns the hashes of the variation specs the search images were generated from.
+func applyScenarioRun[Result any](
+	match func(searchImage image_database.SearchImageEntity, rawImage *image_handling.RawImage) Result,
+	record func(searchImage image_database.SearchImageEntity, result Result),
 	scenario string,
-) {
-	searchImages := image_service.GetSearchImages(scenario)
-	if searchImages == nil || len(*searchImages) == 0 {
+	manifest *image_dataset.Manifest,
+	checkpoint *scenarioCheckpoint,
+) string {
+	searchImages, paths := loadScenarioSearchImages(scenario, manifest)
+
+	type imageResult struct {
+		index  int
+		result Result
+	}
+	indices := make(chan int)
+	results := make(chan imageResult, ScenarioWorkers)
+	var workers sync.WaitGroup
+	for worker := 0; worker < ScenarioWorkers; worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for index := range indices {
+				log.Println("Matching", searchImages[index].ExternalReference)
+				rawImage := image_handling.LoadRawImage(paths[index])
+				if rawImage != nil {
+					rawImage.IgnoredReference = ignoredReference(searchImages[index].Notes)
+				}
+				results <- imageResult{index: index, result: match(searchImages[index], rawImage)}
+			}
+		}()
+	}
+	go func() {
+		for index, searchImage := range searchImages {
+			if !checkpoint.completed(searchImage.ExternalReference) {
+				indices <- index
+			}
+		}
+		close(indices)
+		workers.Wait()
+		close(results)
+	}()
+
+	pendingResults := make(map[int]Result)
+	var specHashes []string
+	for index, searchImage := range searchImages {
+		var result Result
+		if checkpoint.completed(searchImage.ExternalReference) {
+			err := checkpoint.result(searchImage.ExternalReference, &result)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			for {
+				pendingResult, done := pendingResults[index]
+				if done {
+					result = pendingResult
+					delete(pendingResults, index)
+					break
+				}
+				nextResult, open := <-results
+				if !open {
+					log.Fatal("missing result of ", searchImage.ExternalReference)
+				}
+				pendingResults[nextResult.index] = nextResult.result
+			}
+			err := checkpoint.complete(searchImage.ExternalReference, result)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		record(searchImage, result)
+		specHashes = appendIfMissing(specHashes, searchImage.SpecHash)
+	}
+
+	sort.Strings(specHashes)
+	return strings.Join(specHashes, " ")
+}
+
+func loadScenarioSearchImages(
+	scenario string, manifest *image_dataset.Manifest,
+) ([]image_database.SearchImageEntity, []string) {
+	var searchImages []image_database.SearchImageEntity
+	var paths []string
+	if manifest != nil {
+		for _, entry := range manifest.EntriesOfScenario(scenario) {
+			searchImages = append(searchImages, entry.SearchImage())
+			paths = append(paths, manifest.ImagePath(&entry))
+		}
+	} else {
+		databaseSearchImages := image_service.GetSearchImages(scenario)
+		if databaseSearchImages != nil {
+			searchImages = *databaseSearchImages
+		}
+		for _, searchImage := range searchImages {
+			paths = append(paths, image_service.VariationPath(scenario, searchImage.ExternalReference))
+		}
+	}
+	if len(searchImages) == 0 {
 		log.Fatal("Couldn't retrieve search images")
 	}
-	for _, searchImage := range *searchImages {
-		log.Println("Matching", searchImage.ExternalReference)
+	return searchImages, paths
+}
+
+// formulaMatcherLabel is the matcher of the results, results of other formulas than the weighted one are stored as
+// separate matcher, so they don't mix with the weighted results of the matcher
+func formulaMatcherLabel(matchingAlgorithm string, formula string) string {
+	if formula == "" || formula == image_matching.WeightedFormula {
+		return matchingAlgorithm
+	}
+	return matchingAlgorithm + "+" + formula
+}
 
-		path := fmt.Sprintf("images/variations/%s/%s.png", scenario, searchImage.ExternalReference)
-		rawImage := image_handling.LoadRawImage(path)
+func thresholdKey(threshold float64) string {
+	return strconv.FormatFloat(threshold, 'g', -1, 64)
+}
+
+func appendIfMissing(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	for _, existingValue := range values {
+		if existingValue == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
 
-		applyFunction(searchImage, rawImage)
+// ignoredReference is the registration of the query of a hard negative, the query matching itself isn't a false
+// positive
+func ignoredReference(notes string) string {
+	metadata, err := image_handling.DecodeVariationMetadata(notes)
+	if err != nil || metadata.HardNegative == nil {
+		return ""
+	}
+	return metadata.HardNegative.Query
+}
 
-		//release memory
-		rawImage.Data = nil
-		rawImage = nil
+func withoutReference(matchedRefs *[]string, reference string) *[]string {
+	if reference == "" {
+		return matchedRefs
+	}
+	var remainingRefs []string
+	for _, matchedRef := range *matchedRefs {
+		if matchedRef != reference {
+			remainingRefs = append(remainingRefs, matchedRef)
+		}
 	}
-	searchImages = nil
+	return &remainingRefs
 }
 
 func evaluateClassificationsFeatureBased(
 	classificationMap *map[float64]statistics.ClassificationEvaluation, matchedMap *map[float64][]string,
 	originalRef, searchImageRef *string,
+	ignoredRef string,
 	numberOfKeypoints int,
 	extractionTime, matchingTime time.Duration,
 ) *[]statistics.SearchImageFeatureBasedEval {
 	var imageEvaluations []statistics.SearchImageFeatureBasedEval
 	for threshold, evaluation := range *classificationMap {
-		matchedRefs := (*matchedMap)[threshold]
-		class := evaluation.EvaluateClassification(&matchedRefs, originalRef)
+		thresholdRefs := (*matchedMap)[threshold]
+		matchedRefs := withoutReference(&thresholdRefs, ignoredRef)
+		class := evaluation.EvaluateClassification(matchedRefs, originalRef)
 		(*classificationMap)[threshold] = evaluation
 
 		imageEvaluations = append(
@@ -261,12 +693,14 @@ func evaluateClassificationsFeatureBased(
 func evaluateClassificationsPHash(
 	classificationMap *map[int]statistics.ClassificationEvaluation, matchedMap *map[int][]string,
 	originalRef, searchImageRef *string,
+	ignoredRef string,
 	extractionTime, matchingTime time.Duration,
 ) *[]statistics.SearchImagePHashEval {
 	var imageEvaluations []statistics.SearchImagePHashEval
 	for threshold, evaluation := range *classificationMap {
-		matchedRefs := (*matchedMap)[threshold]
-		class := evaluation.EvaluateClassification(&matchedRefs, originalRef)
+		thresholdRefs := (*matchedMap)[threshold]
+		matchedRefs := withoutReference(&thresholdRefs, ignoredRef)
+		class := evaluation.EvaluateClassification(matchedRefs, originalRef)
 		(*classificationMap)[threshold] = evaluation
 
 		imageEvaluations = append(
@@ -8,7 +8,40 @@ CREATE TABLE IF NOT EXISTS forbidden_image
     orb_descriptor     MEDIUMBLOB,
     brisk_descriptor   MEDIUMBLOB,
     p_hash             BIGINT UNSIGNED,
-    rotation_phash      BIGINT UNSIGNED,
+    rotation_hash      BIGINT UNSIGNED,
+    file_sha256        CHAR(64),
+    pixel_sha256       CHAR(64),
+    registered_by      VARCHAR(255),
+    reason             VARCHAR(32),
+    tags               VARCHAR(1024),
+    expires_at         DATE,
+    source_url         VARCHAR(2048),
+    deleted_at         DATETIME DEFAULT NULL,
+    PRIMARY KEY (external_reference),
+    INDEX file_sha256_index (file_sha256),
+    INDEX pixel_sha256_index (pixel_sha256)
+);
+
+CREATE TABLE IF NOT EXISTS forbidden_image_audit
+(
+    id INT AUTO_INCREMENT,
+    external_reference VARCHAR(255),
+    action VARCHAR(16),
+    details TEXT,
+    actor VARCHAR(255),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS allowed_image
+(
+    external_reference VARCHAR(255),
+    sift_descriptor    MEDIUMBLOB,
+    orb_descriptor     MEDIUMBLOB,
+    brisk_descriptor   MEDIUMBLOB,
+    p_hash             BIGINT UNSIGNED,
+    rotation_hash      BIGINT UNSIGNED,
+    registered_by      VARCHAR(255),
     PRIMARY KEY (external_reference)
 );
 
@@ -17,7 +50,8 @@ CREATE TABLE IF NOT EXISTS search_image
     id INT AUTO_INCREMENT,
     external_reference VARCHAR(255),
     original_reference VARCHAR(255),
-    scenario ENUM('identical', 'scaled', 'rotated', 'mirrored', 'moved', 'background', 'motive', 'part', 'mixed'),
-    notes VARCHAR(255),
+    scenario VARCHAR(64),
+    notes TEXT,
+    spec_hash VARCHAR(64),
     PRIMARY KEY(id)
 );
\ No newline at end of file